@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	// longer client IDs are replaced with generated ones
+	MaxRequestIDLength = 128
+)
+
+// requestID returns X-Request-ID supplied by the client or a new random one
+func requestID(req *Request) string {
+	if id := req.Header.Get(RequestIDHeader); id != "" && len(id) <= MaxRequestIDLength {
+		return id
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder keeps status code written by the wrapped handler
+type statusRecorder struct {
+	ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog logs method, path, status, duration and remote address of every request.
+// Request ID is returned in X-Request-ID and added to every line logged with the request context
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer ResponseWriter, req *Request) {
+		start := time.Now()
+		id := requestID(req)
+		writer.Header().Set(RequestIDHeader, id)
+		logger := log.With().Str(LogFieldRequestID, id).Logger()
+		req = req.WithContext(withLogger(req.Context(), logger))
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		logger.Info().
+			Str("method", req.Method).
+			Str("path", req.URL.Path).
+			Int("status", recorder.status).
+			Dur("duration", time.Since(start)).
+			Str("remote", req.RemoteAddr).
+			Msg("HTTP request")
+	})
+}
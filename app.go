@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/rsa"
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -19,9 +21,8 @@ import (
 	"github.com/eoscanada/eos-go"
 	"github.com/eoscanada/eos-go/ecc"
 	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/zenazn/goji/graceful"
-	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -30,18 +31,57 @@ const (
 	EosInternalDuplicateErrorCode = 3040008 // see: https://github.com/DaoCasino/DAObet/blob/master/libraries/chain/include/eosio/chain/exceptions.hpp
 )
 
+// signidice failure reasons reported in metrics
+const (
+	FailureReasonDigest       = "digest"
+	FailureReasonRsaSign      = "rsa_sign"
+	FailureReasonChainState   = "chain_state"
+	FailureReasonBuildTrx     = "build_trx"
+	FailureReasonPushRejected = "push_rejected"
+	FailureReasonPushFailed   = "push_failed"
+	FailureReasonNotConfirmed = "not_confirmed"
+	FailureReasonConfirmation = "confirmation" // node failed to report trx status
+	FailureReasonCircuitOpen  = "circuit_open"
+	FailureReasonTimeout      = "timeout"
+)
+
 type ResponseWriter = http.ResponseWriter
 type Request = http.Request
 type JSONResponse = map[string]interface{}
 
+// TopicConfig is subscribed broker topic, offset is used until topic has committed offset
+type TopicConfig struct {
+	ID     broker.EventType
+	Offset uint64
+}
+
 type BrokerConfig struct {
-	TopicID     broker.EventType
-	TopicOffset uint64
+	Topics        []TopicConfig
+	ReplayTimeout time.Duration
+	// initial subscribe retries, later reconnections are made by the broker client
+	ConnectMaxAttempts int
+	ConnectBaseDelay   time.Duration // doubled after every failed attempt
+	ConnectMaxDelay    time.Duration
+	// topics are re-subscribed when no events are received within the window, 0 disables
+	IdleResubscribe time.Duration
+	// replay offsets skipped by the broker with a temporary subscription
+	ReplayGaps bool
 }
 
 type PubKeys struct {
 	Deposit   ecc.PublicKey
 	SigniDice ecc.PublicKey
+	Deposits  []ecc.PublicKey // all deposit keys including Deposit
+	// deposit keys of other casino accounts, selected by account param of sign requests
+	AccountDeposits map[eos.AccountName]ecc.PublicKey
+}
+
+// KeyPermissions are permissions the keys are authorized for
+type KeyPermissions struct {
+	SigniDice eos.PermissionName // of the casino account, DefaultSigniDicePermission when empty
+	// of deposit transfers to the casino account, named after the account when empty,
+	// deposits to other casino accounts always use permissions named after them
+	Deposit eos.PermissionName
 }
 
 type BlockChainConfig struct {
@@ -51,6 +91,11 @@ type BlockChainConfig struct {
 	RSAKey              *rsa.PrivateKey
 	PlatformAccountName eos.AccountName
 	PlatformPubKey      ecc.PublicKey
+	RSAPubKey           *rsa.PublicKey // registered in the contract, RSAKey is checked against it at startup
+	DigestHash          crypto.Hash    // hash signidice digests are made with, the contract verifies signatures with it
+	Permissions         KeyPermissions
+	RSAKeyPassphrase    []byte       // decrypts encrypted RSA key PEM, reloaded keys too
+	ChainIDCheck        ChainIDCheck // ChainID is verified against the node at startup, detected when empty
 }
 
 type HTTPConfig struct {
@@ -63,16 +108,106 @@ type AppConfig struct {
 	Broker     BrokerConfig
 	BlockChain BlockChainConfig
 	HTTP       HTTPConfig
+	TLS        TLSConfig
+	Server     ServerConfig // API server timeouts and HTTP/2
+	Batch      BatchConfig
+	Standby    bool
+	StrictJSON bool
+	DryRun     bool // sign and build trxs without pushing them
+	Pprof      bool // serve runtime profiles at /debug/pprof/, see registerPprof
+	Relay      RelayConfig
+	// failures needing operator attention are reported to an external tracker
+	ErrorReporting ErrorReportingConfig
+	Processor  ProcessorConfig
+	Inclusion  InclusionConfig
+	Shutdown   ShutdownConfig
+	Resources  ResourcesConfig
+	Nonce      NonceConfig
+	Push       PushConfig
+	Auth       AuthConfig
+	RateLimit  RateLimitConfig // applied to /sign_transaction and every trx of /sign_transactions
+	// cache of /sign_transaction and /sign_transactions results by Idempotency-Key header
+	Idempotency IdempotencyConfig
+	// max deposit trxs signed per casino account within a window
+	SigningCap SigningCapConfig
+	// failover between several node endpoints
+	Nodes NodesConfig
+	// limits every node API call, 0 means no limit
+	ChainRequestTimeout time.Duration
+	// packing of pushed transactions: signidice, deposits and top ups
+	Compression eos.CompressionType
+	// lifetime of built signidice and top up trxs, 0 keeps eos-go default of 30s
+	TrxExpiration time.Duration
+	// CPU and NET limits of signidice trxs
+	SigniDiceLimits TrxLimits
+	// wait for pushed signidice trx to become irreversible before reporting success
+	Confirmation ConfirmationConfig
+	// persistent queue of events failed after all retries
+	DLQ DLQConfig
+	// skip events of requests already resolved on chain, costs a node call per event
+	ResolvedCheck ResolvedCheckConfig
+	// limit of /sign_transaction and /sign_transactions request body, 0 means no limit
+	MaxRequestBodySize int64
+	// global logger setup, see InitLogger
+	LogLevel  zerolog.Level
+	LogFormat string
 }
 
+// App is shared by the event processor, HTTP handlers and background loops. Fields set in NewApp and MakeApp
+// are read-only once it runs, mutable state is guarded as commented: int32, int64 and uint64 flags and counters
+// are accessed with sync/atomic only, other fields by the named lock
 type App struct {
 	bcAPI         *eos.API
-	lastGetInfoStamp time.Time
 	lastGetInfoLock  sync.Mutex
-	lastCachedInfo *eos.InfoResp
+	lastGetInfoStamp time.Time     // guarded by lastGetInfoLock
+	lastCachedInfo *eos.InfoResp // guarded by lastGetInfoLock
+	headBlockNum  uint32         // guarded by lastGetInfoLock
+	headBlockChanged time.Time // when head block num last changed, guarded by lastGetInfoLock
+	rsaKeyLock    sync.RWMutex // guards BlockChain.RSAKey, use rsaKey and setRsaKey
+	serverLock    sync.Mutex
+	server        *http.Server // guarded by serverLock, set when Serve is called
 	BrokerClient  EventListener
-	OffsetHandler utils.FileStorage
+	OffsetStore   utils.OffsetStore
 	EventMessages chan *broker.EventMessage
+	NewReplayListener ListenerFactory
+	ResourceLowHook ResourceHook
+	EventResultHook EventResultHook
+	ErrorReporter   ErrorReporter // nil when disabled
+	DigestSigner  DigestSigner // local RSA key by default
+	NodePool      *NodePool    // set when failover nodes are configured
+	sendTrx2Unsupported int32 // set when node responded send_transaction2 isn't found
+	pushBreaker   *CircuitBreaker // nil when disabled
+	standby       int32
+	shadowOffsets map[broker.EventType]*uint64
+	offsetGaps    *gapDetector
+	replayingGap  int32
+	goroutineGuard chan struct{}
+	workerJobs    chan<- func() // owned by the processor goroutine
+	offsets       map[broker.EventType]*offsetCommitter
+	processedRequests *utils.LRUCache
+	signedRequests *utils.RequestStore // persisted across restarts, nil when disabled
+	signingCap    *signingCap // nil when disabled
+	middlewareLock sync.RWMutex
+	eventMiddleware []EventMiddleware // guarded by middlewareLock
+	eventHandler  EventHandler        // guarded by middlewareLock
+	inFlight      sync.WaitGroup
+	inFlightEvents int64 // reported to operators, inFlight is what shutdown waits for
+	drainLock     sync.Mutex
+	undrained     chan struct{} // guarded by drainLock, nil when not drained
+	// events of the processor are processed with eventsCtx, it's cancelled when drain on shutdown times out
+	eventsCtx     context.Context
+	cancelEvents  context.CancelFunc
+	pendingResults sync.WaitGroup
+	ready         int32
+	lastEventReceived    int64 // unix nanoseconds
+	subscriptionActivity int64 // unix nanoseconds of the last subscribe or received event
+	processedEvents uint64
+	failedEvents  uint64
+	txHeaders     txHeaders
+	malformedLogLock sync.Mutex
+	auditLog      *AuditWriter // nil when disabled
+	dlqLock       sync.Mutex
+	started       time.Time
 	*AppConfig
 }
 
@@ -84,88 +219,236 @@ type EventListener interface {
 }
 
 func NewApp(bcAPI *eos.API, brokerClient EventListener, eventMessages chan *broker.EventMessage,
-	offsetHandler utils.FileStorage,
+	offsetStore utils.OffsetStore,
 	cfg *AppConfig) *App {
-	return &App{bcAPI: bcAPI, BrokerClient: brokerClient, OffsetHandler: offsetHandler,
-		EventMessages: eventMessages, AppConfig: cfg}
+	app := &App{bcAPI: bcAPI, BrokerClient: brokerClient, OffsetStore: offsetStore,
+		EventMessages: eventMessages, AppConfig: cfg, started: time.Now(),
+		offsets:       make(map[broker.EventType]*offsetCommitter, len(cfg.Broker.Topics)),
+		shadowOffsets: make(map[broker.EventType]*uint64, len(cfg.Broker.Topics)),
+		offsetGaps:    newGapDetector()}
+	for _, topic := range cfg.Broker.Topics {
+		app.offsets[topic.ID] = newOffsetCommitter(offsetStore, topic.ID, cfg.Processor.MaxPendingMessages)
+		app.shadowOffsets[topic.ID] = new(uint64)
+	}
+	app.DigestSigner = LocalRsaSigner{Key: app.rsaKey, Hash: cfg.BlockChain.DigestHash}
+	app.ErrorReporter = NewErrorReporter(cfg.ErrorReporting)
+	app.signingCap = newSigningCap(cfg.SigningCap)
+	metrics.EventMessagesBufferSize.Set(float64(cap(eventMessages)))
+	metrics.SetEventMessagesBuffer(func() int { return len(eventMessages) })
+	app.eventsCtx, app.cancelEvents = context.WithCancel(context.Background())
+	if cfg.Standby {
+		app.standby = 1
+	}
+	middlewares := DefaultEventMiddleware()
+	if cfg.Processor.DedupCacheSize > 0 {
+		app.processedRequests = utils.NewLRUCache(cfg.Processor.DedupCacheSize)
+		middlewares = append([]EventMiddleware{app.DedupEventMiddleware}, middlewares...)
+	}
+	middlewares = append([]EventMiddleware{app.SignedRequestsEventMiddleware}, middlewares...)
+	if cfg.ResolvedCheck.Enabled {
+		middlewares = append(middlewares, app.ResolvedRequestsEventMiddleware)
+	}
+	if cfg.Processor.EventTimeout > 0 {
+		middlewares = append([]EventMiddleware{app.TimeoutEventMiddleware}, middlewares...)
+	}
+	app.UseEventMiddleware(middlewares...)
+	if cfg.Push.Breaker.FailureThreshold > 0 {
+		app.pushBreaker = NewCircuitBreaker(cfg.Push.Breaker)
+	}
+	if cfg.Processor.MaxGoroutines > 0 {
+		app.goroutineGuard = make(chan struct{}, cfg.Processor.MaxGoroutines)
+	}
+	if cfg.Resources.TopUp.Action != "" {
+		app.ResourceLowHook = app.topUp
+	}
+	return app
 }
 
-func (app *App) getTxOpts() (*eos.TxOptions, error) {
+// invalidateChainState makes the next getTxOpts fetch fresh chain state
+func (app *App) invalidateChainState() {
 	app.lastGetInfoLock.Lock()
 	defer app.lastGetInfoLock.Unlock()
+	app.lastGetInfoStamp = time.Time{}
+}
 
-	var info *eos.InfoResp
+// getInfo returns chain info cached for GetInfoCacheTTL, fetched info tracks head block to detect stalled node
+func (app *App) getInfo(ctx context.Context) (*eos.InfoResp, error) {
+	app.lastGetInfoLock.Lock()
+	defer app.lastGetInfoLock.Unlock()
 
 	if !app.lastGetInfoStamp.IsZero() && time.Now().Add(-GetInfoCacheTTL*time.Second).Before(app.lastGetInfoStamp) {
-		info = app.lastCachedInfo
-	} else {
-		var err error
-		info, err = app.bcAPI.GetInfo()
-		if err != nil {
-			return nil, err
-		}
-		app.lastGetInfoStamp = time.Now()
-		app.lastCachedInfo = info
+		return app.lastCachedInfo, nil
+	}
+	var info *eos.InfoResp
+	err := app.chainRequest(ctx, "get_info", func() error {
+		var e error
+		info, e = app.bcAPI.GetInfo()
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	app.lastGetInfoStamp = time.Now()
+	app.lastCachedInfo = info
+	if app.headBlockChanged.IsZero() || info.HeadBlockNum != app.headBlockNum {
+		app.headBlockNum = info.HeadBlockNum
+		app.headBlockChanged = app.lastGetInfoStamp
+	}
+	return info, nil
+}
+
+func (app *App) getTxOpts(ctx context.Context) (*eos.TxOptions, error) {
+	info, err := app.getInfo(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return &eos.TxOptions{
+	txOpts := &eos.TxOptions{
 		ChainID:          info.ChainID,
 		HeadBlockID:      info.LastIrreversibleBlockID, // set lib as TAPOS block reference
-	}, nil
+		Compress:         app.Compression,
+	}
+	if err := ValidateTxOptions(txOpts); err != nil {
+		// drop cached info so next attempt refetches chain state
+		app.invalidateChainState()
+		return nil, fmt.Errorf("invalid chain state: %s", err.Error())
+	}
+	return txOpts, nil
 }
 
-func (app *App) processEvent(event *broker.Event) *string {
-	log.Debug().Msgf("Processing event %+v", event)
-	start := time.Now()
-	defer func() {
-		elapsed := time.Since(start)
-		metrics.SigniDiceProcessingTimeMs.Observe(elapsed.Seconds() * 1000)
-	}()
-	var data struct {
-		Digest eos.Checksum256 `json:"digest"`
-	}
-	parseError := json.Unmarshal(event.Data, &data)
+// processEvent signs event digest and pushes signidice trx, node calls are cancelled when ctx is done.
+// Cancelled event isn't dead-lettered, so it holds back offset commit and is redelivered.
+// Completed event is recorded to the audit log
+func (app *App) processEvent(ctx context.Context, event *broker.Event) (result *string) {
+	logger := eventLogger(ctx, event)
+	ctx = withLogger(ctx, logger)
+	digest, parseError := app.parseDigest(event)
+	defer func() { app.auditEvent(ctx, event, digest, result) }()
 	if parseError != nil {
-		log.Error().Msgf("Couldnt get digest from event, sessionID: %d, reason: %s", event.RequestID, parseError.Error())
+		app.malformedEvent(event, parseError)
 		return nil
 	}
 
-	api := app.bcAPI
-	signature, signError := utils.RsaSign(data.Digest, app.BlockChain.RSAKey)
+	signature, signError := app.DigestSigner.Sign(digest)
 
 	if signError != nil {
-		log.Error().Msgf("Couldnt sign signidice_part_2, sessionID: %d, reason: %s", event.RequestID, signError.Error())
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonRsaSign).Inc()
+		reason := "couldnt sign signidice_part_2: " + signError.Error()
+		app.queueDeadLetter(event, reason)
+		app.deadLetter(event, reason)
+		app.reportEventFailure(event, FailureReasonRsaSign, signError, "")
 		return nil
 	}
 
-	var txOpts *eos.TxOptions
-	err := utils.RetryWithTimeout(func() error {
-		var e error
-		txOpts, e = app.getTxOpts()
-		return e
-	}, app.HTTP.RetryAmount, app.HTTP.Timeout, app.HTTP.RetryDelay)
-	if err != nil {
-		log.Error().Msgf("Failed to get blockchain state, sessionID: %d, reason: %s", event.RequestID, err.Error())
+	packedTx, trxID, sendError := app.buildAndPushWithRetry(ctx, app.signidiceBuilder(event, signature))
+	if sendError != nil && ctx.Err() != nil {
+		logger.Warn().Msgf("Cancelled signidice_part_2 trx push, sessionID: %d, reason: %s", event.RequestID, sendError.Error())
 		return nil
 	}
-	packedTx, err := GetSigndiceTransaction(api, eos.AN(event.Sender), app.BlockChain.CasinoAccountName,
-		event.RequestID, signature, app.BlockChain.EosPubKeys.SigniDice, txOpts)
-
-	if err != nil {
-		log.Error().Msgf("Couldn't form signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, err.Error())
+	switch sendError.(type) {
+	case chainStateError:
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonChainState).Inc()
+		logger.Error().Msgf("Failed to get blockchain state, sessionID: %d, reason: %s", event.RequestID, sendError.Error())
+		if reason := "failed to get blockchain state: " + sendError.Error(); app.queueDeadLetter(event, reason) {
+			app.deadLetter(event, reason)
+		}
+		app.reportEventFailure(event, FailureReasonChainState, sendError, "")
+		return nil
+	case buildTrxError:
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonBuildTrx).Inc()
+		logger.Error().Msgf("Couldn't form signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, sendError.Error())
+		if reason := "couldn't form signidice_part_2 trx: " + sendError.Error(); app.queueDeadLetter(event, reason) {
+			app.deadLetter(event, reason)
+		}
+		app.reportEventFailure(event, FailureReasonBuildTrx, sendError, "")
+		return nil
+	}
+	if isCircuitOpen(sendError) {
+		app.circuitOpenEvent(event)
+		return nil
+	}
+	if utils.IsPermanent(sendError) {
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushRejected).Inc()
+		reason := "signidice_part_2 trx was rejected: " + sendError.Error()
+		trace := failureTrace(sendError)
+		if trace != "" {
+			logger.Error().Msgf("signidice_part_2 trx failure trace, sessionID: %d, trace: %s", event.RequestID, trace)
+		}
+		app.queueDeadLetter(event, reason)
+		app.deadLetter(event, reason)
+		app.reportEventFailure(event, FailureReasonPushRejected, sendError, trace)
 		return nil
 	}
-
-	result, sendError := api.PushTransaction(packedTx)
 	if sendError != nil {
-		log.Error().Msgf("Failed to send signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, sendError.Error())
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushFailed).Inc()
+		logger.Error().Msgf("Failed to send signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, sendError.Error())
+		// queued event can be replayed later, so it doesn't need to hold back offset
+		if reason := "failed to send signidice_part_2 trx: " + sendError.Error(); app.queueDeadLetter(event, reason) {
+			app.deadLetter(event, reason)
+		}
+		app.reportEventFailure(event, FailureReasonPushFailed, sendError, "")
 		return nil
 	}
-	log.Info().Msgf("Successfully sent signidice_part_2 txn, sessionID: %d, trxID: %s", event.RequestID, result.TransactionID)
-	return &result.TransactionID
+	if app.Confirmation.Enabled && !app.DryRun {
+		if err := app.waitIrreversible(ctx, trxID); err != nil {
+			reason := FailureReasonNotConfirmed
+			if _, isAPIError := asAPIError(err); isAPIError {
+				reason = FailureReasonConfirmation
+			}
+			metrics.SigniDiceFailures.WithLabelValues(reason).Inc()
+			logger.Error().Msgf("Failed to confirm signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, err.Error())
+			app.reportEventFailure(event, reason, err, "")
+			return nil
+		}
+		metrics.SigniDiceSigned.Inc()
+		logger.Info().Msgf("Confirmed signidice_part_2 txn, sessionID: %d, trxID: %s", event.RequestID, trxID)
+		// irreversible trx can't be dropped, no need for inclusion check
+		return &trxID
+	}
+	metrics.SigniDiceSigned.Inc()
+	logger.Info().Msgf("Successfully sent signidice_part_2 txn, sessionID: %d, trxID: %s", event.RequestID, trxID)
+	app.scheduleInclusionCheck([]*broker.Event{event}, packedTx, trxID)
+	return &trxID
+}
+
+// signidiceBuilder returns builder of the event's signidice_part_2 trx, it's called with fresh chain state on every push attempt
+func (app *App) signidiceBuilder(event *broker.Event, signature string) TrxBuilder {
+	return func(txOpts *eos.TxOptions) (*eos.PackedTransaction, error) {
+		txOpts = app.SigniDiceLimits.Apply(txOpts)
+		if app.Nonce.Enabled {
+			return app.getSigndiceNonceTransaction(eos.AN(event.Sender), event.RequestID, signature, txOpts)
+		}
+		return GetSigndiceTransaction(app.bcAPI.Signer, eos.AN(event.Sender), app.signidiceAuth(),
+			event.RequestID, signature, app.BlockChain.EosPubKeys.SigniDice, txOpts, app.TrxExpiration)
+	}
+}
+
+// deadLetter records event which won't be processed anymore, such event doesn't hold back offset commit
+func (app *App) deadLetter(event *broker.Event, reason string) {
+	logger := eventLogger(context.Background(), event)
+	logger.Error().Msgf("Dropping event, sessionID: %d, sender: %s, reason: %s", event.RequestID, event.Sender, reason)
+	if offsets, ok := app.offsets[event.EventType]; ok {
+		offsets.drop(event)
+	}
 }
 
 func (app *App) RunEventProcessor(ctx context.Context) {
+	results := make(chan EventResult, EventResultsBuffer)
+	go app.collectResults(results)
+	defer func() {
+		// in-flight events still report results after the processor is stopped
+		go func() {
+			app.inFlight.Wait()
+			close(results)
+		}()
+	}()
+	if app.Processor.MaxConcurrentSigns > 0 {
+		app.workerJobs = app.startWorkers(app.Processor.MaxConcurrentSigns)
+		defer func() {
+			close(app.workerJobs)
+			app.workerJobs = nil
+		}()
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -179,63 +462,170 @@ func (app *App) RunEventProcessor(ctx context.Context) {
 				log.Debug().Msg("Gotta event message with no events")
 				break
 			}
-			log.Debug().Msgf("Processing %+v events", len(eventMessage.Events))
-			for _, event := range eventMessage.Events {
-				go app.processEvent(event)
+			if !app.waitUndrained(ctx) {
+				// not tracked message is redelivered after restart
+				return
+			}
+			// broker delivers every topic in separate messages
+			topic := eventMessage.Events[0].EventType
+			offsets, ok := app.offsets[topic]
+			if !ok {
+				log.Warn().Msgf("Got event message of not subscribed topic %d, skipping", topic)
+				break
+			}
+			if !offsets.waitRoom(ctx) {
+				return
 			}
+			app.eventReceived()
+			app.checkOffsetGaps(topic, eventMessage.Events)
+			log.Debug().Msgf("Processing %+v events of topic %d", len(eventMessage.Events), topic)
+			metrics.EventsReceived.Add(float64(len(eventMessage.Events)))
 			offset := eventMessage.Offset + 1
-			if err := utils.WriteOffset(app.OffsetHandler, offset); err != nil {
-				log.Error().Msgf("Failed to write offset, reason: %s", err.Error())
+			switch {
+			case app.IsStandby():
+				log.Debug().Msg("Standby mode, skipping signing")
+				storeMaxOffset(app.shadowOffsets[topic], offset)
+				offsets.track(offset, nil)
+			case app.Batch.Enabled:
+				events := eventMessage.Events
+				offsets.track(offset, events)
+				app.spawn(ctx, func() {
+					trxIDs := app.handleBatch(app.eventsCtx, events)
+					for i, event := range events {
+						app.reportResult(results, EventResult{Event: event, TxID: trxIDs[i]})
+					}
+				})
+			default:
+				offsets.track(offset, eventMessage.Events)
+				for _, event := range eventMessage.Events {
+					event := event
+					if !app.spawn(ctx, func() {
+						app.reportResult(results, EventResult{Event: event, TxID: app.handleEvent(app.eventsCtx, event)})
+					}) {
+						return
+					}
+				}
 			}
 		}
 	}
 }
 
+// connectBroker starts the broker client and subscribes to every topic from its last committed offset.
+// Client's Run dials and reconnects on its own restoring subscriptions, so it's started once and only
+// the initial subscribe, which waits for the first connection, is retried with backoff
+func (app *App) connectBroker(ctx context.Context) error {
+	go app.BrokerClient.Run(ctx)
+	return utils.RetryWithBackoffContext(ctx, func() error {
+		if ctx.Err() != nil {
+			return utils.Permanent(ctx.Err())
+		}
+		err := utils.WithContext(ctx, app.subscribeTopics)
+		if err == broker.ListenerClosed {
+			// client ran out of reconnection attempts
+			return utils.Permanent(err)
+		}
+		return err
+	}, app.Broker.ConnectMaxAttempts, app.Broker.ConnectBaseDelay, app.Broker.ConnectMaxDelay)
+}
+
+// fetchChainState makes sure node is reachable and chain state is valid before app gets ready
+func (app *App) fetchChainState(ctx context.Context) error {
+	return utils.RetryWithBackoffContext(ctx, func() error {
+		if _, err := app.getTxOpts(ctx); err != nil {
+			log.Warn().Msgf("Failed to fetch chain state, reason: %s", err.Error())
+			return err
+		}
+		return nil
+	}, app.Broker.ConnectMaxAttempts, app.Broker.ConnectBaseDelay, app.Broker.ConnectMaxDelay)
+}
+
 func (app *App) Run(addr string) error {
 	ctx, cancel := context.WithCancel(context.Background())
-	errGroup, ctx := errgroup.WithContext(ctx)
 	defer cancel()
 
-	// no errGroup because ctx close cannot be handled
+	serverErr := make(chan error, 1)
 	go func() {
-		defer cancel()
 		log.Debug().Msg("starting http server")
-		log.Panic().Msg(graceful.ListenAndServe(addr, app.GetRouter()).Error())
+		serverErr <- app.ListenAndServe(addr)
 	}()
 
-	errGroup.Go(func() error {
-		defer cancel()
+	if app.Resources.Enabled {
+		go app.RunResourceMonitor(ctx)
+	}
+
+	if app.NodePool != nil {
+		go app.NodePool.RunHealthCheck(ctx, app.Nodes.HealthCheckInterval)
+	}
+
+	if app.signedRequests != nil {
+		go app.RunSignedRequestsFlush(ctx)
+	}
+
+	processorErr := make(chan error, 1)
+	processorDone := make(chan struct{})
+	go func() {
+		defer close(processorDone)
 		log.Debug().Msg("starting event listener")
-		go app.BrokerClient.Run(ctx)
-		if _, err := app.BrokerClient.Subscribe(app.Broker.TopicID, app.Broker.TopicOffset); err != nil {
-			return err
+		if err := app.connectBroker(ctx); err != nil {
+			processorErr <- err
+			return
 		}
-		log.Debug().Msgf("starting event processor with offset %v", app.Broker.TopicOffset)
+		if err := app.fetchChainState(ctx); err != nil {
+			processorErr <- err
+			return
+		}
+		app.setReady(true)
+		if app.Broker.IdleResubscribe > 0 {
+			go app.RunSubscriptionWatchdog(ctx, app.Broker.IdleResubscribe)
+		}
+		log.Debug().Msg("starting event processor")
 		app.RunEventProcessor(ctx)
-		return nil
-	})
+		processorErr <- nil
+	}()
 
-	errGroup.Go(func() error {
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-quit:
-			cancel()
-		}
-		return nil
-	})
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	var err error
+	select {
+	case <-quit:
+		log.Info().Msg("Received shutdown signal")
+	case err = <-serverErr:
+		err = fmt.Errorf("http server stopped: %v", err)
+	case err = <-processorErr:
+	}
+
+	// processor must not spawn events anymore when drain starts
+	stopProcessor := func() {
+		cancel()
+		<-processorDone
+	}
+	shutdown(app.shutdownSteps(app.stopHTTP, stopProcessor))
+	return err
+}
 
-	return errGroup.Wait()
+// readBody reads request body limited by MaxRequestBodySize, responds with 413 and returns false
+// if the body is larger, 0 means no limit
+func (app *App) readBody(writer ResponseWriter, req *Request) ([]byte, bool) {
+	if app.MaxRequestBodySize <= 0 {
+		body, _ := ioutil.ReadAll(req.Body)
+		return body, true
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, app.MaxRequestBodySize))
+	if err != nil && int64(len(body)) >= app.MaxRequestBodySize {
+		log.Warn().Msgf("Rejected too large request, path: %s, remote: %s", req.URL.Path, req.RemoteAddr)
+		respondWithError(writer, http.StatusRequestEntityTooLarge, ErrorCodeRequestTooLarge,
+			fmt.Sprintf("request body exceeds %d bytes", app.MaxRequestBodySize))
+		return nil, false
+	}
+	return body, true
 }
 
-func respondWithError(writer ResponseWriter, code int, message string) {
-	respondWithJSON(writer, code, JSONResponse{"error": message})
+func respondWithError(writer ResponseWriter, status int, code ErrorCode, message string) {
+	respondWithJSON(writer, status, JSONResponse{"error": message, "code": code})
 }
 
 func respondWithJSON(writer ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+	response, _ := jsonCodec.Marshal(payload)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(code)
 	_, err := writer.Write(response)
@@ -248,72 +638,195 @@ func (app *App) PingQuery(writer ResponseWriter, req *Request) {
 	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "pong"})
 }
 
-func (app *App) SignQuery(writer ResponseWriter, req *Request) {
-	log.Info().Msg("Called /sign_transaction")
-	start := time.Now()
-	defer func() {
-		elapsed := time.Since(start)
-		metrics.SignTransactionProcessingTimeMs.Observe(elapsed.Seconds() * 1000)
-	}()
-	rawTransaction, _ := ioutil.ReadAll(req.Body)
-	tx := &eos.SignedTransaction{}
-	err := json.Unmarshal(rawTransaction, tx)
-	if err != nil {
-		log.Debug().Msgf("failed to deserialize transaction, reason: %s", err.Error())
-		respondWithError(writer, http.StatusBadRequest, "failed to deserialize transaction")
-		return
+// Retry-After of sign requests failed because the node is unavailable
+const ChainUnavailableRetryAfter = 5 * time.Second
+
+// depositError is deposit trx processing failure reported to the client
+type depositError struct {
+	status  int
+	code    ErrorCode
+	message string
+}
+
+// respond writes the error, unavailable node is reported with Retry-After
+func (e *depositError) respond(writer ResponseWriter) {
+	if e.status == http.StatusServiceUnavailable {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(ChainUnavailableRetryAfter/time.Second)))
 	}
-	if err := ValidateDepositTransaction(tx, app.BlockChain.CasinoAccountName, app.BlockChain.PlatformAccountName,
+	respondWithError(writer, e.status, e.code, e.message)
+}
+
+func (e *depositError) Error() string {
+	return e.message
+}
+
+// signDepositTransaction validates deposit trx, signs it with deposit key and pushes it to the node.
+// Deposit to another casino account is signed with the key configured for the account,
+// empty account means the default casino account. In dry run mode signed trx isn't pushed
+func (app *App) signDepositTransaction(ctx context.Context, tx *eos.SignedTransaction, account eos.AccountName) (*eos.PackedTransaction, string, *depositError) {
+	logger := ctxLogger(ctx)
+	casino := app.BlockChain.CasinoAccountName
+	accountKey, isAccount := app.BlockChain.EosPubKeys.AccountDeposits[account]
+	if account != "" && account != casino {
+		if !isAccount {
+			logger.Debug().Msgf("unknown casino account supplied, account: %s", account)
+			return nil, "", &depositError{http.StatusBadRequest, ErrorCodeUnknownAccount, "unknown casino account"}
+		}
+		casino = account
+	}
+	if err := ValidateDepositTransaction(tx, app.depositPermission(casino), app.BlockChain.PlatformAccountName,
 		app.BlockChain.PlatformPubKey,
 		app.BlockChain.ChainID); err != nil {
-		log.Debug().Msgf("invalid transaction supplied, reason: %s", err.Error())
-		respondWithError(writer, http.StatusBadRequest, "invalid transaction supplied")
-		return
+		logger.Debug().Msgf("invalid transaction supplied, reason: %s", err.Error())
+		return nil, "", &depositError{http.StatusBadRequest, ErrorCodeInvalidTransaction, "invalid transaction supplied"}
+	}
+	depositKeys := []ecc.PublicKey{accountKey}
+	if casino == app.BlockChain.CasinoAccountName {
+		var err error
+		if depositKeys, err = app.selectDepositKeys(ctx, tx); err != nil {
+			if _, unavailable := err.(chainStateError); unavailable && ctx.Err() == nil {
+				logger.Warn().Msgf("failed to reach the blockchain, reason: %s", err.Error())
+				return nil, "", &depositError{http.StatusServiceUnavailable, ErrorCodeChainUnavailable,
+					"blockchain node is unavailable, reason: " + err.Error()}
+			}
+			logger.Debug().Msgf("failed to select deposit key, reason: %s", err.Error())
+			return nil, "", &depositError{http.StatusBadRequest, ErrorCodeInvalidTransaction, "failed to select deposit key"}
+		}
 	}
-	signedTx, signError := app.bcAPI.Signer.Sign(tx, app.BlockChain.ChainID, app.BlockChain.EosPubKeys.Deposit)
+	signer, err := trxSigner(app.bcAPI)
+	if err != nil {
+		logger.Error().Msgf("failed to sign transaction, reason: %s", err.Error())
+		return nil, "", &depositError{http.StatusInternalServerError, ErrorCodeSignerNotConfigured, err.Error()}
+	}
+	if capErr := app.takeSigningCap(casino); capErr != nil {
+		return nil, "", capErr
+	}
+	signedTx, signError := signer.Sign(tx, app.BlockChain.ChainID, depositKeys...)
 
 	if signError != nil {
-		log.Warn().Msgf("failed to sign transaction, reason: %s", signError.Error())
-		respondWithError(writer, http.StatusInternalServerError, "failed to sign transaction")
-		return
+		app.refundSigningCap(casino)
+		logger.Warn().Msgf("failed to sign transaction, reason: %s", signError.Error())
+		return nil, "", &depositError{http.StatusInternalServerError, ErrorCodeSignFailed, "failed to sign transaction"}
 	}
-	log.Debug().Msg(signedTx.String())
-	packedTrx, _ := signedTx.Pack(eos.CompressionNone)
+	logger.Debug().Msg(signedTx.String())
+	packedTrx, _ := signedTx.Pack(app.Compression)
 	trxID, err := packedTrx.ID()
 	if err != nil {
-		log.Warn().Msgf("failed to calc trx ID, reason: %s", err.Error())
-		respondWithError(writer, http.StatusInternalServerError, "failed to calc trx ID")
-		return
+		logger.Warn().Msgf("failed to calc trx ID, reason: %s", err.Error())
+		return nil, "", &depositError{http.StatusInternalServerError, ErrorCodeInternal, "failed to calc trx ID"}
+	}
+
+	if app.DryRun {
+		if _, err := app.dryRunPush(packedTrx); err != nil {
+			logger.Warn().Msgf("failed to log dry run trx, reason: %s", err.Error())
+		}
+		return packedTrx, trxID.String(), nil
 	}
 
 	sendError := utils.RetryWithTimeout(func() error {
 		var e error
-		_, e = app.bcAPI.PushTransaction(packedTrx)
-		if e != nil {
-			if apiErr, ok := e.(eos.APIError); ok {
-				// if error is duplicate trx assume as OK
-				if apiErr.Code == EosInternalErrorCode && apiErr.ErrorStruct.Code == EosInternalDuplicateErrorCode {
-					log.Debug().Msgf("Got duplicate trx error, assuming as OK, trx_id: %s", trxID.String())
-					return nil
-				}
-			}
+		e = app.guardPush(ctx, func() error {
+			return app.chainRequest(ctx, "push_transaction", func() error {
+				_, err := app.bcAPI.PushTransaction(packedTrx)
+				return err
+			})
+		})
+		// if error is duplicate trx assume as OK
+		if isDuplicateTrx(e) {
+			logger.Debug().Msgf("Got duplicate trx error, assuming as OK, trx_id: %s", trxID.String())
+			return nil
 		}
 		return e
 	}, app.HTTP.RetryAmount, app.HTTP.Timeout, app.HTTP.RetryDelay)
+	if sendError != nil && (isCircuitOpen(sendError) || classifyPushError(sendError) == PushErrorNetwork) {
+		logger.Warn().Msgf("failed to reach the blockchain, reason: %s", sendError.Error())
+		return nil, "", &depositError{http.StatusServiceUnavailable, ErrorCodeChainUnavailable,
+			"blockchain node is unavailable, reason: " + sendError.Error()}
+	}
 	if sendError != nil {
-		log.Debug().Msgf("failed to send transaction to the blockchain, reason: %s", sendError.Error())
-		respondWithError(writer, http.StatusBadRequest, "failed to send transaction to the blockchain, reason: "+
-			sendError.Error())
+		logger.Debug().Msgf("failed to send transaction to the blockchain, reason: %s", sendError.Error())
+		return nil, "", &depositError{http.StatusBadRequest, ErrorCodeChainRejected,
+			"failed to send transaction to the blockchain, reason: " + sendError.Error()}
+	}
+	return packedTrx, trxID.String(), nil
+}
+
+// depositResult is response of signed deposit trx, in dry run mode it contains the trx which wasn't pushed
+func (app *App) depositResult(packedTrx *eos.PackedTransaction, trxID string) JSONResponse {
+	result := JSONResponse{"txid": trxID}
+	if app.DryRun {
+		result["transaction"] = packedTrx
+	}
+	return result
+}
+
+// SignQuery signs and pushes deposit trx, optional account query param selects casino account of the deposit.
+// Trx is either eos.SignedTransaction JSON or eos.PackedTransaction one with hex packed_trx.
+// Failures are reported with error codes:
+//   REQUEST_TOO_LARGE   (413) body exceeds max request body size
+//   DESERIALIZE_FAILED  (400) body is not a trx
+//   UNKNOWN_ACCOUNT     (400) account isn't a configured casino account
+//   INVALID_TRANSACTION (400) trx isn't a valid deposit or no deposit key matches it
+//   SIGN_FAILED         (500) signer failed
+//   SIGNER_NOT_CONFIGURED (500) trx signer isn't set up
+//   INTERNAL_ERROR      (500) trx ID can't be calculated
+//   CHAIN_REJECTED      (400) node didn't accept signed trx
+//   CHAIN_UNAVAILABLE   (503) node is unreachable or timed out, Retry-After is set
+//   IDEMPOTENCY_KEY_REUSED (422) Idempotency-Key header is already used with another trx
+//   SIGNING_CAP_EXCEEDED (429) casino account signed max deposit trxs of the current window
+func (app *App) SignQuery(writer ResponseWriter, req *Request) {
+	ctxLogger(req.Context()).Info().Msg("Called /sign_transaction")
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		metrics.SignTransactionProcessingTimeMs.Observe(elapsed.Seconds() * 1000)
+	}()
+	rawTransaction, ok := app.readBody(writer, req)
+	if !ok {
+		return
+	}
+	tx, err := app.decodeDepositTransaction(rawTransaction)
+	if err != nil {
+		ctxLogger(req.Context()).Debug().Msgf("failed to deserialize transaction, reason: %s", err.Error())
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeDeserializeFailed,
+			app.inputError("failed to deserialize transaction", err))
+		return
+	}
+	packedTrx, trxID, depositErr := app.signDepositTransaction(req.Context(), tx, eos.AN(req.URL.Query().Get("account")))
+	if depositErr != nil {
+		depositErr.respond(writer)
 		return
 	}
 
-	respondWithJSON(writer, http.StatusOK, JSONResponse{"txid": trxID.String()})
+	respondWithJSON(writer, http.StatusOK, app.depositResult(packedTrx, trxID))
 }
 
 func (app *App) GetRouter() *mux.Router {
 	var router mux.Router
 	router.HandleFunc("/ping", app.PingQuery).Methods("GET")
-	router.HandleFunc("/sign_transaction", app.SignQuery).Methods("POST")
+	// both sign endpoints share the limit, so batches don't bypass it. Only authenticated requests
+	// are charged, so unauthenticated ones can't exhaust it for the clients
+	signRateLimit := app.rateLimit()
+	router.HandleFunc("/sign_transaction",
+		app.requireAuth(signRateLimit(singleRequest, app.idempotent(app.SignQuery)))).Methods("POST")
+	router.HandleFunc("/sign_transactions",
+		app.requireAuth(signRateLimit(app.batchCost, app.idempotent(app.SignTransactionsQuery)))).Methods("POST")
+	router.HandleFunc("/replay", app.requireAuth(app.ReplayQuery)).Methods("POST")
+	router.HandleFunc("/promote", app.requireAuth(app.PromoteQuery)).Methods("POST")
+	router.HandleFunc("/drain", app.requireAuth(app.DrainQuery)).Methods("POST")
+	router.HandleFunc("/undrain", app.requireAuth(app.UndrainQuery)).Methods("POST")
+	router.HandleFunc("/rsa_public_key", app.RsaPublicKeyQuery).Methods("GET")
+	router.HandleFunc("/reload_rsa", app.requireAuth(app.ReloadRsaQuery)).Methods("POST")
+	router.HandleFunc("/status", app.StatusQuery).Methods("GET")
+	router.HandleFunc("/healthz", app.HealthzQuery).Methods("GET")
+	router.HandleFunc("/ready", app.ReadyQuery).Methods("GET")
+	router.HandleFunc("/version", app.VersionQuery).Methods("GET")
+	router.HandleFunc("/dead_letters", app.requireAuth(app.DeadLettersQuery)).Methods("GET")
+	router.HandleFunc("/dead_letters/replay", app.requireAuth(app.ReplayDeadLettersQuery)).Methods("POST")
 	router.Handle("/metrics", metrics.GetHandler())
+	if app.Pprof {
+		app.registerPprof(&router)
+	}
+	router.Use(accessLog)
 	return &router
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+// AuditStdout as audit log path writes records to stdout
+const AuditStdout = "-"
+
+const (
+	AuditOutcomeSigned = "signed"
+	AuditOutcomeFailed = "failed"
+)
+
+// AuditRecord is a line of the audit log written for every completed event
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Sender    string    `json:"sender"`
+	RequestID uint64    `json:"req_id"`
+	Digest    string    `json:"digest"` // empty when event data is malformed
+	TxID      string    `json:"txid,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+// AuditWriter appends records as JSON lines, file is synced before Write returns
+type AuditWriter struct {
+	m    sync.Mutex
+	out  io.Writer
+	file *os.File // nil for stdout
+}
+
+func NewAuditWriter(path string) (*AuditWriter, error) {
+	if path == AuditStdout {
+		return &AuditWriter{out: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditWriter{out: file, file: file}, nil
+}
+
+func (w *AuditWriter) Write(record *AuditRecord) error {
+	line, err := jsonCodec.Marshal(record)
+	if err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if w.file != nil {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+func (w *AuditWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// auditEvent records event outcome if audit log is configured,
+// cancelled event isn't completed and is recorded when it's redelivered
+func (app *App) auditEvent(ctx context.Context, event *broker.Event, digest eos.Checksum256, trxID *string) {
+	if app.auditLog == nil || (trxID == nil && ctx.Err() != nil) {
+		return
+	}
+	record := &AuditRecord{
+		Time:      time.Now().UTC(),
+		Sender:    event.Sender,
+		RequestID: event.RequestID,
+		Digest:    digest.String(),
+		Outcome:   AuditOutcomeFailed,
+	}
+	if trxID != nil {
+		record.TxID = *trxID
+		record.Outcome = AuditOutcomeSigned
+	}
+	if err := app.auditLog.Write(record); err != nil {
+		log.Error().Msgf("Failed to write audit record, sessionID: %d, reason: %s", event.RequestID, err.Error())
+	}
+}
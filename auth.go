@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+type AuthConfig struct {
+	Token string // shared secret expected in "Authorization: Bearer <token>" header, empty disables auth
+}
+
+const bearerPrefix = "Bearer "
+
+// requireAuth rejects requests without valid bearer token with 401
+func (app *App) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer ResponseWriter, req *Request) {
+		if app.Auth.Token == "" {
+			next(writer, req)
+			return
+		}
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, bearerPrefix) {
+			respondWithError(writer, http.StatusUnauthorized, ErrorCodeUnauthorized, "missing bearer token")
+			return
+		}
+		token := strings.TrimPrefix(header, bearerPrefix)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(app.Auth.Token)) != 1 {
+			log.Warn().Msgf("Rejected request with invalid token, path: %s, remote: %s", req.URL.Path, req.RemoteAddr)
+			respondWithError(writer, http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid bearer token")
+			return
+		}
+		next(writer, req)
+	}
+}
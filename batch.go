@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+type BatchFailurePolicy string
+
+const (
+	// whole batch is retried and failed together
+	BatchFailAll BatchFailurePolicy = "fail"
+	// offending event is dead-lettered and the rest are signed again
+	BatchDropFailed BatchFailurePolicy = "drop"
+)
+
+type BatchConfig struct {
+	Enabled       bool
+	FailurePolicy BatchFailurePolicy
+}
+
+func ParseBatchFailurePolicy(policy string) (BatchFailurePolicy, error) {
+	switch BatchFailurePolicy(strings.ToLower(policy)) {
+	case BatchFailAll, "":
+		return BatchFailAll, nil
+	case BatchDropFailed:
+		return BatchDropFailed, nil
+	default:
+		return "", fmt.Errorf("unknown batch failure policy: %s", policy)
+	}
+}
+
+type eventBatchKey struct{}
+
+type batchEventState int
+
+const (
+	batchEventPending batchEventState = iota
+	batchEventJoined
+	batchEventLeft
+)
+
+// eventBatch runs events of a message through the middleware chain, events reaching the end of the chain
+// are signed with a single trx once every event of the batch either joined it or left: was skipped, failed
+// or waits for result of another event, so duplicates and timeouts are handled the same way as for single events
+type eventBatch struct {
+	lock    sync.Mutex
+	states  map[*broker.Event]batchEventState // guarded by lock
+	pending int                               // guarded by lock
+	joined  []*broker.Event                   // guarded by lock
+	results map[*broker.Event]*string         // set before done is closed
+	done    chan struct{}
+	sign    func(events []*broker.Event) []*string
+}
+
+func newEventBatch(events []*broker.Event, sign func(events []*broker.Event) []*string) *eventBatch {
+	batch := &eventBatch{states: make(map[*broker.Event]batchEventState, len(events)), pending: len(events),
+		results: make(map[*broker.Event]*string, len(events)), done: make(chan struct{}), sign: sign}
+	for _, event := range events {
+		batch.states[event] = batchEventPending
+	}
+	return batch
+}
+
+// join is the end of the middleware chain, it waits for the batch trx and returns its ID,
+// event which already left the batch isn't signed
+func (b *eventBatch) join(ctx context.Context, event *broker.Event) *string {
+	b.lock.Lock()
+	if b.states[event] != batchEventPending {
+		b.lock.Unlock()
+		return nil
+	}
+	b.states[event] = batchEventJoined
+	b.joined = append(b.joined, event)
+	b.settle()
+	b.lock.Unlock()
+	<-b.done
+	return b.results[event]
+}
+
+// leave tells the batch not to wait for the event, it's a no-op for joined event
+func (b *eventBatch) leave(event *broker.Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.states[event] != batchEventPending {
+		return
+	}
+	b.states[event] = batchEventLeft
+	b.settle()
+}
+
+// settle signs joined events when no event is pending anymore, lock should be held
+func (b *eventBatch) settle() {
+	if b.pending--; b.pending > 0 {
+		return
+	}
+	joined := b.joined
+	go func() {
+		if len(joined) > 0 {
+			for i, trxID := range b.sign(joined) {
+				b.results[joined[i]] = trxID
+			}
+		}
+		close(b.done)
+	}()
+}
+
+// leaveEventBatch is called by middlewares before waiting for result of another event,
+// so the batch of the event doesn't wait for it
+func leaveEventBatch(ctx context.Context, event *broker.Event) {
+	if batch, ok := ctx.Value(eventBatchKey{}).(*eventBatch); ok {
+		batch.leave(event)
+	}
+}
+
+// handleBatch runs events through the middleware chain and signs ones which passed it with a single trx,
+// returns trx ID for each event or nil if event wasn't processed
+func (app *App) handleBatch(ctx context.Context, events []*broker.Event) []*string {
+	batch := newEventBatch(events, func(joined []*broker.Event) []*string {
+		return app.processBatch(ctx, joined)
+	})
+	app.middlewareLock.RLock()
+	handler := ChainEventMiddleware(batch.join, app.eventMiddleware...)
+	app.middlewareLock.RUnlock()
+	batchCtx := context.WithValue(ctx, eventBatchKey{}, batch)
+	results := make([]*string, len(events))
+	var wg sync.WaitGroup
+	for i, event := range events {
+		wg.Add(1)
+		go func(i int, event *broker.Event) {
+			defer wg.Done()
+			results[i] = handler(batchCtx, event)
+			batch.leave(event)
+		}(i, event)
+	}
+	wg.Wait()
+	for _, trxID := range results {
+		// cancelled events will be redelivered, they aren't counted as failed
+		if trxID != nil || ctx.Err() == nil {
+			app.countResults(trxID)
+		}
+	}
+	return results
+}
+
+type batchItem struct {
+	event   *broker.Event
+	request SigndiceRequest
+}
+
+// processBatch signs all events with a single signidice_part_2 trx,
+// returns trx ID for each event or nil if event wasn't processed
+func (app *App) processBatch(ctx context.Context, events []*broker.Event) []*string {
+	log.Debug().Msgf("Processing batch of %d events", len(events))
+	results := make([]*string, len(events))
+	index := make(map[*broker.Event]int, len(events))
+	items := make([]batchItem, 0, len(events))
+	digests := make([]eos.Checksum256, len(events))
+	defer func() {
+		for i, event := range events {
+			app.auditEvent(ctx, event, digests[i], results[i])
+		}
+	}()
+	for i, event := range events {
+		index[event] = i
+		digest, err := app.parseDigest(event)
+		digests[i] = digest
+		if err != nil {
+			app.malformedEvent(event, err)
+			continue
+		}
+		signature, err := app.DigestSigner.Sign(digest)
+		if err != nil {
+			metrics.SigniDiceFailures.WithLabelValues(FailureReasonRsaSign).Inc()
+			reason := "couldnt sign signidice_part_2: " + err.Error()
+			app.queueDeadLetter(event, reason)
+			app.deadLetter(event, reason)
+			app.reportEventFailure(event, FailureReasonRsaSign, err, "")
+			continue
+		}
+		items = append(items, batchItem{event, SigndiceRequest{eos.AN(event.Sender), event.RequestID, signature}})
+	}
+
+	setResult := func(items []batchItem, trxID string) {
+		for _, item := range items {
+			id := trxID
+			results[index[item.event]] = &id
+		}
+	}
+
+	for len(items) > 0 {
+		trxID, err := app.pushBatch(ctx, items)
+		if err == nil {
+			log.Info().Msgf("Successfully sent signidice_part_2 batch txn of %d events, trxID: %s", len(items), trxID)
+			setResult(items, trxID)
+			metrics.SigniDiceSigned.Add(float64(len(items)))
+			return results
+		}
+		if ctx.Err() != nil {
+			// cancelled events are redelivered, they mustn't be dead-lettered
+			log.Warn().Msgf("Cancelled signidice_part_2 batch txn of %d events, reason: %s", len(items), err.Error())
+			return results
+		}
+		if isCircuitOpen(err) {
+			for _, item := range items {
+				app.circuitOpenEvent(item.event)
+			}
+			return results
+		}
+		log.Error().Msgf("Failed to send signidice_part_2 batch txn of %d events, reason: %s", len(items), err.Error())
+		// only rejected trx can be caused by one of the events, others fail the whole batch
+		if app.Batch.FailurePolicy != BatchDropFailed || !utils.IsPermanent(err) {
+			metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushFailed).Add(float64(len(items)))
+			// queued events can be replayed later, so they don't need to hold back offset
+			reason := "failed to send signidice_part_2 batch trx: " + err.Error()
+			for _, item := range items {
+				if app.queueDeadLetter(item.event, reason) {
+					app.deadLetter(item.event, reason)
+				}
+				app.reportEventFailure(item.event, FailureReasonPushFailed, err, "")
+			}
+			return results
+		}
+		failed, ok := failedBatchItem(err, items)
+		if !ok {
+			// node didn't report failed action, isolate it by sending events one by one
+			for _, item := range items {
+				if trxID, err := app.pushBatch(ctx, []batchItem{item}); err != nil && utils.IsPermanent(err) {
+					metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushRejected).Inc()
+					reason := "signidice_part_2 trx was rejected: " + err.Error()
+					app.queueDeadLetter(item.event, reason)
+					app.deadLetter(item.event, reason)
+					app.reportEventFailure(item.event, FailureReasonPushRejected, err, failureTrace(err))
+				} else if err != nil {
+					metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushFailed).Inc()
+					log.Error().Msgf("Failed to send signidice_part_2 trx, sessionID: %d, reason: %s",
+						item.request.RequestID, err.Error())
+					if reason := "failed to send signidice_part_2 trx: " + err.Error(); app.queueDeadLetter(item.event, reason) {
+						app.deadLetter(item.event, reason)
+					}
+					app.reportEventFailure(item.event, FailureReasonPushFailed, err, "")
+				} else {
+					setResult([]batchItem{item}, trxID)
+					metrics.SigniDiceSigned.Inc()
+				}
+			}
+			return results
+		}
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushRejected).Inc()
+		reason := "signidice_part_2 batch trx was rejected: " + err.Error()
+		app.queueDeadLetter(items[failed].event, reason)
+		app.deadLetter(items[failed].event, reason)
+		app.reportEventFailure(items[failed].event, FailureReasonPushRejected, err, failureTrace(err))
+		items = append(items[:failed], items[failed+1:]...)
+	}
+	return results
+}
+
+// pushBatch builds and pushes batch trx the same way single event trxs are pushed: transient errors are retried
+// with backoff, duplicate trx is a success and rejected trx fails with permanent error
+func (app *App) pushBatch(ctx context.Context, items []batchItem) (string, error) {
+	requests := make([]SigndiceRequest, 0, len(items))
+	events := make([]*broker.Event, 0, len(items))
+	for _, item := range items {
+		requests = append(requests, item.request)
+		events = append(events, item.event)
+	}
+	packedTx, trxID, err := app.buildAndPushWithRetry(ctx, func(txOpts *eos.TxOptions) (*eos.PackedTransaction, error) {
+		return GetSigndiceBatchTransaction(app.bcAPI.Signer, app.signidiceAuth(), requests,
+			app.BlockChain.EosPubKeys.SigniDice, app.SigniDiceLimits.Apply(txOpts), app.TrxExpiration)
+	})
+	if err != nil {
+		return "", err
+	}
+	app.scheduleInclusionCheck(events, packedTx, trxID)
+	return trxID, nil
+}
+
+// failedBatchItem finds the item which caused batch failure.
+// nodeos doesn't report index of the failed action, so we look for
+// the only request ID mentioned in the error messages (game contracts put it in assertions)
+func failedBatchItem(err error, items []batchItem) (int, bool) {
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		return 0, false
+	}
+	messages := []string{apiErr.ErrorStruct.What}
+	for _, detail := range apiErr.ErrorStruct.Details {
+		messages = append(messages, detail.Message)
+	}
+	text := strings.Join(messages, "\n")
+
+	found := -1
+	for i, item := range items {
+		pattern := regexp.MustCompile(`\b` + strconv.FormatUint(item.request.RequestID, 10) + `\b`)
+		if pattern.MatchString(text) {
+			if found != -1 {
+				return 0, false
+			}
+			found = i
+		}
+	}
+	return found, found != -1
+}
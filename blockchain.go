@@ -1,20 +1,25 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/eoscanada/eos-go"
 	"github.com/eoscanada/eos-go/ecc"
 	"github.com/rs/zerolog/log"
 )
 
-func NewSigndice(contract, casinoAccount eos.AccountName, requestID uint64, signature string) *eos.Action {
+// casino account permission signidice key is authorized for by default
+const DefaultSigniDicePermission = eos.PermissionName("signidice")
+
+// NewSigndice returns sgdicesecond action authorized by the casino account permission of signidice key
+func NewSigndice(contract eos.AccountName, casino eos.PermissionLevel, requestID uint64, signature string) *eos.Action {
 	return &eos.Action{
-		Account: contract,
-		Name:    eos.ActN("sgdicesecond"),
-		Authorization: []eos.PermissionLevel{
-			{Actor: casinoAccount, Permission: eos.PN("signidice")},
-		},
+		Account:       contract,
+		Name:          eos.ActN("sgdicesecond"),
+		Authorization: []eos.PermissionLevel{casino},
 		ActionData: eos.NewActionData(Signidice{
 			requestID,
 			signature,
@@ -22,41 +27,194 @@ func NewSigndice(contract, casinoAccount eos.AccountName, requestID uint64, sign
 	}
 }
 
+// nodeos default max_transaction_lifetime
+const MaxTransactionLifetime = time.Hour
+
+// ValidateTxOptions checks that chain state contains usable TAPOS reference
+func ValidateTxOptions(txOpts *eos.TxOptions) error {
+	if len(txOpts.ChainID) != 32 {
+		return fmt.Errorf("invalid chain ID size: %d", len(txOpts.ChainID))
+	}
+	if len(txOpts.HeadBlockID) != 32 {
+		return fmt.Errorf("invalid reference block ID size: %d", len(txOpts.HeadBlockID))
+	}
+	// ref_block_num is the low 16 bits of the block num, it's 0 once every 65536 blocks
+	if binary.BigEndian.Uint32(txOpts.HeadBlockID[:4]) == 0 {
+		return fmt.Errorf("zero reference block num")
+	}
+	if binary.LittleEndian.Uint32(txOpts.HeadBlockID[8:16]) == 0 {
+		return fmt.Errorf("zero reference block prefix")
+	}
+	return nil
+}
+
+// ValidateTransactionHeader checks TAPOS and expiration of the transaction before signing
+func ValidateTransactionHeader(tx *eos.Transaction, now time.Time) error {
+	// ref_block_num alone is legitimately 0 once every 65536 blocks
+	if tx.RefBlockPrefix == 0 {
+		return fmt.Errorf("transaction has no TAPOS reference")
+	}
+	if !tx.Expiration.After(now) {
+		return fmt.Errorf("transaction already expired at %s", tx.Expiration.String())
+	}
+	if tx.Expiration.Sub(now) > MaxTransactionLifetime {
+		return fmt.Errorf("transaction expiration %s exceeds max lifetime", tx.Expiration.String())
+	}
+	return nil
+}
+
+// NewTransaction creates trx expiring after expiration, 0 keeps eos-go default
+func NewTransaction(actions []*eos.Action, txOpts *eos.TxOptions, expiration time.Duration) *eos.Transaction {
+	tx := eos.NewTransaction(actions, txOpts)
+	if expiration > 0 {
+		tx.SetExpiration(expiration)
+	}
+	return tx
+}
+
+// TrxLimits caps resources the trx may be billed for, 0 leaves the limit to the chain
+type TrxLimits struct {
+	MaxCPUUsageMs    uint8
+	MaxNetUsageWords uint32 // 8 bytes words
+}
+
+// Apply returns copy of txOpts with the limits set
+func (l TrxLimits) Apply(txOpts *eos.TxOptions) *eos.TxOptions {
+	limited := *txOpts
+	limited.MaxCPUUsageMS = l.MaxCPUUsageMs
+	limited.MaxNetUsageWords = l.MaxNetUsageWords
+	return &limited
+}
+
 // Game contract's sgdicesecond action parameters
 type Signidice struct {
 	RequestID uint64 `json:"req_id"`
 	Signature string `json:"sign"`
 }
 
+// GetSigndiceTransaction builds signed and packed sgdicesecond trx on the chain state of txOpts, it doesn't call the node,
+// so retries build it again with fresh txOpts and dry run and tests use it as is
 func GetSigndiceTransaction(
-	api *eos.API,
-	contract, casinoAccount eos.AccountName,
+	signer eos.Signer,
+	contract eos.AccountName,
+	casino eos.PermissionLevel,
 	requestID uint64, signature string,
 	signidiceKey ecc.PublicKey,
 	txOpts *eos.TxOptions,
+	expiration time.Duration,
 ) (*eos.PackedTransaction, error) {
-	action := NewSigndice(contract, casinoAccount, requestID, signature)
-	tx := eos.NewSignedTransaction(eos.NewTransaction([]*eos.Action{action}, txOpts))
-	signedTx, err := api.Signer.Sign(tx, txOpts.ChainID, signidiceKey)
+	action := NewSigndice(contract, casino, requestID, signature)
+	tx := eos.NewSignedTransaction(NewTransaction([]*eos.Action{action}, txOpts, expiration))
+	return signAndPack(signer, tx, txOpts.ChainID, signidiceKey, txOpts.Compress)
+}
+
+func signAndPack(signer eos.Signer, tx *eos.SignedTransaction, chainID eos.Checksum256,
+	key ecc.PublicKey, compression eos.CompressionType) (*eos.PackedTransaction, error) {
+	if err := ValidateTransactionHeader(tx.Transaction, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(signer); err != nil {
+		return nil, err
+	}
+	signedTx, err := signer.Sign(tx, chainID, key)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug().Msg(signedTx.String())
-	return tx.Pack(eos.CompressionNone)
+	return tx.Pack(compression)
+}
+
+// ParseCompression maps config value to trx packing compression, empty means none
+func ParseCompression(compression string) (eos.CompressionType, error) {
+	switch strings.ToLower(compression) {
+	case "none", "":
+		return eos.CompressionNone, nil
+	case "zlib":
+		return eos.CompressionZlib, nil
+	default:
+		return eos.CompressionNone, fmt.Errorf("unknown compression: %s", compression)
+	}
+}
+
+// SigndiceRequest represents single sgdicesecond action inside batch transaction
+type SigndiceRequest struct {
+	Contract  eos.AccountName
+	RequestID uint64
+	Signature string
+}
+
+// GetSigndiceBatchTransaction builds signed and packed trx of several sgdicesecond actions, it doesn't call the node
+func GetSigndiceBatchTransaction(
+	signer eos.Signer,
+	casino eos.PermissionLevel,
+	requests []SigndiceRequest,
+	signidiceKey ecc.PublicKey,
+	txOpts *eos.TxOptions,
+	expiration time.Duration,
+) (*eos.PackedTransaction, error) {
+	actions := make([]*eos.Action, 0, len(requests))
+	for _, request := range requests {
+		actions = append(actions, NewSigndice(request.Contract, casino, request.RequestID, request.Signature))
+	}
+	tx := eos.NewSignedTransaction(NewTransaction(actions, txOpts, expiration))
+	return signAndPack(signer, tx, txOpts.ChainID, signidiceKey, txOpts.Compress)
 }
 
-// allowed only 3 invariants: {transfer, newgame}, {transfer, gameaction}, {transfer, newgame, gameaction}
+// NewNonce returns context free action which makes trx unique, the same way cleos --force-unique does
+func NewNonce(contract eos.AccountName, nonce []byte) *eos.Action {
+	return &eos.Action{
+		Account:    contract,
+		Name:       eos.ActN("nonce"),
+		ActionData: eos.NewActionDataFromHexData(nonce),
+	}
+}
+
+// SigndiceNonce derives nonce from the signidice request, so it's the same for every retry
+func SigndiceNonce(contract eos.AccountName, requestID uint64) []byte {
+	nonce := make([]byte, 8, 8+len(contract))
+	binary.LittleEndian.PutUint64(nonce, requestID)
+	return append(nonce, contract...)
+}
+
+// GetSigndiceNonceTransaction builds signidice trx with deterministic nonce and the given header,
+// so the same request produces the same trx ID while header is reused
+func GetSigndiceNonceTransaction(
+	signer eos.Signer,
+	contract eos.AccountName,
+	casino eos.PermissionLevel,
+	requestID uint64, signature string,
+	signidiceKey ecc.PublicKey,
+	chainID eos.Checksum256,
+	header eos.TransactionHeader,
+	nonceContract eos.AccountName,
+	compression eos.CompressionType,
+) (*eos.PackedTransaction, error) {
+	action := NewSigndice(contract, casino, requestID, signature)
+	tx := eos.NewSignedTransaction(&eos.Transaction{
+		TransactionHeader:  header,
+		ContextFreeActions: []*eos.Action{NewNonce(nonceContract, SigndiceNonce(contract, requestID))},
+		Actions:            []*eos.Action{action},
+	})
+	return signAndPack(signer, tx, chainID, signidiceKey, compression)
+}
+
+// allowed only 3 invariants: {transfer, newgame}, {transfer, gameaction}, {transfer, newgame, gameaction},
+// transfer should be authorized with the permission deposit key is authorized for
 func ValidateDepositTransaction(
 	tx *eos.SignedTransaction,
-	casinoName, platformName eos.AccountName,
+	depositPermission eos.PermissionName,
+	platformName eos.AccountName,
 	platformPubKey ecc.PublicKey,
 	chainID eos.Checksum256) error {
+	if tx.Transaction == nil {
+		return fmt.Errorf("empty transaction")
+	}
 	if len(tx.Actions) != 2 && len(tx.Actions) != 3 {
 		return fmt.Errorf("invalid actions size")
 	}
 
 	transferAction := tx.Actions[0] // first action always is transfer
-	if err := ValidateTransferAction(transferAction, casinoName); err != nil {
+	if err := ValidateTransferAction(transferAction, depositPermission); err != nil {
 		return err
 	}
 
@@ -92,7 +250,7 @@ func ValidateDepositTransaction(
 	return nil
 }
 
-func ValidateTransferAction(action *eos.Action, casinoName eos.AccountName) error {
+func ValidateTransferAction(action *eos.Action, permission eos.PermissionName) error {
 	if action.Account != eos.AN("eosio.token") {
 		return fmt.Errorf("invalid contract name in transfer action")
 	}
@@ -102,7 +260,7 @@ func ValidateTransferAction(action *eos.Action, casinoName eos.AccountName) erro
 	if len(action.Authorization) != 1 {
 		return fmt.Errorf("invalid authorization size in transfer action")
 	}
-	if string(action.Authorization[0].Permission) != string(casinoName) {
+	if action.Authorization[0].Permission != permission {
 		return fmt.Errorf("invalid permission in transfer action")
 	}
 	return nil
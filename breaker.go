@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// circuit breaker states reported by /status
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned instead of pushing trx while the circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open, node is considered degraded")
+
+type BreakerConfig struct {
+	FailureThreshold int           // consecutive failed pushes opening the circuit, 0 disables the breaker
+	Cooldown         time.Duration // open circuit fails pushes fast for that long, then a single trial push is let through
+}
+
+// CircuitBreaker stops pushes to degraded node: it opens after FailureThreshold consecutive failures,
+// after Cooldown it's half open and lets a single trial push through, which closes or reopens it
+type CircuitBreaker struct {
+	m        sync.Mutex
+	cfg      BreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool // trial push of half open circuit is in flight
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{cfg: cfg, state: BreakerClosed, now: time.Now}
+}
+
+// Allow reports whether push can be made, allowed push must be followed by Report or Cancel
+func (b *CircuitBreaker) Allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cfg.Cooldown {
+		b.setState(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Report records result of the allowed push
+func (b *CircuitBreaker) Report(success bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+		if success {
+			b.failures = 0
+			b.setState(BreakerClosed)
+		} else {
+			b.open()
+		}
+		return
+	}
+	if success {
+		b.failures = 0
+		return
+	}
+	if b.failures++; b.state == BreakerClosed && b.failures >= b.cfg.FailureThreshold {
+		b.open()
+	}
+}
+
+// Cancel releases the allowed push which result says nothing about the node, e.g. cancelled one
+func (b *CircuitBreaker) Cancel() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.trial = false
+}
+
+func (b *CircuitBreaker) State() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cfg.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(BreakerOpen)
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	log.Warn().Msgf("Push circuit breaker is %s, was %s", state, b.state)
+	b.state = state
+}
+
+// isNodeFailure reports whether push failed because of degraded node rather than rejected trx
+func isNodeFailure(err error) bool {
+	category := classifyPushError(err)
+	return isRetryablePushError(category) && category != PushErrorExpired
+}
+
+func isCircuitOpen(err error) bool {
+	if permanent, ok := err.(*utils.PermanentError); ok {
+		err = permanent.Err
+	}
+	return err == ErrCircuitOpen
+}
+
+// guardPush runs push through the circuit breaker when it's enabled, open circuit fails push with permanent ErrCircuitOpen
+func (app *App) guardPush(ctx context.Context, push func() error) error {
+	if app.pushBreaker == nil {
+		return push()
+	}
+	if !app.pushBreaker.Allow() {
+		return utils.Permanent(ErrCircuitOpen)
+	}
+	err := push()
+	if err != nil && ctx.Err() != nil {
+		app.pushBreaker.Cancel()
+		return err
+	}
+	app.pushBreaker.Report(err == nil || !isNodeFailure(err))
+	return err
+}
+
+// circuitOpenEvent records event which push was skipped because the circuit is open.
+// It's dead-lettered when the queue is enabled, so it can be replayed after node recovers,
+// otherwise it holds back offset commit and is redelivered after restart
+func (app *App) circuitOpenEvent(event *broker.Event) {
+	metrics.SigniDiceFailures.WithLabelValues(FailureReasonCircuitOpen).Inc()
+	reason := "push skipped: " + ErrCircuitOpen.Error()
+	if app.queueDeadLetter(event, reason) {
+		app.deadLetter(event, reason)
+		return
+	}
+	logger := eventLogger(context.Background(), event)
+	logger.Error().Msgf("Failed to send signidice_part_2 trx, sessionID: %d, reason: %s", event.RequestID, reason)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrChainRequestTimeout = errors.New("chain request timed out")
+
+// limitChainRequests gives every node HTTP request of api the deadline, so a call timed out by chainRequest
+// is aborted instead of running in background, e.g. push can't land after its event is dead-lettered
+func limitChainRequests(api *eos.API, timeout time.Duration) {
+	if timeout > 0 {
+		api.HttpClient.Timeout = timeout
+	}
+}
+
+// chainRequest runs node API call f limited by ChainRequestTimeout, so unresponsive node
+// doesn't block the caller, and by ctx, so the caller can cancel waiting for it.
+// The request itself is aborted by the HTTP client deadline set with limitChainRequests,
+// call cancelled with ctx before it is left running in background and its results must be discarded
+func (app *App) chainRequest(ctx context.Context, name string, f func() error) error {
+	if app.ChainRequestTimeout <= 0 {
+		return utils.WithContext(ctx, f)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, app.ChainRequestTimeout)
+	defer cancel()
+	err := utils.WithContext(callCtx, f)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		log.Error().Msgf("Chain request %s timed out after %s", name, app.ChainRequestTimeout)
+		return ErrChainRequestTimeout
+	}
+	return err
+}
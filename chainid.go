@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ChainIDCheck is what happens when BlockChain.ChainID doesn't match chain ID of the node at startup
+type ChainIDCheck string
+
+const (
+	// chain ID isn't checked, it must be configured
+	ChainIDCheckOff ChainIDCheck = "off"
+	// mismatch is logged, configured chain ID is used
+	ChainIDCheckWarn ChainIDCheck = "warn"
+	// mismatch fails startup
+	ChainIDCheckFail ChainIDCheck = "fail"
+)
+
+func ParseChainIDCheck(check string) (ChainIDCheck, error) {
+	switch ChainIDCheck(strings.ToLower(check)) {
+	case ChainIDCheckOff, "":
+		return ChainIDCheckOff, nil
+	case ChainIDCheckWarn:
+		return ChainIDCheckWarn, nil
+	case ChainIDCheckFail:
+		return ChainIDCheckFail, nil
+	default:
+		return "", fmt.Errorf("unknown chain ID check: %s", check)
+	}
+}
+
+// detectChainID gets chain ID of the node, it's used when BlockChain.ChainID isn't configured
+// and the configured one is verified against it otherwise. Deposits are signed with the configured chain ID,
+// so signatures made for another chain are rejected by the node without a hint
+func (app *App) detectChainID(ctx context.Context) error {
+	check := app.BlockChain.ChainIDCheck
+	if check == ChainIDCheckOff {
+		return nil
+	}
+	configured := app.BlockChain.ChainID
+	info, err := app.getInfo(ctx)
+	if err != nil {
+		if len(configured) == 0 || check == ChainIDCheckFail {
+			return fmt.Errorf("failed to get chain ID of the node: %s", err.Error())
+		}
+		log.Warn().Msgf("Failed to get chain ID of the node, using configured %s, reason: %s", configured, err.Error())
+		return nil
+	}
+	if len(configured) == 0 {
+		app.BlockChain.ChainID = info.ChainID
+		log.Info().Msgf("Detected chain ID %s", info.ChainID)
+		return nil
+	}
+	if bytes.Equal(configured, info.ChainID) {
+		return nil
+	}
+	if check == ChainIDCheckFail {
+		return fmt.Errorf("configured chain ID %s doesn't match chain ID %s of the node", configured, info.ChainID)
+	}
+	log.Warn().Msgf("Configured chain ID %s doesn't match chain ID %s of the node, deposits will be rejected",
+		configured, info.ChainID)
+	return nil
+}
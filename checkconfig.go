@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+)
+
+// runConfigCheck reports result of the config check, returns process exit code
+func runConfigCheck(cfg *Config, loadErr error, out io.Writer) int {
+	if loadErr == nil {
+		loadErr = CheckConfig(cfg, out)
+	}
+	if loadErr != nil {
+		fmt.Fprintf(out, "failed: %s\n", loadErr.Error())
+		return 1
+	}
+	fmt.Fprintln(out, "config check passed")
+	return 0
+}
+
+// CheckConfig validates config and key material the way startup does, but doesn't connect to the broker or the node.
+// Passed checks are reported to out, the first failed one is returned
+func CheckConfig(cfg *Config, out io.Writer) error {
+	appConfig, keyBag, err := MakeAppConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to process config, reason: %s", err.Error())
+	}
+	if appConfig.BlockChain.RSAKey == nil {
+		return fmt.Errorf("RSA key is not set")
+	}
+	fmt.Fprintf(out, "ok: %d EOS keys parsed, RSA key is %d bits\n",
+		len(keyBag.Keys), appConfig.BlockChain.RSAKey.N.BitLen())
+	if err := appConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %s", err.Error())
+	}
+	fmt.Fprintln(out, "ok: config is valid")
+	if appConfig.BlockChain.ChainIDCheck != ChainIDCheckOff {
+		fmt.Fprintln(out, "skipped: chain ID check against the node")
+	}
+	if err := CheckSigner(keyBag, appConfig.BlockChain.EosPubKeys); err != nil {
+		return fmt.Errorf("invalid signer: %s", err.Error())
+	}
+	if appConfig.BlockChain.RSAPubKey != nil {
+		if err := CheckRsaKeyPair(appConfig.BlockChain.RSAKey, appConfig.BlockChain.RSAPubKey, appConfig.BlockChain.DigestHash); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "ok: RSA key pair matches")
+	} else {
+		fmt.Fprintln(out, "skipped: RSA public key is not set, RSA key self-test")
+	}
+	if appConfig.TLS.Enabled() {
+		if _, err := tls.LoadX509KeyPair(appConfig.TLS.CertFile, appConfig.TLS.KeyFile); err != nil {
+			return fmt.Errorf("failed to load TLS key pair: %s", err.Error())
+		}
+		fmt.Fprintln(out, "ok: TLS key pair loaded")
+	}
+	if _, err := lookupJSONCodec(cfg.Server.JSONCodec); err != nil {
+		return err
+	}
+	return nil
+}
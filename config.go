@@ -4,26 +4,172 @@ import broker "github.com/DaoCasino/platform-action-monitor-client"
 
 type Config struct {
 	Server struct {
-		Port     int    `default:"80"`
-		LogLevel string `default:"INFO"`
+		Port      int    `default:"80"`
+		BindHost  string // interface to listen on, all interfaces when empty
+		LogLevel  string `default:"INFO"`
+		LogFormat string `default:"console"` // console or json
+		JSONCodec string `default:"std"`
+		Standby   bool
+		// reject events and requests with unknown fields
+		StrictJSON bool
+		// sign and build trxs, but log them instead of pushing
+		DryRun bool
+		// serve HTTPS with these PEM files, plain HTTP when not set
+		TLSCertFile string
+		TLSKeyFile  string
+		// sign endpoints request body limit, bytes
+		MaxBodySize int64 `default:"1048576"`
+		// serve net/http/pprof profiles at /debug/pprof/ on the API port, auth token protected
+		Pprof bool
+		// API connections limits, seconds, 0 means no limit
+		ReadTimeout  int `default:"30"`
+		WriteTimeout int // covers signing and pushing deposits, keep it above node retries
+		IdleTimeout  int `default:"120"`
+		// negotiate HTTP/2 with HTTPS clients
+		HTTP2 bool `default:"true"`
 	}
 	Broker struct {
 		TopicOffsetPath      string
+		TopicOffsetSync      bool // fsync offset file and its directory after every commit, no fsync at all otherwise
 		URL                  string
 		TopicID              broker.EventType
-		ReconnectionAttempts int `default:"3"`
-		ReconnectionDelay    int `default:"3"`
+		TopicIDs             []broker.EventType // topics to subscribe, TopicID is used when empty
+		ReconnectionAttempts int                `default:"3"`
+		ReconnectionDelay    int                `default:"3"`
 		Token                string
+		ReplayTimeout        int  `default:"60"`
+		ConnectMaxAttempts   int  `default:"5"`
+		ConnectBaseDelay     int  `default:"1"` // seconds, doubled after every failed initial subscribe
+		ConnectMaxDelay      int  `default:"30"`
+		IdleResubscribe      int  // seconds without events before re-subscribing, 0 disables
+		ReplayGaps           bool // replay offsets skipped by the broker
 	}
 	BlockChain struct {
-		DepositKey          string
-		SigniDiceKey        string
-		RSAKey              string
-		URL                 string
-		ChainID             string
-		CasinoAccountName   string
-		PlatformAccountName string
-		PlatformPubKey      string
+		DepositKey           string
+		DepositKeyFile       string   // WIF file, preferred over DepositKey
+		DepositKeys          []string // additional deposit keys
+		SigniDiceKey         string
+		SigniDiceKeyFile     string // WIF file, preferred over SigniDiceKey
+		RSAKey               string // base64 encoded PEM
+		RSAKeyFile           string // PEM file, preferred over RSAKey
+		RSAKeyPassphrase     string // passphrase of encrypted RSA key PEM, better set with BLOCKCHAIN_RSAKEYPASSPHRASE env var
+		RSAKeyPassphraseFile string // file with the passphrase, preferred over RSAKeyPassphrase
+		RSAPubKey            string // base64 DER as registered in the contract, optional
+		DigestHash           string `default:"sha256"` // sha256, sha384 or sha512
+		URL                  string
+		FailoverURLs         []string // nodes to switch to when URL is down, in priority order
+		ChainID              string
+		ChainIDCheck         string // off, warn or fail on mismatch with the node, detected from the node when ChainID is empty
+		CasinoAccountName    string
+		PlatformAccountName  string
+		PlatformPubKey       string
+		RequestTimeout       int    `default:"5"`    // node API call timeout, seconds
+		Compression          string `default:"none"` // none or zlib
+		TrxExpiration        int    `default:"30"`   // built trxs lifetime, seconds
+		NodeTimeoutMs        int    `default:"2000"` // single node call limit before failing over
+		HealthCheckInterval  int    `default:"10"`   // unhealthy nodes re-check period, seconds
+		// signidice trx limits, 0 means no limit
+		MaxCPUUsageMs    uint8
+		MaxNetUsageWords uint32 // 8 bytes words
+		// casino account -> its deposit key, selected by account param of sign requests
+		AccountDepositKeys map[string]string
+		// permissions the keys are authorized for
+		SigniDicePermission string `default:"signidice"`
+		DepositPermission   string // casino account name when empty
+	}
+	Batch struct {
+		Enabled       bool
+		FailurePolicy string `default:"fail"`
+	}
+	Processor struct {
+		MaxGoroutines      int `default:"1000"`
+		MaxConcurrentSigns int
+		DedupCacheSize     int    `default:"10000"`
+		EventBufferSize    int    `default:"100"`
+		EventTimeout       int    `default:"120"`   // seconds, 0 disables
+		MaxPendingMessages int    `default:"10000"` // not committed messages per topic before reading pauses, 0 disables
+		MalformedEventsLog string // file to append events with unparsable data to
+		AuditLog           string // file to append every completed event outcome to, "-" for stdout
+		// JSON file of recently signed requests surviving restarts, disabled when empty
+		SignedRequestsFile     string
+		SignedRequestsMaxCount int `default:"100000"`
+		SignedRequestsMaxAge   int `default:"86400"` // seconds
+		SignedRequestsFlushMs  int `default:"1000"`
+	}
+	Confirmation struct {
+		Enabled        bool
+		PollIntervalMs int `default:"500"`
+		Timeout        int `default:"20"` // seconds
+	}
+	DLQ struct {
+		Path    string // dead letter queue file, disabled when empty
+		MaxSize int64  `default:"104857600"` // bytes
+	}
+	Inclusion struct {
+		Enabled bool
+		Delay   int  `default:"10"`
+		Repush  bool `default:"true"`
+	}
+	Auth struct {
+		Token string // better set with AUTH_TOKEN env var
+	}
+	RateLimit struct {
+		RPS        float64 // signed trxs per second of all clients, 0 disables
+		Burst      int     `default:"10"`
+		PerIPRPS   float64 // signed trxs per second of a single IP, 0 disables
+		PerIPBurst int     `default:"5"`
+		MaxClients int     `default:"10000"`
+	}
+	Idempotency struct {
+		TTL     int `default:"3600"` // seconds sign result is kept for retries with the same Idempotency-Key, 0 disables
+		MaxKeys int `default:"10000"`
+	}
+	SigningCap struct {
+		MaxPerAccount int    // deposit trxs signed per casino account within a window, 0 disables
+		Window        int    `default:"86400"` // seconds, windows are aligned to UTC midnight
+		File          string // JSON file of counts surviving restarts, kept in memory when empty
+	}
+	Push struct {
+		MaxAttempts int `default:"5"`
+		BaseDelayMs int `default:"200"`
+		MaxDelayMs  int `default:"5000"`
+		// use send_transaction2 to log failure traces of rejected trxs
+		SendTransaction2 bool
+		// consecutive failed pushes opening the circuit breaker, 0 disables it
+		BreakerFailures int
+		BreakerCooldown int `default:"30"` // seconds
+	}
+	Relay struct {
+		URL string
+	}
+	ErrorReporting struct {
+		WebhookURL string // signing and startup failures are POSTed there as JSON, disabled when empty
+		Timeout    int    `default:"5"` // seconds
+	}
+	Resources struct {
+		Enabled         bool
+		Interval        int `default:"60"`
+		Account         string
+		Threshold       float64 `default:"0.1"`
+		TopUpContract   string
+		TopUpAction     string
+		TopUpPermission string `default:"active"`
+		TopUpData       string
+	}
+	Nonce struct {
+		Enabled  bool
+		Contract string `default:"eosio.null"`
+	}
+	ResolvedCheck struct {
+		Enabled      bool
+		Table        string `default:"session"`
+		PendingState uint8  `default:"4"` // req_signidice_part_2 state of the game sdk
+	}
+	Shutdown struct {
+		HTTPTimeout   int `default:"10"` // seconds in-flight requests are waited for, then connections are closed
+		BrokerTimeout int `default:"5"`
+		DrainTimeout  int `default:"30"`
+		OffsetTimeout int `default:"5"`
 	}
 	HTTP struct {
 		RetryAmount int `default:"3"`
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// GetConfig loads config in order of precedence: env vars, config file, defaults.
+// Config file format is chosen by its extension: .yaml/.yml, .json or TOML otherwise, missing file is ignored.
+// Env var names are upper cased section and field joined with underscore, e.g. SERVER_PORT or AUTH_TOKEN
+func GetConfig(configPath string) (*Config, error) {
+	cfg := &Config{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := decodeConfigFile(configPath, cfg); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return cfg, nil
+	}
+	// file values override env ones filled above, restore them
+	env := &Config{}
+	if err := envconfig.Process("", env); err != nil {
+		return nil, err
+	}
+	overrideFromEnv(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(env).Elem(), "")
+	return cfg, nil
+}
+
+func decodeConfigFile(configPath string, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		content, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return err
+		}
+		// decoded as JSON to match keys case insensitively, the same way TOML and JSON files are
+		content, err = json.Marshal(yamlToJSON(doc))
+		if err != nil {
+			return err
+		}
+		return decodeJSONConfig(content, cfg)
+	case ".json":
+		content, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return err
+		}
+		return decodeJSONConfig(content, cfg)
+	default:
+		_, err := toml.DecodeFile(configPath, cfg)
+		return err
+	}
+}
+
+func decodeJSONConfig(content []byte, cfg *Config) error {
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return fmt.Errorf("invalid config file: %s", err.Error())
+	}
+	return nil
+}
+
+// yamlToJSON converts YAML maps with interface{} keys, which can't be marshalled to JSON
+func yamlToJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlToJSON(item)
+		}
+	}
+	return value
+}
+
+// overrideFromEnv copies fields which env vars are set for from env to cfg, keys are named as envconfig does
+func overrideFromEnv(cfg, env reflect.Value, prefix string) {
+	for i := 0; i < cfg.NumField(); i++ {
+		key := strings.ToUpper(cfg.Type().Field(i).Name)
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if cfg.Field(i).Kind() == reflect.Struct {
+			overrideFromEnv(cfg.Field(i), env.Field(i), key)
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			cfg.Field(i).Set(env.Field(i))
+		}
+	}
+}
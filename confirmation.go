@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+type ConfirmationConfig struct {
+	Enabled      bool
+	PollInterval time.Duration
+	Timeout      time.Duration // should be less than trx expiration, otherwise it can't be retried
+}
+
+// waitIrreversible polls history API until pushed trx gets into an irreversible block,
+// node accepts trx before block inclusion and it still can be dropped on a microfork.
+// Chain error other than unknown trx, e.g. missing history plugin, fails the wait at once
+func (app *App) waitIrreversible(ctx context.Context, trxID string) error {
+	deadline := time.Now().Add(app.Confirmation.Timeout)
+	for {
+		irreversible, err := app.isIrreversible(ctx, trxID)
+		if _, isAPIError := asAPIError(err); isAPIError {
+			return err
+		}
+		if err != nil {
+			log.Debug().Msgf("Failed to get trx status, trxID: %s, reason: %s", trxID, err.Error())
+		} else if irreversible {
+			return nil
+		}
+		if time.Now().Add(app.Confirmation.PollInterval).After(deadline) {
+			return fmt.Errorf("trx %s isn't irreversible after %s", trxID, app.Confirmation.Timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(app.Confirmation.PollInterval):
+		}
+	}
+}
+
+func (app *App) isIrreversible(ctx context.Context, trxID string) (bool, error) {
+	var resp *eos.TransactionResp
+	err := app.chainRequest(ctx, "get_transaction", func() error {
+		var e error
+		resp, e = app.bcAPI.GetTransaction(trxID)
+		return e
+	})
+	if err == eos.ErrNotFound {
+		return false, nil
+	}
+	if apiErr, ok := err.(eos.APIError); ok && apiErr.ErrorStruct.Code == EosTrxNotFoundErrorCode {
+		// history plugin responds with an error for unknown trx
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.BlockNum != 0 && resp.BlockNum <= resp.LastIrreversibleBlock, nil
+}
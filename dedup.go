@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+type processedRequest struct {
+	done  chan struct{}
+	trxID *string
+}
+
+func requestKey(event *broker.Event) string {
+	return fmt.Sprintf("%s:%d", event.Sender, event.RequestID)
+}
+
+// DedupEventMiddleware skips redelivered events of already signed requests and returns trx ID of the first one,
+// event of the request being processed waits for it, failed requests are removed so they can be retried
+func (app *App) DedupEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		key := requestKey(event)
+		request := &processedRequest{done: make(chan struct{})}
+		if !app.processedRequests.Add(key, request) {
+			cached, ok := app.processedRequests.Get(key)
+			if !ok {
+				// evicted meanwhile
+				return next(ctx, event)
+			}
+			original := cached.(*processedRequest)
+			// the original may be in the same batch, which can't be signed while this event holds it
+			leaveEventBatch(ctx, event)
+			<-original.done
+			log.Info().Msgf("Skipping duplicate event, sessionID: %d, sender: %s", event.RequestID, event.Sender)
+			return original.trxID
+		}
+		request.trxID = next(ctx, event)
+		if request.trxID == nil {
+			app.processedRequests.Remove(key)
+		}
+		close(request.done)
+		return request.trxID
+	}
+}
+
+// SignedRequestsEventMiddleware skips events of requests signed before restart and returns the stored trx ID,
+// it does nothing when signed requests store is disabled
+func (app *App) SignedRequestsEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		if app.signedRequests == nil {
+			return next(ctx, event)
+		}
+		key := requestKey(event)
+		if trxID, ok := app.signedRequests.Get(key); ok {
+			log.Info().Msgf("Skipping event of already signed request, sessionID: %d, sender: %s, trxID: %s",
+				event.RequestID, event.Sender, trxID)
+			return &trxID
+		}
+		trxID := next(ctx, event)
+		if trxID != nil {
+			app.signedRequests.Add(key, *trxID)
+		}
+		return trxID
+	}
+}
+
+// RunSignedRequestsFlush periodically writes signed requests until ctx is done, the last flush is done on shutdown
+func (app *App) RunSignedRequestsFlush(ctx context.Context) {
+	ticker := time.NewTicker(app.Processor.SignedRequestsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := app.signedRequests.Flush(); err != nil {
+				log.Warn().Msgf("Failed to flush signed requests, reason: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/eoscanada/eos-go"
+)
+
+// max deposit trxs accepted by a single /sign_transactions request
+const MaxSignTransactionsBatch = 16
+
+// SignTransactionsQuery signs and pushes array of deposit trxs one by one,
+// each trx gets its own result so partial failures don't fail the whole request
+func (app *App) SignTransactionsQuery(writer ResponseWriter, req *Request) {
+	ctxLogger(req.Context()).Info().Msg("Called /sign_transactions")
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		metrics.SignTransactionProcessingTimeMs.Observe(elapsed.Seconds() * 1000)
+	}()
+	rawTransactions, ok := app.readBody(writer, req)
+	if !ok {
+		return
+	}
+	var transactions []json.RawMessage
+	if err := app.decodeInput(rawTransactions, &transactions); err != nil {
+		ctxLogger(req.Context()).Debug().Msgf("failed to deserialize transactions, reason: %s", err.Error())
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeDeserializeFailed,
+			app.inputError("failed to deserialize transactions", err))
+		return
+	}
+	if len(transactions) == 0 || len(transactions) > MaxSignTransactionsBatch {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest,
+			"transactions amount should be from 1 to "+strconv.Itoa(MaxSignTransactionsBatch))
+		return
+	}
+
+	account := eos.AN(req.URL.Query().Get("account"))
+	results := make([]JSONResponse, 0, len(transactions))
+	for _, rawTransaction := range transactions {
+		tx, err := app.decodeDepositTransaction(rawTransaction)
+		if err != nil {
+			ctxLogger(req.Context()).Debug().Msgf("failed to deserialize transaction, reason: %s", err.Error())
+			results = append(results, JSONResponse{"error": app.inputError("failed to deserialize transaction", err),
+				"code": ErrorCodeDeserializeFailed})
+			continue
+		}
+		packedTrx, trxID, depositErr := app.signDepositTransaction(req.Context(), tx, account)
+		if depositErr != nil {
+			results = append(results, JSONResponse{"error": depositErr.message, "code": depositErr.code})
+			continue
+		}
+		results = append(results, app.depositResult(packedTrx, trxID))
+	}
+	respondWithJSON(writer, http.StatusOK, results)
+}
+
+// batchCost counts every trx of /sign_transactions request against the rate limit,
+// body is put back for the handler and malformed one costs a single request as it's rejected anyway
+func (app *App) batchCost(writer ResponseWriter, req *Request) (int, bool) {
+	body, ok := app.readBody(writer, req)
+	if !ok {
+		return 0, false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var transactions []json.RawMessage
+	if err := jsonCodec.Unmarshal(body, &transactions); err != nil || len(transactions) == 0 {
+		return 1, true
+	}
+	return len(transactions), true
+}
+
+// decodeDepositTransaction decodes deposit trx JSON, either eos.SignedTransaction or eos.PackedTransaction
+// detected by packed_trx field. Packed trx is unpacked with its signatures and actions data kept as is,
+// so it's signed and repacked the same way
+func (app *App) decodeDepositTransaction(rawTransaction []byte) (*eos.SignedTransaction, error) {
+	var fields map[string]json.RawMessage
+	if err := jsonCodec.Unmarshal(rawTransaction, &fields); err == nil {
+		if _, ok := fields["packed_trx"]; ok {
+			packedTrx := &eos.PackedTransaction{}
+			if err := app.decodeInput(rawTransaction, packedTrx); err != nil {
+				return nil, err
+			}
+			return packedTrx.UnpackBare()
+		}
+	}
+	tx := &eos.SignedTransaction{}
+	if err := app.decodeInput(rawTransaction, tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
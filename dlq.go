@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+type DLQConfig struct {
+	Path    string // JSON lines file of events failed after all retries, disabled when empty
+	MaxSize int64  // bytes, new events are refused when reached, 0 means unlimited
+}
+
+type DeadLetterRecord struct {
+	ID     string        `json:"id"`
+	Time   time.Time     `json:"time"`
+	Reason string        `json:"reason"`
+	Event  *broker.Event `json:"event"`
+}
+
+type DLQReplayRequest struct {
+	IDs []string `json:"ids"` // all queued events when empty
+}
+
+type DLQReplayResult struct {
+	Succeeded []string `json:"succeeded"`
+	Failed    []string `json:"failed"`
+	TxIDs     []string `json:"txids"`
+}
+
+func deadLetterID(event *broker.Event) string {
+	return fmt.Sprintf("%d-%d-%d", event.EventType, event.Offset, event.RequestID)
+}
+
+// queueDeadLetter appends failed event to the dead letter queue, returns false when the queue
+// is disabled or the event couldn't be written, event queued before isn't duplicated
+func (app *App) queueDeadLetter(event *broker.Event, reason string) bool {
+	if app.DLQ.Path == "" {
+		return false
+	}
+	if err := app.appendDeadLetter(event, reason); err != nil {
+		log.Error().Msgf("Failed to queue dead letter, sessionID: %d, reason: %s", event.RequestID, err.Error())
+		return false
+	}
+	return true
+}
+
+func (app *App) appendDeadLetter(event *broker.Event, reason string) error {
+	app.dlqLock.Lock()
+	defer app.dlqLock.Unlock()
+	records, err := app.readDeadLetters()
+	if err != nil {
+		return err
+	}
+	id := deadLetterID(event)
+	for _, record := range records {
+		if record.ID == id {
+			// failed again on replay
+			return nil
+		}
+	}
+	line, err := jsonCodec.Marshal(&DeadLetterRecord{ID: id, Time: time.Now().UTC(), Reason: reason, Event: event})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if app.DLQ.MaxSize > 0 {
+		info, err := os.Stat(app.DLQ.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && info.Size()+int64(len(line)) > app.DLQ.MaxSize {
+			return fmt.Errorf("dead letter queue is full, max size: %d bytes", app.DLQ.MaxSize)
+		}
+	}
+	file, err := os.OpenFile(app.DLQ.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readDeadLetters returns queued records, caller should hold dlqLock
+func (app *App) readDeadLetters() ([]*DeadLetterRecord, error) {
+	content, err := ioutil.ReadFile(app.DLQ.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*DeadLetterRecord
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		record := &DeadLetterRecord{}
+		if err := jsonCodec.Unmarshal(line, record); err != nil {
+			return nil, fmt.Errorf("invalid dead letter at line %d: %s", i+1, err.Error())
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// DeadLetters lists queued records
+func (app *App) DeadLetters() ([]*DeadLetterRecord, error) {
+	app.dlqLock.Lock()
+	defer app.dlqLock.Unlock()
+	return app.readDeadLetters()
+}
+
+func (app *App) removeDeadLetters(ids map[string]bool) error {
+	app.dlqLock.Lock()
+	defer app.dlqLock.Unlock()
+	records, err := app.readDeadLetters()
+	if err != nil {
+		return err
+	}
+	var content []byte
+	for _, record := range records {
+		if ids[record.ID] {
+			continue
+		}
+		line, err := jsonCodec.Marshal(record)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	return utils.NewAtomicFile(app.DLQ.Path).WriteAtomic(content)
+}
+
+// ReplayDeadLetters reprocesses queued events, succeeded ones are removed from the queue
+func (app *App) ReplayDeadLetters(ctx context.Context, ids []string) (*DLQReplayResult, error) {
+	records, err := app.DeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	result := &DLQReplayResult{Succeeded: []string{}, Failed: []string{}, TxIDs: []string{}}
+	succeeded := make(map[string]bool)
+	for _, record := range records {
+		if len(ids) > 0 && !selected[record.ID] {
+			continue
+		}
+		if trxID := app.handleEvent(ctx, record.Event); trxID != nil {
+			succeeded[record.ID] = true
+			result.Succeeded = append(result.Succeeded, record.ID)
+			result.TxIDs = append(result.TxIDs, *trxID)
+		} else {
+			result.Failed = append(result.Failed, record.ID)
+		}
+	}
+	if len(succeeded) == 0 {
+		return result, nil
+	}
+	return result, app.removeDeadLetters(succeeded)
+}
+
+func (app *App) DeadLettersQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /dead_letters")
+	records, err := app.DeadLetters()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, ErrorCodeInternal,
+			"failed to read dead letters, reason: "+err.Error())
+		return
+	}
+	if records == nil {
+		records = []*DeadLetterRecord{}
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"records": records})
+}
+
+func (app *App) ReplayDeadLettersQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /dead_letters/replay")
+	if app.DLQ.Path == "" {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "dead letter queue is disabled")
+		return
+	}
+	rawRequest, ok := app.readBody(writer, req)
+	if !ok {
+		return
+	}
+	replayReq := &DLQReplayRequest{}
+	if len(bytes.TrimSpace(rawRequest)) > 0 {
+		if err := app.decodeInput(rawRequest, replayReq); err != nil {
+			respondWithError(writer, http.StatusBadRequest, ErrorCodeDeserializeFailed,
+				app.inputError("failed to deserialize replay request", err))
+			return
+		}
+	}
+	result, err := app.ReplayDeadLetters(req.Context(), replayReq.IDs)
+	if err != nil {
+		log.Warn().Msgf("Failed to replay dead letters, reason: %s", err.Error())
+		respondWithError(writer, http.StatusInternalServerError, ErrorCodeInternal,
+			"failed to replay dead letters, reason: "+err.Error())
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": result})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Drain mode: processor holds the next event message, so nothing new is dispatched to workers,
+// while in-flight events finish and commit their offsets. Further messages are kept by the broker client buffer
+// and the broker until undrain. Deposits are still signed. Drained instance isn't ready, so it's taken out of rotation.
+
+// Drain pauses event processing, returns false if it's drained already
+func (app *App) Drain() bool {
+	app.drainLock.Lock()
+	defer app.drainLock.Unlock()
+	if app.undrained != nil {
+		return false
+	}
+	app.undrained = make(chan struct{})
+	return true
+}
+
+// Undrain resumes event processing, returns false if it wasn't drained
+func (app *App) Undrain() bool {
+	app.drainLock.Lock()
+	defer app.drainLock.Unlock()
+	if app.undrained == nil {
+		return false
+	}
+	// no events were received while drained, it isn't an expired subscription
+	app.touchSubscription()
+	close(app.undrained)
+	app.undrained = nil
+	return true
+}
+
+func (app *App) IsDrained() bool {
+	return app.drainWait() != nil
+}
+
+// waitUndrained holds the processor while drained, returns false if ctx is done meanwhile
+func (app *App) waitUndrained(ctx context.Context) bool {
+	undrained := app.drainWait()
+	if undrained == nil {
+		return true
+	}
+	log.Info().Msg("Event processing is drained, waiting for undrain")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-undrained:
+		return true
+	}
+}
+
+// drainWait returns chan closed on undrain, nil if not drained
+func (app *App) drainWait() <-chan struct{} {
+	app.drainLock.Lock()
+	defer app.drainLock.Unlock()
+	return app.undrained
+}
+
+// InFlightEvents returns amount of events (or batches) being processed
+func (app *App) InFlightEvents() int64 {
+	return atomic.LoadInt64(&app.inFlightEvents)
+}
+
+func (app *App) DrainQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /drain")
+	result := "drained"
+	if !app.Drain() {
+		result = "already drained"
+	} else {
+		log.Info().Msgf("Drained, in-flight events: %d", app.InFlightEvents())
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": result, "in_flight_events": app.InFlightEvents()})
+}
+
+func (app *App) UndrainQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /undrain")
+	if !app.Undrain() {
+		respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "not drained"})
+		return
+	}
+	log.Info().Msg("Undrained, resuming event processing")
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "resumed"})
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+// dryRunPush logs packed trx instead of pushing it and returns ID the trx would get on chain
+func (app *App) dryRunPush(packedTx *eos.PackedTransaction) (string, error) {
+	id, err := packedTx.ID()
+	if err != nil {
+		return "", err
+	}
+	content, err := jsonCodec.Marshal(packedTx)
+	if err != nil {
+		return "", err
+	}
+	log.Info().Msgf("Dry run, skipping trx push, trxID: %s, trx: %s", id.String(), content)
+	return id.String(), nil
+}
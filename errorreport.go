@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+type ErrorReportingConfig struct {
+	WebhookURL string        // reports are POSTed there as JSON, disabled when empty
+	Timeout    time.Duration // single report delivery limit
+}
+
+// ErrorReport is a failure needing operator attention
+type ErrorReport struct {
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Error   string                 `json:"error"`
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+// ErrorReporter delivers reports to an external error tracker
+type ErrorReporter interface {
+	Report(report ErrorReport) error
+}
+
+// WebhookReporter POSTs reports as JSON to URL, any 2xx response is a success
+type WebhookReporter struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewErrorReporter(cfg ErrorReportingConfig) ErrorReporter {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return &WebhookReporter{URL: cfg.WebhookURL, Client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+func (r *WebhookReporter) Report(report ErrorReport) error {
+	body, err := jsonCodec.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := r.Client.Post(r.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("webhook failed, status: %d, body: %s", resp.StatusCode, content)
+	}
+	return nil
+}
+
+// reportError sends report in background, so a slow tracker doesn't hold back event processing
+func (app *App) reportError(report ErrorReport) {
+	if app.ErrorReporter == nil {
+		return
+	}
+	report.Time = time.Now().UTC()
+	if report.Context == nil {
+		report.Context = make(map[string]interface{})
+	}
+	report.Context["casino_account"] = app.BlockChain.CasinoAccountName
+	go func() {
+		if err := app.ErrorReporter.Report(report); err != nil {
+			log.Warn().Msgf("Failed to report error %q, reason: %s", report.Message, err.Error())
+		}
+	}()
+}
+
+// reportEventFailure reports event which signidice_part_2 trx failed for good, reason is one of FailureReason* values
+func (app *App) reportEventFailure(event *broker.Event, reason string, err error, trace string) {
+	details := map[string]interface{}{
+		"reason":  reason,
+		"req_id":  event.RequestID,
+		"sender":  event.Sender,
+		"offset":  event.Offset,
+		"topic":   event.EventType,
+		"game_id": event.GameID,
+	}
+	if trace != "" {
+		details["trace"] = trace
+	}
+	app.reportError(ErrorReport{Message: "signidice_part_2 failed", Error: err.Error(), Context: details})
+}
+
+// reportStartupFailure reports failed startup before the process exits, logger may be not initialized yet
+func reportStartupFailure(cfg *Config, startupErr error) {
+	reporter := NewErrorReporter(ErrorReportingConfig{
+		WebhookURL: cfg.ErrorReporting.WebhookURL,
+		Timeout:    time.Duration(cfg.ErrorReporting.Timeout) * time.Second,
+	})
+	if reporter == nil {
+		return
+	}
+	report := ErrorReport{Time: time.Now().UTC(), Message: "startup failed", Error: startupErr.Error(),
+		Context: map[string]interface{}{"casino_account": cfg.BlockChain.CasinoAccountName}}
+	if err := reporter.Report(report); err != nil {
+		log.Warn().Msgf("Failed to report startup failure, reason: %s", err.Error())
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+// ErrorCode is stable machine readable error reason returned in "code" field alongside "error" message
+type ErrorCode string
+
+const (
+	// request body can't be decoded
+	ErrorCodeDeserializeFailed ErrorCode = "DESERIALIZE_FAILED"
+	// request is decoded but its content is not acceptable
+	ErrorCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+	// deposit trx doesn't pass validation or no deposit key matches it
+	ErrorCodeInvalidTransaction ErrorCode = "INVALID_TRANSACTION"
+	// account param of sign request isn't a configured casino account
+	ErrorCodeUnknownAccount ErrorCode = "UNKNOWN_ACCOUNT"
+	// signer failed to sign deposit trx
+	ErrorCodeSignFailed ErrorCode = "SIGN_FAILED"
+	// eos signer isn't set up, the service is misconfigured
+	ErrorCodeSignerNotConfigured ErrorCode = "SIGNER_NOT_CONFIGURED"
+	// node didn't accept signed trx
+	ErrorCodeChainRejected ErrorCode = "CHAIN_REJECTED"
+	// node is unreachable or timed out, request can be retried
+	ErrorCodeChainUnavailable ErrorCode = "CHAIN_UNAVAILABLE"
+	// missing or wrong auth token
+	ErrorCodeUnauthorized ErrorCode = "UNAUTHORIZED"
+	// request body exceeds configured max size
+	ErrorCodeRequestTooLarge ErrorCode = "REQUEST_TOO_LARGE"
+	// client exceeded requests rate, retry later
+	ErrorCodeRateLimited ErrorCode = "RATE_LIMITED"
+	// Idempotency-Key header is already used with another request
+	ErrorCodeIdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+	// casino account signed max deposit trxs of the current window, retry after the window is over
+	ErrorCodeSigningCapExceeded ErrorCode = "SIGNING_CAP_EXCEEDED"
+	// failure on the service side
+	ErrorCodeInternal ErrorCode = "INTERNAL_ERROR"
+)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// OffsetGap is a range of offsets [From, To] of the topic skipped by the broker
+type OffsetGap struct {
+	Topic broker.EventType
+	From  uint64
+	To    uint64
+}
+
+// gapDetector tracks offset of the event expected next in every topic stream
+type gapDetector struct {
+	m    sync.Mutex
+	next map[broker.EventType]uint64 // topic isn't tracked until subscribed or the first message is received
+}
+
+func newGapDetector() *gapDetector {
+	return &gapDetector{next: make(map[broker.EventType]uint64)}
+}
+
+// expect sets offset the subscription starts from, re-subscription from committed offset doesn't move it back,
+// so messages of the previous subscription still buffered aren't taken for a gap
+func (d *gapDetector) expect(topic broker.EventType, offset uint64) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if next, tracked := d.next[topic]; !tracked || offset > next {
+		d.next[topic] = offset
+	}
+}
+
+// observe returns gaps between expected offset and offsets of received events.
+// Redelivered events with already seen offsets aren't gaps and don't move expected offset back
+func (d *gapDetector) observe(topic broker.EventType, events []*broker.Event) []OffsetGap {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var gaps []OffsetGap
+	for _, event := range events {
+		next, tracked := d.next[topic]
+		if tracked && event.Offset > next {
+			gaps = append(gaps, OffsetGap{Topic: topic, From: next, To: event.Offset - 1})
+		}
+		if !tracked || event.Offset >= next {
+			d.next[topic] = event.Offset + 1
+		}
+	}
+	return gaps
+}
+
+// checkOffsetGaps reports offsets missed before the received events, replays them when Broker.ReplayGaps is set
+func (app *App) checkOffsetGaps(topic broker.EventType, events []*broker.Event) {
+	for _, gap := range app.offsetGaps.observe(topic, events) {
+		missed := gap.To - gap.From + 1
+		log.Warn().Msgf("Broker skipped %d offsets of topic %d: %d-%d, events may be missed", missed, topic, gap.From, gap.To)
+		metrics.MissedOffsets.WithLabelValues(strconv.FormatUint(uint64(topic), 10)).Add(float64(missed))
+		if app.Broker.ReplayGaps && !app.IsStandby() {
+			app.replayGap(gap)
+		}
+	}
+}
+
+// replayGap reprocesses the gap in background, one gap at a time: others are left to /replay
+func (app *App) replayGap(gap OffsetGap) {
+	if !atomic.CompareAndSwapInt32(&app.replayingGap, 0, 1) {
+		log.Warn().Msgf("Another gap is being replayed, replay offsets %d-%d of topic %d with /replay", gap.From, gap.To, gap.Topic)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&app.replayingGap, 0)
+		result, err := app.ReplayRange(context.Background(), gap.Topic, gap.From, gap.To)
+		if err != nil {
+			log.Error().Msgf("Failed to replay offsets %d-%d of topic %d, reason: %s", gap.From, gap.To, gap.Topic, err.Error())
+			return
+		}
+		log.Info().Msgf("Replayed offsets %d-%d of topic %d, processed: %d, failed: %d",
+			gap.From, gap.To, gap.Topic, result.Processed, result.Failed)
+	}()
+}
@@ -7,10 +7,10 @@ require (
 	github.com/DaoCasino/platform-action-monitor-client v1.1.0
 	github.com/eoscanada/eos-go v0.9.0
 	github.com/gorilla/mux v1.7.4
+	github.com/json-iterator/go v1.1.12
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/prometheus/client_golang v1.7.1
 	github.com/rs/zerolog v1.18.0
 	github.com/stretchr/testify v1.5.1
-	github.com/zenazn/goji v0.9.0
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+)
+
+// node which doesn't respond in time is considered down, so hung node doesn't hang the probe
+const HealthCheckTimeout = 2 * time.Second
+
+const (
+	healthOK   = "ok"
+	healthDown = "down"
+)
+
+// ConnectionChecker is implemented by broker listeners able to report connection state
+type ConnectionChecker interface {
+	Connected() bool
+}
+
+func (app *App) blockchainHealth() JSONResponse {
+	var info *eos.InfoResp
+	err := utils.WithTimeout(func() error {
+		var e error
+		info, e = app.bcAPI.GetInfo()
+		return e
+	}, HealthCheckTimeout)
+	if err != nil {
+		return JSONResponse{"status": healthDown, "error": err.Error()}
+	}
+	return JSONResponse{"status": healthOK, "head_block_num": info.HeadBlockNum}
+}
+
+func (app *App) brokerHealth() JSONResponse {
+	if !app.IsReady() {
+		return JSONResponse{"status": healthDown, "error": "not subscribed"}
+	}
+	if checker, ok := app.BrokerClient.(ConnectionChecker); ok && !checker.Connected() {
+		return JSONResponse{"status": healthDown, "error": "not connected"}
+	}
+	return JSONResponse{"status": healthOK}
+}
+
+// ReadyQuery is the readiness probe, responds 503 until app is subscribed to the broker and fetched chain state
+// and while event processing is drained
+func (app *App) ReadyQuery(writer ResponseWriter, req *Request) {
+	if app.IsDrained() {
+		respondWithJSON(writer, http.StatusServiceUnavailable, JSONResponse{"status": "drained"})
+		return
+	}
+	if !app.IsReady() {
+		respondWithJSON(writer, http.StatusServiceUnavailable, JSONResponse{"status": "not ready"})
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"status": "ready"})
+}
+
+// HealthzQuery checks blockchain node and broker connectivity, responds 503 if any of them is down
+func (app *App) HealthzQuery(writer ResponseWriter, req *Request) {
+	dependencies := JSONResponse{
+		"blockchain": app.blockchainHealth(),
+		"broker":     app.brokerHealth(),
+	}
+	code, status := http.StatusOK, healthOK
+	for _, dependency := range dependencies {
+		if dependency.(JSONResponse)["status"] != healthOK {
+			code, status = http.StatusServiceUnavailable, healthDown
+		}
+	}
+	respondWithJSON(writer, code, JSONResponse{"status": status, "dependencies": dependencies})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/utils"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// set on responses replayed from the cache
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	MaxIdempotencyKeyLength  = 255
+)
+
+type IdempotencyConfig struct {
+	TTL     time.Duration // how long result of a request is returned for retries with its key, 0 disables
+	MaxKeys int           // keys kept at once, least recently used ones are forgotten
+}
+
+// idempotentResult is response to the first request with a key, done is closed once it's set
+type idempotentResult struct {
+	done        chan struct{}
+	requestHash [sha256.Size]byte
+	expires     time.Time // guarded by idempotencyCache.lock, zero while the request is in progress
+	status      int
+	body        []byte
+}
+
+// cached results are the ones a retry would get too, failures on the service or node side are retried
+func (r *idempotentResult) cached() bool {
+	return r.status != 0 && r.status < http.StatusInternalServerError
+}
+
+type idempotencyCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	results *utils.LRUCache
+}
+
+// acquire returns result of the key, owner is true when the caller has to process the request and release the result
+func (c *idempotencyCache) acquire(key string, requestHash [sha256.Size]byte) (result *idempotentResult, owner bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached, ok := c.results.Get(key); ok {
+		result = cached.(*idempotentResult)
+		if result.expires.IsZero() || time.Now().Before(result.expires) {
+			return result, false
+		}
+	}
+	result = &idempotentResult{done: make(chan struct{}), requestHash: requestHash}
+	c.results.Set(key, result)
+	return result, true
+}
+
+func (c *idempotencyCache) release(key string, result *idempotentResult, status int, body []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result.status, result.body = status, body
+	result.expires = time.Now().Add(c.ttl)
+	if !result.cached() {
+		if current, ok := c.results.Get(key); ok && current == result {
+			c.results.Remove(key)
+		}
+	}
+	close(result.done)
+}
+
+// responseCapture keeps status and body written by the wrapped handler
+type responseCapture struct {
+	ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(data []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(data)
+	return c.ResponseWriter.Write(data)
+}
+
+// idempotent returns the cached response to requests retried with the same Idempotency-Key header within TTL
+// instead of processing them again, retries arriving while the first request is in progress wait for its result.
+// Reusing a key with another request is rejected with 422, requests without the key aren't cached
+func (app *App) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	cfg := app.Idempotency
+	if cfg.TTL <= 0 {
+		return next
+	}
+	cache := &idempotencyCache{ttl: cfg.TTL, results: utils.NewLRUCache(cfg.MaxKeys)}
+	return func(writer ResponseWriter, req *Request) {
+		key := req.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(writer, req)
+			return
+		}
+		if len(key) > MaxIdempotencyKeyLength {
+			respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "idempotency key is too long")
+			return
+		}
+		body, ok := app.readBody(writer, req)
+		if !ok {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		// account query param selects the signing key, so it's a part of the request
+		requestHash := sha256.Sum256(append([]byte(req.URL.RawQuery+"\n"), body...))
+		for {
+			result, owner := cache.acquire(key, requestHash)
+			if owner {
+				capture := &responseCapture{ResponseWriter: writer}
+				defer func() { cache.release(key, result, capture.status, capture.body.Bytes()) }()
+				next(capture, req)
+				return
+			}
+			if result.requestHash != requestHash {
+				respondWithError(writer, http.StatusUnprocessableEntity, ErrorCodeIdempotencyKeyReused,
+					"idempotency key is already used with another request")
+				return
+			}
+			select {
+			case <-result.done:
+			case <-req.Context().Done():
+				return
+			}
+			if result.cached() {
+				ctxLogger(req.Context()).Info().Msgf("Replayed response to request with idempotency key %q", key)
+				writer.Header().Set("Content-Type", "application/json")
+				writer.Header().Set(IdempotentReplayedHeader, "true")
+				writer.WriteHeader(result.status)
+				_, _ = writer.Write(result.body)
+				return
+			}
+			// the first request failed on the service side, process this one
+		}
+	}
+}
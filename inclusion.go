@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+type InclusionConfig struct {
+	Enabled bool
+	Delay   time.Duration // should be less than trx expiration to allow re-push
+	Repush  bool          // re-push not included trx instead of dead-lettering events
+}
+
+// scheduleInclusionCheck verifies after a delay that pushed trx made it into a block,
+// node can accept trx and then drop it on a microfork
+func (app *App) scheduleInclusionCheck(events []*broker.Event, packedTx *eos.PackedTransaction, trxID string) {
+	if !app.Inclusion.Enabled || app.DryRun {
+		return
+	}
+	time.AfterFunc(app.Inclusion.Delay, func() {
+		app.checkInclusion(events, packedTx, trxID)
+	})
+}
+
+func (app *App) checkInclusion(events []*broker.Event, packedTx *eos.PackedTransaction, trxID string) {
+	included, err := app.isIncluded(trxID)
+	if err != nil {
+		log.Warn().Msgf("Failed to check trx inclusion, trxID: %s, reason: %s", trxID, err.Error())
+		return
+	}
+	if included {
+		log.Debug().Msgf("Trx included, trxID: %s", trxID)
+		return
+	}
+	metrics.SigniDiceNotIncluded.Inc()
+	log.Warn().Msgf("Pushed trx wasn't included, trxID: %s", trxID)
+	if app.Inclusion.Repush {
+		_, err := app.pushTransaction(context.Background(), packedTx)
+		if err == nil {
+			log.Info().Msgf("Re-pushed not included trx, trxID: %s", trxID)
+			return
+		}
+		if isDuplicateTrx(err) {
+			// the trx got into a block after the check
+			log.Info().Msgf("Not included trx is already known to the node, trxID: %s", trxID)
+			return
+		}
+		log.Error().Msgf("Failed to re-push trx, trxID: %s, reason: %s", trxID, err.Error())
+	}
+	// queued events can be replayed, they're signed with a new trx then
+	reason := "trx " + trxID + " wasn't included into a block"
+	for _, event := range events {
+		app.queueDeadLetter(event, reason)
+		app.deadLetter(event, reason)
+	}
+}
+
+// isIncluded returns whether trx is in a block, unknown trx isn't included, other node errors fail the check
+func (app *App) isIncluded(trxID string) (bool, error) {
+	var resp *eos.TransactionResp
+	err := app.chainRequest(context.Background(), "get_transaction", func() error {
+		var e error
+		resp, e = app.bcAPI.GetTransaction(trxID)
+		return e
+	})
+	if err == eos.ErrNotFound {
+		return false, nil
+	}
+	if apiErr, ok := err.(eos.APIError); ok && apiErr.ErrorStruct.Code == EosTrxNotFoundErrorCode {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.BlockNum != 0, nil
+}
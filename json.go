@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+)
+
+// JSONCodec abstracts JSON serialization used on the hot paths (responses and events parsing)
+type JSONCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type stdJSONCodec struct{}
+
+func (stdJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+const defaultJSONCodec = "std"
+
+// available codecs, alternative implementations register themselves behind build tags
+var jsonCodecs = map[string]JSONCodec{
+	defaultJSONCodec: stdJSONCodec{},
+}
+
+var jsonCodec JSONCodec = stdJSONCodec{}
+
+func SetJSONCodec(name string) error {
+	codec, err := lookupJSONCodec(name)
+	if err != nil {
+		return err
+	}
+	jsonCodec = codec
+	return nil
+}
+
+func lookupJSONCodec(name string) (JSONCodec, error) {
+	if name == "" {
+		name = defaultJSONCodec
+	}
+	codec, ok := jsonCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown JSON codec: %s (not compiled in?)", name)
+	}
+	return codec, nil
+}
+
+// decodeInput parses external input (events and requests), in strict mode
+// unknown fields and trailing data are rejected instead of being silently ignored
+func (app *App) decodeInput(data []byte, v interface{}) error {
+	if !app.StrictJSON {
+		return jsonCodec.Unmarshal(data, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// inputError describes rejected input, the reason is exposed to clients in strict mode only
+// to keep lenient mode responses unchanged
+func (app *App) inputError(message string, err error) string {
+	if !app.StrictJSON {
+		return message
+	}
+	return message + ": " + err.Error()
+}
+
+// decompressed event data limit, so a small compressed payload can't exhaust memory
+const MaxEventDataSize = 1 << 20
+
+// decompressEventData returns JSON of event data compressed with zlib or gzip,
+// compressed data is detected by magic bytes and is either raw or a base64 JSON string.
+// Plain JSON is returned as is
+func decompressEventData(data []byte) ([]byte, error) {
+	compressed, encoded := data, false
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '"' {
+		var str string
+		if err := json.Unmarshal(trimmed, &str); err != nil {
+			return nil, err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("event data string isn't base64: %s", err.Error())
+		}
+		compressed, encoded = decoded, true
+	}
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case isGzip(compressed):
+		reader, err = gzip.NewReader(bytes.NewReader(compressed))
+	case isZlib(compressed):
+		reader, err = zlib.NewReader(bytes.NewReader(compressed))
+	case !encoded:
+		return data, nil
+	default:
+		return nil, fmt.Errorf("event data string isn't compressed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, MaxEventDataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress event data: %s", err.Error())
+	}
+	if len(decompressed) > MaxEventDataSize {
+		return nil, fmt.Errorf("decompressed event data exceeds %d bytes", MaxEventDataSize)
+	}
+	return decompressed, nil
+}
+
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// zlib header is CMF (deflate with 32K window) and FLG making the pair a multiple of 31
+func isZlib(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
+
+// parseDigest extracts signidice digest from event data, plain or compressed
+func (app *App) parseDigest(event *broker.Event) (eos.Checksum256, error) {
+	var data struct {
+		Digest eos.Checksum256 `json:"digest"`
+	}
+	content, err := decompressEventData(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.decodeInput(content, &data); err != nil {
+		return nil, err
+	}
+	// digest of another length can't be signed as signidice seed, so it's rejected even in lenient mode
+	if len(data.Digest) == 0 {
+		return nil, fmt.Errorf("digest is empty")
+	}
+	if size := app.BlockChain.DigestHash.Size(); len(data.Digest) != size {
+		return nil, fmt.Errorf("digest should be %d bytes, got %d", size, len(data.Digest))
+	}
+	return data.Digest, nil
+}
@@ -0,0 +1,12 @@
+//go:build jsoniter
+// +build jsoniter
+
+// build with `-tags jsoniter` and set server.jsonCodec = "jsoniter" to use json-iterator
+
+package main
+
+import jsoniter "github.com/json-iterator/go"
+
+func init() {
+	jsonCodecs["jsoniter"] = jsoniter.ConfigCompatibleWithStandardLibrary
+}
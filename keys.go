@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+)
+
+// ErrSignerNotConfigured is returned instead of signing trx when node API has no signer set
+var ErrSignerNotConfigured = errors.New("trx signer isn't configured")
+
+// trxSigner returns signer of the node API, missing one is reported with ErrSignerNotConfigured instead of nil dereference
+func trxSigner(api *eos.API) (eos.Signer, error) {
+	if err := requireSigner(api.Signer); err != nil {
+		return nil, err
+	}
+	return api.Signer, nil
+}
+
+func requireSigner(signer eos.Signer) error {
+	if signer == nil {
+		metrics.SignerNotConfigured.Inc()
+		return ErrSignerNotConfigured
+	}
+	return nil
+}
+
+// CheckSigner makes sure signer is set and holds all configured keys, so it's caught at startup rather than on signing
+func CheckSigner(signer eos.Signer, keys PubKeys) error {
+	if signer == nil {
+		return ErrSignerNotConfigured
+	}
+	available, err := signer.AvailableKeys()
+	if err != nil {
+		return err
+	}
+	required := append([]ecc.PublicKey{keys.Deposit, keys.SigniDice}, keys.Deposits...)
+	for _, key := range keys.AccountDeposits {
+		required = append(required, key)
+	}
+	for _, key := range required {
+		found := false
+		for _, availableKey := range available {
+			if key.String() == availableKey.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("signer has no private key of %s", key.String())
+		}
+	}
+	return nil
+}
+
+// GetRequiredKeys asks the node which of availableKeys are required to sign tx.
+// eos-go's GetRequiredKeys always offers all signer keys, so the call is made directly
+// to offer only the keys we're allowed to sign with plus keys which already signed tx.
+// The request goes through api.HttpClient, so node failover applies to it, and is canceled with ctx
+func GetRequiredKeys(ctx context.Context, api *eos.API, tx *eos.Transaction, availableKeys []ecc.PublicKey) ([]ecc.PublicKey, error) {
+	body, err := jsonCodec.Marshal(eos.M{"transaction": tx, "available_keys": availableKeys})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", api.BaseURL+"/v1/chain/get_required_keys", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range api.Header {
+		req.Header[k] = append(req.Header[k], v...)
+	}
+	resp, err := api.HttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 299 {
+		var apiErr eos.APIError
+		if err := jsonCodec.Unmarshal(content, &apiErr); err != nil {
+			return nil, fmt.Errorf("get_required_keys failed, status: %d, body: %s", resp.StatusCode, content)
+		}
+		return nil, apiErr
+	}
+	out := &eos.GetRequiredKeysResp{}
+	if err := jsonCodec.Unmarshal(content, out); err != nil {
+		return nil, err
+	}
+	return out.RequiredKeys, nil
+}
+
+// selectDepositKeys returns deposit keys required by tx authorizations
+func (app *App) selectDepositKeys(ctx context.Context, tx *eos.SignedTransaction) ([]ecc.PublicKey, error) {
+	deposits := app.BlockChain.EosPubKeys.Deposits
+	if len(deposits) <= 1 {
+		return []ecc.PublicKey{app.BlockChain.EosPubKeys.Deposit}, nil
+	}
+	signedBy, err := tx.SignedByKeys(app.BlockChain.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	availableKeys := append(append([]ecc.PublicKey{}, deposits...), signedBy...)
+	var required []ecc.PublicKey
+	if err := app.chainRequest(ctx, "get_required_keys", func() error {
+		var e error
+		required, e = GetRequiredKeys(ctx, app.bcAPI, tx.Transaction, availableKeys)
+		return e
+	}); err != nil {
+		if _, rejected := asAPIError(err); !rejected {
+			// node wasn't reached or didn't answer in time
+			return nil, chainStateError{err}
+		}
+		return nil, err
+	}
+	selected := make([]ecc.PublicKey, 0, len(required))
+	for _, key := range required {
+		for _, deposit := range deposits {
+			if key.String() == deposit.String() {
+				selected = append(selected, deposit)
+				break
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no deposit key matches required authorizations")
+	}
+	return selected, nil
+}
+
+// signidiceAuth is authorization of sgdicesecond actions signed with signidice key
+func (app *App) signidiceAuth() eos.PermissionLevel {
+	permission := app.BlockChain.Permissions.SigniDice
+	if permission == "" {
+		permission = DefaultSigniDicePermission
+	}
+	return eos.PermissionLevel{Actor: app.BlockChain.CasinoAccountName, Permission: permission}
+}
+
+// depositPermission returns permission transfers of deposits to the casino account should be authorized with
+func (app *App) depositPermission(casino eos.AccountName) eos.PermissionName {
+	if casino == app.BlockChain.CasinoAccountName && app.BlockChain.Permissions.Deposit != "" {
+		return app.BlockChain.Permissions.Deposit
+	}
+	return eos.PN(string(casino))
+}
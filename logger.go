@@ -1,18 +1,77 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"io"
 	"os"
 	"strings"
 	"time"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	LogFormatConsole = "console" // colored human-readable lines
+	LogFormatJSON    = "json"
 )
 
-func InitLogger(level string) {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+// structured fields correlating log lines of a single event or HTTP request
+const (
+	LogFieldReqID     = "req_id" // signidice request ID of the event
+	LogFieldSender    = "sender"
+	LogFieldRequestID = "request_id" // X-Request-ID of the HTTP request
+)
 
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+type loggerKey struct{}
+
+// withLogger attaches logger to ctx, it's used by ctxLogger
+func withLogger(ctx context.Context, logger zerolog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, &logger)
+}
+
+// ctxLogger returns logger attached to ctx, global logger if there's none
+func ctxLogger(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
+// eventLogger returns child of ctx logger carrying request ID and sender of the event,
+// so lines of concurrently processed events can be told apart
+func eventLogger(ctx context.Context, event *broker.Event) zerolog.Logger {
+	return ctxLogger(ctx).With().Uint64(LogFieldReqID, event.RequestID).Str(LogFieldSender, event.Sender).Logger()
+}
+
+// InitLogger sets up the global logger, debug logs are written with debug level only
+func InitLogger(level zerolog.Level, format string) error {
+	logger, err := NewLogger(os.Stdout, level, format)
+	if err != nil {
+		return err
+	}
+	log.Logger = logger
+	zerolog.TimestampFunc = func() time.Time {
+		return time.Now().UTC()
+	}
+	return nil
+}
+
+func NewLogger(out io.Writer, level zerolog.Level, format string) (zerolog.Logger, error) {
+	switch format {
+	case "", LogFormatConsole:
+		out = consoleWriter(out)
+	case LogFormatJSON:
+	default:
+		return zerolog.Logger{}, fmt.Errorf("unknown log format: %s", format)
+	}
+	return zerolog.New(out).Level(level).With().Timestamp().Logger(), nil
+}
+
+func consoleWriter(out io.Writer) zerolog.ConsoleWriter {
+	output := zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
 	output.FormatLevel = func(i interface{}) string {
 		const (
 			colorBlack = iota + 30
@@ -40,24 +99,20 @@ func InitLogger(level string) {
 	output.FormatFieldValue = func(i interface{}) string {
 		return strings.ToUpper(fmt.Sprintf("%s", i))
 	}
-	log.Logger = log.Output(output)
-	zerolog.SetGlobalLevel(getLevel(level))
-	zerolog.TimestampFunc = func() time.Time {
-		return time.Now().UTC()
-	}
+	return output
 }
 
-func getLevel(level string) zerolog.Level {
+func ParseLogLevel(level string) (zerolog.Level, error) {
 	switch strings.ToLower(level) {
 	case "debug":
-		return zerolog.DebugLevel
-	case "info":
-		return zerolog.InfoLevel
-	case "warning":
-		return zerolog.WarnLevel
+		return zerolog.DebugLevel, nil
+	case "", "info":
+		return zerolog.InfoLevel, nil
+	case "warn", "warning":
+		return zerolog.WarnLevel, nil
 	case "error":
-		return zerolog.ErrorLevel
+		return zerolog.ErrorLevel, nil
 	default:
-		return zerolog.InfoLevel
+		return zerolog.NoLevel, fmt.Errorf("unknown log level: %s", level)
 	}
 }
@@ -1,67 +1,171 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
-	"io"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/eoscanada/eos-go/ecc"
 
-	"github.com/BurntSushi/toml"
 	"github.com/DaoCasino/casino-backend/utils"
 	broker "github.com/DaoCasino/platform-action-monitor-client"
 	"github.com/eoscanada/eos-go"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// topicIDs returns topics to subscribe, single TopicID is used when TopicIDs is not set
+func topicIDs(cfg *Config) []broker.EventType {
+	if len(cfg.Broker.TopicIDs) == 0 {
+		return []broker.EventType{cfg.Broker.TopicID}
+	}
+	return cfg.Broker.TopicIDs
+}
+
+// readRsaPassphrase returns passphrase of encrypted RSA key from the file when it's set, from config value otherwise
+func readRsaPassphrase(cfg *Config) ([]byte, error) {
+	if cfg.BlockChain.RSAKeyPassphraseFile == "" {
+		return []byte(cfg.BlockChain.RSAKeyPassphrase), nil
+	}
+	content, err := ioutil.ReadFile(cfg.BlockChain.RSAKeyPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RSA key passphrase file: %s", err.Error())
+	}
+	return bytes.TrimRight(content, "\r\n"), nil
+}
+
+// readRsaKey loads RSA key from the file when it's set, from base64 config value otherwise
+func readRsaKey(cfg *Config, passphrase []byte) (*rsa.PrivateKey, error) {
+	if cfg.BlockChain.RSAKeyFile == "" {
+		return utils.ReadRsa(cfg.BlockChain.RSAKey, passphrase)
+	}
+	if cfg.BlockChain.RSAKey != "" {
+		log.Warn().Msg("Both RSA key and RSA key file are set, using the file")
+	}
+	key, err := utils.ReadRsaFromFile(cfg.BlockChain.RSAKeyFile, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RSA key file: %s", err.Error())
+	}
+	return key, nil
+}
+
+// readEosKey returns private key read from file when it's set, inline key otherwise
+func readEosKey(name string, key string, file string) (string, error) {
+	if file == "" {
+		return key, nil
+	}
+	if key != "" {
+		log.Warn().Msgf("Both %s and %s file are set, using the file", name, name)
+	}
+	wif, err := utils.ReadWIF(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s file: %s", name, err.Error())
+	}
+	return wif, nil
+}
+
 func MakeAppConfig(cfg *Config) (*AppConfig, *eos.KeyBag, error) {
 	appCfg := new(AppConfig)
 	var err error
 
+	appCfg.Standby = cfg.Server.Standby
+	appCfg.StrictJSON = cfg.Server.StrictJSON
+	appCfg.DryRun = cfg.Server.DryRun
+	appCfg.Pprof = cfg.Server.Pprof
+	appCfg.TLS.CertFile = cfg.Server.TLSCertFile
+	appCfg.TLS.KeyFile = cfg.Server.TLSKeyFile
+	appCfg.MaxRequestBodySize = cfg.Server.MaxBodySize
+	appCfg.Server.ReadTimeout = time.Duration(cfg.Server.ReadTimeout) * time.Second
+	appCfg.Server.WriteTimeout = time.Duration(cfg.Server.WriteTimeout) * time.Second
+	appCfg.Server.IdleTimeout = time.Duration(cfg.Server.IdleTimeout) * time.Second
+	appCfg.Server.HTTP2 = cfg.Server.HTTP2
+
+	// set logger config
+	if appCfg.LogLevel, err = ParseLogLevel(cfg.Server.LogLevel); err != nil {
+		return nil, nil, err
+	}
+	appCfg.LogFormat = cfg.Server.LogFormat
+
 	// set broker config
-	appCfg.Broker.TopicID = cfg.Broker.TopicID
-
-	if f, err := os.Open(cfg.Broker.TopicOffsetPath); err == nil {
-		defer f.Close()
-		appCfg.Broker.TopicOffset, err = utils.ReadOffset(f)
-		if err != nil {
-			if err == io.EOF { // if file empty just set 0
-				appCfg.Broker.TopicOffset = 0
-			} else {
-				return nil, nil, err
-			}
-		}
-	} else {
-		// initial start
-		appCfg.Broker.TopicOffset = 0
+	appCfg.Broker.ReplayTimeout = time.Duration(cfg.Broker.ReplayTimeout) * time.Second
+	appCfg.Broker.ConnectMaxAttempts = cfg.Broker.ConnectMaxAttempts
+	appCfg.Broker.ConnectBaseDelay = time.Duration(cfg.Broker.ConnectBaseDelay) * time.Second
+	appCfg.Broker.ConnectMaxDelay = time.Duration(cfg.Broker.ConnectMaxDelay) * time.Second
+	appCfg.Broker.IdleResubscribe = time.Duration(cfg.Broker.IdleResubscribe) * time.Second
+	appCfg.Broker.ReplayGaps = cfg.Broker.ReplayGaps
+
+	// topics start from 0, committed offsets are read from the offset store on subscribe
+	for _, topic := range topicIDs(cfg) {
+		appCfg.Broker.Topics = append(appCfg.Broker.Topics, TopicConfig{ID: topic})
 	}
 
 	// set blockchain config
+	depositKey, err := readEosKey("deposit key", cfg.BlockChain.DepositKey, cfg.BlockChain.DepositKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	signiDiceKey, err := readEosKey("signidice key", cfg.BlockChain.SigniDiceKey, cfg.BlockChain.SigniDiceKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
 	keyBag := &eos.KeyBag{}
-	if err = keyBag.Add(cfg.BlockChain.DepositKey); err != nil {
+	if err = keyBag.Add(depositKey); err != nil {
 		return nil, nil, err
 	}
-	if err = keyBag.Add(cfg.BlockChain.SigniDiceKey); err != nil {
+	if err = keyBag.Add(signiDiceKey); err != nil {
 		return nil, nil, err
 	}
+	for _, depositKey := range cfg.BlockChain.DepositKeys {
+		if err = keyBag.Add(depositKey); err != nil {
+			return nil, nil, err
+		}
+	}
 	pubKeys, err := keyBag.AvailableKeys()
 	if err != nil {
 		return nil, nil, err
 	}
 	appCfg.BlockChain.CasinoAccountName = eos.AN(cfg.BlockChain.CasinoAccountName)
-	appCfg.BlockChain.EosPubKeys = PubKeys{pubKeys[0], pubKeys[1]}
-	if appCfg.BlockChain.RSAKey, err = utils.ReadRsa(cfg.BlockChain.RSAKey); err != nil {
+	appCfg.BlockChain.EosPubKeys = PubKeys{pubKeys[0], pubKeys[1], append([]ecc.PublicKey{pubKeys[0]}, pubKeys[2:]...), nil}
+	if len(cfg.BlockChain.AccountDepositKeys) > 0 {
+		appCfg.BlockChain.EosPubKeys.AccountDeposits = make(map[eos.AccountName]ecc.PublicKey)
+	}
+	for account, depositKey := range cfg.BlockChain.AccountDepositKeys {
+		if err = keyBag.Add(depositKey); err != nil {
+			return nil, nil, fmt.Errorf("invalid deposit key of account %s: %s", account, err.Error())
+		}
+		appCfg.BlockChain.EosPubKeys.AccountDeposits[eos.AN(account)] = keyBag.Keys[len(keyBag.Keys)-1].PublicKey()
+	}
+	if appCfg.BlockChain.RSAKeyPassphrase, err = readRsaPassphrase(cfg); err != nil {
+		return nil, nil, err
+	}
+	if appCfg.BlockChain.RSAKey, err = readRsaKey(cfg, appCfg.BlockChain.RSAKeyPassphrase); err != nil {
+		return nil, nil, err
+	}
+	if cfg.BlockChain.RSAPubKey != "" {
+		if appCfg.BlockChain.RSAPubKey, err = utils.ReadRsaPublicKey(cfg.BlockChain.RSAPubKey); err != nil {
+			return nil, nil, fmt.Errorf("invalid RSA public key: %s", err.Error())
+		}
+	}
+	if appCfg.BlockChain.DigestHash, err = utils.ParseDigestHash(cfg.BlockChain.DigestHash); err != nil {
 		return nil, nil, err
 	}
 	if appCfg.BlockChain.ChainID, err = hex.DecodeString(cfg.BlockChain.ChainID); err != nil {
 		return nil, nil, err
 	}
+	if appCfg.BlockChain.ChainIDCheck, err = ParseChainIDCheck(cfg.BlockChain.ChainIDCheck); err != nil {
+		return nil, nil, err
+	}
 
 	appCfg.BlockChain.PlatformAccountName = eos.AN(cfg.BlockChain.PlatformAccountName)
+	appCfg.BlockChain.Permissions.SigniDice = eos.PN(cfg.BlockChain.SigniDicePermission)
+	appCfg.BlockChain.Permissions.Deposit = eos.PN(cfg.BlockChain.DepositPermission)
 	if appCfg.BlockChain.PlatformPubKey, err = ecc.NewPublicKey(cfg.BlockChain.PlatformPubKey); err != nil {
 		return nil, nil, err
 	}
@@ -70,68 +174,224 @@ func MakeAppConfig(cfg *Config) (*AppConfig, *eos.KeyBag, error) {
 	appCfg.HTTP.RetryDelay = time.Duration(cfg.HTTP.RetryDelay) * time.Second
 	appCfg.HTTP.Timeout = time.Duration(cfg.HTTP.Timeout) * time.Second
 	appCfg.HTTP.RetryAmount = cfg.HTTP.RetryAmount
+
+	// set auth config
+	appCfg.Auth.Token = cfg.Auth.Token
+
+	// set push retry config
+	appCfg.Push.MaxAttempts = cfg.Push.MaxAttempts
+	appCfg.Push.BaseDelay = time.Duration(cfg.Push.BaseDelayMs) * time.Millisecond
+	appCfg.Push.MaxDelay = time.Duration(cfg.Push.MaxDelayMs) * time.Millisecond
+	appCfg.Push.SendTransaction2 = cfg.Push.SendTransaction2
+	appCfg.Push.Breaker.FailureThreshold = cfg.Push.BreakerFailures
+	appCfg.Push.Breaker.Cooldown = time.Duration(cfg.Push.BreakerCooldown) * time.Second
+
+	// set node endpoints, the first one is the primary
+	appCfg.Nodes.URLs = append([]string{cfg.BlockChain.URL}, cfg.BlockChain.FailoverURLs...)
+	appCfg.Nodes.Timeout = time.Duration(cfg.BlockChain.NodeTimeoutMs) * time.Millisecond
+	appCfg.Nodes.HealthCheckInterval = time.Duration(cfg.BlockChain.HealthCheckInterval) * time.Second
+
+	// set node API calls timeout
+	appCfg.ChainRequestTimeout = time.Duration(cfg.BlockChain.RequestTimeout) * time.Second
+
+	// set built trxs expiration
+	appCfg.TrxExpiration = time.Duration(cfg.BlockChain.TrxExpiration) * time.Second
+
+	// set signidice trxs resource limits
+	appCfg.SigniDiceLimits.MaxCPUUsageMs = cfg.BlockChain.MaxCPUUsageMs
+	appCfg.SigniDiceLimits.MaxNetUsageWords = cfg.BlockChain.MaxNetUsageWords
+
+	// set transactions compression
+	if appCfg.Compression, err = ParseCompression(cfg.BlockChain.Compression); err != nil {
+		return nil, nil, err
+	}
+
+	// set relay config
+	appCfg.Relay.URL = cfg.Relay.URL
+	appCfg.ErrorReporting.WebhookURL = cfg.ErrorReporting.WebhookURL
+	appCfg.ErrorReporting.Timeout = time.Duration(cfg.ErrorReporting.Timeout) * time.Second
+
+	// set processor config
+	appCfg.Processor.MaxGoroutines = cfg.Processor.MaxGoroutines
+	appCfg.Processor.MaxConcurrentSigns = cfg.Processor.MaxConcurrentSigns
+	appCfg.Processor.DedupCacheSize = cfg.Processor.DedupCacheSize
+	appCfg.Processor.EventBufferSize = cfg.Processor.EventBufferSize
+	appCfg.Processor.EventTimeout = time.Duration(cfg.Processor.EventTimeout) * time.Second
+	appCfg.Processor.MaxPendingMessages = cfg.Processor.MaxPendingMessages
+	appCfg.Processor.MalformedEventsPath = cfg.Processor.MalformedEventsLog
+	appCfg.Processor.AuditLogPath = cfg.Processor.AuditLog
+	appCfg.Processor.SignedRequestsPath = cfg.Processor.SignedRequestsFile
+	appCfg.Processor.SignedRequestsMaxCount = cfg.Processor.SignedRequestsMaxCount
+	appCfg.Processor.SignedRequestsMaxAge = time.Duration(cfg.Processor.SignedRequestsMaxAge) * time.Second
+	appCfg.Processor.SignedRequestsFlushInterval = time.Duration(cfg.Processor.SignedRequestsFlushMs) * time.Millisecond
+
+	// set confirmation config
+	appCfg.Confirmation.Enabled = cfg.Confirmation.Enabled
+	appCfg.Confirmation.PollInterval = time.Duration(cfg.Confirmation.PollIntervalMs) * time.Millisecond
+	appCfg.Confirmation.Timeout = time.Duration(cfg.Confirmation.Timeout) * time.Second
+
+	// set rate limit config
+	appCfg.RateLimit.RPS = cfg.RateLimit.RPS
+	appCfg.RateLimit.Burst = cfg.RateLimit.Burst
+	appCfg.RateLimit.PerIPRPS = cfg.RateLimit.PerIPRPS
+	appCfg.RateLimit.PerIPBurst = cfg.RateLimit.PerIPBurst
+	appCfg.RateLimit.MaxClients = cfg.RateLimit.MaxClients
+
+	// set idempotency config
+	appCfg.Idempotency.TTL = time.Duration(cfg.Idempotency.TTL) * time.Second
+	appCfg.Idempotency.MaxKeys = cfg.Idempotency.MaxKeys
+	appCfg.SigningCap.MaxPerAccount = cfg.SigningCap.MaxPerAccount
+	appCfg.SigningCap.Window = time.Duration(cfg.SigningCap.Window) * time.Second
+	appCfg.SigningCap.Path = cfg.SigningCap.File
+
+	// set dead letter queue config
+	appCfg.DLQ.Path = cfg.DLQ.Path
+	appCfg.DLQ.MaxSize = cfg.DLQ.MaxSize
+
+	// set inclusion check config
+	appCfg.Inclusion.Enabled = cfg.Inclusion.Enabled
+	appCfg.Inclusion.Delay = time.Duration(cfg.Inclusion.Delay) * time.Second
+	appCfg.Inclusion.Repush = cfg.Inclusion.Repush
+
+	// set resources monitoring config
+	appCfg.Resources.Enabled = cfg.Resources.Enabled
+	appCfg.Resources.Interval = time.Duration(cfg.Resources.Interval) * time.Second
+	appCfg.Resources.Account = eos.AN(cfg.Resources.Account)
+	appCfg.Resources.Threshold = cfg.Resources.Threshold
+	if cfg.Resources.TopUpAction != "" {
+		appCfg.Resources.TopUp = TopUpConfig{
+			Contract:   eos.AN(cfg.Resources.TopUpContract),
+			Action:     eos.ActN(cfg.Resources.TopUpAction),
+			Permission: eos.PN(cfg.Resources.TopUpPermission),
+			Data:       json.RawMessage(cfg.Resources.TopUpData),
+		}
+	}
+
+	// set nonce config
+	appCfg.Nonce.Enabled = cfg.Nonce.Enabled
+	appCfg.Nonce.Contract = eos.AN(cfg.Nonce.Contract)
+
+	// set resolved requests check config
+	appCfg.ResolvedCheck.Enabled = cfg.ResolvedCheck.Enabled
+	appCfg.ResolvedCheck.Table = eos.TableName(cfg.ResolvedCheck.Table)
+	appCfg.ResolvedCheck.PendingState = cfg.ResolvedCheck.PendingState
+
+	// set shutdown config
+	appCfg.Shutdown.HTTPTimeout = time.Duration(cfg.Shutdown.HTTPTimeout) * time.Second
+	appCfg.Shutdown.BrokerTimeout = time.Duration(cfg.Shutdown.BrokerTimeout) * time.Second
+	appCfg.Shutdown.DrainTimeout = time.Duration(cfg.Shutdown.DrainTimeout) * time.Second
+	appCfg.Shutdown.OffsetTimeout = time.Duration(cfg.Shutdown.OffsetTimeout) * time.Second
+
+	// set batch config
+	appCfg.Batch.Enabled = cfg.Batch.Enabled
+	if appCfg.Batch.FailurePolicy, err = ParseBatchFailurePolicy(cfg.Batch.FailurePolicy); err != nil {
+		return nil, nil, err
+	}
 	return appCfg, keyBag, nil
 }
 
-func MakeApp(cfg *Config) (*App, *os.File, error) {
+func MakeApp(cfg *Config) (*App, error) {
 	appConfig, keyBag, err := MakeAppConfig(cfg)
 	if err != nil {
-		log.Panic().Msgf("Failed to process config, reason: %s", err.Error())
+		return nil, fmt.Errorf("failed to process config, reason: %s", err.Error())
 	}
-
-	events := make(chan *broker.EventMessage)
-	f, err := os.OpenFile(cfg.Broker.TopicOffsetPath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, nil, err
+	if err := InitLogger(appConfig.LogLevel, appConfig.LogFormat); err != nil {
+		return nil, err
 	}
+	if appConfig.LogLevel == zerolog.DebugLevel {
+		broker.EnableDebugLogging()
+	}
+	if err := appConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err.Error())
+	}
+	if appConfig.BlockChain.RSAPubKey != nil {
+		if err := CheckRsaKeyPair(appConfig.BlockChain.RSAKey, appConfig.BlockChain.RSAPubKey, appConfig.BlockChain.DigestHash); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Warn().Msg("RSA public key is not set, skipping RSA key self-test")
+	}
+	if appConfig.Pprof && appConfig.Auth.Token == "" {
+		log.Warn().Msg("Profiling is enabled without auth token, /debug/pprof/ is open to everyone reaching the API port")
+	}
+
+	events := make(chan *broker.EventMessage, appConfig.Processor.EventBufferSize)
+	// offset file of the single topic versions is migrated to TopicID
+	offsetFile := utils.NewAtomicFile(cfg.Broker.TopicOffsetPath)
+	// content and directory are fsynced only when durability is asked for
+	offsetFile.NoSync = !cfg.Broker.TopicOffsetSync
+	offsetStore := utils.NewJSONOffsetStore(offsetFile, cfg.Broker.TopicID)
+	offsetStore.SyncWrites = cfg.Broker.TopicOffsetSync
 
 	bc := eos.New(cfg.BlockChain.URL)
+	var nodePool *NodePool
+	if len(appConfig.Nodes.URLs) > 1 {
+		bc, nodePool = NewFailoverAPI(appConfig.Nodes)
+	}
+	limitChainRequests(bc, appConfig.ChainRequestTimeout)
 	bc.SetSigner(keyBag)
+	if err := CheckSigner(bc.Signer, appConfig.BlockChain.EosPubKeys); err != nil {
+		return nil, fmt.Errorf("invalid signer: %s", err.Error())
+	}
 
-	brokerClient := broker.NewEventListener(cfg.Broker.URL, events)
-	brokerClient.ReconnectionAttempts = cfg.Broker.ReconnectionAttempts
-	brokerClient.ReconnectionDelay = time.Duration(cfg.Broker.ReconnectionDelay) * time.Second
-	brokerClient.SetToken(cfg.Broker.Token)
-	app := NewApp(bc, brokerClient, events, f, appConfig)
-	return app, f, nil
-}
-
-func GetConfig(configPath string) (*Config, error) {
-	cfg := &Config{}
-	if err := envconfig.Process("", cfg); err != nil {
+	newListener := func(events chan<- *broker.EventMessage) EventListener {
+		brokerClient := broker.NewEventListener(cfg.Broker.URL, events)
+		brokerClient.ReconnectionAttempts = cfg.Broker.ReconnectionAttempts
+		brokerClient.ReconnectionDelay = time.Duration(cfg.Broker.ReconnectionDelay) * time.Second
+		brokerClient.SetToken(cfg.Broker.Token)
+		return brokerClient
+	}
+	app := NewApp(bc, newListener(events), events, offsetStore, appConfig)
+	app.NewReplayListener = newListener
+	app.NodePool = nodePool
+	if err := app.detectChainID(context.Background()); err != nil {
 		return nil, err
 	}
-	if _, err := toml.DecodeFile(configPath, cfg); err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
+	if path := appConfig.Processor.AuditLogPath; path != "" {
+		if app.auditLog, err = NewAuditWriter(path); err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %s", err.Error())
+		}
+	}
+	if path := appConfig.Processor.SignedRequestsPath; path != "" {
+		if app.signedRequests, err = utils.NewRequestStore(utils.NewAtomicFile(path),
+			appConfig.Processor.SignedRequestsMaxCount, appConfig.Processor.SignedRequestsMaxAge); err != nil {
+			return nil, fmt.Errorf("failed to load signed requests: %s", err.Error())
+		}
+	}
+	if path := appConfig.SigningCap.Path; path != "" && app.signingCap != nil {
+		if err := app.signingCap.load(utils.NewAtomicFile(path)); err != nil {
+			return nil, fmt.Errorf("failed to load signing cap counts: %s", err.Error())
 		}
 	}
-	return cfg, nil
+	return app, nil
 }
 
 func main() {
 	configPath := flag.String("config", utils.GetConfigPath(configEnvVar, defaultConfigPath),
 		"config file path")
+	checkConfig := flag.Bool("check-config", false, "validate config and keys, then exit without starting")
 	flag.Parse()
 
 	cfg, err := GetConfig(*configPath)
+	if *checkConfig {
+		os.Exit(runConfigCheck(cfg, err, os.Stdout))
+	}
 	if err != nil {
 		log.Panic().Msg(err.Error())
 	}
-	logLevel := cfg.Server.LogLevel
-	InitLogger(cfg.Server.LogLevel)
 
-	if strings.ToLower(logLevel) == "debug" {
-		broker.EnableDebugLogging()
+	// logger is initialized by MakeApp from the app config
+	app, err := MakeApp(cfg)
+	if err != nil {
+		reportStartupFailure(cfg, err)
+		log.Panic().Msg(err.Error())
 	}
 
-	app, f, err := MakeApp(cfg)
-	if err != nil {
+	if err := SetJSONCodec(cfg.Server.JSONCodec); err != nil {
 		log.Panic().Msg(err.Error())
 	}
-	defer f.Close()
 
-	if err := app.Run(utils.GetAddr(cfg.Server.Port)); err != nil {
+	if err := app.Run(utils.GetAddr(cfg.Server.BindHost, cfg.Server.Port)); err != nil {
 		log.Panic().Msg(err.Error())
 	}
 }
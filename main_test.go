@@ -4,21 +4,47 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/eoscanada/eos-go/ecc"
 
+	"github.com/DaoCasino/casino-backend/metrics"
 	"github.com/DaoCasino/casino-backend/mocks"
+	"github.com/DaoCasino/casino-backend/utils"
 	broker "github.com/DaoCasino/platform-action-monitor-client"
 	"github.com/eoscanada/eos-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 var a *App
@@ -45,28 +71,34 @@ func MakeTestConfig() (*AppConfig, *eos.KeyBag) {
 	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
 	platformKey, _ := ecc.NewPrivateKey(platformPk)
 	return &AppConfig{
-		BrokerConfig{0, 0},
-		BlockChainConfig{
-			eos.Checksum256(chainID),
+		Broker: BrokerConfig{Topics: []TopicConfig{{ID: 0, Offset: 0}}, ReplayTimeout: 5 * time.Second},
+		BlockChain: BlockChainConfig{
+			mocks.ChainID(),
 			casinoAccName,
-			PubKeys{pubKeys[0], pubKeys[1]},
+			PubKeys{pubKeys[0], pubKeys[1], []ecc.PublicKey{pubKeys[0]}, nil},
 			rsaKey,
 			platformAccName,
 			platformKey.PublicKey(),
+			&rsaKey.PublicKey,
+			crypto.SHA256,
+			KeyPermissions{},
+			nil,
+			ChainIDCheckOff,
 		},
-		HTTPConfig{3, 3 * time.Second, 3 * time.Second},
+		HTTP:  HTTPConfig{3, 3 * time.Second, 3 * time.Second},
+		Batch: BatchConfig{Enabled: false, FailurePolicy: BatchFailAll},
 	}, &keyBag
 }
 
 func TestMain(m *testing.M) {
-	InitLogger("debug")
+	InitLogger(zerolog.DebugLevel, LogFormatConsole)
 	events := make(chan *broker.EventMessage)
 	listener := new(mocks.EventListenerMock)
-	f := &mocks.SafeBuffer{}
+	offsetStore := utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0)
 	appCfg, keyBag := MakeTestConfig()
 	bc := eos.New(bcURL)
 	bc.SetSigner(keyBag)
-	a = NewApp(bc, listener, events, f, appCfg)
+	a = NewApp(bc, listener, events, offsetStore, appCfg)
 	code := m.Run()
 	os.Exit(code)
 }
@@ -118,12 +150,13 @@ func TestSignTransactionBadRequest(t *testing.T) {
 
 	a.SignQuery(response, request)
 
-	assert.Equal(response.Body.String(), `{"error":"failed to deserialize transaction"}`)
+	assert.Equal(response.Body.String(), `{"code":"DESERIALIZE_FAILED","error":"failed to deserialize transaction"}`)
 }
 
 func TestSignidiceAction(t *testing.T) {
 	assert := assert.New(t)
-	action := NewSigndice("gamesc", "onecasino", 42, "casinosig")
+	action := NewSigndice("gamesc", eos.PermissionLevel{Actor: "onecasino", Permission: DefaultSigniDicePermission},
+		42, "casinosig")
 	assert.Equal(eos.AN("gamesc"), action.Account)
 	assert.Equal(eos.ActionName("sgdicesecond"), action.Name)
 	assert.Equal([]eos.PermissionLevel{
@@ -136,9 +169,11 @@ func TestSignidiceAction(t *testing.T) {
 func TestSignidiceTransaction(t *testing.T) {
 	assert := assert.New(t)
 	dicePubKey := a.BlockChain.EosPubKeys.SigniDice
-	txOpts := &eos.TxOptions{ChainID: eos.Checksum256(chainID)}
-	packedTx, err := GetSigndiceTransaction(a.bcAPI, "gamesc", "onecasino",
-		42, "casinosig", dicePubKey, txOpts)
+	blockID, _ := hex.DecodeString(mocks.NodeBlockID)
+	txOpts := &eos.TxOptions{ChainID: eos.Checksum256(chainID), HeadBlockID: blockID}
+	packedTx, err := GetSigndiceTransaction(a.bcAPI.Signer, "gamesc",
+		eos.PermissionLevel{Actor: "onecasino", Permission: DefaultSigniDicePermission},
+		42, "casinosig", dicePubKey, txOpts, 0)
 	assert.Nil(err)
 	signedTx, err := packedTx.Unpack()
 	assert.Nil(err)
@@ -149,6 +184,61 @@ func TestSignidiceTransaction(t *testing.T) {
 	assert.Equal(dicePubKey, pubKeys[0])
 }
 
+func TestSigndiceBuilder(t *testing.T) {
+	assert := assert.New(t)
+	cfg, keyBag := MakeTestConfig()
+	cfg.SigniDiceLimits = TrxLimits{MaxCPUUsageMs: 5}
+	// unreachable node: the builder must not call it
+	api := eos.New("http://127.0.0.1:1")
+	api.SetSigner(keyBag)
+	app := NewApp(api, nil, make(chan *broker.EventMessage), nil, cfg)
+	blockID, _ := hex.DecodeString(mocks.NodeBlockID)
+	txOpts := &eos.TxOptions{ChainID: cfg.BlockChain.ChainID, HeadBlockID: blockID}
+	event := newTestEvent(0, 42)
+	build := app.signidiceBuilder(event, "casinosig")
+
+	packedTx, err := build(txOpts)
+	assert.NoError(err)
+	signedTx, err := packedTx.Unpack()
+	assert.NoError(err)
+	assert.Equal(uint16(binary.BigEndian.Uint32(blockID[:4])), signedTx.RefBlockNum)
+	assert.Equal(uint8(5), signedTx.MaxCPUUsageMS)
+	if assert.Len(signedTx.Actions, 1) {
+		assert.Equal(eos.AN(event.Sender), signedTx.Actions[0].Account)
+		assert.Equal(app.signidiceAuth(), signedTx.Actions[0].Authorization[0])
+	}
+	pubKeys, err := signedTx.SignedByKeys(cfg.BlockChain.ChainID)
+	assert.NoError(err)
+	assert.Equal([]ecc.PublicKey{cfg.BlockChain.EosPubKeys.SigniDice}, pubKeys)
+	assert.Zero(txOpts.MaxCPUUsageMS, "txOpts shouldn't be modified")
+
+	// fresh chain state of a retry is used as is
+	nextBlockID := append([]byte{}, blockID...)
+	nextBlockID[3]++
+	packedTx, err = build(&eos.TxOptions{ChainID: cfg.BlockChain.ChainID, HeadBlockID: nextBlockID})
+	assert.NoError(err)
+	signedTx, err = packedTx.Unpack()
+	assert.NoError(err)
+	assert.Equal(uint16(binary.BigEndian.Uint32(nextBlockID[:4])), signedTx.RefBlockNum)
+
+	// nonce trx keeps pinned header, so retries build the same trx
+	app.Nonce = NonceConfig{Enabled: true, Contract: "eosio.null"}
+	first, err := build(txOpts)
+	assert.NoError(err)
+	retried, err := build(&eos.TxOptions{ChainID: cfg.BlockChain.ChainID, HeadBlockID: nextBlockID})
+	assert.NoError(err)
+	firstID, _ := first.ID()
+	retriedID, _ := retried.ID()
+	assert.Equal(firstID, retriedID)
+
+	app.Nonce.Enabled = false
+	_, err = build(&eos.TxOptions{ChainID: cfg.BlockChain.ChainID, HeadBlockID: make([]byte, 32)})
+	assert.EqualError(err, "transaction has no TAPOS reference")
+	api.Signer = nil
+	_, err = build(txOpts)
+	assert.Equal(ErrSignerNotConfigured, err)
+}
+
 func TestValidateTransaction(t *testing.T) {
 	assert := assert.New(t)
 	sponsorPk := "5J6wt29qMkX2d22x2dw7QQb2S7A9c9xjrSiA16t6TAwTNqntpi1"
@@ -181,8 +271,8 @@ func TestValidateTransaction(t *testing.T) {
 			{Actor: eos.AN(platformAccName), Permission: eos.PN("gameaction")},
 		},
 	}
-	assert.Nil(ValidateTransferAction(transferAction, eos.AN(casinoAccName)))
-	assert.Equal(ValidateTransferAction(transferAction, eos.AN("onebet")),
+	assert.Nil(ValidateTransferAction(transferAction, eos.PN(casinoAccName)))
+	assert.Equal(ValidateTransferAction(transferAction, eos.PN("onebet")),
 		fmt.Errorf("invalid permission in transfer action"))
 	assert.Nil(ValidateGameActionAuth(newGameAction, eos.AN(platformAccName)))
 	assert.Equal(ValidateGameActionAuth(newGameAction, eos.AN("buggyplatform")),
@@ -197,7 +287,7 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err := keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Nil(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)))
 
@@ -205,7 +295,7 @@ func TestValidateTransaction(t *testing.T) {
 	nonPlatformTxn, err := keyBag.Sign(&origTxn, eos.Checksum256(chainID), pubKeys[0], pubKeys[2])
 	assert.Nil(err)
 	assert.Equal(ValidateDepositTransaction(nonPlatformTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)),
 		fmt.Errorf("platform pub key not found in deposit txn"))
@@ -215,7 +305,7 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err = keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Nil(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)))
 
@@ -224,7 +314,7 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err = keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Nil(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)))
 
@@ -233,7 +323,7 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err = keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Equal(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)),
 		fmt.Errorf("first action should be newgame, second gameaction"))
@@ -243,7 +333,7 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err = keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Equal(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)),
 		fmt.Errorf("first action should be newgame, second gameaction"))
@@ -253,8 +343,4330 @@ func TestValidateTransaction(t *testing.T) {
 	signedTxn, err = keyBag.Sign(&txn, eos.Checksum256(chainID), pubKeys[0], pubKeys[1])
 	assert.Nil(err)
 	assert.Equal(ValidateDepositTransaction(signedTxn,
-		eos.AN(casinoAccName), eos.AN(platformAccName),
+		eos.PN(casinoAccName), eos.AN(platformAccName),
 		a.BlockChain.PlatformPubKey,
 		eos.Checksum256(chainID)),
 		fmt.Errorf("first action should be newgame, second gameaction"))
 }
+
+func newTestApp(node *mocks.NodeMock) *App {
+	appCfg, keyBag := MakeTestConfig()
+	appCfg.HTTP = HTTPConfig{RetryAmount: 1, RetryDelay: time.Millisecond, Timeout: time.Second}
+	bc := eos.New(node.URL)
+	bc.SetSigner(keyBag)
+	return NewApp(bc, new(mocks.EventListenerMock), make(chan *broker.EventMessage),
+		utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0), appCfg)
+}
+
+func newTestEvent(offset uint64, requestID uint64) *broker.Event {
+	return &broker.Event{
+		Offset:    offset,
+		Sender:    "dice",
+		RequestID: requestID,
+		Data:      []byte(`{"digest":"` + mocks.NodeBlockID + `"}`),
+	}
+}
+
+func TestOffsetGaps(t *testing.T) {
+	assert := assert.New(t)
+	detector := newGapDetector()
+	events := func(offsets ...uint64) []*broker.Event {
+		var result []*broker.Event
+		for _, offset := range offsets {
+			result = append(result, newTestEvent(offset, offset+1))
+		}
+		return result
+	}
+	// untracked topic starts from the first event
+	assert.Empty(detector.observe(1, events(3, 4)))
+	assert.Equal([]OffsetGap{{1, 5, 6}}, detector.observe(1, events(7)))
+
+	detector.expect(0, 5)
+	assert.Equal([]OffsetGap{{0, 5, 5}}, detector.observe(0, events(6, 7)))
+	assert.Equal([]OffsetGap{{0, 8, 9}, {0, 11, 11}}, detector.observe(0, events(10, 12)))
+	// redelivered events aren't gaps
+	assert.Empty(detector.observe(0, events(7, 8)))
+	// re-subscription from committed offset doesn't move expected offset back
+	detector.expect(0, 6)
+	assert.Empty(detector.observe(0, events(13)))
+
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Broker.ReplayGaps = true
+	app = NewApp(app.bcAPI, mocks.NewBrokerMock(app.EventMessages), app.EventMessages, app.OffsetStore, app.AppConfig)
+	replayed := make(chan *mocks.BrokerMock, 1)
+	app.NewReplayListener = func(events chan<- *broker.EventMessage) EventListener {
+		replayBroker := mocks.NewBrokerMock(events, &broker.EventMessage{Offset: 3, Events: []*broker.Event{
+			newTestEvent(1, 2), newTestEvent(2, 3), newTestEvent(3, 4)}})
+		replayed <- replayBroker
+		return replayBroker
+	}
+	missed := testutil.ToFloat64(metrics.MissedOffsets.WithLabelValues("0"))
+	assert.NoError(app.subscribeTopics())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: events(0)}
+	app.EventMessages <- &broker.EventMessage{Offset: 4, Events: events(3, 4)}
+
+	// offsets 1 and 2 are missed and replayed, already received 3 is skipped by the replay
+	select {
+	case replayBroker := <-replayed:
+		assert.Equal(uint64(1), replayBroker.Subscriptions()[0])
+	case <-time.After(time.Second):
+		assert.Fail("gap isn't replayed")
+	}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 5 }, time.Second, time.Millisecond)
+	assert.Equal(missed+2, testutil.ToFloat64(metrics.MissedOffsets.WithLabelValues("0")))
+}
+
+func TestReplayRange(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	var replayBroker *mocks.BrokerMock
+	app.NewReplayListener = func(events chan<- *broker.EventMessage) EventListener {
+		replayBroker = mocks.NewBrokerMock(events,
+			&broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), newTestEvent(1, 2)}},
+			&broker.EventMessage{Offset: 3, Events: []*broker.Event{newTestEvent(2, 3), newTestEvent(3, 4)}},
+			&broker.EventMessage{Offset: 5, Events: []*broker.Event{newTestEvent(4, 5), newTestEvent(5, 6)}},
+		)
+		return replayBroker
+	}
+
+	app.Auth.Token = "secret"
+	router := app.GetRouter()
+	request := httptest.NewRequest("POST", "/replay", bytes.NewBufferString(`{"from": 1, "to": 4}`))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.Nil(replayBroker)
+
+	request = httptest.NewRequest("POST", "/replay", bytes.NewBufferString(`{"from": 1, "to": 4}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	assert.Equal(http.StatusOK, response.Code)
+	var body struct {
+		Result ReplayResult `json:"result"`
+	}
+	assert.Nil(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(4, body.Result.Processed)
+	assert.Equal(4, body.Result.Succeeded)
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(uint64(1), replayBroker.Subscriptions()[0])
+	assert.Equal([]broker.EventType{0}, replayBroker.Unsubscriptions())
+	_, err := app.OffsetStore.ReadOffset(0)
+	assert.Equal(utils.ErrNoOffset, err)
+
+	request = httptest.NewRequest("POST", "/replay", bytes.NewBufferString(`{"from": 4, "to": 1}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+}
+
+func signidiceRequestIDs(tx *eos.SignedTransaction) []uint64 {
+	ids := make([]uint64, 0, len(tx.Actions))
+	for _, action := range tx.Actions {
+		var signidice Signidice
+		if err := eos.UnmarshalBinary(action.HexData, &signidice); err != nil {
+			panic(err)
+		}
+		ids = append(ids, signidice.RequestID)
+	}
+	return ids
+}
+
+// rejects every trx which contains badRequestID, mentions it in error when mention is set
+func rejectingPushHandler(badRequestID uint64, mention bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		if err != nil {
+			mocks.RespondNodeError(writer, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+		for _, id := range signidiceRequestIDs(tx) {
+			if id == badRequestID {
+				what := "assertion failure"
+				if mention {
+					what = fmt.Sprintf("assertion failure with message: request %d not found", id)
+				}
+				mocks.RespondNodeError(writer, http.StatusInternalServerError, 3050003, what)
+				return
+			}
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	dir, err := ioutil.TempDir("", "casino-batch-dlq")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	app.DLQ.Path = filepath.Join(dir, "dlq.jsonl")
+	events := []*broker.Event{newTestEvent(0, 11), newTestEvent(1, 12), newTestEvent(2, 13)}
+	deadLetters := func() []string {
+		records, err := app.DeadLetters()
+		assert.NoError(err)
+		ids := make([]string, 0, len(records))
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		os.Remove(app.DLQ.Path)
+		return ids
+	}
+
+	// all events are sent within single trx
+	results := app.processBatch(context.Background(), events)
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	for _, result := range results {
+		assert.NotNil(result)
+	}
+
+	// fail policy fails whole batch
+	node.Handle(mocks.PushTransactionPath, rejectingPushHandler(12, true))
+	app.Batch.FailurePolicy = BatchFailAll
+	results = app.processBatch(context.Background(), events)
+	assert.Equal([]*string{nil, nil, nil}, results)
+	assert.Equal([]string{"0-0-11", "0-1-12", "0-2-13"}, deadLetters())
+
+	// drop policy drops reported event and signs the rest
+	app.Batch.FailurePolicy = BatchDropFailed
+	results = app.processBatch(context.Background(), events)
+	assert.NotNil(results[0])
+	assert.Nil(results[1])
+	assert.NotNil(results[2])
+	assert.Equal([]string{"0-1-12"}, deadLetters())
+
+	// drop policy isolates failed event when node doesn't report it
+	node.Handle(mocks.PushTransactionPath, rejectingPushHandler(13, false))
+	calls := node.Calls(mocks.PushTransactionPath)
+	results = app.processBatch(context.Background(), events)
+	assert.NotNil(results[0])
+	assert.NotNil(results[1])
+	assert.Nil(results[2])
+	assert.Equal(calls+4, node.Calls(mocks.PushTransactionPath))
+	assert.Equal([]string{"0-2-13"}, deadLetters())
+}
+
+func TestHandleBatchMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Batch.Enabled = true
+	app.Processor.DedupCacheSize = 10
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	var batchSizes []int
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		if assert.NoError(err) {
+			batchSizes = append(batchSizes, len(tx.Actions))
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+
+	// duplicate request of the same batch isn't signed twice
+	events := []*broker.Event{newTestEvent(0, 21), newTestEvent(1, 22), newTestEvent(2, 21)}
+	results := app.handleBatch(context.Background(), events)
+	assert.Equal([]int{2}, batchSizes)
+	for _, result := range results {
+		assert.NotNil(result)
+	}
+	assert.Equal(results[0], results[2])
+
+	// redelivered events are skipped by dedup, new one is signed alone
+	events = []*broker.Event{newTestEvent(0, 21), newTestEvent(1, 22), newTestEvent(3, 23)}
+	results = app.handleBatch(context.Background(), events)
+	assert.Equal([]int{2, 1}, batchSizes)
+	for _, result := range results {
+		assert.NotNil(result)
+	}
+
+	// nothing to sign
+	results = app.handleBatch(context.Background(), events[:2])
+	assert.Equal([]int{2, 1}, batchSizes)
+	assert.NotNil(results[0])
+	assert.NotNil(results[1])
+}
+
+func benchmarkCodecs(b *testing.B, bench func(b *testing.B)) {
+	defer func() { _ = SetJSONCodec(defaultJSONCodec) }()
+	for name := range jsonCodecs {
+		if err := SetJSONCodec(name); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, bench)
+	}
+}
+
+func BenchmarkRespondWithJSON(b *testing.B) {
+	benchmarkCodecs(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			respondWithJSON(httptest.NewRecorder(), http.StatusOK, JSONResponse{"txid": mocks.NodeTrxID})
+		}
+	})
+}
+
+func BenchmarkParseEventData(b *testing.B) {
+	event := newTestEvent(0, 1)
+	benchmarkCodecs(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var data struct {
+				Digest eos.Checksum256 `json:"digest"`
+			}
+			if err := jsonCodec.Unmarshal(event.Data, &data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestStandby(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Standby = true
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	assert.True(app.IsStandby())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), newTestEvent(1, 2)}}
+	app.EventMessages <- &broker.EventMessage{Offset: 2, Events: []*broker.Event{newTestEvent(2, 3)}}
+	assert.Eventually(func() bool { return app.ShadowOffset(0) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+
+	// promote requires auth token
+	app.Auth.Token = "secret"
+	response := httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, httptest.NewRequest("POST", "/promote", nil))
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.True(app.IsStandby())
+
+	request, _ := http.NewRequest("POST", "/promote", nil)
+	response = httptest.NewRecorder()
+	app.PromoteQuery(response, request)
+	assert.Equal(`{"offset":3,"offsets":{"0":3},"result":"promoted"}`, response.Body.String())
+	assert.False(app.IsStandby())
+
+	app.EventMessages <- &broker.EventMessage{Offset: 3, Events: []*broker.Event{newTestEvent(3, 4)}}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 1 }, time.Second, time.Millisecond)
+
+	response = httptest.NewRecorder()
+	app.PromoteQuery(response, request)
+	assert.Equal(`{"result":"already active"}`, response.Body.String())
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	app.setReady(true)
+	release := make(chan struct{})
+	app.UseEventMiddleware(func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *broker.Event) *string {
+			if event.RequestID == 1 {
+				<-release
+			}
+			return next(ctx, event)
+		}
+	})
+	router := app.GetRouter()
+	query := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	status := func() map[string]interface{} {
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(query("GET", "/status").Body.Bytes(), &body))
+		return body
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(func() bool { return app.InFlightEvents() == 1 }, time.Second, time.Millisecond)
+
+	// in-flight event finishes after drain, new ones wait for undrain
+	response := query("POST", "/drain")
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal(`{"in_flight_events":1,"result":"drained"}`, response.Body.String())
+	assert.True(app.IsDrained())
+	assert.Equal(http.StatusServiceUnavailable, query("GET", "/ready").Code)
+	assert.Equal(true, status()["drained"])
+	assert.Equal(`{"in_flight_events":1,"result":"already drained"}`, query("POST", "/drain").Body.String())
+
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(1, 2)}}
+	close(release)
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 1 }, time.Second, time.Millisecond)
+	assert.Eventually(func() bool { return app.InFlightEvents() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(float64(0), status()["in_flight_events"])
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	response = query("POST", "/undrain")
+	assert.Equal(`{"result":"resumed"}`, response.Body.String())
+	assert.False(app.IsDrained())
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(http.StatusOK, query("GET", "/ready").Code)
+	assert.Equal(false, status()["drained"])
+	assert.Equal(`{"result":"not drained"}`, query("POST", "/undrain").Body.String())
+
+	// drain requires auth token
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("POST", "/drain", nil))
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.False(app.IsDrained())
+}
+
+func TestRsaPublicKeyQuery(t *testing.T) {
+	assert := assert.New(t)
+	request, _ := http.NewRequest("GET", "/rsa_public_key", nil)
+	response := httptest.NewRecorder()
+	a.RsaPublicKeyQuery(response, request)
+	assert.Equal(http.StatusOK, response.Code)
+
+	var body struct {
+		RsaKey   string `json:"rsa_key"`
+		Modulus  string `json:"modulus"`
+		Exponent int    `json:"exponent"`
+	}
+	assert.Nil(json.Unmarshal(response.Body.Bytes(), &body))
+	expected, _ := utils.RsaPublicKeyBase64(&a.BlockChain.RSAKey.PublicKey)
+	assert.Equal(expected, body.RsaKey)
+	assert.Equal(a.BlockChain.RSAKey.PublicKey.E, body.Exponent)
+	assert.Equal(hex.EncodeToString(a.BlockChain.RSAKey.PublicKey.N.Bytes()), body.Modulus)
+}
+
+func TestInvalidTxOptionsRefetched(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.HTTP.RetryAmount = 2
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		blockID := mocks.NodeBlockID
+		if node.Calls(mocks.GetInfoPath) == 1 {
+			// ref block prefix bytes are zero
+			blockID = mocks.NodeBlockID[:16] + "0000000000000000" + mocks.NodeBlockID[32:]
+		}
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"chain_id":                   mocks.NodeChainID,
+			"last_irreversible_block_id": blockID,
+			"head_block_id":              blockID,
+		})
+	})
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(2, node.Calls(mocks.GetInfoPath))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestValidateTxOptions(t *testing.T) {
+	assert := assert.New(t)
+	blockID, _ := hex.DecodeString(mocks.NodeBlockID)
+	assert.Nil(ValidateTxOptions(&eos.TxOptions{ChainID: mocks.ChainID(), HeadBlockID: blockID}))
+	assert.NotNil(ValidateTxOptions(&eos.TxOptions{ChainID: mocks.ChainID()}))
+	assert.NotNil(ValidateTxOptions(&eos.TxOptions{HeadBlockID: blockID}))
+	assert.Equal(fmt.Errorf("zero reference block num"),
+		ValidateTxOptions(&eos.TxOptions{ChainID: mocks.ChainID(), HeadBlockID: make([]byte, 32)}))
+
+	// ref_block_num of every 65536th block is 0
+	wrappedBlockID := append([]byte{}, blockID...)
+	binary.BigEndian.PutUint32(wrappedBlockID[:4], 3*65536)
+	assert.Nil(ValidateTxOptions(&eos.TxOptions{ChainID: mocks.ChainID(), HeadBlockID: wrappedBlockID}))
+	wrappedTx := eos.NewTransaction(nil, &eos.TxOptions{HeadBlockID: wrappedBlockID})
+	assert.Equal(uint16(0), wrappedTx.RefBlockNum)
+	assert.Nil(ValidateTransactionHeader(wrappedTx, time.Now().UTC()))
+
+	tx := eos.NewTransaction(nil, &eos.TxOptions{HeadBlockID: blockID})
+	assert.Nil(ValidateTransactionHeader(tx, time.Now().UTC()))
+	assert.NotNil(ValidateTransactionHeader(tx, time.Now().UTC().Add(time.Minute)))
+	assert.NotNil(ValidateTransactionHeader(tx, time.Now().UTC().Add(-2*time.Hour)))
+	assert.NotNil(ValidateTransactionHeader(eos.NewTransaction(nil, nil), time.Now().UTC()))
+}
+
+func TestRelayTransaction(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.HTTP.RetryAmount = 2
+
+	relayCalls := 0
+	var relayedTx *eos.SignedTransaction
+	relay := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		relayCalls++
+		if relayCalls == 1 {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		relayedTx = tx
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{"transaction_id": "relayedtrx"})
+	}))
+	defer relay.Close()
+	app.Relay.URL = relay.URL
+
+	// retried after relay failure
+	txID := app.processEvent(context.Background(), newTestEvent(0, 42))
+	assert.NotNil(txID)
+	assert.Equal("relayedtrx", *txID)
+	assert.Equal(2, relayCalls)
+	assert.Equal([]uint64{42}, signidiceRequestIDs(relayedTx))
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+
+	// client errors aren't retried
+	relay.Config.Handler = http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		relayCalls++
+		writer.WriteHeader(http.StatusBadRequest)
+	})
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 43)))
+	assert.Equal(3, relayCalls)
+}
+
+func TestStatusSignRate(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+
+	status := func() float64 {
+		request, _ := http.NewRequest("GET", "/status", nil)
+		response := httptest.NewRecorder()
+		app.StatusQuery(response, request)
+		var body struct {
+			SignsPerMinute float64 `json:"signs_per_minute"`
+		}
+		assert.Nil(json.Unmarshal(response.Body.Bytes(), &body))
+		return body.SignsPerMinute
+	}
+	before := status()
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(0, 1)))
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(before+2, status())
+}
+
+func TestGoroutinesLimit(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Processor.MaxGoroutines = 2
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+
+	limitReached := testutil.ToFloat64(metrics.EventGoroutinesLimitReached)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 2, Events: []*broker.Event{
+		newTestEvent(0, 1), newTestEvent(1, 2), newTestEvent(2, 3),
+	}}
+
+	assert.Eventually(func() bool {
+		return testutil.ToFloat64(metrics.EventGoroutinesLimitReached) == limitReached+1
+	}, time.Second, time.Millisecond)
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(2.0, testutil.ToFloat64(metrics.EventGoroutines))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	close(release)
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 3 }, time.Second, time.Millisecond)
+	assert.Eventually(func() bool { return testutil.ToFloat64(metrics.EventGoroutines) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestInclusionCheck(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	included := false
+	var m sync.Mutex
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if !included {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3040011, "Transaction not found")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{"block_num": 9})
+	})
+	app := newTestApp(node)
+	app.Inclusion = InclusionConfig{Enabled: true, Delay: time.Millisecond, Repush: true}
+	notIncluded := testutil.ToFloat64(metrics.SigniDiceNotIncluded)
+
+	// not included trx is re-pushed
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(notIncluded+1, testutil.ToFloat64(metrics.SigniDiceNotIncluded))
+
+	// included trx isn't touched
+	m.Lock()
+	included = true
+	m.Unlock()
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Eventually(func() bool { return node.Calls(mocks.GetTransactionPath) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(notIncluded+1, testutil.ToFloat64(metrics.SigniDiceNotIncluded))
+
+	// events of not included trx are queued to DLQ
+	dir, err := ioutil.TempDir("", "casino-inclusion")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	app.DLQ.Path = filepath.Join(dir, "dlq.jsonl")
+	app.Inclusion.Repush = false
+	m.Lock()
+	included = false
+	m.Unlock()
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Eventually(func() bool {
+		records, err := app.DeadLetters()
+		return err == nil && len(records) == 1 && records[0].Event.RequestID == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+
+	// duplicate re-push means the trx is on chain already
+	assert.NoError(os.Remove(app.DLQ.Path))
+	app.Inclusion.Repush = true
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, EosInternalDuplicateErrorCode, "duplicate")
+	})
+	app.checkInclusion([]*broker.Event{newTestEvent(3, 4)}, &eos.PackedTransaction{}, mocks.NodeTrxID)
+	assert.Equal(5, node.Calls(mocks.PushTransactionPath))
+	records, err := app.DeadLetters()
+	assert.NoError(err)
+	assert.Empty(records)
+
+	// node errors other than unknown trx fail the check
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusNotFound, 0, "Not Found")
+	})
+	_, err = app.isIncluded(mocks.NodeTrxID)
+	assert.Error(err)
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3010000, "database exception")
+	})
+	_, err = app.isIncluded(mocks.NodeTrxID)
+	assert.Error(err)
+	// hung node doesn't block the check
+	app.ChainRequestTimeout = 50 * time.Millisecond
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	_, err = app.isIncluded(mocks.NodeTrxID)
+	assert.Equal(ErrChainRequestTimeout, err)
+}
+
+func TestEventMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+
+	var calls []string
+	tracer := func(name string) EventMiddleware {
+		return func(next EventHandler) EventHandler {
+			return func(ctx context.Context, event *broker.Event) *string {
+				calls = append(calls, name+" before")
+				trxID := next(ctx, event)
+				calls = append(calls, name+" after")
+				return trxID
+			}
+		}
+	}
+	skipper := func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *broker.Event) *string {
+			if event.RequestID == 0 {
+				return nil
+			}
+			return next(ctx, event)
+		}
+	}
+	app.UseEventMiddleware(tracer("first"), tracer("second"), skipper)
+
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal([]string{"first before", "second before", "second after", "first after"}, calls)
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	assert.Nil(app.handleEvent(context.Background(), newTestEvent(1, 0)))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	handler := ChainEventMiddleware(func(ctx context.Context, event *broker.Event) *string { return nil }, skipper)
+	assert.Nil(handler(context.Background(), newTestEvent(0, 1)))
+}
+
+// returns valid {transfer, newgame} deposit trx signed by platform and sponsor
+func makeDepositTransaction(chainID eos.Checksum256) []byte {
+	return makeCasinoDepositTransaction(chainID, casinoAccName)
+}
+
+// returns deposit trx to the given casino account
+func makeCasinoDepositTransaction(chainID eos.Checksum256, casino string) []byte {
+	keyBag := eos.KeyBag{}
+	if err := keyBag.Add("5J6wt29qMkX2d22x2dw7QQb2S7A9c9xjrSiA16t6TAwTNqntpi1"); err != nil {
+		panic(err)
+	}
+	if err := keyBag.Add(platformPk); err != nil {
+		panic(err)
+	}
+	pubKeys, _ := keyBag.AvailableKeys()
+	blockID, _ := hex.DecodeString(mocks.NodeBlockID)
+	txn := eos.NewSignedTransaction(eos.NewTransaction([]*eos.Action{
+		{
+			Account: eos.AN("eosio.token"),
+			Name:    eos.ActN("transfer"),
+			Authorization: []eos.PermissionLevel{
+				{Actor: eos.AN("player"), Permission: eos.PN(casino)},
+			},
+			ActionData: eos.NewActionDataFromHexData([]byte{}),
+		},
+		{
+			Account: eos.AN("dice"),
+			Name:    eos.ActN("newgame"),
+			Authorization: []eos.PermissionLevel{
+				{Actor: eos.AN(platformAccName), Permission: eos.PN("gameaction")},
+			},
+			ActionData: eos.NewActionDataFromHexData([]byte{}),
+		},
+	}, &eos.TxOptions{HeadBlockID: blockID}))
+	signedTxn, err := keyBag.Sign(txn, chainID, pubKeys[0], pubKeys[1])
+	if err != nil {
+		panic(err)
+	}
+	raw, err := json.Marshal(signedTxn)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestSignQueryMultipleDepositKeys(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	const extraDepositPk = "5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3"
+	keyBag := app.bcAPI.Signer.(*eos.KeyBag)
+	assert.Nil(keyBag.Add(extraDepositPk))
+	extraKey, _ := ecc.NewPrivateKey(extraDepositPk)
+	app.BlockChain.EosPubKeys.Deposits = []ecc.PublicKey{app.BlockChain.EosPubKeys.Deposit, extraKey.PublicKey()}
+
+	node.Handle("/v1/chain/get_required_keys", func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"required_keys": []string{extraKey.PublicKey().String()},
+		})
+	})
+	var pushedTx *eos.SignedTransaction
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, pushedTx, _ = mocks.DecodePushedTransaction(req)
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+
+	request, _ := http.NewRequest("POST", "/sign_transaction",
+		bytes.NewBuffer(makeDepositTransaction(app.BlockChain.ChainID)))
+	response := httptest.NewRecorder()
+	app.SignQuery(response, request)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	signedBy, err := pushedTx.SignedByKeys(app.BlockChain.ChainID)
+	assert.Nil(err)
+	assert.Contains(signedBy, extraKey.PublicKey())
+	assert.NotContains(signedBy, app.BlockChain.EosPubKeys.Deposit)
+
+	// none of deposit keys is required
+	node.Handle("/v1/chain/get_required_keys", func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{"required_keys": []string{}})
+	})
+	request, _ = http.NewRequest("POST", "/sign_transaction",
+		bytes.NewBuffer(makeDepositTransaction(app.BlockChain.ChainID)))
+	response = httptest.NewRecorder()
+	app.SignQuery(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Equal(`{"code":"INVALID_TRANSACTION","error":"failed to select deposit key"}`, response.Body.String())
+
+	// node hangs on the required keys request
+	release := make(chan struct{})
+	defer close(release)
+	node.Handle("/v1/chain/get_required_keys", func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	})
+	app.ChainRequestTimeout = 50 * time.Millisecond
+	request, _ = http.NewRequest("POST", "/sign_transaction",
+		bytes.NewBuffer(makeDepositTransaction(app.BlockChain.ChainID)))
+	response = httptest.NewRecorder()
+	app.SignQuery(response, request)
+	assert.Equal(http.StatusServiceUnavailable, response.Code)
+	assert.Contains(response.Body.String(), `"code":"CHAIN_UNAVAILABLE"`)
+	assert.Contains(response.Body.String(), ErrChainRequestTimeout.Error())
+}
+
+func TestSignQueryAccountDepositKey(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	const otherCasino = "othercasino1"
+	const otherDepositPk = "5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3"
+	keyBag := app.bcAPI.Signer.(*eos.KeyBag)
+	assert.Nil(keyBag.Add(otherDepositPk))
+	otherKey, _ := ecc.NewPrivateKey(otherDepositPk)
+	app.BlockChain.EosPubKeys.AccountDeposits = map[eos.AccountName]ecc.PublicKey{otherCasino: otherKey.PublicKey()}
+	var pushedTx *eos.SignedTransaction
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, pushedTx, _ = mocks.DecodePushedTransaction(req)
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	sign := func(account string, casino string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/sign_transaction?account="+account,
+			bytes.NewBuffer(makeCasinoDepositTransaction(app.BlockChain.ChainID, casino)))
+		response := httptest.NewRecorder()
+		app.SignQuery(response, request)
+		return response
+	}
+
+	// deposit to the known account is signed with its key
+	response := sign(otherCasino, otherCasino)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	signedBy, err := pushedTx.SignedByKeys(app.BlockChain.ChainID)
+	assert.Nil(err)
+	assert.Contains(signedBy, otherKey.PublicKey())
+	assert.NotContains(signedBy, app.BlockChain.EosPubKeys.Deposit)
+
+	// default account is signed with the default deposit key
+	response = sign(casinoAccName, casinoAccName)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	signedBy, err = pushedTx.SignedByKeys(app.BlockChain.ChainID)
+	assert.Nil(err)
+	assert.Contains(signedBy, app.BlockChain.EosPubKeys.Deposit)
+
+	// deposit to another casino than the selected one
+	response = sign(otherCasino, casinoAccName)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Equal(`{"code":"INVALID_TRANSACTION","error":"invalid transaction supplied"}`, response.Body.String())
+
+	response = sign("unknowncasin", "unknowncasin")
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Equal(`{"code":"UNKNOWN_ACCOUNT","error":"unknown casino account"}`, response.Body.String())
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+}
+
+type closableOffsetStore struct {
+	utils.OffsetStore
+	onClose func() error
+}
+
+func (s *closableOffsetStore) Close() error {
+	return s.onClose()
+}
+
+func TestShutdownSequence(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Shutdown = ShutdownConfig{time.Second, time.Second, 5 * time.Second, time.Second}
+	brokerMock := mocks.NewBrokerMock(app.EventMessages)
+	var steps []string
+	var m sync.Mutex
+	record := func(step string) {
+		m.Lock()
+		defer m.Unlock()
+		steps = append(steps, step)
+	}
+	offsetStore := &closableOffsetStore{OffsetStore: app.OffsetStore, onClose: func() error {
+		record("offset closed")
+		return nil
+	}}
+	app = NewApp(app.bcAPI, brokerMock, app.EventMessages, offsetStore, app.AppConfig)
+	app.setReady(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processorDone := make(chan struct{})
+	go func() {
+		app.RunEventProcessor(ctx)
+		close(processorDone)
+	}()
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 1 }, time.Second, time.Millisecond)
+
+	stopHTTP := func(ctx context.Context) error {
+		assert.False(app.IsReady())
+		record("http stopped")
+		return nil
+	}
+	stopProcessor := func() {
+		record("processor stopped")
+		cancel()
+		// in-flight event finishes only after the processor is stopped
+		time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	}
+	shutdown(app.shutdownSteps(stopHTTP, stopProcessor))
+
+	<-processorDone
+	assert.Equal([]string{"http stopped", "processor stopped", "offset closed"}, steps)
+	assert.Equal([]broker.EventType{0}, brokerMock.Unsubscriptions())
+	assert.Equal(uint64(1), atomic.LoadUint64(&app.processedEvents))
+	assert.Equal(uint64(0), atomic.LoadUint64(&app.failedEvents))
+}
+
+func TestShutdownStepTimeout(t *testing.T) {
+	assert := assert.New(t)
+	var done []string
+	shutdown([]shutdownStep{
+		{"stuck", time.Millisecond, func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}},
+		{"next", time.Second, func(ctx context.Context) error {
+			done = append(done, "next")
+			return nil
+		}},
+	})
+	assert.Equal([]string{"next"}, done)
+}
+
+func TestShutdownUnsubscribe(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Broker.Topics = []TopicConfig{{ID: 1}, {ID: 2}, {ID: 3}}
+	app.Shutdown = ShutdownConfig{time.Second, 50 * time.Millisecond, time.Second, time.Second}
+	brokerMock := mocks.NewBrokerMock(app.EventMessages)
+	app = NewApp(app.bcAPI, brokerMock, app.EventMessages, app.OffsetStore, app.AppConfig)
+	noHTTP := func(ctx context.Context) error { return nil }
+
+	// failed topic doesn't stop unsubscribing the rest
+	brokerMock.UnsubscribeHook = func(topic broker.EventType) error {
+		if topic == 2 {
+			return fmt.Errorf("broker is gone")
+		}
+		return nil
+	}
+	stopped := 0
+	shutdown(app.shutdownSteps(noHTTP, func() { stopped++ }))
+	assert.Equal([]broker.EventType{1, 2, 3}, brokerMock.Unsubscriptions())
+	assert.EqualError(app.unsubscribeTopics(context.Background()), "failed to unsubscribe from 1 of 3 topics")
+	assert.Equal(1, stopped)
+
+	// hung unsubscribe doesn't block shutdown beyond broker timeout, the processor is stopped anyway
+	release := make(chan struct{})
+	defer close(release)
+	brokerMock.UnsubscribeHook = func(topic broker.EventType) error {
+		<-release
+		return nil
+	}
+	start := time.Now()
+	shutdown(app.shutdownSteps(noHTTP, func() { stopped++ }))
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(2, stopped)
+}
+
+func TestShutdownHTTPGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Shutdown.HTTPTimeout = 50 * time.Millisecond
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		started <- req.URL.Path
+		if req.URL.Path == "/hung" {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	stopped := make(chan error, 1)
+	stopServerStep := func(ctx context.Context) error {
+		err := stopServer(ctx, func() { _ = server.Config.Shutdown(context.Background()) }, server.CloseClientConnections)
+		stopped <- err
+		return err
+	}
+
+	response, err := http.Get(server.URL + "/fast")
+	assert.NoError(err)
+	response.Body.Close()
+	<-started
+
+	// hung request is cut off after the grace period
+	requestErr := make(chan error, 1)
+	go func() {
+		response, err := http.Get(server.URL + "/hung")
+		if err == nil {
+			response.Body.Close()
+		}
+		requestErr <- err
+	}()
+	<-started
+	start := time.Now()
+	shutdown(app.shutdownSteps(stopServerStep, func() {})[:1])
+	assert.EqualError(<-stopped, "connections were closed forcibly")
+	elapsed := time.Since(start)
+	assert.True(elapsed >= app.Shutdown.HTTPTimeout && elapsed < time.Second, elapsed.String())
+	select {
+	case err := <-requestErr:
+		assert.Error(err)
+	case <-time.After(time.Second):
+		assert.Fail("hung request wasn't cut off")
+	}
+
+	// server without in-flight requests stops at once
+	idle := httptest.NewServer(http.NotFoundHandler())
+	defer idle.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(stopServer(ctx, func() { _ = idle.Config.Shutdown(context.Background()) }, idle.CloseClientConnections))
+}
+
+func TestShutdownDrainsWorkers(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Processor = ProcessorConfig{MaxConcurrentSigns: 2}
+	app.Shutdown = ShutdownConfig{time.Second, time.Second, 5 * time.Second, time.Second}
+	app = NewApp(app.bcAPI, mocks.NewBrokerMock(app.EventMessages), app.EventMessages, app.OffsetStore, app.AppConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processorDone := make(chan struct{})
+	go func() {
+		app.RunEventProcessor(ctx)
+		close(processorDone)
+	}()
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), newTestEvent(1, 2)}}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 2 }, time.Second, time.Millisecond)
+
+	stopProcessor := func() {
+		cancel()
+		<-processorDone
+		time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	}
+	shutdown(app.shutdownSteps(func(ctx context.Context) error { return nil }, stopProcessor))
+
+	assert.Equal(uint64(2), atomic.LoadUint64(&app.processedEvents))
+	offset, err := app.OffsetStore.ReadOffset(0)
+	assert.Nil(err)
+	assert.Equal(uint64(2), offset)
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	defer close(release)
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Shutdown = ShutdownConfig{time.Second, time.Second, 20 * time.Millisecond, time.Second}
+	app = NewApp(app.bcAPI, mocks.NewBrokerMock(app.EventMessages), app.EventMessages, app.OffsetStore, app.AppConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 1 }, time.Second, time.Millisecond)
+
+	// stuck event doesn't block shutdown longer than drain timeout
+	start := time.Now()
+	shutdown(app.shutdownSteps(func(ctx context.Context) error { return nil }, cancel))
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(uint64(0), atomic.LoadUint64(&app.processedEvents))
+	// abandoned event is cancelled
+	assert.Eventually(func() bool { return app.eventsCtx.Err() == context.Canceled }, time.Second, time.Millisecond)
+}
+
+func TestResourceMonitor(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	node.Handle("/v1/chain/get_account", func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"account_name": "daocasinoxxx",
+			"ram_quota":    1000,
+			"ram_usage":    100,
+			"cpu_limit":    map[string]interface{}{"used": 95, "available": 5, "max": 100},
+			"net_limit":    map[string]interface{}{"used": 10, "available": 90, "max": 100},
+		})
+	})
+	app := newTestApp(node)
+	app.Resources = ResourcesConfig{Enabled: true, Interval: time.Second, Threshold: 0.1}
+	cpuLow := testutil.ToFloat64(metrics.AccountResourceLow.WithLabelValues(ResourceCPU))
+
+	// warning only
+	assert.NoError(app.checkResources())
+	assert.Equal(cpuLow+1, testutil.ToFloat64(metrics.AccountResourceLow.WithLabelValues(ResourceCPU)))
+	assert.Equal(0.05, testutil.ToFloat64(metrics.AccountResourceFreeRatio.WithLabelValues(ResourceCPU)))
+	assert.Equal(0.9, testutil.ToFloat64(metrics.AccountResourceFreeRatio.WithLabelValues(ResourceRAM)))
+
+	var low []ResourceUsage
+	app.ResourceLowHook = func(usages []ResourceUsage) error {
+		low = usages
+		return nil
+	}
+	assert.NoError(app.checkResources())
+	assert.Equal([]ResourceUsage{{ResourceCPU, 95, 100}}, low)
+
+	// configured top-up action is pushed
+	node.Handle("/v1/chain/abi_json_to_bin", func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{"binargs": "00"})
+	})
+	node.Handle("/v1/chain/get_required_keys", func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"required_keys": []string{app.BlockChain.EosPubKeys.SigniDice.String()},
+		})
+	})
+	var pushed *eos.SignedTransaction
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, pushed, _ = mocks.DecodePushedTransaction(req)
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app.Resources.TopUp = TopUpConfig{eos.AN("eosio"), eos.ActN("powerup"), eos.PN("active"), json.RawMessage(`{"days":1}`)}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	assert.NoError(app.checkResources())
+	if assert.NotNil(pushed) {
+		assert.Equal(eos.ActN("powerup"), pushed.Actions[0].Name)
+		assert.Equal([]eos.PermissionLevel{{Actor: app.BlockChain.CasinoAccountName, Permission: eos.PN("active")}},
+			pushed.Actions[0].Authorization)
+		assert.Len(pushed.Signatures, 1)
+	}
+}
+
+func TestSigndiceNonce(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var trxIDs []string
+	var pushed *eos.SignedTransaction
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		packedTx, signedTx, err := mocks.DecodePushedTransaction(req)
+		assert.NoError(err)
+		id, _ := packedTx.ID()
+		trxIDs = append(trxIDs, id.String())
+		pushed = signedTx
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": id.String()})
+	})
+	app := newTestApp(node)
+	app.Nonce = NonceConfig{Enabled: true, Contract: eos.AN("eosio.null")}
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	if assert.NotNil(pushed) && assert.Len(pushed.ContextFreeActions, 1) {
+		nonce := pushed.ContextFreeActions[0]
+		assert.Equal(eos.AN("eosio.null"), nonce.Account)
+		assert.Equal(eos.ActN("nonce"), nonce.Name)
+		assert.Empty(nonce.Authorization)
+		assert.Equal(eos.HexBytes(SigndiceNonce("dice", 1)), nonce.HexData)
+	}
+
+	// retry after chain state refetch produces the same trx
+	app.lastGetInfoStamp = time.Time{}
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	if assert.Len(trxIDs, 3) {
+		assert.Equal(trxIDs[0], trxIDs[1])
+		assert.NotEqual(trxIDs[0], trxIDs[2])
+	}
+}
+
+func TestTxHeadersPin(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now().UTC()
+	header := func(expiration time.Time, refBlockNum uint16) eos.TransactionHeader {
+		return eos.TransactionHeader{Expiration: eos.JSONTime{Time: expiration}, RefBlockNum: refBlockNum}
+	}
+	var headers txHeaders
+	first := header(now.Add(30*time.Second), 1)
+	assert.Equal(first, headers.pin("dice:1", first, now))
+	assert.Equal(first, headers.pin("dice:1", header(now.Add(40*time.Second), 2), now.Add(10*time.Second)))
+	assert.Equal(header(now.Add(30*time.Second), 3), headers.pin("dice:2", header(now.Add(30*time.Second), 3), now))
+
+	// header about to expire is replaced, expired ones are evicted
+	later := now.Add(28 * time.Second)
+	fresh := header(later.Add(30*time.Second), 4)
+	assert.Equal(fresh, headers.pin("dice:1", fresh, later))
+	headers.pin("dice:3", header(now.Add(time.Minute), 5), now.Add(31*time.Second))
+	assert.Len(headers.headers, 2)
+}
+
+func TestStrictJSON(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	unknownField := newTestEvent(0, 1)
+	unknownField.Data = []byte(`{"digest":"` + mocks.NodeBlockID + `","seed":1}`)
+	noDigest := newTestEvent(1, 2)
+	noDigest.Data = []byte(`{}`)
+
+	// lenient mode ignores unknown fields
+	assert.NotNil(app.processEvent(context.Background(), unknownField))
+
+	app.StrictJSON = true
+	assert.Nil(app.processEvent(context.Background(), unknownField))
+	_, err := app.parseDigest(noDigest)
+	assert.EqualError(err, "digest is empty")
+	_, err = app.parseDigest(&broker.Event{Data: []byte(`{"digest":"` + mocks.NodeBlockID + `"} {}`)})
+	assert.EqualError(err, "unexpected data after JSON value")
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+
+	request, _ := http.NewRequest("POST", "/sign_transaction", bytes.NewBufferString(`{"signatures":[],"foo":1}`))
+	response := httptest.NewRecorder()
+	app.SignQuery(response, request)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Equal(`{"code":"DESERIALIZE_FAILED","error":"failed to deserialize transaction: json: unknown field \"foo\""}`, response.Body.String())
+}
+
+func TestPushRetry(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var m sync.Mutex
+	var responses []func(writer http.ResponseWriter)
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		if len(responses) == 0 {
+			mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+			return
+		}
+		responses[0](writer)
+		responses = responses[1:]
+	})
+	respondsWith := func(eosCode int, what string) func(writer http.ResponseWriter) {
+		return func(writer http.ResponseWriter) {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, eosCode, what)
+		}
+	}
+	setResponses := func(r ...func(writer http.ResponseWriter)) {
+		m.Lock()
+		defer m.Unlock()
+		responses = r
+	}
+	app := newTestApp(node)
+	app.Push = PushConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	// transient errors are retried
+	setResponses(respondsWith(3080002, "net_usage_exceeded"), respondsWith(3080006, "deadline exceeded"))
+	assert.Equal(mocks.NodeTrxID, *app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+
+	// attempts are limited
+	setResponses(respondsWith(3080002, ""), respondsWith(3080002, ""), respondsWith(3080002, ""))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(6, node.Calls(mocks.PushTransactionPath))
+
+	// permanent errors aren't retried
+	setResponses(respondsWith(3050003, "assertion failure"))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(7, node.Calls(mocks.PushTransactionPath))
+
+	// duplicate means trx was already applied
+	setResponses(respondsWith(3080006, "deadline exceeded"), respondsWith(EosInternalDuplicateErrorCode, "duplicate"))
+	trxID := app.processEvent(context.Background(), newTestEvent(3, 4))
+	if assert.NotNil(trxID) {
+		assert.NotEqual(mocks.NodeTrxID, *trxID)
+		assert.Len(*trxID, 64)
+	}
+	assert.Equal(9, node.Calls(mocks.PushTransactionPath))
+
+	// batch trxs are pushed the same way
+	batch := []*broker.Event{newTestEvent(4, 5), newTestEvent(5, 6)}
+	setResponses(respondsWith(3080006, "deadline exceeded"), respondsWith(EosInternalDuplicateErrorCode, "duplicate"))
+	results := app.processBatch(context.Background(), batch)
+	assert.NotNil(results[0])
+	assert.NotNil(results[1])
+	assert.Equal(11, node.Calls(mocks.PushTransactionPath))
+
+	// transient failure of the batch isn't blamed on its events
+	app.Batch.FailurePolicy = BatchDropFailed
+	setResponses(respondsWith(3080002, ""), respondsWith(3080002, ""), respondsWith(3080002, ""))
+	assert.Equal([]*string{nil, nil}, app.processBatch(context.Background(), batch))
+	assert.Equal(14, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestWorkersPool(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Processor = ProcessorConfig{MaxConcurrentSigns: 2}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	var running, maxRunning, processed int32
+	app.UseEventMiddleware(func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *broker.Event) *string {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			defer func() {
+				atomic.AddInt32(&running, -1)
+				atomic.AddInt32(&processed, 1)
+			}()
+			return next(ctx, event)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	events := make([]*broker.Event, 0, 6)
+	for i := uint64(0); i < 6; i++ {
+		events = append(events, newTestEvent(i, i+1))
+	}
+	app.EventMessages <- &broker.EventMessage{Offset: 5, Events: events}
+
+	assert.Eventually(func() bool { return atomic.LoadInt32(&processed) == 6 }, time.Second, time.Millisecond)
+	assert.Equal(int32(2), atomic.LoadInt32(&maxRunning))
+	assert.Equal(6, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestEventTimeout(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Processor = ProcessorConfig{MaxConcurrentSigns: 1, EventTimeout: 300 * time.Millisecond}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	timeouts := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonTimeout))
+	release := make(chan struct{})
+	defer close(release)
+	app.UseEventMiddleware(func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *broker.Event) *string {
+			switch event.RequestID {
+			case 1:
+				// stuck handler ignoring ctx
+				<-release
+				return nil
+			case 2:
+				<-ctx.Done()
+				return nil
+			}
+			return next(ctx, event)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 2,
+		Events: []*broker.Event{newTestEvent(0, 1), newTestEvent(1, 2), newTestEvent(2, 3)}}
+
+	// timed out events are dropped and the only worker is freed for the next one
+	assert.Eventually(func() bool {
+		stored, err := app.OffsetStore.ReadOffset(0)
+		return err == nil && stored == 3
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(timeouts+2, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonTimeout)))
+	assert.Equal(uint64(2), atomic.LoadUint64(&app.failedEvents))
+
+	// cancelled event isn't dead-lettered
+	eventsCtx, cancelEvents := context.WithCancel(context.Background())
+	cancelEvents()
+	assert.Nil(app.handleEvent(eventsCtx, newTestEvent(3, 2)))
+	assert.Equal(timeouts+2, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonTimeout)))
+}
+
+type stubReporter struct {
+	reports chan ErrorReport
+}
+
+func (r *stubReporter) Report(report ErrorReport) error {
+	r.reports <- report
+	return nil
+}
+
+func TestErrorReporting(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	reporter := &stubReporter{reports: make(chan ErrorReport, 10)}
+	app.ErrorReporter = reporter
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 6)))
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3050003, "assertion failure")
+	})
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 7)))
+	select {
+	case report := <-reporter.reports:
+		assert.Equal("signidice_part_2 failed", report.Message)
+		assert.Contains(report.Error, "assertion failure")
+		assert.False(report.Time.IsZero())
+		assert.Equal(FailureReasonPushRejected, report.Context["reason"])
+		assert.Equal(uint64(7), report.Context["req_id"])
+		assert.Equal(app.BlockChain.CasinoAccountName, report.Context["casino_account"])
+	case <-time.After(time.Second):
+		assert.Fail("failure isn't reported")
+	}
+	// succeeded event isn't reported
+	assert.Len(reporter.reports, 0)
+
+	// every event of failed batch is reported
+	node.Handle(mocks.PushTransactionPath, rejectingPushHandler(9, true))
+	app.Batch.FailurePolicy = BatchDropFailed
+	assert.Equal([]*string{nil}, app.processBatch(context.Background(), []*broker.Event{newTestEvent(2, 9)}))
+	select {
+	case report := <-reporter.reports:
+		assert.Equal(FailureReasonPushRejected, report.Context["reason"])
+		assert.Equal(uint64(9), report.Context["req_id"])
+	case <-time.After(time.Second):
+		assert.Fail("batch failure isn't reported")
+	}
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+	})
+	app.processBatch(context.Background(), []*broker.Event{newTestEvent(3, 10), newTestEvent(4, 11)})
+	var reported []interface{}
+	for i := 0; i < 2; i++ {
+		select {
+		case report := <-reporter.reports:
+			assert.Equal(FailureReasonPushFailed, report.Context["reason"])
+			reported = append(reported, report.Context["req_id"])
+		case <-time.After(time.Second):
+			assert.Fail("batch failure isn't reported")
+		}
+	}
+	assert.ElementsMatch([]interface{}{uint64(10), uint64(11)}, reported)
+
+	// startup failure is delivered to the webhook before exit
+	var received []ErrorReport
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		var report ErrorReport
+		assert.NoError(json.NewDecoder(req.Body).Decode(&report))
+		received = append(received, report)
+		writer.WriteHeader(status)
+	}))
+	defer webhook.Close()
+	cfg := &Config{}
+	cfg.ErrorReporting.WebhookURL = webhook.URL
+	cfg.ErrorReporting.Timeout = 1
+	cfg.BlockChain.CasinoAccountName = "daocasinoxxx"
+	reportStartupFailure(cfg, fmt.Errorf("invalid config: chain ID is zero"))
+	if assert.Len(received, 1) {
+		assert.Equal("startup failed", received[0].Message)
+		assert.Equal("invalid config: chain ID is zero", received[0].Error)
+		assert.Equal("daocasinoxxx", received[0].Context["casino_account"])
+	}
+
+	status = http.StatusBadGateway
+	err := NewErrorReporter(ErrorReportingConfig{WebhookURL: webhook.URL, Timeout: time.Second}).Report(ErrorReport{Message: "test"})
+	assert.EqualError(err, "webhook failed, status: 502, body: ")
+	assert.Nil(NewErrorReporter(ErrorReportingConfig{}))
+}
+
+// run with -race: app state is read and written by HTTP handlers, the processor and shutdown at once
+func TestAppConcurrentAccess(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Standby = true
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				f(i)
+			}
+		}()
+	}
+	run(func(i int) { app.handleEvent(context.Background(), newTestEvent(uint64(i), uint64(i+1))) })
+	run(func(i int) {
+		app.UseEventMiddleware(func(next EventHandler) EventHandler { return next })
+	})
+	run(func(i int) {
+		app.setReady(i%2 == 0)
+		app.IsReady()
+	})
+	run(func(i int) {
+		app.Promote()
+		app.IsStandby()
+		storeMaxOffset(app.shadowOffsets[0], uint64(i))
+		app.ShadowOffsets()
+	})
+	run(func(i int) {
+		app.setRsaKey(key)
+		app.rsaKey()
+	})
+	run(func(i int) {
+		app.invalidateChainState()
+		_, _ = app.getTxOpts(context.Background())
+	})
+	run(func(i int) {
+		app.eventReceived()
+		app.LastEventReceived()
+	})
+	run(func(i int) {
+		response := httptest.NewRecorder()
+		app.StatusQuery(response, httptest.NewRequest("GET", "/status", nil))
+		assert.Equal(http.StatusOK, response.Code)
+	})
+	wg.Wait()
+	assert.Equal(uint64(rounds), atomic.LoadUint64(&app.processedEvents))
+	assert.False(app.IsStandby())
+	assert.Equal(key, app.rsaKey())
+}
+
+func TestOffsetCommittedAfterProcessing(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var failRequest3 int32 = 1
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, _ := mocks.DecodePushedTransaction(req)
+		if tx != nil && signidiceRequestIDs(tx)[0] == 3 && atomic.LoadInt32(&failRequest3) == 1 {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	offsetIs := func(offset uint64) func() bool {
+		return func() bool {
+			stored, err := app.OffsetStore.ReadOffset(0)
+			return err == nil && stored == offset
+		}
+	}
+
+	// permanently failed event is acknowledged
+	badDigest := newTestEvent(1, 2)
+	badDigest.Data = []byte(`{"digest":"zz"}`)
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), badDigest}}
+	assert.Eventually(offsetIs(2), time.Second, time.Millisecond)
+
+	// transiently failed event holds back offset
+	app.EventMessages <- &broker.EventMessage{Offset: 2, Events: []*broker.Event{newTestEvent(2, 3)}}
+	app.EventMessages <- &broker.EventMessage{Offset: 3, Events: []*broker.Event{newTestEvent(3, 4)}}
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 3 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.True(offsetIs(2)())
+
+	// redelivered event of the failed request releases offset once signed
+	atomic.StoreInt32(&failRequest3, 0)
+	app.EventMessages <- &broker.EventMessage{Offset: 2, Events: []*broker.Event{newTestEvent(2, 3)}}
+	assert.Eventually(offsetIs(4), time.Second, time.Millisecond)
+}
+
+func TestOffsetQueueLimit(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Processor.MaxPendingMessages = 2
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+
+	queueFull := testutil.ToFloat64(metrics.OffsetQueueFull)
+	for offset := uint64(0); offset < 3; offset++ {
+		app.EventMessages <- &broker.EventMessage{Offset: offset, Events: []*broker.Event{newTestEvent(offset, offset+1)}}
+	}
+	// the third message waits for the first ones to be committed
+	assert.Eventually(func() bool { return testutil.ToFloat64(metrics.OffsetQueueFull) == queueFull+1 },
+		time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	close(release)
+	assert.Eventually(func() bool {
+		offset, err := app.OffsetStore.ReadOffset(0)
+		return err == nil && offset == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestOffsetLagMetric(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.HTTP.Timeout = 5 * time.Second
+	app.Broker.Topics = []TopicConfig{{ID: 0}, {ID: 7}}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	lagIs := func(topic string, lag float64) func() bool {
+		return func() bool { return testutil.ToFloat64(metrics.OffsetLag.WithLabelValues(topic)) == lag }
+	}
+
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(lagIs("0", 1), time.Second, time.Millisecond)
+	// broker head moves on while the first event is in flight
+	app.EventMessages <- &broker.EventMessage{Offset: 4, Events: []*broker.Event{newTestEvent(4, 2)}}
+	assert.Eventually(lagIs("0", 5), time.Second, time.Millisecond)
+	event := newTestEvent(2, 3)
+	event.EventType = 7
+	app.EventMessages <- &broker.EventMessage{Offset: 2, Events: []*broker.Event{event}}
+	assert.Eventually(lagIs("7", 3), time.Second, time.Millisecond)
+
+	close(release)
+	assert.Eventually(lagIs("0", 0), time.Second, time.Millisecond)
+	assert.Eventually(lagIs("7", 0), time.Second, time.Millisecond)
+
+	// the gauge is exposed on /metrics
+	response := httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(response.Body.String(), `offset_lag{topic="7"} 0`)
+}
+
+func TestHealthzQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	healthz := func() (int, map[string]interface{}) {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/healthz", nil))
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		return response.Code, body
+	}
+
+	// not subscribed yet
+	code, body := healthz()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("down", body["status"])
+	dependencies := body["dependencies"].(map[string]interface{})
+	assert.Equal("ok", dependencies["blockchain"].(map[string]interface{})["status"])
+	assert.Equal("down", dependencies["broker"].(map[string]interface{})["status"])
+
+	app.setReady(true)
+	code, body = healthz()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", body["status"])
+
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 0, "node is syncing")
+	})
+	code, body = healthz()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	dependencies = body["dependencies"].(map[string]interface{})
+	assert.Equal("down", dependencies["blockchain"].(map[string]interface{})["status"])
+}
+
+func TestSigningMetrics(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	failures := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(reason))
+	}
+	received := testutil.ToFloat64(metrics.EventsReceived)
+	signed := testutil.ToFloat64(metrics.SigniDiceSigned)
+	digestFailures := failures(FailureReasonDigest)
+	pushFailures := failures(FailureReasonPushFailed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	badDigest := newTestEvent(1, 2)
+	badDigest.Data = []byte(`{"digest":"zz"}`)
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), badDigest}}
+	assert.Eventually(func() bool { return testutil.ToFloat64(metrics.SigniDiceSigned) == signed+1 }, time.Second, time.Millisecond)
+	assert.Eventually(func() bool { return failures(FailureReasonDigest) == digestFailures+1 }, time.Second, time.Millisecond)
+	assert.Equal(received+2, testutil.ToFloat64(metrics.EventsReceived))
+
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+	})
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(pushFailures+1, failures(FailureReasonPushFailed))
+}
+
+func TestDetectChainID(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	otherChainID := bytes.Repeat([]byte{1}, 32)
+	detect := func(check ChainIDCheck, chainID []byte) (*App, error) {
+		app := newTestApp(node)
+		app.BlockChain.ChainIDCheck = check
+		app.BlockChain.ChainID = chainID
+		return app, app.detectChainID(context.Background())
+	}
+
+	// not configured chain ID is taken from the node
+	app, err := detect(ChainIDCheckWarn, nil)
+	assert.NoError(err)
+	assert.Equal(mocks.ChainID(), []byte(app.BlockChain.ChainID))
+	assert.Equal(1, node.Calls(mocks.GetInfoPath))
+
+	app, err = detect(ChainIDCheckFail, mocks.ChainID())
+	assert.NoError(err)
+	assert.Equal(mocks.ChainID(), []byte(app.BlockChain.ChainID))
+
+	// mismatch keeps configured chain ID unless it fails startup
+	app, err = detect(ChainIDCheckWarn, otherChainID)
+	assert.NoError(err)
+	assert.Equal(otherChainID, []byte(app.BlockChain.ChainID))
+	_, err = detect(ChainIDCheckFail, otherChainID)
+	assert.EqualError(err, "configured chain ID "+hex.EncodeToString(otherChainID)+
+		" doesn't match chain ID "+mocks.NodeChainID+" of the node")
+
+	calls := node.Calls(mocks.GetInfoPath)
+	_, err = detect(ChainIDCheckOff, otherChainID)
+	assert.NoError(err)
+	assert.Equal(calls, node.Calls(mocks.GetInfoPath))
+
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 0, "node is down")
+	})
+	_, err = detect(ChainIDCheckWarn, otherChainID)
+	assert.NoError(err)
+	_, err = detect(ChainIDCheckWarn, nil)
+	assert.Error(err)
+	_, err = detect(ChainIDCheckFail, otherChainID)
+	assert.Error(err)
+
+	// empty chain ID passes validation only when it's detected
+	cfg, _ := MakeTestConfig()
+	cfg.BlockChain.ChainID = nil
+	assert.Error(cfg.Validate())
+	cfg.BlockChain.ChainIDCheck = ChainIDCheckWarn
+	assert.NoError(cfg.Validate())
+
+	check, err := ParseChainIDCheck("")
+	assert.NoError(err)
+	assert.Equal(ChainIDCheckOff, check)
+	check, err = ParseChainIDCheck("FAIL")
+	assert.NoError(err)
+	assert.Equal(ChainIDCheckFail, check)
+	_, err = ParseChainIDCheck("panic")
+	assert.EqualError(err, "unknown chain ID check: panic")
+}
+
+func TestAppConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+	valid, _ := MakeTestConfig()
+	assert.NoError(valid.Validate())
+
+	cases := []struct {
+		name   string
+		modify func(cfg *AppConfig)
+		err    string
+	}{
+		{"no chain ID", func(cfg *AppConfig) { cfg.BlockChain.ChainID = nil }, "chain ID should be 32 bytes, got 0"},
+		{"zero chain ID", func(cfg *AppConfig) { cfg.BlockChain.ChainID = make([]byte, 32) }, "chain ID is zero"},
+		{"no casino account", func(cfg *AppConfig) { cfg.BlockChain.CasinoAccountName = "" },
+			"casino account name is not set"},
+		{"invalid casino account", func(cfg *AppConfig) { cfg.BlockChain.CasinoAccountName = "Casino_Account" },
+			`casino account name "Casino_Account" is not a valid account name`},
+		{"long casino account", func(cfg *AppConfig) { cfg.BlockChain.CasinoAccountName = "daocasinoxxxxx" },
+			`casino account name "daocasinoxxxxx" is not a valid account name`},
+		{"no platform account", func(cfg *AppConfig) { cfg.BlockChain.PlatformAccountName = "" },
+			"platform account name is not set"},
+		{"no RSA key", func(cfg *AppConfig) { cfg.BlockChain.RSAKey = nil }, "RSA key is not set"},
+		{"no deposit key", func(cfg *AppConfig) { cfg.BlockChain.EosPubKeys.Deposit = ecc.PublicKey{} },
+			"deposit key is not set"},
+		{"no signidice key", func(cfg *AppConfig) { cfg.BlockChain.EosPubKeys.SigniDice = ecc.PublicKey{} },
+			"signidice key is not set"},
+		{"no deposit keys", func(cfg *AppConfig) { cfg.BlockChain.EosPubKeys.Deposits = nil },
+			"deposit keys are not set"},
+		{"no platform key", func(cfg *AppConfig) { cfg.BlockChain.PlatformPubKey = ecc.PublicKey{} },
+			"platform public key is not set"},
+		{"truncated platform key", func(cfg *AppConfig) { cfg.BlockChain.PlatformPubKey.Content = []byte{2, 1} },
+			"platform public key should be 33 bytes, got 2"},
+		{"TLS key without cert", func(cfg *AppConfig) { cfg.TLS.KeyFile = "server.key" },
+			`TLS cert and key files should be set both or neither, cert: "", key: "server.key"`},
+		{"TLS cert without key", func(cfg *AppConfig) { cfg.TLS.CertFile = "server.crt" },
+			`TLS cert and key files should be set both or neither, cert: "server.crt", key: ""`},
+		{"no retries", func(cfg *AppConfig) { cfg.HTTP.RetryAmount = 0 }, "HTTP retry amount should be positive"},
+		{"no timeout", func(cfg *AppConfig) { cfg.HTTP.Timeout = 0 }, "HTTP timeout should be positive"},
+		{"no resources interval", func(cfg *AppConfig) { cfg.Resources = ResourcesConfig{Enabled: true} },
+			"resources check interval should be positive"},
+		{"no topics", func(cfg *AppConfig) { cfg.Broker.Topics = nil }, "broker topics are not set"},
+		{"duplicated topic", func(cfg *AppConfig) { cfg.Broker.Topics = []TopicConfig{{ID: 1}, {ID: 2}, {ID: 1}} },
+			"broker topic 1 is duplicated"},
+	}
+	for _, c := range cases {
+		cfg, _ := MakeTestConfig()
+		c.modify(cfg)
+		assert.EqualError(cfg.Validate(), c.err, c.name)
+	}
+}
+
+func TestChainRequestTimeout(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	blockingHandler := func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+	}
+	newTimeoutApp := func(node *mocks.NodeMock) *App {
+		app := newTestApp(node)
+		app.ChainRequestTimeout = 20 * time.Millisecond
+		app.Push = PushConfig{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		return app
+	}
+
+	hungInfoNode := mocks.NewNodeMock()
+	defer hungInfoNode.Close()
+	hungInfoNode.Handle(mocks.GetInfoPath, blockingHandler)
+	start := time.Now()
+	_, err := newTimeoutApp(hungInfoNode).getTxOpts(context.Background())
+	assert.Equal(ErrChainRequestTimeout, err)
+	assert.True(time.Since(start) < time.Second)
+
+	// timed out push is retried
+	hungPushNode := mocks.NewNodeMock()
+	defer hungPushNode.Close()
+	hungPushNode.Handle(mocks.PushTransactionPath, blockingHandler)
+	assert.Nil(newTimeoutApp(hungPushNode).processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Eventually(func() bool { return hungPushNode.Calls(mocks.PushTransactionPath) == 2 }, time.Second, time.Millisecond)
+
+	// timed out request is aborted, not left running
+	var aborted int32
+	abortedPushNode := mocks.NewNodeMock()
+	defer abortedPushNode.Close()
+	abortedPushNode.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		// server notices closed connection only once the body is read
+		_, _ = ioutil.ReadAll(req.Body)
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			atomic.AddInt32(&aborted, 1)
+		}
+	})
+	app := newTimeoutApp(abortedPushNode)
+	limitChainRequests(app.bcAPI, app.ChainRequestTimeout)
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Eventually(func() bool { return atomic.LoadInt32(&aborted) == 2 }, time.Second, time.Millisecond)
+	close(release)
+}
+
+func TestSignTransactionsQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	signTransactions := func(body []byte) (int, string) {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("POST", "/sign_transactions", bytes.NewReader(body)))
+		return response.Code, response.Body.String()
+	}
+
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+	body := []byte(`[` + string(deposit) + `, 123, {"signatures": []}]`)
+	code, response := signTransactions(body)
+	assert.Equal(http.StatusOK, code)
+	var results []map[string]string
+	assert.NoError(json.Unmarshal([]byte(response), &results))
+	if assert.Len(results, 3) {
+		assert.Len(results[0]["txid"], 64)
+		assert.Equal("failed to deserialize transaction", results[1]["error"])
+		assert.Equal(string(ErrorCodeDeserializeFailed), results[1]["code"])
+		assert.Equal("invalid transaction supplied", results[2]["error"])
+		assert.Equal(string(ErrorCodeInvalidTransaction), results[2]["code"])
+	}
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3050003, "assertion failure")
+	})
+	code, response = signTransactions([]byte(`[` + string(deposit) + `]`))
+	assert.Equal(http.StatusOK, code)
+	assert.Contains(response, "failed to send transaction to the blockchain")
+
+	code, _ = signTransactions(deposit)
+	assert.Equal(http.StatusBadRequest, code)
+	code, response = signTransactions([]byte(`[]`))
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal(`{"code":"INVALID_REQUEST","error":"transactions amount should be from 1 to 16"}`, response)
+}
+
+func TestSignQueryAuth(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	router := app.GetRouter()
+	request := func(method, path, authorization string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+
+	response := request("POST", "/sign_transaction", "", deposit)
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.Equal(`{"code":"UNAUTHORIZED","error":"missing bearer token"}`, response.Body.String())
+
+	response = request("POST", "/sign_transaction", "Bearer wrong", deposit)
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.Equal(`{"code":"UNAUTHORIZED","error":"invalid bearer token"}`, response.Body.String())
+	response = request("POST", "/sign_transactions", "Basic secret", []byte(`[`+string(deposit)+`]`))
+	assert.Equal(http.StatusUnauthorized, response.Code)
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+
+	response = request("POST", "/sign_transaction", "Bearer secret", deposit)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	assert.Equal(http.StatusOK, request("GET", "/ping", "", nil).Code)
+}
+
+func TestDedupEvents(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Processor.DedupCacheSize = 2
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	// redelivered after reconnect
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(func() bool { return atomic.LoadUint64(&app.processedEvents) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	// failed request is retried
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+	})
+	assert.Nil(app.handleEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Nil(app.handleEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+
+	// other contract's request with the same ID isn't a duplicate
+	other := newTestEvent(2, 1)
+	other.Sender = "roulette"
+	assert.Nil(app.handleEvent(context.Background(), other))
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestReloadRsaQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	router := app.GetRouter()
+	reload := func(authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/reload_rsa", strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	oldKey := app.rsaKey()
+	newKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	encodedKey := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(newKey),
+	}))
+	garbagePem := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: []byte("garbage"),
+	}))
+
+	assert.Equal(http.StatusUnauthorized, reload("", `{"rsa_key":"`+encodedKey+`"}`).Code)
+	for _, body := range []string{
+		`{"rsa_key":`,
+		`{"rsa_key":"not base64"}`,
+		`{"rsa_key":"` + base64.StdEncoding.EncodeToString([]byte("not pem")) + `"}`,
+		`{"rsa_key":"` + garbagePem + `"}`,
+	} {
+		response := reload("Bearer secret", body)
+		assert.Equal(http.StatusBadRequest, response.Code, body)
+	}
+	assert.Equal(oldKey, app.rsaKey())
+
+	response := reload("Bearer secret", `{"rsa_key":"`+encodedKey+`"}`)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	expected, _ := utils.RsaPublicKeyBase64(&newKey.PublicKey)
+	assert.Equal(`{"result":"ok","rsa_key":"`+expected+`"}`, response.Body.String())
+	assert.Equal(newKey, app.rsaKey())
+
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("GET", "/rsa_public_key", nil))
+	assert.Contains(response.Body.String(), expected)
+
+	// reload is disabled without auth token
+	app.Auth.Token = ""
+	assert.Equal(http.StatusForbidden, reload("", `{"rsa_key":"`+encodedKey+`"}`).Code)
+}
+
+func TestTransactionCompression(t *testing.T) {
+	assert := assert.New(t)
+	for _, compression := range []eos.CompressionType{eos.CompressionNone, eos.CompressionZlib} {
+		for _, nonce := range []bool{false, true} {
+			node := mocks.NewNodeMock()
+			var m sync.Mutex
+			var pushed []eos.CompressionType
+			node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+				packedTx, _, err := mocks.DecodePushedTransaction(req)
+				if err != nil {
+					mocks.RespondNodeError(writer, http.StatusBadRequest, 3000000, err.Error())
+					return
+				}
+				m.Lock()
+				pushed = append(pushed, packedTx.Compression)
+				m.Unlock()
+				mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+			})
+			app := newTestApp(node)
+			app.Compression = compression
+			app.Nonce = NonceConfig{Enabled: nonce, Contract: "eosio.null"}
+
+			assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+			request := httptest.NewRequest("POST", "/sign_transaction",
+				bytes.NewReader(makeDepositTransaction(app.BlockChain.ChainID)))
+			response := httptest.NewRecorder()
+			app.SignQuery(response, request)
+			assert.Equal(http.StatusOK, response.Code, response.Body.String())
+
+			assert.Equal([]eos.CompressionType{compression, compression}, pushed)
+			node.Close()
+		}
+	}
+
+	compression, err := ParseCompression("ZLIB")
+	assert.Nil(err)
+	assert.Equal(eos.CompressionZlib, compression)
+	_, err = ParseCompression("gzip")
+	assert.EqualError(err, "unknown compression: gzip")
+}
+
+func TestConnectBrokerRetry(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Broker = BrokerConfig{Topics: []TopicConfig{{ID: 1, Offset: 3}},
+		ConnectMaxAttempts: 3, ConnectBaseDelay: time.Millisecond, ConnectMaxDelay: time.Millisecond}
+	offsetStore := utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 1)
+	brokerMock := mocks.NewBrokerMock(app.EventMessages)
+	brokerMock.SubscribeErrors = []error{fmt.Errorf("request timeout")}
+	app = NewApp(app.bcAPI, brokerMock, app.EventMessages, offsetStore, app.AppConfig)
+
+	// nothing committed yet, config offset is used
+	assert.Nil(app.connectBroker(context.Background()))
+	assert.Equal(2, brokerMock.SubscribeCalls())
+	assert.Equal(map[broker.EventType]uint64{1: 3}, brokerMock.Subscriptions())
+	// client is started once, it reconnects on its own
+	assert.Eventually(func() bool { return brokerMock.RunCalls() == 1 }, time.Second, time.Millisecond)
+
+	// resubscribed from the committed offset
+	assert.Nil(offsetStore.WriteOffset(1, 7))
+	brokerMock.SubscribeErrors = []error{fmt.Errorf("request timeout")}
+	assert.Nil(app.connectBroker(context.Background()))
+	assert.Equal(map[broker.EventType]uint64{1: 7}, brokerMock.Subscriptions())
+
+	// gives up after max attempts
+	brokerMock.SubscribeErrors = []error{fmt.Errorf("e1"), fmt.Errorf("e2"), fmt.Errorf("e3"), nil}
+	assert.EqualError(app.connectBroker(context.Background()), "e3")
+	assert.Equal(7, brokerMock.SubscribeCalls())
+
+	// closed client isn't retried
+	brokerMock.SubscribeErrors = []error{broker.ListenerClosed, nil}
+	assert.EqualError(app.connectBroker(context.Background()), broker.ListenerClosed.Error())
+	assert.Equal(8, brokerMock.SubscribeCalls())
+
+	// cancelled context stops retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.connectBroker(ctx)
+	assert.EqualError(err, context.Canceled.Error())
+	assert.Equal(8, brokerMock.SubscribeCalls())
+}
+
+func TestSubscribePersistedOffset(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-subscribe")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset.txt")
+
+	subscribe := func() uint64 {
+		app := newTestApp(node)
+		app.Broker = BrokerConfig{Topics: []TopicConfig{{ID: 1, Offset: 3}}, ConnectMaxAttempts: 1}
+		brokerMock := mocks.NewBrokerMock(app.EventMessages)
+		app = NewApp(app.bcAPI, brokerMock, app.EventMessages,
+			utils.NewJSONOffsetStore(utils.NewAtomicFile(path), 1), app.AppConfig)
+		assert.Nil(app.connectBroker(context.Background()))
+		return brokerMock.Subscriptions()[1]
+	}
+
+	// no offset file, config offset is used
+	assert.Equal(uint64(3), subscribe())
+
+	// single offset file is migrated
+	assert.Nil(utils.WriteOffset(utils.NewAtomicFile(path), 42))
+	assert.Equal(uint64(42), subscribe())
+
+	// persisted offset wins over config
+	assert.Nil(utils.NewJSONOffsetStore(utils.NewAtomicFile(path), 1).WriteOffset(1, 43))
+	assert.Equal(uint64(43), subscribe())
+}
+
+func TestSignQueryErrorCodes(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+	sign := func(body []byte) (int, ErrorCode) {
+		response := httptest.NewRecorder()
+		app.SignQuery(response, httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(body)))
+		var result struct {
+			Code ErrorCode `json:"code"`
+		}
+		assert.Nil(json.Unmarshal(response.Body.Bytes(), &result))
+		return response.Code, result.Code
+	}
+	assertCode := func(body []byte, expectedStatus int, expectedCode ErrorCode) {
+		status, code := sign(body)
+		assert.Equal(expectedStatus, status)
+		assert.Equal(expectedCode, code)
+	}
+
+	assertCode([]byte(`{"expiration":`), http.StatusBadRequest, ErrorCodeDeserializeFailed)
+	assertCode([]byte(`{"signatures": []}`), http.StatusBadRequest, ErrorCodeInvalidTransaction)
+
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3050003, "assertion failure")
+	})
+	assertCode(deposit, http.StatusBadRequest, ErrorCodeChainRejected)
+
+	// connection error means the request wasn't bad and can be retried
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		conn, _, err := writer.(http.Hijacker).Hijack()
+		assert.NoError(err)
+		conn.Close()
+	})
+	response := httptest.NewRecorder()
+	app.SignQuery(response, httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(deposit)))
+	assert.Equal(http.StatusServiceUnavailable, response.Code)
+	assert.Equal("5", response.Header().Get("Retry-After"))
+	assert.Contains(response.Body.String(), `"code":"CHAIN_UNAVAILABLE"`)
+
+	app.bcAPI.SetSigner(eos.NewKeyBag())
+	assertCode(deposit, http.StatusInternalServerError, ErrorCodeSignFailed)
+}
+
+func TestMultipleTopics(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Broker = BrokerConfig{Topics: []TopicConfig{{ID: 1, Offset: 5}, {ID: 2}}, ConnectMaxAttempts: 1}
+	brokerMock := mocks.NewBrokerMock(app.EventMessages)
+	app = NewApp(app.bcAPI, brokerMock, app.EventMessages, utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 1),
+		app.AppConfig)
+
+	assert.Nil(app.connectBroker(context.Background()))
+	assert.Equal(map[broker.EventType]uint64{1: 5, 2: 0}, brokerMock.Subscriptions())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	topicEvent := func(topic broker.EventType, offset, requestID uint64) *broker.Event {
+		event := newTestEvent(offset, requestID)
+		event.EventType = topic
+		return event
+	}
+	app.EventMessages <- &broker.EventMessage{Offset: 5, Events: []*broker.Event{topicEvent(1, 5, 1)}}
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{topicEvent(2, 0, 2), topicEvent(2, 1, 3)}}
+	// not subscribed topic is skipped
+	app.EventMessages <- &broker.EventMessage{Offset: 9, Events: []*broker.Event{topicEvent(3, 9, 4)}}
+
+	assert.Eventually(func() bool {
+		first, _ := app.OffsetStore.ReadOffset(1)
+		second, _ := app.OffsetStore.ReadOffset(2)
+		return first == 6 && second == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+
+	steps := app.shutdownSteps(func(ctx context.Context) error { return nil }, cancel)
+	assert.Nil(steps[1].run(context.Background()))
+	assert.Equal([]broker.EventType{1, 2}, brokerMock.Unsubscriptions())
+
+	cfg := &Config{}
+	cfg.Broker.TopicID = 1
+	assert.Equal([]broker.EventType{1}, topicIDs(cfg))
+	cfg.Broker.TopicIDs = []broker.EventType{1, 2}
+	assert.Equal([]broker.EventType{1, 2}, topicIDs(cfg))
+}
+
+func TestConfirmation(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var m sync.Mutex
+	statuses := []map[string]interface{}{nil, {"block_num": 9, "last_irreversible_block": 8}}
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		status := map[string]interface{}{"block_num": 9, "last_irreversible_block": 9}
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		if status == nil {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3040011, "Transaction not found")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusOK, status)
+	})
+	app := newTestApp(node)
+	app.Confirmation = ConfirmationConfig{Enabled: true, PollInterval: time.Millisecond, Timeout: time.Second}
+	app.Inclusion = InclusionConfig{Enabled: true, Delay: time.Millisecond}
+
+	// not found, then reversible, then irreversible
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(3, node.Calls(mocks.GetTransactionPath))
+	// confirmed trx doesn't get inclusion check
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(3, node.Calls(mocks.GetTransactionPath))
+
+	// never confirmed trx fails the event
+	m.Lock()
+	statuses = []map[string]interface{}{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil}
+	m.Unlock()
+	app.Confirmation.Timeout = 5 * time.Millisecond
+	notConfirmed := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonNotConfirmed))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(notConfirmed+1, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonNotConfirmed)))
+
+	// other chain error isn't taken for pending trx
+	node.Handle(mocks.GetTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusNotFound, 3110003, "Missing History API Plugin")
+	})
+	app.Confirmation.Timeout = time.Second
+	calls := node.Calls(mocks.GetTransactionPath)
+	confirmation := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonConfirmation))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(calls+1, node.Calls(mocks.GetTransactionPath))
+	assert.Equal(confirmation+1, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonConfirmation)))
+	assert.Equal(notConfirmed+1, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonNotConfirmed)))
+}
+
+func TestStatusQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Broker.Topics = []TopicConfig{{ID: 0, Offset: 4}, {ID: 1, Offset: 2}}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	app.started = time.Now().Add(-time.Minute)
+
+	assert.Nil(app.OffsetStore.WriteOffset(0, 7))
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(0, 1)))
+	badDigest := newTestEvent(1, 2)
+	badDigest.Data = []byte(`{"digest":"zz"}`)
+	assert.Nil(app.handleEvent(context.Background(), badDigest))
+
+	response := httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	var body struct {
+		Offsets         map[string]uint64 `json:"offsets"`
+		CasinoAccount   string            `json:"casino_account"`
+		UptimeSeconds   int64             `json:"uptime_seconds"`
+		ProcessedEvents uint64            `json:"processed_events"`
+		FailedEvents    uint64            `json:"failed_events"`
+	}
+	assert.Nil(json.Unmarshal(response.Body.Bytes(), &body))
+	// topic without committed offset reports its start offset
+	assert.Equal(map[string]uint64{"0": 7, "1": 2}, body.Offsets)
+	assert.Equal(casinoAccName, body.CasinoAccount)
+	assert.True(body.UptimeSeconds >= 60)
+	assert.Equal(uint64(2), body.ProcessedEvents)
+	assert.Equal(uint64(1), body.FailedEvents)
+}
+
+func TestStatusChainInfo(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	var head uint32 = 10
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"chain_id":                    mocks.NodeChainID,
+			"head_block_num":              atomic.LoadUint32(&head),
+			"last_irreversible_block_num": 8,
+			"last_irreversible_block_id":  mocks.NodeBlockID,
+			"head_block_id":               mocks.NodeBlockID,
+			"head_block_time":             "2020-03-25T17:41:38",
+		})
+	})
+	type chainStatus struct {
+		HeadBlockNum             *uint32 `json:"head_block_num"`
+		LastIrreversibleBlockNum uint32  `json:"last_irreversible_block_num"`
+		ChainID                  string  `json:"chain_id"`
+		ChainStalled             bool    `json:"chain_stalled"`
+		ChainError               string  `json:"chain_error"`
+	}
+	status := func() chainStatus {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/status", nil))
+		assert.Equal(http.StatusOK, response.Code)
+		var body chainStatus
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		return body
+	}
+
+	body := status()
+	if assert.NotNil(body.HeadBlockNum) {
+		assert.Equal(uint32(10), *body.HeadBlockNum)
+	}
+	assert.Equal(uint32(8), body.LastIrreversibleBlockNum)
+	assert.Equal(mocks.NodeChainID, body.ChainID)
+	assert.False(body.ChainStalled)
+	// info is cached
+	status()
+	assert.Equal(1, node.Calls(mocks.GetInfoPath))
+
+	// head isn't advancing
+	app.invalidateChainState()
+	app.headBlockChanged = time.Now().Add(-ChainStallTimeout)
+	assert.True(status().ChainStalled)
+	assert.Equal(2, node.Calls(mocks.GetInfoPath))
+
+	atomic.StoreUint32(&head, 11)
+	app.invalidateChainState()
+	body = status()
+	assert.Equal(uint32(11), *body.HeadBlockNum)
+	assert.False(body.ChainStalled)
+
+	// status is reported when node is down
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 0, "node is down")
+	})
+	app.invalidateChainState()
+	body = status()
+	assert.Nil(body.HeadBlockNum)
+	assert.NotEmpty(body.ChainError)
+}
+
+func TestMalformedEvents(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-malformed")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	app := newTestApp(node)
+	app.Processor.MalformedEventsPath = filepath.Join(dir, "malformed.log")
+	malformed := testutil.ToFloat64(metrics.MalformedEvents)
+
+	invalidJSON := newTestEvent(1, 2)
+	invalidJSON.Data = []byte(`{"digest":`)
+	emptyDigest := newTestEvent(2, 3)
+	emptyDigest.Data = []byte(`{}`)
+	assert.Nil(app.processEvent(context.Background(), invalidJSON))
+	assert.Nil(app.processEvent(context.Background(), emptyDigest))
+	assert.Equal(malformed+2, testutil.ToFloat64(metrics.MalformedEvents))
+	assert.Empty(node.Calls(mocks.PushTransactionPath))
+
+	content, err := ioutil.ReadFile(app.Processor.MalformedEventsPath)
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(lines, 2) {
+		var record malformedEventRecord
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &record))
+		assert.Equal(uint64(1), record.Offset)
+		assert.Equal(uint64(2), record.RequestID)
+		assert.Equal(`{"digest":`, record.Data)
+		assert.NotEmpty(record.Reason)
+		assert.NoError(json.Unmarshal([]byte(lines[1]), &record))
+		assert.Equal(uint64(3), record.RequestID)
+		assert.Equal("digest is empty", record.Reason)
+	}
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-dlq")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	var failing int32 = 1
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	app.DLQ.Path = filepath.Join(dir, "dlq.jsonl")
+	router := app.GetRouter()
+	query := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	// the same event failed again isn't duplicated
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	records, err := app.DeadLetters()
+	assert.NoError(err)
+	if assert.Len(records, 2) {
+		assert.Equal("0-1-2", records[0].ID)
+		assert.Equal(uint64(2), records[0].Event.RequestID)
+		assert.Contains(records[0].Reason, "failed to send signidice_part_2 trx")
+		assert.False(records[0].Time.IsZero())
+		assert.Equal("0-2-3", records[1].ID)
+	}
+
+	assert.Equal(http.StatusUnauthorized, query("GET", "/dead_letters", "", "").Code)
+	response := query("GET", "/dead_letters", "Bearer secret", "")
+	assert.Equal(http.StatusOK, response.Code)
+	var listed struct {
+		Records []*DeadLetterRecord `json:"records"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &listed))
+	assert.Len(listed.Records, 2)
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Equal(http.StatusUnauthorized, query("POST", "/dead_letters/replay", "", `{"ids":["0-2-3"]}`).Code)
+	response = query("POST", "/dead_letters/replay", "Bearer secret", `{"ids":["0-2-3"]}`)
+	assert.Equal(http.StatusOK, response.Code)
+	var replayed struct {
+		Result DLQReplayResult `json:"result"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &replayed))
+	assert.Equal([]string{"0-2-3"}, replayed.Result.Succeeded)
+	assert.Empty(replayed.Result.Failed)
+	assert.Equal([]string{mocks.NodeTrxID}, replayed.Result.TxIDs)
+
+	records, err = app.DeadLetters()
+	assert.NoError(err)
+	if assert.Len(records, 1) {
+		assert.Equal("0-1-2", records[0].ID)
+	}
+
+	// queue is full
+	app.DLQ.MaxSize = 1
+	atomic.StoreInt32(&failing, 1)
+	assert.False(app.queueDeadLetter(newTestEvent(3, 4), "test"))
+	records, err = app.DeadLetters()
+	assert.NoError(err)
+	assert.Len(records, 1)
+
+	// replay everything left
+	atomic.StoreInt32(&failing, 0)
+	result, err := app.ReplayDeadLetters(context.Background(), nil)
+	assert.NoError(err)
+	assert.Equal([]string{"0-1-2"}, result.Succeeded)
+	records, err = app.DeadLetters()
+	assert.NoError(err)
+	assert.Empty(records)
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, zerolog.InfoLevel, LogFormatJSON)
+	assert.NoError(err)
+	logger.Debug().Msg("debug message")
+	logger.Info().Msg("info message")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(lines, 1) {
+		var entry map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal("info", entry["level"])
+		assert.Equal("info message", entry["message"])
+	}
+
+	buf.Reset()
+	logger, err = NewLogger(&buf, zerolog.DebugLevel, LogFormatConsole)
+	assert.NoError(err)
+	logger.Debug().Msg("debug message")
+	assert.Contains(buf.String(), "debug message")
+
+	_, err = NewLogger(&buf, zerolog.InfoLevel, "xml")
+	assert.EqualError(err, "unknown log format: xml")
+
+	level, err := ParseLogLevel("WARNING")
+	assert.NoError(err)
+	assert.Equal(zerolog.WarnLevel, level)
+	_, err = ParseLogLevel("verbose")
+	assert.EqualError(err, "unknown log level: verbose")
+}
+
+type recordingOffsetStore struct {
+	utils.OffsetStore
+	m      sync.Mutex
+	writes []uint64
+}
+
+func (s *recordingOffsetStore) WriteOffset(topic broker.EventType, offset uint64) error {
+	s.m.Lock()
+	s.writes = append(s.writes, offset)
+	s.m.Unlock()
+	return s.OffsetStore.WriteOffset(topic, offset)
+}
+
+func (s *recordingOffsetStore) Writes() []uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]uint64(nil), s.writes...)
+}
+
+func TestOffsetNeverRegresses(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	store := &recordingOffsetStore{OffsetStore: app.OffsetStore}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, store, app.AppConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	// message redelivered after reconnect arrives after the newer one
+	for i, offset := range []uint64{5, 3, 7} {
+		app.EventMessages <- &broker.EventMessage{Offset: offset, Events: []*broker.Event{newTestEvent(offset, uint64(i))}}
+		assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == i+1 }, time.Second, time.Millisecond)
+	}
+	assert.Eventually(func() bool {
+		offset, err := store.ReadOffset(0)
+		return err == nil && offset == 8
+	}, time.Second, time.Millisecond)
+	assert.Equal([]uint64{6, 8}, store.Writes())
+
+	// standby shadow offset doesn't go backwards either
+	atomic.StoreInt32(&app.standby, 1)
+	app.EventMessages <- &broker.EventMessage{Offset: 10, Events: []*broker.Event{newTestEvent(10, 3)}}
+	app.EventMessages <- &broker.EventMessage{Offset: 9, Events: []*broker.Event{newTestEvent(9, 4)}}
+	assert.Eventually(func() bool { return app.ShadowOffset(0) == 11 }, time.Second, time.Millisecond)
+	app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(1, 5)}}
+	assert.Equal(uint64(11), app.ShadowOffset(0))
+}
+
+func TestSignQueryRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	sign := func(router http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/sign_transaction", strings.NewReader(`{"signatures": []}`))
+		req.RemoteAddr = remoteAddr
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+
+	app := newTestApp(node)
+	app.RateLimit = RateLimitConfig{RPS: 0.001, Burst: 2}
+	router := app.GetRouter()
+	assert.Equal(http.StatusBadRequest, sign(router, "10.0.0.1:1000").Code)
+	assert.Equal(http.StatusBadRequest, sign(router, "10.0.0.2:1000").Code)
+	response := sign(router, "10.0.0.3:1000")
+	assert.Equal(http.StatusTooManyRequests, response.Code)
+	assert.Equal(`{"code":"RATE_LIMITED","error":"too many requests"}`, response.Body.String())
+
+	app.RateLimit = RateLimitConfig{PerIPRPS: 0.001, PerIPBurst: 1, MaxClients: 10}
+	router = app.GetRouter()
+	assert.Equal(http.StatusBadRequest, sign(router, "10.0.0.1:1000").Code)
+	// port doesn't matter
+	assert.Equal(http.StatusTooManyRequests, sign(router, "10.0.0.1:2000").Code)
+	assert.Equal(http.StatusBadRequest, sign(router, "10.0.0.2:1000").Code)
+
+	// every trx of a batch is counted and the limit is shared with /sign_transaction
+	signBatch := func(router http.Handler, size int) *httptest.ResponseRecorder {
+		batch := "[" + strings.TrimSuffix(strings.Repeat(`{"signatures": []},`, size), ",") + "]"
+		req := httptest.NewRequest("POST", "/sign_transactions", strings.NewReader(batch))
+		req.RemoteAddr = "10.0.0.1:1000"
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	app.RateLimit = RateLimitConfig{RPS: 0.001, Burst: 3}
+	router = app.GetRouter()
+	assert.Equal(http.StatusOK, signBatch(router, 2).Code)
+	assert.Equal(http.StatusBadRequest, sign(router, "10.0.0.1:1000").Code)
+	assert.Equal(http.StatusTooManyRequests, signBatch(router, 1).Code)
+	assert.Equal(http.StatusTooManyRequests, sign(router, "10.0.0.1:1000").Code)
+
+	app.RateLimit = RateLimitConfig{PerIPRPS: 0.001, PerIPBurst: 2, MaxClients: 10}
+	router = app.GetRouter()
+	assert.Equal(http.StatusOK, signBatch(router, 2).Code)
+	assert.Equal(http.StatusTooManyRequests, signBatch(router, 1).Code)
+
+	// unauthenticated requests don't take tokens of the clients
+	app.RateLimit = RateLimitConfig{RPS: 0.001, Burst: 1}
+	app.Auth.Token = "secret"
+	router = app.GetRouter()
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusUnauthorized, sign(router, "10.0.0.9:1000").Code)
+	}
+	req := httptest.NewRequest("POST", "/sign_transaction", strings.NewReader(`{"signatures": []}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	// other endpoints aren't limited
+	for i := 0; i < 3; i++ {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest("GET", "/ping", nil))
+		assert.Equal(http.StatusOK, response.Code)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	get := func(router http.Handler, path, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	paths := []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap", "/debug/pprof/cmdline"}
+
+	// disabled by default
+	router := app.GetRouter()
+	for _, path := range paths {
+		assert.Equal(http.StatusNotFound, get(router, path, "Bearer secret").Code, path)
+	}
+
+	app.Pprof = true
+	router = app.GetRouter()
+	for _, path := range paths {
+		assert.Equal(http.StatusUnauthorized, get(router, path, "").Code, path)
+		assert.Equal(http.StatusOK, get(router, path, "Bearer secret").Code, path)
+	}
+	assert.Contains(get(router, "/debug/pprof/goroutine?debug=1", "Bearer secret").Body.String(), "goroutine profile")
+	assert.Equal(http.StatusNotFound, get(router, "/debug/pprof/unknown", "Bearer secret").Code)
+}
+
+func TestSignQueryIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Idempotency = IdempotencyConfig{TTL: time.Minute, MaxKeys: 10}
+	router := app.GetRouter()
+	sign := func(key string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+
+	first := sign("key-1", deposit)
+	assert.Equal(http.StatusOK, first.Code, first.Body.String())
+	assert.Empty(first.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	// retry gets the cached result without pushing
+	retry := sign("key-1", deposit)
+	assert.Equal(http.StatusOK, retry.Code)
+	assert.Equal(first.Body.String(), retry.Body.String())
+	assert.Equal("true", retry.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	// another key is a new request
+	other := sign("key-2", deposit)
+	assert.Equal(http.StatusOK, other.Code)
+	assert.Empty(other.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	// key can't be reused with another trx
+	reused := sign("key-1", []byte(`{"signatures": []}`))
+	assert.Equal(http.StatusUnprocessableEntity, reused.Code)
+	assert.Contains(reused.Body.String(), `"code":"IDEMPOTENCY_KEY_REUSED"`)
+
+	// requests without key aren't cached
+	assert.Equal(http.StatusOK, sign("", deposit).Code)
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+
+	// batch is cached too
+	signBatch := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/sign_transactions",
+			bytes.NewReader([]byte("["+string(deposit)+"]")))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		return response
+	}
+	first = signBatch("batch-1")
+	assert.Equal(http.StatusOK, first.Code, first.Body.String())
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+	retry = signBatch("batch-1")
+	assert.Equal(first.Body.String(), retry.Body.String())
+	assert.Equal("true", retry.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestSigningCap(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	dir, err := ioutil.TempDir("", "casino-signing-cap")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signing_cap.json")
+
+	now := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	newCap := func() *signingCap {
+		signCap := newSigningCap(SigningCapConfig{MaxPerAccount: 2, Window: 24 * time.Hour})
+		signCap.now = clock
+		assert.NoError(signCap.load(utils.NewAtomicFile(path)))
+		return signCap
+	}
+	app.signingCap = newCap()
+	router := app.GetRouter()
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+	sign := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(deposit)))
+		return response
+	}
+
+	assert.Equal(http.StatusOK, sign().Code)
+	assert.Equal(http.StatusOK, sign().Code)
+	capped := sign()
+	assert.Equal(http.StatusTooManyRequests, capped.Code)
+	assert.Contains(capped.Body.String(), `"code":"SIGNING_CAP_EXCEEDED"`)
+	assert.Contains(capped.Body.String(), "2020-05-02T00:00:00Z")
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	// counts survive restart
+	app.signingCap = newCap()
+	assert.Equal(http.StatusTooManyRequests, sign().Code)
+
+	// invalid trx isn't counted
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader([]byte(`{}`))))
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	// cap resets on the window boundary
+	now = now.Add(time.Hour)
+	assert.Equal(http.StatusOK, sign().Code)
+	assert.Equal(http.StatusOK, sign().Code)
+	assert.Equal(http.StatusTooManyRequests, sign().Code)
+	assert.Equal(4, node.Calls(mocks.PushTransactionPath))
+
+	// other casino accounts have their own counts
+	assert.False(app.signingCap.take(app.BlockChain.CasinoAccountName))
+	assert.True(app.signingCap.take("othercasino"))
+}
+
+// writeTestCert writes self-signed localhost cert and its key to dir
+func writeTestCert(dir string) (certFile, keyFile string, cert *x509.Certificate, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		return
+	}
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	return
+}
+
+func TestServeTLS(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, cert, err := writeTestCert(dir)
+	assert.NoError(err)
+
+	app := newTestApp(node)
+	app.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	app.Server.HTTP2 = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go app.Serve(listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/ping")
+	if assert.NoError(err) {
+		defer response.Body.Close()
+		assert.Equal(http.StatusOK, response.StatusCode)
+		assert.Equal(2, response.ProtoMajor)
+		if assert.NotNil(response.TLS) {
+			assert.True(response.TLS.HandshakeComplete)
+			assert.True(response.TLS.Version >= tls.VersionTLS12)
+		}
+	}
+
+	// plain HTTP isn't served
+	plainClient := &http.Client{Timeout: time.Second}
+	if response, err := plainClient.Get("http://" + listener.Addr().String() + "/ping"); err == nil {
+		response.Body.Close()
+		assert.NotEqual(http.StatusOK, response.StatusCode)
+	}
+
+	app.TLS.KeyFile = filepath.Join(dir, "missing.key")
+	brokenListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	assert.Error(app.Serve(brokenListener))
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Server = ServerConfig{ReadTimeout: 200 * time.Millisecond}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	served := make(chan error, 1)
+	go func() { served <- app.Serve(listener) }()
+
+	// slow client never finishes its request
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /sign_transaction HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n{"))
+	assert.NoError(err)
+	assert.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(err, "connection should be closed by the server")
+	assert.True(time.Since(start) < 3*time.Second)
+
+	// requests in time are served
+	response, err := http.Get("http://" + listener.Addr().String() + "/ping")
+	if assert.NoError(err) {
+		response.Body.Close()
+		assert.Equal(http.StatusOK, response.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(app.stopHTTP(ctx))
+	assert.NoError(<-served)
+}
+
+func TestTrxExpiration(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var m sync.Mutex
+	var expirations []time.Time
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		assert.NoError(err)
+		m.Lock()
+		expirations = append(expirations, tx.Expiration.Time)
+		m.Unlock()
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.TrxExpiration = 10 * time.Minute
+
+	start := time.Now().UTC()
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	app.Nonce.Enabled = true
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	app.Nonce.Enabled = false
+	app.Batch.Enabled = true
+	assert.NotNil(app.processBatch(context.Background(), []*broker.Event{newTestEvent(3, 4)})[0])
+
+	m.Lock()
+	defer m.Unlock()
+	if assert.Len(expirations, 3) {
+		for _, expiration := range expirations {
+			// expiration has seconds precision
+			assert.WithinDuration(start.Add(10*time.Minute), expiration, 2*time.Second)
+		}
+	}
+
+	cfg, _ := MakeTestConfig()
+	cfg.TrxExpiration = 2 * time.Hour
+	assert.EqualError(cfg.Validate(), "trx expiration should be from 0 to 1h0m0s")
+}
+
+func TestVersionQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	defer func(version, commit, buildTime string) {
+		Version, GitCommit, BuildTime = version, commit, buildTime
+	}(Version, GitCommit, BuildTime)
+	Version, GitCommit, BuildTime = "v1.2.3", "0123abcd", "2020-01-02T03:04:05Z"
+
+	response := httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.JSONEq(`{"version":"v1.2.3","git_commit":"0123abcd","build_time":"2020-01-02T03:04:05Z"}`, response.Body.String())
+}
+
+func TestCheckRsaKeyPair(t *testing.T) {
+	assert := assert.New(t)
+	cfg, _ := MakeTestConfig()
+	assert.NoError(CheckRsaKeyPair(cfg.BlockChain.RSAKey, cfg.BlockChain.RSAPubKey, crypto.SHA256))
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	err = CheckRsaKeyPair(other, cfg.BlockChain.RSAPubKey, crypto.SHA256)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "RSA key doesn't match RSA public key")
+	}
+}
+
+func TestEventResults(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			assert := assert.New(t)
+			node := mocks.NewNodeMock()
+			defer node.Close()
+			app := newTestApp(node)
+			app.Batch = BatchConfig{Enabled: batch, FailurePolicy: BatchDropFailed}
+			var m sync.Mutex
+			results := make(map[uint64]*string)
+			app.EventResultHook = func(result EventResult) {
+				m.Lock()
+				defer m.Unlock()
+				results[result.Event.RequestID] = result.TxID
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go app.RunEventProcessor(ctx)
+			malformed := newTestEvent(1, 2)
+			malformed.Data = []byte(`{"digest":"zz"}`)
+			app.EventMessages <- &broker.EventMessage{Offset: 1, Events: []*broker.Event{newTestEvent(0, 1), malformed}}
+
+			assert.Eventually(func() bool {
+				m.Lock()
+				defer m.Unlock()
+				return len(results) == 2
+			}, time.Second, time.Millisecond)
+			m.Lock()
+			defer m.Unlock()
+			if assert.NotNil(results[1]) {
+				assert.Equal(mocks.NodeTrxID, *results[1])
+			}
+			assert.Nil(results[2])
+			// malformed event is dead-lettered, so offset is committed past it
+			assert.Eventually(func() bool {
+				offset, err := app.OffsetStore.ReadOffset(0)
+				return err == nil && offset == 2
+			}, time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestPushRetryRefreshesChainState(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var failures int32 = 2
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.Push = PushConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+	// every attempt is built on fresh chain state, not on the cached one
+	assert.Equal(3, node.Calls(mocks.GetInfoPath))
+
+	// trx which can't be built isn't pushed
+	node.Handle(mocks.GetInfoPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3010000, "node is down")
+	})
+	app.invalidateChainState()
+	chainStateFailures := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonChainState))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(chainStateFailures+1, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonChainState)))
+
+	// queued to DLQ, so it doesn't hold back offset
+	dir, err := ioutil.TempDir("", "casino-chain-state-dlq")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	app.DLQ.Path = filepath.Join(dir, "dlq.jsonl")
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	records, err := app.readDeadLetters()
+	assert.NoError(err)
+	if assert.Len(records, 1) {
+		assert.Equal(uint64(3), records[0].Event.RequestID)
+		assert.Contains(records[0].Reason, "failed to get blockchain state")
+	}
+}
+
+func TestReadEosKeyPrefersFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-eos-key")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deposit.wif")
+	assert.NoError(ioutil.WriteFile(path, []byte(depositPk+"\n"), 0600))
+
+	key, err := readEosKey("deposit key", signiDicePk, "")
+	assert.NoError(err)
+	assert.Equal(signiDicePk, key)
+
+	key, err = readEosKey("deposit key", signiDicePk, path)
+	assert.NoError(err)
+	assert.Equal(depositPk, key)
+
+	_, err = readEosKey("deposit key", "", filepath.Join(dir, "missing.wif"))
+	assert.Error(err)
+
+	assert.NoError(ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = readEosKey("deposit key", "", path)
+	assert.Error(err)
+}
+
+func TestReadRsaKeyPrefersFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-rsa")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	fileKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	envKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	encode := func(key *rsa.PrivateKey) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	}
+	path := filepath.Join(dir, "rsa.pem")
+	assert.NoError(ioutil.WriteFile(path, encode(fileKey), 0600))
+
+	cfg := &Config{}
+	cfg.BlockChain.RSAKey = base64.StdEncoding.EncodeToString(encode(envKey))
+	key, err := readRsaKey(cfg, nil)
+	assert.NoError(err)
+	assert.Equal(envKey.D, key.D)
+
+	cfg.BlockChain.RSAKeyFile = path
+	key, err = readRsaKey(cfg, nil)
+	assert.NoError(err)
+	assert.Equal(fileKey.D, key.D)
+
+	cfg.BlockChain.RSAKeyFile = filepath.Join(dir, "missing.pem")
+	_, err = readRsaKey(cfg, nil)
+	assert.Error(err)
+
+	// encrypted key file with passphrase file, trailing newline isn't a part of the passphrase
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(fileKey),
+		[]byte("secret"), x509.PEMCipherAES256)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600))
+	passphrasePath := filepath.Join(dir, "passphrase")
+	assert.NoError(ioutil.WriteFile(passphrasePath, []byte("secret\n"), 0600))
+	cfg.BlockChain.RSAKeyFile = path
+	cfg.BlockChain.RSAKeyPassphrase = "ignored"
+	cfg.BlockChain.RSAKeyPassphraseFile = passphrasePath
+	passphrase, err := readRsaPassphrase(cfg)
+	assert.NoError(err)
+	assert.Equal([]byte("secret"), passphrase)
+	key, err = readRsaKey(cfg, passphrase)
+	assert.NoError(err)
+	assert.Equal(fileKey.D, key.D)
+
+	cfg.BlockChain.RSAKeyPassphraseFile = ""
+	passphrase, err = readRsaPassphrase(cfg)
+	assert.NoError(err)
+	_, err = readRsaKey(cfg, passphrase)
+	assert.Error(err)
+}
+
+func TestDigestSigner(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var m sync.Mutex
+	var signatures []string
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		assert.NoError(err)
+		var signidice Signidice
+		assert.NoError(eos.UnmarshalBinary(tx.Actions[0].HexData, &signidice))
+		m.Lock()
+		signatures = append(signatures, signidice.Signature)
+		m.Unlock()
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	signer := &mocks.DigestSignerMock{Signature: "remotesig"}
+	app.DigestSigner = signer
+
+	event := newTestEvent(0, 1)
+	assert.NotNil(app.processEvent(context.Background(), event))
+	digest, err := app.parseDigest(event)
+	assert.NoError(err)
+	assert.Equal([]eos.Checksum256{digest}, signer.Digests())
+	m.Lock()
+	assert.Equal([]string{"remotesig"}, signatures)
+	m.Unlock()
+
+	signer.Err = fmt.Errorf("HSM is unavailable")
+	rsaFailures := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonRsaSign))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(rsaFailures+1, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonRsaSign)))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+
+	// default signer uses the local RSA key
+	local := LocalRsaSigner{Key: newTestApp(node).rsaKey, Hash: crypto.SHA256}
+	signature, err := local.Sign(digest)
+	assert.NoError(err)
+	assert.NoError(utils.RsaVerify(digest, signature, &local.Key().PublicKey, crypto.SHA256))
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.MaxRequestBodySize = 64
+	app.DLQ.Path = filepath.Join(os.TempDir(), "casino-body-size-dlq.jsonl")
+	router := app.GetRouter()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return response
+	}
+	oversized := `{"signatures": [], "context_free_data": [], "actions": [], "expiration": "2020-01-01T00:00:00"}`
+
+	for _, path := range []string{"/sign_transaction", "/sign_transactions", "/replay", "/dead_letters/replay"} {
+		response := post(path, oversized)
+		assert.Equal(http.StatusRequestEntityTooLarge, response.Code, path)
+		assert.Equal(`{"code":"REQUEST_TOO_LARGE","error":"request body exceeds 64 bytes"}`, response.Body.String())
+	}
+	// body within the limit is processed as usual
+	assert.Equal(http.StatusBadRequest, post("/sign_transaction", `{"signatures": []}`).Code)
+	assert.Equal(http.StatusBadRequest, post("/sign_transactions", `[]`).Code)
+}
+
+func TestPushErrorCategories(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		status   int
+		eosCode  int
+		category string
+		pushes   int
+		success  bool
+	}{
+		{http.StatusInternalServerError, EosCPUUsageExceededErrorCode, PushErrorCPUExceeded, 3, false},
+		{http.StatusInternalServerError, EosNetUsageExceededErrorCode, PushErrorNetExceeded, 3, false},
+		{http.StatusInternalServerError, 3080006, PushErrorResource, 3, false},
+		{http.StatusInternalServerError, EosExpiredTrxErrorCode, PushErrorExpired, 3, false},
+		{http.StatusInternalServerError, EosInternalDuplicateErrorCode, PushErrorDuplicate, 1, true},
+		{http.StatusInternalServerError, 3090003, PushErrorAuth, 1, false},
+		{http.StatusInternalServerError, 3050003, PushErrorOther, 1, false},
+		{http.StatusServiceUnavailable, 0, PushErrorNetwork, 3, false},
+	}
+	for i, c := range cases {
+		node := mocks.NewNodeMock()
+		c := c
+		node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+			mocks.RespondNodeError(writer, c.status, c.eosCode, "mock error")
+		})
+		app := newTestApp(node)
+		app.Push = PushConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		errors := testutil.ToFloat64(metrics.PushErrors.WithLabelValues(c.category))
+
+		trxID := app.processEvent(context.Background(), newTestEvent(uint64(i), uint64(i+1)))
+		assert.Equal(c.success, trxID != nil, c.category)
+		assert.Equal(c.pushes, node.Calls(mocks.PushTransactionPath), c.category)
+		assert.Equal(errors+float64(c.pushes), testutil.ToFloat64(metrics.PushErrors.WithLabelValues(c.category)), c.category)
+		node.Close()
+	}
+}
+
+func TestNodeFailover(t *testing.T) {
+	assert := assert.New(t)
+	primary := mocks.NewNodeMock()
+	defer primary.Close()
+	secondary := mocks.NewNodeMock()
+	defer secondary.Close()
+	hang := func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+	primary.Handle(mocks.PushTransactionPath, hang)
+
+	appCfg, keyBag := MakeTestConfig()
+	appCfg.HTTP = HTTPConfig{RetryAmount: 1, RetryDelay: time.Millisecond, Timeout: time.Second}
+	appCfg.Nodes = NodesConfig{URLs: []string{primary.URL, secondary.URL}, Timeout: 100 * time.Millisecond}
+	bc, pool := NewFailoverAPI(appCfg.Nodes)
+	bc.SetSigner(keyBag)
+	app := NewApp(bc, new(mocks.EventListenerMock), make(chan *broker.EventMessage),
+		utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0), appCfg)
+	failovers := testutil.ToFloat64(metrics.NodeFailovers)
+
+	// timed out push is retried on the secondary node
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(1, primary.Calls(mocks.PushTransactionPath))
+	assert.Equal(1, secondary.Calls(mocks.PushTransactionPath))
+	assert.Equal(secondary.URL, pool.Current())
+	assert.Equal(failovers+1, testutil.ToFloat64(metrics.NodeFailovers))
+
+	// following calls go to the secondary node directly
+	app.invalidateChainState()
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(1, primary.Calls(mocks.PushTransactionPath))
+	assert.Equal(2, secondary.Calls(mocks.PushTransactionPath))
+
+	// recovered primary node is used again when the secondary one goes down
+	primary.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	pool.CheckHealth()
+	assert.Equal(secondary.URL, pool.Current())
+	secondary.Close()
+	pool.CheckHealth()
+	assert.Equal(primary.URL, pool.Current())
+	app.invalidateChainState()
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(2, primary.Calls(mocks.PushTransactionPath))
+
+	// down node fails over within the same call without health check
+	restored := mocks.NewNodeMock()
+	defer restored.Close()
+	pool = NewNodePool([]string{secondary.URL, restored.URL}, http.DefaultTransport, time.Second)
+	client := &http.Client{Transport: pool}
+	resp, err := client.Post(secondary.URL+mocks.GetInfoPath, "application/json", strings.NewReader("{}"))
+	assert.NoError(err)
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(1, restored.Calls(mocks.GetInfoPath))
+	assert.Equal(restored.URL, pool.Current())
+}
+
+func TestAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.Auth.Token = "secret"
+	var buf bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	logger, err := NewLogger(&buf, zerolog.InfoLevel, LogFormatJSON)
+	assert.NoError(err)
+	log.Logger = logger
+
+	request := func(method, path string) map[string]interface{} {
+		buf.Reset()
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		app.GetRouter().ServeHTTP(httptest.NewRecorder(), req)
+		var entry map[string]interface{}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.NoError(json.Unmarshal([]byte(lines[len(lines)-1]), &entry))
+		return entry
+	}
+	entry := request("GET", "/ping")
+	assert.Equal("GET", entry["method"])
+	assert.Equal("/ping", entry["path"])
+	assert.Equal(float64(http.StatusOK), entry["status"])
+	assert.Equal("10.0.0.1:1234", entry["remote"])
+	assert.Contains(entry, "duration")
+
+	entry = request("POST", "/sign_transaction")
+	assert.Equal("/sign_transaction", entry["path"])
+	assert.Equal(float64(http.StatusUnauthorized), entry["status"])
+}
+
+func TestSigniDiceLimits(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	var m sync.Mutex
+	var headers []eos.TransactionHeader
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		assert.NoError(err)
+		m.Lock()
+		headers = append(headers, tx.TransactionHeader)
+		m.Unlock()
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.SigniDiceLimits = TrxLimits{MaxCPUUsageMs: 5, MaxNetUsageWords: 1000}
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	app.Nonce.Enabled = true
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	app.Nonce.Enabled = false
+	app.Batch.Enabled = true
+	assert.NotNil(app.processBatch(context.Background(), []*broker.Event{newTestEvent(3, 4)})[0])
+	app.SigniDiceLimits = TrxLimits{}
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(4, 5)))
+
+	m.Lock()
+	defer m.Unlock()
+	if assert.Len(headers, 4) {
+		for _, header := range headers[:3] {
+			assert.Equal(uint8(5), header.MaxCPUUsageMS)
+			assert.Equal(eos.Varuint32(1000), header.MaxNetUsageWords)
+		}
+		// no limits by default
+		assert.Equal(uint8(0), headers[3].MaxCPUUsageMS)
+		assert.Equal(eos.Varuint32(0), headers[3].MaxNetUsageWords)
+	}
+}
+
+func TestSignedRequestsSurviveRestart(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-signed")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signed.json")
+
+	start := func() *App {
+		app := newTestApp(node)
+		app.signedRequests, err = utils.NewRequestStore(utils.NewAtomicFile(path), 100, time.Hour)
+		assert.NoError(err)
+		return app
+	}
+	app := start()
+	trxID := app.handleEvent(context.Background(), newTestEvent(1, 2))
+	assert.NotNil(trxID)
+	assert.Nil(app.handleEvent(context.Background(), &broker.Event{Offset: 2, Sender: "dice", RequestID: 3, Data: []byte(`{}`)}))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	assert.NoError(app.signedRequests.Close())
+
+	// redelivered event of the signed request isn't signed again after restart
+	app = start()
+	replayed := app.handleEvent(context.Background(), newTestEvent(1, 2))
+	if assert.NotNil(replayed) {
+		assert.Equal(*trxID, *replayed)
+	}
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	// failed request isn't remembered
+	assert.Equal(1, app.signedRequests.Len())
+}
+
+func TestProcessEventCancel(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	release := make(chan struct{})
+	defer close(release)
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.ChainRequestTimeout = 0
+	app.Push = PushConfig{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Second}
+	pushFailures := testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushFailed))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for node.Calls(mocks.PushTransactionPath) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	done := make(chan *string)
+	go func() { done <- app.handleEvent(ctx, newTestEvent(0, 1)) }()
+	select {
+	case trxID := <-done:
+		assert.Nil(trxID)
+	case <-time.After(time.Second):
+		t.Fatal("cancelled processEvent didn't return")
+	}
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	// cancelled event isn't failed, it's redelivered later
+	assert.Equal(pushFailures, testutil.ToFloat64(metrics.SigniDiceFailures.WithLabelValues(FailureReasonPushFailed)))
+	assert.Equal(uint64(0), atomic.LoadUint64(&app.processedEvents))
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	app := newTestApp(node)
+	app.auditLog, err = NewAuditWriter(path)
+	assert.NoError(err)
+
+	trxID := app.processEvent(context.Background(), newTestEvent(0, 1))
+	assert.NotNil(trxID)
+	app.processEvent(context.Background(), &broker.Event{Offset: 1, Sender: "dice", RequestID: 2, Data: []byte(`{`)})
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 3050003, "assertion failure")
+	})
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	// cancelled event isn't completed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(app.processEvent(ctx, newTestEvent(3, 4)))
+	assert.NoError(app.auditLog.Close())
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(lines, 3) {
+		records := make([]AuditRecord, len(lines))
+		for i, line := range lines {
+			assert.NoError(json.Unmarshal([]byte(line), &records[i]))
+		}
+		assert.Equal("dice", records[0].Sender)
+		assert.Equal(uint64(1), records[0].RequestID)
+		assert.Equal(mocks.NodeBlockID, records[0].Digest)
+		assert.Equal(*trxID, records[0].TxID)
+		assert.Equal(AuditOutcomeSigned, records[0].Outcome)
+		assert.WithinDuration(time.Now(), records[0].Time, time.Minute)
+
+		assert.Equal(uint64(2), records[1].RequestID)
+		assert.Empty(records[1].Digest)
+		assert.Equal(AuditOutcomeFailed, records[1].Outcome)
+
+		assert.Equal(uint64(3), records[2].RequestID)
+		assert.Equal(mocks.NodeBlockID, records[2].Digest)
+		assert.Empty(records[2].TxID)
+		assert.Equal(AuditOutcomeFailed, records[2].Outcome)
+	}
+}
+
+func TestSendTransaction2(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	node.Handle(mocks.SendTrx2Path, func(writer http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(json.NewDecoder(req.Body).Decode(&body))
+		assert.Equal(true, body["return_failure_trace"])
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+			"transaction_id": mocks.NodeTrxID,
+			"processed": map[string]interface{}{
+				"except": map[string]interface{}{
+					"code": 3050003, "name": "eosio_assert_message_exception", "message": "eosio_assert_message assertion failure",
+					"stack": []map[string]interface{}{{
+						"format": "assertion failure with message: ${s}",
+						"data":   map[string]interface{}{"s": "game session 1 is finished"},
+					}},
+				},
+				"action_traces": []map[string]interface{}{{"receiver": "game", "console": "session: 1"}},
+			},
+		})
+	})
+	app := newTestApp(node)
+	app.Push = PushConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, SendTransaction2: true}
+	var buf bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&buf)
+	errors := testutil.ToFloat64(metrics.PushErrors.WithLabelValues(PushErrorOther))
+
+	// failed trx is rejected by the assertion and its trace is logged
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(1, node.Calls(mocks.SendTrx2Path))
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(errors+1, testutil.ToFloat64(metrics.PushErrors.WithLabelValues(PushErrorOther)))
+	assert.Contains(buf.String(), "game console: session: 1")
+	assert.Contains(buf.String(), "assertion failure with message: game session 1 is finished")
+
+	// node without send_transaction2 falls back to push_transaction
+	node.Handle(mocks.SendTrx2Path, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusNotFound, 0, "unknown endpoint")
+	})
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(2, node.Calls(mocks.SendTrx2Path))
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestReadyQuery(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	ready := func() (int, string) {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/ready", nil))
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		return response.Code, body["status"].(string)
+	}
+
+	code, status := ready()
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("not ready", status)
+
+	app.setReady(true)
+	code, status = ready()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ready", status)
+
+	// stopping app isn't ready anymore
+	app.setReady(false)
+	code, _ = ready()
+	assert.Equal(http.StatusServiceUnavailable, code)
+}
+
+func TestDigestValidation(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	signer := &mocks.DigestSignerMock{}
+	app.DigestSigner = signer
+	malformed := testutil.ToFloat64(metrics.MalformedEvents)
+
+	emptyDigest := newTestEvent(0, 1)
+	emptyDigest.Data = []byte(`{"seed":"` + mocks.NodeBlockID + `"}`)
+	_, err := app.parseDigest(emptyDigest)
+	assert.EqualError(err, "digest is empty")
+	assert.Nil(app.processEvent(context.Background(), emptyDigest))
+
+	shortDigest := newTestEvent(1, 2)
+	shortDigest.Data = []byte(`{"digest":"` + mocks.NodeBlockID[:40] + `"}`)
+	_, err = app.parseDigest(shortDigest)
+	assert.EqualError(err, "digest should be 32 bytes, got 20")
+	assert.Nil(app.processEvent(context.Background(), shortDigest))
+
+	// malformed events are dropped before signing
+	assert.Equal(malformed+2, testutil.ToFloat64(metrics.MalformedEvents))
+	assert.Empty(signer.Digests())
+	assert.Empty(node.Calls(mocks.PushTransactionPath))
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Len(signer.Digests(), 1)
+}
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.DryRun = true
+	var buf bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&buf)
+
+	// event trx is signed and logged, but not pushed
+	trxID := app.processEvent(context.Background(), newTestEvent(0, 1))
+	if assert.NotNil(trxID) {
+		assert.Contains(buf.String(), "Dry run, skipping trx push, trxID: "+*trxID)
+	}
+	assert.Contains(buf.String(), `\"packed_trx\":`)
+
+	request, _ := http.NewRequest("POST", "/sign_transaction",
+		bytes.NewBuffer(makeDepositTransaction(app.BlockChain.ChainID)))
+	response := httptest.NewRecorder()
+	app.SignQuery(response, request)
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	var result struct {
+		TxID        string                 `json:"txid"`
+		Transaction *eos.PackedTransaction `json:"transaction"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &result))
+	if assert.NotNil(result.Transaction) {
+		id, err := result.Transaction.ID()
+		assert.NoError(err)
+		assert.Equal(id.String(), result.TxID)
+		signedTx, err := result.Transaction.Unpack()
+		assert.NoError(err)
+		signedBy, err := signedTx.SignedByKeys(app.BlockChain.ChainID)
+		assert.NoError(err)
+		assert.Contains(signedBy, app.BlockChain.EosPubKeys.Deposit)
+	}
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestEventMessagesBuffer(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	appCfg, keyBag := MakeTestConfig()
+	bc := eos.New(node.URL)
+	bc.SetSigner(keyBag)
+	app := NewApp(bc, new(mocks.EventListenerMock), make(chan *broker.EventMessage, 3),
+		utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0), appCfg)
+	assert.Equal(float64(3), testutil.ToFloat64(metrics.EventMessagesBufferSize))
+	assert.Equal(float64(0), testutil.ToFloat64(metrics.EventMessagesBuffered))
+
+	// processor isn't running, so messages pile up in the buffer
+	for i := 0; i < 3; i++ {
+		app.EventMessages <- &broker.EventMessage{Offset: uint64(i), Events: []*broker.Event{newTestEvent(uint64(i), uint64(i+1))}}
+	}
+	assert.Equal(float64(3), testutil.ToFloat64(metrics.EventMessagesBuffered))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.RunEventProcessor(ctx)
+	assert.Eventually(func() bool { return testutil.ToFloat64(metrics.EventMessagesBuffered) == 0 }, time.Second, time.Millisecond)
+	assert.Eventually(func() bool { return node.Calls(mocks.PushTransactionPath) == 3 }, time.Second, time.Millisecond)
+	cancel()
+	app.inFlight.Wait()
+}
+
+func TestDigestHash(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	appCfg, keyBag := MakeTestConfig()
+	appCfg.HTTP = HTTPConfig{RetryAmount: 1, RetryDelay: time.Millisecond, Timeout: time.Second}
+	appCfg.BlockChain.DigestHash = crypto.SHA512
+	bc := eos.New(node.URL)
+	bc.SetSigner(keyBag)
+	app := NewApp(bc, new(mocks.EventListenerMock), make(chan *broker.EventMessage),
+		utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0), appCfg)
+	assert.NoError(CheckRsaKeyPair(appCfg.BlockChain.RSAKey, appCfg.BlockChain.RSAPubKey, crypto.SHA512))
+
+	// sha256 digest doesn't match configured hash
+	_, err := app.parseDigest(newTestEvent(0, 1))
+	assert.EqualError(err, "digest should be 64 bytes, got 32")
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+
+	digest := sha512.Sum512([]byte("seed"))
+	event := newTestEvent(1, 2)
+	event.Data = []byte(`{"digest":"` + hex.EncodeToString(digest[:]) + `"}`)
+	assert.NotNil(app.processEvent(context.Background(), event))
+	signature, err := app.DigestSigner.Sign(digest[:])
+	assert.NoError(err)
+	assert.NoError(utils.RsaVerify(digest[:], signature, appCfg.BlockChain.RSAPubKey, crypto.SHA512))
+}
+
+func TestIdleResubscribe(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	brokerMock := mocks.NewBrokerMock(app.EventMessages)
+	app = NewApp(app.bcAPI, brokerMock, app.EventMessages, utils.NewJSONOffsetStore(&mocks.SafeBuffer{}, 0),
+		app.AppConfig)
+	status := func() map[string]interface{} {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/status", nil))
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		return body
+	}
+	assert.Nil(app.connectBroker(context.Background()))
+	assert.Nil(status()["last_event_time"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processorDone := make(chan struct{})
+	go func() {
+		app.RunEventProcessor(ctx)
+		close(processorDone)
+	}()
+	app.EventMessages <- &broker.EventMessage{Offset: 0, Events: []*broker.Event{newTestEvent(0, 1)}}
+	assert.Eventually(func() bool { offset, _ := app.OffsetStore.ReadOffset(0); return offset == 1 },
+		time.Second, time.Millisecond)
+	lastEvent, err := time.Parse(time.RFC3339Nano, status()["last_event_time"].(string))
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), lastEvent, time.Second)
+
+	// broker stopped delivering events, so topic is re-subscribed from the committed offset
+	resubscribes := testutil.ToFloat64(metrics.BrokerResubscribes)
+	go app.RunSubscriptionWatchdog(ctx, 50*time.Millisecond)
+	assert.Eventually(func() bool { return len(brokerMock.Unsubscriptions()) > 0 }, time.Second, time.Millisecond)
+	assert.Equal([]broker.EventType{0}, brokerMock.Unsubscriptions()[:1])
+	assert.Equal(map[broker.EventType]uint64{0: 1}, brokerMock.Subscriptions())
+	assert.True(testutil.ToFloat64(metrics.BrokerResubscribes) > resubscribes)
+	cancel()
+	<-processorDone
+	app.inFlight.Wait()
+}
+
+func TestCompressedEventData(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	plain := []byte(`{"digest":"` + mocks.NodeBlockID + `"}`)
+
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	_, _ = gzipWriter.Write(plain)
+	assert.NoError(gzipWriter.Close())
+	zlibbed := &bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(zlibbed)
+	_, _ = zlibWriter.Write(plain)
+	assert.NoError(zlibWriter.Close())
+
+	for name, data := range map[string][]byte{
+		"plain":       plain,
+		"gzip":        gzipped.Bytes(),
+		"zlib":        zlibbed.Bytes(),
+		"gzip base64": []byte(`"` + base64.StdEncoding.EncodeToString(gzipped.Bytes()) + `"`),
+		"zlib base64": []byte(`"` + base64.StdEncoding.EncodeToString(zlibbed.Bytes()) + `"`),
+	} {
+		event := newTestEvent(0, 1)
+		event.Data = data
+		digest, err := app.parseDigest(event)
+		assert.NoError(err, name)
+		assert.Equal(mocks.NodeBlockID, hex.EncodeToString(digest), name)
+	}
+
+	event := newTestEvent(0, 1)
+	event.Data = []byte(`"` + base64.StdEncoding.EncodeToString(plain) + `"`)
+	_, err := app.parseDigest(event)
+	assert.EqualError(err, "event data string isn't compressed")
+	event.Data = gzipped.Bytes()[:gzipped.Len()/2]
+	_, err = app.parseDigest(event)
+	assert.Error(err)
+
+	bomb := &bytes.Buffer{}
+	gzipWriter = gzip.NewWriter(bomb)
+	_, _ = gzipWriter.Write(bytes.Repeat([]byte(" "), MaxEventDataSize+1))
+	assert.NoError(gzipWriter.Close())
+	event.Data = bomb.Bytes()
+	_, err = app.parseDigest(event)
+	assert.EqualError(err, fmt.Sprintf("decompressed event data exceeds %d bytes", MaxEventDataSize))
+}
+
+func TestResolvedRequestsCheck(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.ResolvedCheck = ResolvedCheckConfig{Enabled: true, Table: "session", PendingState: 4}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	resolved := testutil.ToFloat64(metrics.ResolvedEvents)
+
+	// request 1 waits for signidice_part_2, request 2 is already resolved, request 3 session is removed
+	node.Handle(mocks.GetTableRowsPath, func(writer http.ResponseWriter, req *http.Request) {
+		var query eos.GetTableRowsRequest
+		if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+			mocks.RespondNodeError(writer, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+		rows := []map[string]interface{}{}
+		switch query.LowerBound {
+		case "1":
+			rows = append(rows, map[string]interface{}{"req_id": 1, "state": 4})
+		case "2":
+			rows = append(rows, map[string]interface{}{"req_id": 2, "state": 5})
+		}
+		mocks.RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{"rows": rows, "more": false})
+	})
+
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	assert.Nil(app.handleEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Nil(app.handleEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(1, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(resolved+2, testutil.ToFloat64(metrics.ResolvedEvents))
+	assert.Equal(3, node.Calls(mocks.GetTableRowsPath))
+
+	// failed check doesn't block signing
+	node.Handle(mocks.GetTableRowsPath, func(writer http.ResponseWriter, req *http.Request) {
+		mocks.RespondNodeError(writer, http.StatusInternalServerError, 0, "table not found")
+	})
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(3, 4)))
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+}
+
+func TestGetConfigFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-config")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	rsaPath := filepath.Join(dir, "rsa.pem")
+	assert.NoError(ioutil.WriteFile(rsaPath,
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+	platformKey, _ := ecc.NewPrivateKey(platformPk)
+
+	yamlPath := filepath.Join(dir, "config.yaml")
+	assert.NoError(ioutil.WriteFile(yamlPath, []byte(`
+server:
+  port: 6565
+  logLevel: debug
+  dryRun: true
+broker:
+  topicOffsetPath: offset.json
+  url: localhost:8888
+  topicIDs: [1, 2]
+  idleResubscribe: 60
+blockchain:
+  depositKey: `+depositPk+`
+  signiDiceKey: `+signiDicePk+`
+  rsaKeyFile: `+rsaPath+`
+  digestHash: sha512
+  url: http://localhost:8888
+  chainID: `+chainID+`
+  casinoAccountName: `+casinoAccName+`
+  platformAccountName: `+platformAccName+`
+  platformPubKey: `+platformKey.PublicKey().String()+`
+  accountDepositKeys:
+    othercasino: `+platformPk+`
+http:
+  retryAmount: 3
+  retryDelay: 1
+  timeout: 3
+resolvedCheck:
+  enabled: true
+auth:
+  token: file-token
+`), 0600))
+
+	check := func(path string) {
+		cfg, err := GetConfig(path)
+		if !assert.NoError(err, path) {
+			return
+		}
+		// env vars override the file, defaults fill the rest
+		assert.Equal(7000, cfg.Server.Port)
+		assert.Equal("env-token", cfg.Auth.Token)
+		assert.Equal("debug", cfg.Server.LogLevel)
+		assert.Equal(100, cfg.Processor.EventBufferSize)
+
+		appCfg, _, err := MakeAppConfig(cfg)
+		if !assert.NoError(err, path) {
+			return
+		}
+		assert.NoError(appCfg.Validate(), path)
+		assert.True(appCfg.DryRun)
+		assert.Equal([]TopicConfig{{ID: 1}, {ID: 2}}, appCfg.Broker.Topics)
+		assert.Equal(time.Minute, appCfg.Broker.IdleResubscribe)
+		assert.Equal(crypto.SHA512, appCfg.BlockChain.DigestHash)
+		assert.Equal(rsaKey.D, appCfg.BlockChain.RSAKey.D)
+		assert.Equal(eos.AN(casinoAccName), appCfg.BlockChain.CasinoAccountName)
+		assert.Equal(platformKey.PublicKey(), appCfg.BlockChain.EosPubKeys.AccountDeposits["othercasino"])
+		assert.Equal(3*time.Second, appCfg.HTTP.Timeout)
+		assert.Equal(ResolvedCheckConfig{Enabled: true, Table: "session", PendingState: 4}, appCfg.ResolvedCheck)
+	}
+	os.Setenv("SERVER_PORT", "7000")
+	os.Setenv("AUTH_TOKEN", "env-token")
+	defer os.Unsetenv("SERVER_PORT")
+	defer os.Unsetenv("AUTH_TOKEN")
+	check(yamlPath)
+
+	// the same document as JSON
+	content, err := ioutil.ReadFile(yamlPath)
+	assert.NoError(err)
+	var doc interface{}
+	assert.NoError(yaml.Unmarshal(content, &doc))
+	content, err = json.Marshal(yamlToJSON(doc))
+	assert.NoError(err)
+	jsonPath := filepath.Join(dir, "config.json")
+	assert.NoError(ioutil.WriteFile(jsonPath, content, 0600))
+	check(jsonPath)
+
+	assert.NoError(ioutil.WriteFile(jsonPath, []byte(`{"server": {"port": "80"}}`), 0600))
+	_, err = GetConfig(jsonPath)
+	assert.Error(err)
+
+	// missing file leaves env and defaults
+	cfg, err := GetConfig(filepath.Join(dir, "missing.toml"))
+	assert.NoError(err)
+	assert.Equal(7000, cfg.Server.Port)
+	assert.Equal(3, cfg.Broker.ReconnectionAttempts)
+}
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-config")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	rsaPath := filepath.Join(dir, "rsa.pem")
+	assert.NoError(ioutil.WriteFile(rsaPath,
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(err)
+	platformKey, _ := ecc.NewPrivateKey(platformPk)
+	configPath := filepath.Join(dir, "config.yaml")
+	assert.NoError(ioutil.WriteFile(configPath, []byte(`
+broker:
+  topicOffsetPath: offset.json
+  url: localhost:8888
+blockchain:
+  depositKey: `+depositPk+`
+  signiDiceKey: `+signiDicePk+`
+  rsaKeyFile: `+rsaPath+`
+  rsaPubKey: `+base64.StdEncoding.EncodeToString(rsaPub)+`
+  url: http://localhost:8888
+  chainID: `+chainID+`
+  casinoAccountName: `+casinoAccName+`
+  platformAccountName: `+platformAccName+`
+  platformPubKey: `+platformKey.PublicKey().String()+`
+`), 0600))
+	check := func(modify func(cfg *Config)) (int, string) {
+		cfg, err := GetConfig(configPath)
+		if err == nil && modify != nil {
+			modify(cfg)
+		}
+		out := &bytes.Buffer{}
+		return runConfigCheck(cfg, err, out), out.String()
+	}
+
+	code, report := check(nil)
+	assert.Equal(0, code, report)
+	assert.Equal("ok: 2 EOS keys parsed, RSA key is 1024 bits\nok: config is valid\n"+
+		"ok: RSA key pair matches\nconfig check passed\n", report)
+
+	code, report = check(func(cfg *Config) { cfg.BlockChain.SigniDiceKey = "bad" })
+	assert.Equal(1, code)
+	assert.True(strings.HasPrefix(report, "failed: failed to process config"), report)
+
+	code, report = check(func(cfg *Config) { cfg.HTTP.Timeout = 0 })
+	assert.Equal(1, code)
+	assert.True(strings.HasSuffix(report, "failed: invalid config: HTTP timeout should be positive\n"), report)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	otherPub, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	assert.NoError(err)
+	code, report = check(func(cfg *Config) { cfg.BlockChain.RSAPubKey = base64.StdEncoding.EncodeToString(otherPub) })
+	assert.Equal(1, code)
+	assert.Contains(report, "failed: ")
+	assert.NotContains(report, "RSA key pair matches")
+
+	code, report = check(func(cfg *Config) { cfg.Server.JSONCodec = "unknown" })
+	assert.Equal(1, code)
+	assert.Contains(report, "failed: unknown JSON codec")
+
+	assert.NoError(ioutil.WriteFile(configPath, []byte("broker: [\n"), 0600))
+	code, report = check(nil)
+	assert.Equal(1, code)
+	assert.True(strings.HasPrefix(report, "failed: "), report)
+}
+
+func TestLogCorrelation(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	buf := &mocks.SafeBuffer{}
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	logger, err := NewLogger(buf, zerolog.DebugLevel, LogFormatJSON)
+	assert.NoError(err)
+	log.Logger = logger
+	entries := func() []map[string]interface{} {
+		var result []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]interface{}
+			assert.NoError(json.Unmarshal([]byte(line), &entry))
+			result = append(result, entry)
+		}
+		return result
+	}
+
+	assert.NotNil(app.handleEvent(context.Background(), newTestEvent(0, 7)))
+	malformed := newTestEvent(1, 8)
+	malformed.Data = []byte(`{}`)
+	assert.Nil(app.handleEvent(context.Background(), malformed))
+	reqIDs := map[float64]int{}
+	for _, entry := range entries() {
+		if message := entry["message"].(string); strings.Contains(message, "sessionID") ||
+			strings.HasPrefix(message, "Processing event") {
+			assert.Equal(newTestEvent(0, 0).Sender, entry[LogFieldSender], message)
+			reqIDs[entry[LogFieldReqID].(float64)]++
+		}
+	}
+	assert.Equal(2, reqIDs[7])
+	assert.Equal(2, reqIDs[8])
+
+	// HTTP request ID is propagated to the response and log lines of the request
+	buf.Truncate(0)
+	req := httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(makeDepositTransaction(app.BlockChain.ChainID)))
+	req.Header.Set(RequestIDHeader, "client-id")
+	response := httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, req)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("client-id", response.Header().Get(RequestIDHeader))
+	correlated := map[string]bool{}
+	for _, entry := range entries() {
+		if entry[LogFieldRequestID] == "client-id" {
+			correlated[entry["message"].(string)] = true
+		}
+	}
+	assert.True(correlated["Called /sign_transaction"])
+	assert.True(correlated["HTTP request"])
+
+	response = httptest.NewRecorder()
+	app.GetRouter().ServeHTTP(response, httptest.NewRequest("GET", "/ping", nil))
+	assert.Len(response.Header().Get(RequestIDHeader), 32)
+}
+
+func TestKeyPermissions(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	app.BlockChain.Permissions = KeyPermissions{SigniDice: "casinosign", Deposit: "deposit"}
+	var authorizations [][]eos.PermissionLevel
+	var m sync.Mutex
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		if err != nil {
+			mocks.RespondNodeError(writer, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+		m.Lock()
+		authorizations = append(authorizations, tx.Actions[0].Authorization)
+		m.Unlock()
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	app.Nonce.Enabled = true
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	expected := []eos.PermissionLevel{{Actor: casinoAccName, Permission: "casinosign"}}
+	assert.Equal([][]eos.PermissionLevel{expected, expected}, authorizations)
+
+	// deposit transfer should use the configured permission instead of the one named after casino
+	sign := func(deposit []byte) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		app.SignQuery(response, httptest.NewRequest("POST", "/sign_transaction", bytes.NewReader(deposit)))
+		return response
+	}
+	response := sign(makeCasinoDepositTransaction(app.BlockChain.ChainID, "deposit"))
+	assert.Equal(http.StatusOK, response.Code, response.Body.String())
+	assert.Equal([]eos.PermissionLevel{{Actor: "player", Permission: "deposit"}}, authorizations[2])
+	response = sign(makeDepositTransaction(app.BlockChain.ChainID))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Len(authorizations, 3)
+
+	app.BlockChain.Permissions.SigniDice = "Bad"
+	assert.EqualError(app.Validate(), `signidice permission "Bad" is not a valid account name`)
+}
+
+func TestSignPackedTransaction(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	var pushed []*eos.SignedTransaction
+	var m sync.Mutex
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		_, tx, err := mocks.DecodePushedTransaction(req)
+		if err != nil {
+			mocks.RespondNodeError(writer, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+		m.Lock()
+		pushed = append(pushed, tx)
+		m.Unlock()
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	sign := func(path string, body []byte) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		app.GetRouter().ServeHTTP(response, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+		return response
+	}
+	deposit := makeDepositTransaction(app.BlockChain.ChainID)
+	tx := &eos.SignedTransaction{}
+	assert.NoError(json.Unmarshal(deposit, tx))
+	pack := func(compression eos.CompressionType) []byte {
+		packedTrx, err := tx.Pack(compression)
+		assert.NoError(err)
+		content, err := json.Marshal(packedTrx)
+		assert.NoError(err)
+		return content
+	}
+
+	var results []string
+	for _, body := range [][]byte{deposit, pack(eos.CompressionNone), pack(eos.CompressionZlib)} {
+		response := sign("/sign_transaction", body)
+		assert.Equal(http.StatusOK, response.Code, response.Body.String())
+		results = append(results, response.Body.String())
+	}
+	// packed and JSON inputs of the same trx are signed the same way
+	assert.Equal(results[0], results[1])
+	assert.Equal(results[0], results[2])
+	if assert.Len(pushed, 3) {
+		for _, signed := range pushed {
+			assert.Len(signed.Signatures, len(tx.Signatures)+1)
+			assert.Equal(tx.Actions[0].Authorization, signed.Actions[0].Authorization)
+		}
+	}
+
+	response := sign("/sign_transactions", []byte(`[`+string(pack(eos.CompressionNone))+`,`+string(deposit)+`]`))
+	assert.Equal(http.StatusOK, response.Code)
+	var batch []map[string]string
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &batch))
+	if assert.Len(batch, 2) {
+		assert.NotEmpty(batch[0]["txid"])
+		assert.Equal(batch[0]["txid"], batch[1]["txid"])
+	}
+
+	response = sign("/sign_transaction", []byte(`{"signatures":[],"compression":"none","packed_trx":"zz"}`))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), string(ErrorCodeDeserializeFailed))
+	response = sign("/sign_transaction", []byte(`{"signatures":[],"compression":"none","packed_trx":"00"}`))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), string(ErrorCodeDeserializeFailed))
+	assert.Len(pushed, 5)
+}
+
+func TestUnconfiguredSigner(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	app := newTestApp(node)
+	appCfg, keyBag := MakeTestConfig()
+	assert.NoError(CheckSigner(keyBag, appCfg.BlockChain.EosPubKeys))
+	assert.Equal(ErrSignerNotConfigured, CheckSigner(nil, appCfg.BlockChain.EosPubKeys))
+	signiDiceOnly := &eos.KeyBag{}
+	assert.NoError(signiDiceOnly.Add(signiDicePk))
+	assert.EqualError(CheckSigner(signiDiceOnly, appCfg.BlockChain.EosPubKeys),
+		"signer has no private key of "+appCfg.BlockChain.EosPubKeys.Deposit.String())
+
+	unconfigured := testutil.ToFloat64(metrics.SignerNotConfigured)
+	app.bcAPI.Signer = nil
+	response := httptest.NewRecorder()
+	app.SignQuery(response, httptest.NewRequest("POST", "/sign_transaction",
+		bytes.NewReader(makeDepositTransaction(app.BlockChain.ChainID))))
+	assert.Equal(http.StatusInternalServerError, response.Code)
+	var body map[string]string
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Equal(string(ErrorCodeSignerNotConfigured), body["code"])
+	assert.Equal(ErrSignerNotConfigured.Error(), body["error"])
+
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Equal(0, node.Calls(mocks.PushTransactionPath))
+	assert.Equal(unconfigured+2, testutil.ToFloat64(metrics.SignerNotConfigured))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	breaker := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute})
+	breaker.now = func() time.Time { return now }
+
+	// success resets consecutive failures
+	assert.True(breaker.Allow())
+	breaker.Report(false)
+	assert.True(breaker.Allow())
+	breaker.Report(true)
+	assert.True(breaker.Allow())
+	breaker.Report(false)
+	assert.Equal(BreakerClosed, breaker.State())
+	assert.True(breaker.Allow())
+	breaker.Report(false)
+	assert.Equal(BreakerOpen, breaker.State())
+	assert.False(breaker.Allow())
+
+	// single trial push after cooldown, failed one reopens the circuit
+	now = now.Add(time.Minute)
+	assert.Equal(BreakerHalfOpen, breaker.State())
+	assert.True(breaker.Allow())
+	assert.False(breaker.Allow())
+	breaker.Report(false)
+	assert.Equal(BreakerOpen, breaker.State())
+	assert.False(breaker.Allow())
+
+	// cancelled trial doesn't change the state
+	now = now.Add(time.Minute)
+	assert.True(breaker.Allow())
+	breaker.Cancel()
+	assert.Equal(BreakerHalfOpen, breaker.State())
+	assert.True(breaker.Allow())
+	breaker.Report(true)
+	assert.Equal(BreakerClosed, breaker.State())
+	assert.True(breaker.Allow())
+	breaker.Report(false)
+	assert.Equal(BreakerClosed, breaker.State())
+}
+
+func TestPushCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	node := mocks.NewNodeMock()
+	defer node.Close()
+	dir, err := ioutil.TempDir("", "casino-breaker")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	var failing int32 = 1
+	node.Handle(mocks.PushTransactionPath, func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			mocks.RespondNodeError(writer, http.StatusInternalServerError, 3080006, "deadline exceeded")
+			return
+		}
+		mocks.RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": mocks.NodeTrxID})
+	})
+	app := newTestApp(node)
+	app.Push = PushConfig{MaxAttempts: 1, Breaker: BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute}}
+	app.DLQ.Path = filepath.Join(dir, "dlq.jsonl")
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	now := time.Now()
+	app.pushBreaker.now = func() time.Time { return now }
+	breakerState := func() string {
+		response := httptest.NewRecorder()
+		app.StatusQuery(response, httptest.NewRequest("GET", "/status", nil))
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+		return body["push_breaker"].(string)
+	}
+	assert.Equal(BreakerClosed, breakerState())
+
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(0, 1)))
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(1, 2)))
+	assert.Equal(BreakerOpen, breakerState())
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	// open circuit fails fast, event is dead-lettered without pushing
+	assert.Nil(app.processEvent(context.Background(), newTestEvent(2, 3)))
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+	records, err := app.readDeadLetters()
+	assert.NoError(err)
+	if assert.Len(records, 3) {
+		assert.Equal(uint64(3), records[2].Event.RequestID)
+		assert.Contains(records[2].Reason, ErrCircuitOpen.Error())
+	}
+	response := httptest.NewRecorder()
+	app.SignQuery(response, httptest.NewRequest("POST", "/sign_transaction",
+		bytes.NewReader(makeDepositTransaction(app.BlockChain.ChainID))))
+	assert.Equal(http.StatusServiceUnavailable, response.Code)
+	assert.Equal(2, node.Calls(mocks.PushTransactionPath))
+
+	// trial push after cooldown closes the circuit
+	now = now.Add(time.Minute)
+	assert.Equal(BreakerHalfOpen, breakerState())
+	atomic.StoreInt32(&failing, 0)
+	assert.NotNil(app.processEvent(context.Background(), newTestEvent(3, 4)))
+	assert.Equal(BreakerClosed, breakerState())
+	assert.Equal(3, node.Calls(mocks.PushTransactionPath))
+
+	app.Push.Breaker = BreakerConfig{}
+	app = NewApp(app.bcAPI, app.BrokerClient, app.EventMessages, app.OffsetStore, app.AppConfig)
+	assert.Equal("disabled", breakerState())
+}
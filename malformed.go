@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// malformedEventRecord is a line of the malformed events log,
+// data is kept as a string because it isn't necessarily valid JSON
+type malformedEventRecord struct {
+	Time      time.Time        `json:"time"`
+	Reason    string           `json:"reason"`
+	Offset    uint64           `json:"offset"`
+	Sender    string           `json:"sender"`
+	CasinoID  uint64           `json:"casino_id"`
+	GameID    uint64           `json:"game_id"`
+	RequestID uint64           `json:"req_id"`
+	EventType broker.EventType `json:"event_type"`
+	Data      string           `json:"data"`
+}
+
+// malformedEvent drops event which data can't be parsed,
+// raw event is appended to the malformed events log when it's configured
+func (app *App) malformedEvent(event *broker.Event, err error) {
+	metrics.MalformedEvents.Inc()
+	metrics.SigniDiceFailures.WithLabelValues(FailureReasonDigest).Inc()
+	if app.Processor.MalformedEventsPath != "" {
+		if writeErr := app.writeMalformedEvent(event, err.Error()); writeErr != nil {
+			log.Warn().Msgf("Failed to write malformed event, reason: %s", writeErr.Error())
+		}
+	}
+	app.deadLetter(event, "couldnt get digest from event: "+err.Error())
+}
+
+func (app *App) writeMalformedEvent(event *broker.Event, reason string) error {
+	line, err := jsonCodec.Marshal(&malformedEventRecord{
+		Time:      time.Now().UTC(),
+		Reason:    reason,
+		Offset:    event.Offset,
+		Sender:    event.Sender,
+		CasinoID:  event.CasinoID,
+		GameID:    event.GameID,
+		RequestID: event.RequestID,
+		EventType: event.EventType,
+		Data:      string(event.Data),
+	})
+	if err != nil {
+		return err
+	}
+	app.malformedLogLock.Lock()
+	defer app.malformedLogLock.Unlock()
+	file, err := os.OpenFile(app.Processor.MalformedEventsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close malformed events log: %s", err.Error())
+	}
+	return nil
+}
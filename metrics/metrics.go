@@ -2,7 +2,10 @@ package metrics
 
 import (
 	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/DaoCasino/casino-backend/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -26,14 +29,187 @@ var (
 			Help:    "HTTP /sign_transaction query processing time in ms",
 			Buckets: []float64{20, 50, 100, 200, 500},
 		})
+
+	PushTransactionTimeMs = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "push_transaction_ms",
+			Help:    "signidice part 2 trx push time in ms",
+			Buckets: []float64{20, 50, 100, 200, 500, 1000},
+		})
+
+	EventsReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "events_received_total",
+			Help: "events received from the broker",
+		})
+
+	SigniDiceSigned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "signidice_part_2_signed_total",
+			Help: "successfully sent signidice part 2 trxs",
+		})
+
+	SigniDiceFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signidice_part_2_failures_total",
+			Help: "failed signidice part 2 events by reason",
+		}, []string{"reason"})
+
+	SigniDiceNotIncluded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "signidice_part_2_not_included_total",
+			Help: "pushed signidice part 2 trxs which weren't included into a block",
+		})
+
+	PushErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "push_errors_total",
+			Help: "failed trx push attempts by chain error category",
+		}, []string{"category"})
+
+	NodeFailovers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "node_failovers_total",
+			Help: "switches of node API calls to another node",
+		})
+
+	MalformedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "malformed_events_total",
+			Help: "events dropped because their data couldn't be parsed",
+		})
+
+	ResolvedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "resolved_events_total",
+			Help: "events skipped because their requests were already resolved on chain",
+		})
+
+	SignerNotConfigured = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "signer_not_configured_total",
+			Help: "trx signings refused because eos signer isn't configured",
+		})
+
+	OffsetLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "offset_lag",
+			Help: "offsets received from the broker and not committed yet, per topic",
+		}, []string{"topic"})
+
+	OffsetQueueFull = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "offset_queue_full_total",
+			Help: "times reading from the broker was paused because too many messages weren't committed",
+		})
+
+	MissedOffsets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "broker_missed_offsets_total",
+			Help: "offsets skipped by the broker in delivered event stream, per topic",
+		}, []string{"topic"})
+
+	SigningCapExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "signing_cap_exceeded_total",
+			Help: "deposit trxs rejected because the casino account reached signing cap, per account",
+		}, []string{"account"})
+
+	EventGoroutines = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "event_goroutines",
+			Help: "running event processing goroutines",
+		})
+
+	EventGoroutinesLimitReached = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "event_goroutines_limit_reached_total",
+			Help: "times event processing was deferred because goroutines limit was reached",
+		})
+
+	BrokerResubscribes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "broker_resubscribes_total",
+			Help: "re-subscriptions to the broker topics after no events were received within idle window",
+		})
+
+	EventMessagesBufferSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "event_messages_buffer_size",
+			Help: "capacity of the buffer of event messages received from the broker",
+		})
+
+	EventMessagesBuffered = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "event_messages_buffered",
+			Help: "event messages received from the broker and waiting for the processor",
+		}, bufferedEventMessages)
+
+	AccountResourceFreeRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "account_resource_free_ratio",
+			Help: "free share of the casino account resource",
+		}, []string{"resource"})
+
+	AccountResourceLow = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "account_resource_low_total",
+			Help: "resource checks which found the casino account resource below threshold",
+		}, []string{"resource"})
+
+	// successfully pushed signidice_part_2 events over the last minute
+	SigniDiceSignRate = utils.NewSlidingWindowCounter(time.Minute, 60)
+
+	SigniDiceSignsPerMinute = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "signidice_part_2_signs_per_minute",
+			Help: "successfully sent signidice part 2 events over the last minute",
+		}, SigniDiceSignRate.RatePerMinute)
 )
 
+// eventMessagesBuffer holds func() int returning the current events buffer occupancy
+var eventMessagesBuffer atomic.Value
+
+// SetEventMessagesBuffer sets source of EventMessagesBuffered
+func SetEventMessagesBuffer(buffered func() int) {
+	eventMessagesBuffer.Store(buffered)
+}
+
+func bufferedEventMessages() float64 {
+	if buffered, ok := eventMessagesBuffer.Load().(func() int); ok {
+		return float64(buffered())
+	}
+	return 0
+}
+
 func init() {
 	registry = prometheus.NewRegistry()
 	registerer = prometheus.WrapRegistererWithPrefix(prometheusPrefix, registry)
 	registerer.MustRegister(prometheus.NewGoCollector())
 	registerer.MustRegister(SigniDiceProcessingTimeMs)
 	registerer.MustRegister(SignTransactionProcessingTimeMs)
+	registerer.MustRegister(SigniDiceSignsPerMinute)
+	registerer.MustRegister(PushTransactionTimeMs)
+	registerer.MustRegister(EventsReceived)
+	registerer.MustRegister(SigniDiceSigned)
+	registerer.MustRegister(SigniDiceFailures)
+	registerer.MustRegister(SigniDiceNotIncluded)
+	registerer.MustRegister(MalformedEvents)
+	registerer.MustRegister(ResolvedEvents)
+	registerer.MustRegister(SignerNotConfigured)
+	registerer.MustRegister(PushErrors)
+	registerer.MustRegister(NodeFailovers)
+	registerer.MustRegister(OffsetLag)
+	registerer.MustRegister(OffsetQueueFull)
+	registerer.MustRegister(MissedOffsets)
+	registerer.MustRegister(SigningCapExceeded)
+	registerer.MustRegister(EventGoroutines)
+	registerer.MustRegister(EventGoroutinesLimitReached)
+	registerer.MustRegister(BrokerResubscribes)
+	registerer.MustRegister(EventMessagesBufferSize)
+	registerer.MustRegister(EventMessagesBuffered)
+	registerer.MustRegister(AccountResourceFreeRatio)
+	registerer.MustRegister(AccountResourceLow)
 }
 
 func GetHandler() http.Handler {
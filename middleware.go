@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+)
+
+// EventHandler processes a single event, returns trx ID or nil if event wasn't processed
+type EventHandler func(ctx context.Context, event *broker.Event) *string
+
+// EventMiddleware wraps event handler with a cross-cutting concern
+type EventMiddleware func(next EventHandler) EventHandler
+
+// ChainEventMiddleware wraps handler with middlewares, first middleware is the outermost one
+func ChainEventMiddleware(handler EventHandler, middlewares ...EventMiddleware) EventHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+func DefaultEventMiddleware() []EventMiddleware {
+	return []EventMiddleware{LoggingEventMiddleware, ProcessingTimeEventMiddleware, SignRateEventMiddleware}
+}
+
+// UseEventMiddleware appends middlewares to the chain, they're called after the default ones.
+// It's safe to call while events are processed, events in flight keep the previous chain
+func (app *App) UseEventMiddleware(middlewares ...EventMiddleware) {
+	app.middlewareLock.Lock()
+	defer app.middlewareLock.Unlock()
+	app.eventMiddleware = append(app.eventMiddleware, middlewares...)
+	app.eventHandler = ChainEventMiddleware(app.processEvent, app.eventMiddleware...)
+}
+
+// handleEvent runs event through the middleware chain
+func (app *App) handleEvent(ctx context.Context, event *broker.Event) *string {
+	app.middlewareLock.RLock()
+	handler := app.eventHandler
+	app.middlewareLock.RUnlock()
+	trxID := handler(ctx, event)
+	if trxID == nil && ctx.Err() != nil {
+		// cancelled event will be redelivered, it isn't counted as failed
+		return nil
+	}
+	app.countResults(trxID)
+	return trxID
+}
+
+// countResults updates processed and failed events counters reported on shutdown
+func (app *App) countResults(trxIDs ...*string) {
+	for _, trxID := range trxIDs {
+		atomic.AddUint64(&app.processedEvents, 1)
+		if trxID == nil {
+			atomic.AddUint64(&app.failedEvents, 1)
+		}
+	}
+}
+
+func LoggingEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		logger := eventLogger(ctx, event)
+		logger.Debug().Msgf("Processing event %+v", event)
+		return next(ctx, event)
+	}
+}
+
+func ProcessingTimeEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			metrics.SigniDiceProcessingTimeMs.Observe(elapsed.Seconds() * 1000)
+		}()
+		return next(ctx, event)
+	}
+}
+
+// TimeoutEventMiddleware limits event processing with Processor.EventTimeout: handler ctx is cancelled on timeout
+// and the event is dead-lettered without waiting for the handler, so a stuck one doesn't occupy the worker forever.
+// Result of the handler finishing after the timeout is discarded
+func (app *App) TimeoutEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		timeoutCtx, cancel := context.WithTimeout(ctx, app.Processor.EventTimeout)
+		defer cancel()
+		done := make(chan *string, 1)
+		go func() { done <- next(timeoutCtx, event) }()
+		select {
+		case trxID := <-done:
+			if trxID != nil || timeoutCtx.Err() == nil || ctx.Err() != nil {
+				return trxID
+			}
+		case <-timeoutCtx.Done():
+			if ctx.Err() != nil {
+				// cancelled event is redelivered, handler is left to notice cancellation
+				return nil
+			}
+		}
+		metrics.SigniDiceFailures.WithLabelValues(FailureReasonTimeout).Inc()
+		reason := fmt.Sprintf("event processing timed out after %s", app.Processor.EventTimeout)
+		app.queueDeadLetter(event, reason)
+		app.deadLetter(event, reason)
+		app.reportEventFailure(event, FailureReasonTimeout, errors.New(reason), "")
+		return nil
+	}
+}
+
+func SignRateEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		trxID := next(ctx, event)
+		if trxID != nil {
+			metrics.SigniDiceSignRate.Add(1)
+		}
+		return trxID
+	}
+}
@@ -0,0 +1,126 @@
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+)
+
+// BrokerMock delivers preset messages starting from the subscribed offset
+type BrokerMock struct {
+	Messages []*broker.EventMessage
+	// returned by subsequent Subscribe calls, nil when exhausted
+	SubscribeErrors []error
+	// called by Unsubscribe after the call is recorded, its error is returned
+	UnsubscribeHook func(eventType broker.EventType) error
+
+	events chan<- *broker.EventMessage
+	ctx    context.Context
+	m      sync.Mutex
+
+	subscriptions   map[broker.EventType]uint64
+	unsubscriptions []broker.EventType
+	runCalls        int
+	subscribeCalls  int
+}
+
+func NewBrokerMock(events chan<- *broker.EventMessage, messages ...*broker.EventMessage) *BrokerMock {
+	return &BrokerMock{
+		Messages:      messages,
+		events:        events,
+		ctx:           context.Background(),
+		subscriptions: make(map[broker.EventType]uint64),
+	}
+}
+
+func (b *BrokerMock) ListenAndServe(ctx context.Context) error {
+	b.setContext(ctx)
+	return nil
+}
+
+func (b *BrokerMock) Run(ctx context.Context) {
+	b.m.Lock()
+	b.runCalls++
+	b.m.Unlock()
+	b.setContext(ctx)
+}
+
+// RunCalls returns number of Run calls
+func (b *BrokerMock) RunCalls() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.runCalls
+}
+
+// SubscribeCalls returns number of Subscribe calls including failed ones
+func (b *BrokerMock) SubscribeCalls() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.subscribeCalls
+}
+
+func (b *BrokerMock) setContext(ctx context.Context) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.ctx = ctx
+}
+
+func (b *BrokerMock) Subscribe(eventType broker.EventType, offset uint64) (bool, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.subscribeCalls++
+	if len(b.SubscribeErrors) > 0 {
+		err := b.SubscribeErrors[0]
+		b.SubscribeErrors = b.SubscribeErrors[1:]
+		if err != nil {
+			return false, err
+		}
+	}
+	b.subscriptions[eventType] = offset
+	ctx := b.ctx
+	go func() {
+		for _, message := range b.Messages {
+			if message.Offset < offset {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case b.events <- message:
+			}
+		}
+	}()
+	return true, nil
+}
+
+func (b *BrokerMock) Unsubscribe(eventType broker.EventType) (bool, error) {
+	b.m.Lock()
+	b.unsubscriptions = append(b.unsubscriptions, eventType)
+	hook := b.UnsubscribeHook
+	b.m.Unlock()
+	if hook != nil {
+		if err := hook(eventType); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Subscriptions returns topic to offset map of all subscribe calls
+func (b *BrokerMock) Subscriptions() map[broker.EventType]uint64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	subscriptions := make(map[broker.EventType]uint64, len(b.subscriptions))
+	for topic, offset := range b.subscriptions {
+		subscriptions[topic] = offset
+	}
+	return subscriptions
+}
+
+// Unsubscriptions returns topics of all unsubscribe calls
+func (b *BrokerMock) Unsubscriptions() []broker.EventType {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return append([]broker.EventType(nil), b.unsubscriptions...)
+}
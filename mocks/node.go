@@ -0,0 +1,120 @@
+package mocks
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/eoscanada/eos-go"
+)
+
+const (
+	GetInfoPath         = "/v1/chain/get_info"
+	PushTransactionPath = "/v1/chain/push_transaction"
+	SendTrx2Path        = "/v1/chain/send_transaction2"
+	GetTransactionPath  = "/v1/history/get_transaction"
+	GetTableRowsPath    = "/v1/chain/get_table_rows"
+
+	NodeChainID = "cda75f235aef76ad91ef0503421514d80d8dbb584cd07178022f0bc7deb964ff"
+	NodeBlockID = "00000008f98f0580d7efe7abc60abaaf8a865c9428a4267df30ff7d1937a1084"
+	NodeTrxID   = "6b6b2c5b2ba8a1b45d4a7e5a547a1ba27b0b1c1c3c8a8a3d8d9b6b2c1a5e7f00"
+)
+
+// NodeMock is a fake EOS node serving get_info and push_transaction,
+// every endpoint can be overridden with Handle
+type NodeMock struct {
+	*httptest.Server
+	m        sync.Mutex
+	handlers map[string]http.HandlerFunc
+	calls    map[string]int
+}
+
+func NewNodeMock() *NodeMock {
+	n := &NodeMock{handlers: make(map[string]http.HandlerFunc), calls: make(map[string]int)}
+	n.handlers[GetInfoPath] = n.getInfo
+	n.handlers[PushTransactionPath] = n.pushTransaction
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	return n
+}
+
+func (n *NodeMock) serve(writer http.ResponseWriter, req *http.Request) {
+	n.m.Lock()
+	n.calls[req.URL.Path]++
+	handler, ok := n.handlers[req.URL.Path]
+	n.m.Unlock()
+	if !ok {
+		RespondNodeError(writer, http.StatusNotFound, 0, "unknown endpoint")
+		return
+	}
+	handler(writer, req)
+}
+
+// Handle overrides handler for the given node endpoint path
+func (n *NodeMock) Handle(path string, handler http.HandlerFunc) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.handlers[path] = handler
+}
+
+// Calls returns amount of requests made to the given endpoint path
+func (n *NodeMock) Calls(path string) int {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.calls[path]
+}
+
+func (n *NodeMock) getInfo(writer http.ResponseWriter, req *http.Request) {
+	RespondNodeJSON(writer, http.StatusOK, map[string]interface{}{
+		"chain_id":                    NodeChainID,
+		"head_block_num":              8,
+		"last_irreversible_block_num": 8,
+		"last_irreversible_block_id":  NodeBlockID,
+		"head_block_id":               NodeBlockID,
+		"head_block_time":             "2020-03-25T17:41:38",
+	})
+}
+
+func (n *NodeMock) pushTransaction(writer http.ResponseWriter, req *http.Request) {
+	RespondNodeJSON(writer, http.StatusAccepted, map[string]interface{}{"transaction_id": NodeTrxID})
+}
+
+func RespondNodeJSON(writer http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	_, _ = writer.Write(response)
+}
+
+// RespondNodeError writes error in the nodeos error format
+func RespondNodeError(writer http.ResponseWriter, code int, eosCode int, what string) {
+	RespondNodeJSON(writer, code, map[string]interface{}{
+		"code":    code,
+		"message": "Internal Service Error",
+		"error": map[string]interface{}{
+			"code":    eosCode,
+			"name":    "mock_exception",
+			"what":    what,
+			"details": []interface{}{},
+		},
+	})
+}
+
+func ChainID() []byte {
+	id, _ := hex.DecodeString(NodeChainID)
+	return id
+}
+
+// DecodePushedTransaction unpacks transaction sent to push_transaction endpoint
+func DecodePushedTransaction(req *http.Request) (*eos.PackedTransaction, *eos.SignedTransaction, error) {
+	packedTx := &eos.PackedTransaction{}
+	if err := json.NewDecoder(req.Body).Decode(packedTx); err != nil {
+		return nil, nil, err
+	}
+	signedTx, err := packedTx.Unpack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return packedTx, signedTx, nil
+}
@@ -0,0 +1,28 @@
+package mocks
+
+import (
+	"sync"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// DigestSignerMock returns fixed signature or error and records signed digests
+type DigestSignerMock struct {
+	Signature string
+	Err       error
+	m         sync.Mutex
+	digests   []eos.Checksum256
+}
+
+func (s *DigestSignerMock) Sign(digest eos.Checksum256) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.digests = append(s.digests, digest)
+	return s.Signature, s.Err
+}
+
+func (s *DigestSignerMock) Digests() []eos.Checksum256 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]eos.Checksum256(nil), s.digests...)
+}
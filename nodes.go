@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+const nodeHealthPath = "/v1/chain/get_info"
+
+type NodesConfig struct {
+	URLs                []string      // node API endpoints in priority order, failover is disabled for a single one
+	Timeout             time.Duration // single node call limit before failing over, 0 means no limit
+	HealthCheckInterval time.Duration
+}
+
+// NodePool is a transport of node API client sending calls to the current node,
+// connection errors and timeouts mark it unhealthy and the call is retried on the next healthy one.
+// Unhealthy nodes are tried as a last resort and re-checked with get_info by CheckHealth
+type NodePool struct {
+	bases     []string
+	transport http.RoundTripper
+	timeout   time.Duration
+	lock      sync.RWMutex
+	current   int
+	healthy   []bool
+}
+
+func NewNodePool(urls []string, transport http.RoundTripper, timeout time.Duration) *NodePool {
+	pool := &NodePool{transport: transport, timeout: timeout, healthy: make([]bool, len(urls))}
+	for i, nodeURL := range urls {
+		pool.bases = append(pool.bases, strings.TrimRight(nodeURL, "/"))
+		pool.healthy[i] = true
+	}
+	return pool
+}
+
+// NewFailoverAPI returns node API client which calls fail over between cfg.URLs
+func NewFailoverAPI(cfg NodesConfig) (*eos.API, *NodePool) {
+	api := eos.New(cfg.URLs[0])
+	pool := NewNodePool(cfg.URLs, api.HttpClient.Transport, cfg.Timeout)
+	api.HttpClient.Transport = pool
+	return api, pool
+}
+
+// Current returns URL of the node calls are sent to
+func (p *NodePool) Current() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.bases[p.current]
+}
+
+// candidates returns nodes to try in order: healthy ones starting from the current, then unhealthy ones
+func (p *NodePool) candidates() []int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	healthy := make([]int, 0, len(p.bases))
+	var unhealthy []int
+	for k := range p.bases {
+		i := (p.current + k) % len(p.bases)
+		if p.healthy[i] {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *NodePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// eos-go builds URLs on the first node base
+	path := strings.TrimPrefix(req.URL.String(), p.bases[0])
+	var lastErr error
+	for _, i := range p.candidates() {
+		resp, err := p.roundTripNode(req, i, path, body)
+		if err == nil {
+			p.setHealth(i, nil, true)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+		p.setHealth(i, err, false)
+	}
+	return nil, lastErr
+}
+
+func (p *NodePool) roundTripNode(req *http.Request, i int, path string, body []byte) (*http.Response, error) {
+	target, err := url.Parse(p.bases[i] + path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+	}
+	nodeReq := req.Clone(ctx)
+	nodeReq.URL = target
+	nodeReq.Host = target.Host
+	if req.Body != nil {
+		nodeReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		nodeReq.ContentLength = int64(len(body))
+	}
+	resp, err := p.transport.RoundTrip(nodeReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// timeout covers reading of the response too
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// setHealth records node state, calls are switched to the node when it succeeded
+// and to the first healthy one when the current node failed
+func (p *NodePool) setHealth(i int, err error, switchTo bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil && p.healthy[i] {
+		log.Warn().Msgf("Node is unhealthy, url: %s, reason: %s", p.bases[i], err.Error())
+	}
+	if err == nil && !p.healthy[i] {
+		log.Info().Msgf("Node is healthy again, url: %s", p.bases[i])
+	}
+	p.healthy[i] = err == nil
+	next := p.current
+	if switchTo {
+		next = i
+	} else if !p.healthy[p.current] {
+		for k := 1; k < len(p.bases); k++ {
+			if j := (p.current + k) % len(p.bases); p.healthy[j] {
+				next = j
+				break
+			}
+		}
+	}
+	if next != p.current {
+		log.Warn().Msgf("Failing over to node %s from %s", p.bases[next], p.bases[p.current])
+		metrics.NodeFailovers.Inc()
+		p.current = next
+	}
+}
+
+// CheckHealth calls get_info of every node and updates their state
+func (p *NodePool) CheckHealth() {
+	for i := range p.bases {
+		p.setHealth(i, p.ping(i), false)
+	}
+}
+
+func (p *NodePool) ping(i int) error {
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodPost, p.bases[i]+nodeHealthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get_info status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// RunHealthCheck periodically checks nodes until ctx is done
+func (p *NodePool) RunHealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.CheckHealth()
+		}
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
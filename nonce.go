@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// min remaining lifetime of the pinned header, trx expiring sooner gets a fresh header
+const MinPinnedHeaderLifetime = 5 * time.Second
+
+type NonceConfig struct {
+	Enabled  bool
+	Contract eos.AccountName // receiver of the nonce context free action, eosio.null by default
+}
+
+// txHeaders pins trx header per request, so re-signed trx keeps the same ID and chain dedupes it
+type txHeaders struct {
+	m       sync.Mutex
+	headers map[string]eos.TransactionHeader
+}
+
+// pin returns header pinned for the key, header is pinned if there's no usable one
+func (h *txHeaders) pin(key string, header eos.TransactionHeader, now time.Time) eos.TransactionHeader {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.headers == nil {
+		h.headers = make(map[string]eos.TransactionHeader)
+	}
+	if pinned, ok := h.headers[key]; ok && pinned.Expiration.Sub(now) >= MinPinnedHeaderLifetime {
+		return pinned
+	}
+	for k, pinned := range h.headers {
+		if !pinned.Expiration.After(now) {
+			delete(h.headers, k)
+		}
+	}
+	h.headers[key] = header
+	return header
+}
+
+func (app *App) getSigndiceNonceTransaction(contract eos.AccountName, requestID uint64, signature string,
+	txOpts *eos.TxOptions) (*eos.PackedTransaction, error) {
+	fresh := NewTransaction(nil, txOpts, app.TrxExpiration).TransactionHeader
+	header := app.txHeaders.pin(fmt.Sprintf("%s:%d", contract, requestID), fresh, time.Now().UTC())
+	return GetSigndiceNonceTransaction(app.bcAPI.Signer, contract, app.signidiceAuth(), requestID, signature,
+		app.BlockChain.EosPubKeys.SigniDice, txOpts.ChainID, header, app.Nonce.Contract, txOpts.Compress)
+}
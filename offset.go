@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+type pendingMessage struct {
+	offset    uint64 // offset to commit when all message events are resolved
+	remaining int
+	failed    int // events failed and not signed by a redelivery yet
+}
+
+type pendingEvent struct {
+	message *pendingMessage
+	dropped bool
+}
+
+// offsetCommitter commits offset of the message only when all its events succeeded or were dead-lettered,
+// messages are committed in order, so failed event holds back offset until its request is resolved by a redelivered
+// event or restart reprocesses it. Committed offset only grows: messages redelivered out of order after reconnect
+// don't move it backwards
+type offsetCommitter struct {
+	m       sync.Mutex
+	storage utils.OffsetStore
+	topic   broker.EventType
+	queue   []*pendingMessage
+	events  map[*broker.Event]*pendingEvent
+	failed  map[uint64]*pendingMessage // messages held back by failed events by request ID
+	highest *uint64                    // last committed offset, nil until read from storage
+	head    uint64                     // offset after the latest received message, offset lag is measured from it
+	max     int                        // tracked messages limit, 0 means no limit
+	room    chan struct{}              // closed when the queue gets below max, nil unless someone waits
+}
+
+func newOffsetCommitter(storage utils.OffsetStore, topic broker.EventType, max int) *offsetCommitter {
+	return &offsetCommitter{storage: storage, topic: topic, max: max,
+		events: make(map[*broker.Event]*pendingEvent), failed: make(map[uint64]*pendingMessage)}
+}
+
+// waitRoom blocks while tracked messages limit is reached, returns false if ctx is done meanwhile
+func (c *offsetCommitter) waitRoom(ctx context.Context) bool {
+	c.m.Lock()
+	if c.max <= 0 || len(c.queue) < c.max {
+		c.m.Unlock()
+		return true
+	}
+	if c.room == nil {
+		c.room = make(chan struct{})
+	}
+	room := c.room
+	c.m.Unlock()
+	metrics.OffsetQueueFull.Inc()
+	log.Error().Msgf("%d messages of topic %d aren't committed, pausing reading from the broker", c.max, c.topic)
+	select {
+	case <-room:
+		log.Info().Msgf("Resumed reading topic %d from the broker", c.topic)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// track registers dispatched message, offset is the one to commit after the message
+func (c *offsetCommitter) track(offset uint64, events []*broker.Event) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if offset > c.head {
+		c.head = offset
+	}
+	message := &pendingMessage{offset: offset, remaining: len(events)}
+	c.queue = append(c.queue, message)
+	for _, event := range events {
+		c.events[event] = &pendingEvent{message: message}
+	}
+	c.commit()
+}
+
+// drop acknowledges tracked event as permanently failed
+func (c *offsetCommitter) drop(event *broker.Event) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if pending, ok := c.events[event]; ok {
+		pending.dropped = true
+	}
+}
+
+// resolve records event processing result
+func (c *offsetCommitter) resolve(event *broker.Event, processed bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	pending, ok := c.events[event]
+	if !ok {
+		return
+	}
+	delete(c.events, event)
+	switch {
+	case !processed && !pending.dropped:
+		log.Error().Msgf("Event failed, offset won't be committed past it, sessionID: %d, offset: %d",
+			event.RequestID, event.Offset)
+		if _, ok := c.failed[event.RequestID]; !ok {
+			pending.message.failed++
+			c.failed[event.RequestID] = pending.message
+		}
+	default:
+		// redelivered event of the failed request is signed or dead-lettered, so it doesn't hold back offset anymore
+		if message, ok := c.failed[event.RequestID]; ok {
+			log.Info().Msgf("Failed request is resolved by redelivered event, sessionID: %d", event.RequestID)
+			message.failed--
+			delete(c.failed, event.RequestID)
+		}
+	}
+	pending.message.remaining--
+	c.commit()
+}
+
+// committed returns stored offset of the topic, fallback is used only when nothing is stored yet
+func (c *offsetCommitter) committed(fallback uint64) (uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	offset, err := c.storage.ReadOffset(c.topic)
+	if err == utils.ErrNoOffset {
+		return fallback, nil
+	}
+	return offset, err
+}
+
+func (c *offsetCommitter) commit() {
+	defer c.reportLag()
+	defer c.notifyRoom()
+	for len(c.queue) > 0 && c.queue[0].remaining == 0 && c.queue[0].failed == 0 {
+		highest, err := c.highestCommitted()
+		if err != nil {
+			log.Error().Msgf("Failed to read offset, reason: %s", err.Error())
+			return
+		}
+		offset := c.queue[0].offset
+		if offset <= highest {
+			log.Debug().Msgf("Skipping offset %d of topic %d, already committed %d", offset, c.topic, highest)
+			c.queue = c.queue[1:]
+			continue
+		}
+		if err := c.storage.WriteOffset(c.topic, offset); err != nil {
+			log.Error().Msgf("Failed to write offset, reason: %s", err.Error())
+			return
+		}
+		c.highest = &offset
+		c.queue = c.queue[1:]
+	}
+}
+
+// notifyRoom wakes up waitRoom once the queue gets below max, lock should be held
+func (c *offsetCommitter) notifyRoom() {
+	if c.room != nil && len(c.queue) < c.max {
+		close(c.room)
+		c.room = nil
+	}
+}
+
+// reportLag updates offset lag metric of the topic: received head offset minus committed one
+func (c *offsetCommitter) reportLag() {
+	committed, err := c.highestCommitted()
+	if err != nil {
+		return
+	}
+	var lag uint64
+	if c.head > committed {
+		lag = c.head - committed
+	}
+	metrics.OffsetLag.WithLabelValues(strconv.FormatUint(uint64(c.topic), 10)).Set(float64(lag))
+}
+
+func (c *offsetCommitter) highestCommitted() (uint64, error) {
+	if c.highest != nil {
+		return *c.highest, nil
+	}
+	offset, err := c.storage.ReadOffset(c.topic)
+	if err == utils.ErrNoOffset {
+		offset, err = 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.highest = &offset
+	return offset, nil
+}
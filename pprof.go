@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+const PprofPathPrefix = "/debug/pprof/"
+
+// registerPprof serves runtime profiles at /debug/pprof/, e.g. /debug/pprof/goroutine?debug=2 or /debug/pprof/profile?seconds=30.
+// Profiles expose internals of the process, so they require auth token and are registered only when Server.Pprof is set
+func (app *App) registerPprof(router *mux.Router) {
+	router.HandleFunc(PprofPathPrefix+"cmdline", app.requireAuth(pprof.Cmdline)).Methods("GET")
+	router.HandleFunc(PprofPathPrefix+"profile", app.requireAuth(pprof.Profile)).Methods("GET")
+	router.HandleFunc(PprofPathPrefix+"symbol", app.requireAuth(pprof.Symbol)).Methods("GET", "POST")
+	router.HandleFunc(PprofPathPrefix+"trace", app.requireAuth(pprof.Trace)).Methods("GET")
+	// index lists profiles and serves named ones: goroutine, heap, allocs, block, mutex, threadcreate
+	router.PathPrefix(PprofPathPrefix).HandlerFunc(app.requireAuth(pprof.Index)).Methods("GET")
+}
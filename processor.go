@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// results reported by workers and not consumed yet, workers block when it's full
+const EventResultsBuffer = 256
+
+// EventResult is outcome of a single event processing, nil TxID means the event failed
+type EventResult struct {
+	Event *broker.Event
+	TxID  *string
+}
+
+// EventResultHook is called by the results collector for every processed event
+type EventResultHook func(result EventResult)
+
+type ProcessorConfig struct {
+	MaxGoroutines       int           // hard cap on event processing goroutines, 0 means unlimited
+	MaxConcurrentSigns  int           // size of the fixed workers pool, 0 means goroutine per event capped by MaxGoroutines
+	DedupCacheSize      int           // amount of recently signed requests remembered to skip redelivered events, 0 disables
+	EventBufferSize     int           // event messages received from the broker and not taken by the processor yet
+	EventTimeout        time.Duration // single event processing deadline, timed out event is dead-lettered, 0 disables
+	MaxPendingMessages  int           // not committed messages per topic before reading from the broker pauses, 0 means no limit
+	MalformedEventsPath string        // JSON lines log of events with unparsable data, disabled when empty
+	AuditLogPath        string        // JSON lines log of every completed event, AuditStdout for stdout, disabled when empty
+	// signed requests kept across restarts to skip events redelivered after crash, disabled when path is empty
+	SignedRequestsPath          string
+	SignedRequestsMaxCount      int
+	SignedRequestsMaxAge        time.Duration
+	SignedRequestsFlushInterval time.Duration
+}
+
+// reportResult passes event result to the collector, results are tracked in app.pendingResults
+// so drain on shutdown waits for them to be consumed
+func (app *App) reportResult(results chan<- EventResult, result EventResult) {
+	app.pendingResults.Add(1)
+	results <- result
+}
+
+// collectResults consumes results until the chan is closed: commits offsets and calls result hook
+func (app *App) collectResults(results <-chan EventResult) {
+	for result := range results {
+		if offsets, ok := app.offsets[result.Event.EventType]; ok {
+			offsets.resolve(result.Event, result.TxID != nil)
+		}
+		if app.EventResultHook != nil {
+			app.EventResultHook(result)
+		}
+		app.pendingResults.Done()
+	}
+}
+
+// startWorkers runs fixed pool of workers executing jobs until returned chan is closed
+func (app *App) startWorkers(n int) chan<- func() {
+	jobs := make(chan func())
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range jobs {
+				metrics.EventGoroutines.Inc()
+				job()
+				metrics.EventGoroutines.Dec()
+				app.inFlight.Done()
+			}
+		}()
+	}
+	return jobs
+}
+
+// spawn runs f in a new goroutine, when the goroutines cap is reached
+// it waits for a free slot instead of spawning more, returns false if ctx is done meanwhile.
+// Spawned goroutines are tracked in app.inFlight to be drained on shutdown.
+// If workers pool is running f is dispatched to a free worker instead
+func (app *App) spawn(ctx context.Context, f func()) bool {
+	job := f
+	f = func() {
+		atomic.AddInt64(&app.inFlightEvents, 1)
+		defer atomic.AddInt64(&app.inFlightEvents, -1)
+		job()
+	}
+	if app.workerJobs != nil {
+		app.inFlight.Add(1)
+		select {
+		case app.workerJobs <- f:
+			return true
+		case <-ctx.Done():
+			app.inFlight.Done()
+			return false
+		}
+	}
+	if app.goroutineGuard == nil {
+		app.inFlight.Add(1)
+		go func() {
+			defer app.inFlight.Done()
+			f()
+		}()
+		return true
+	}
+	select {
+	case app.goroutineGuard <- struct{}{}:
+	default:
+		metrics.EventGoroutinesLimitReached.Inc()
+		log.Error().Msgf("Event processing goroutines limit %d reached, deferring events", app.Processor.MaxGoroutines)
+		select {
+		case <-ctx.Done():
+			return false
+		case app.goroutineGuard <- struct{}{}:
+		}
+	}
+	metrics.EventGoroutines.Inc()
+	app.inFlight.Add(1)
+	go func() {
+		defer func() {
+			metrics.EventGoroutines.Dec()
+			<-app.goroutineGuard
+			app.inFlight.Done()
+		}()
+		f()
+	}()
+	return true
+}
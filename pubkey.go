@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// RsaPublicKeyQuery returns public half of the loaded RSA key,
+// "rsa_key" value should be passed as is to the casino contract key registration action
+func (app *App) RsaPublicKeyQuery(writer ResponseWriter, req *Request) {
+	publicKey := &app.rsaKey().PublicKey
+	encoded, err := utils.RsaPublicKeyBase64(publicKey)
+	if err != nil {
+		log.Warn().Msgf("failed to encode RSA public key, reason: %s", err.Error())
+		respondWithError(writer, http.StatusInternalServerError, ErrorCodeInternal, "failed to encode RSA public key")
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{
+		"rsa_key":  encoded,
+		"modulus":  hex.EncodeToString(publicKey.N.Bytes()),
+		"exponent": publicKey.E,
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+)
+
+// see: https://github.com/DaoCasino/DAObet/blob/master/libraries/chain/include/eosio/chain/exceptions.hpp
+const (
+	EosExpiredTrxErrorCode       = 3040005
+	EosTrxNotFoundErrorCode      = 3040011 // history plugin doesn't know the trx
+	EosNetUsageExceededErrorCode = 3080002
+	EosCPUUsageExceededErrorCode = 3080004
+	// resource_exhausted_exception range: net/cpu usage exceeded, deadline exceptions etc.
+	EosResourceExhaustedErrorCodeMin = 3080000
+	EosResourceExhaustedErrorCodeMax = 3080999
+	// authorization_exception range: unsatisfied or missing authorization etc.
+	EosAuthorizationErrorCodeMin = 3090000
+	EosAuthorizationErrorCodeMax = 3090999
+)
+
+// push error categories reported in metrics
+const (
+	PushErrorCPUExceeded = "cpu_exceeded"
+	PushErrorNetExceeded = "net_exceeded"
+	PushErrorResource    = "resource" // other exhausted resources: ram, deadline etc.
+	PushErrorDuplicate   = "duplicate"
+	PushErrorExpired     = "expired"
+	PushErrorAuth        = "auth"
+	PushErrorNetwork     = "network" // node is unreachable or responded without chain error
+	PushErrorOther       = "other"
+)
+
+type PushConfig struct {
+	MaxAttempts int
+	BaseDelay   time.Duration // doubled after every failed attempt
+	MaxDelay    time.Duration
+	// push with send_transaction2 to get the failure trace, push_transaction is used if node doesn't support it
+	SendTransaction2 bool
+	Breaker          BreakerConfig
+}
+
+func isDuplicateTrx(err error) bool {
+	apiErr, ok := asAPIError(err)
+	return ok && apiErr.Code == EosInternalErrorCode && apiErr.ErrorStruct.Code == EosInternalDuplicateErrorCode
+}
+
+// classifyPushError maps push failure to one of PushError categories
+func classifyPushError(err error) string {
+	permanent, isPermanent := err.(*utils.PermanentError)
+	if isPermanent {
+		err = permanent.Err
+	}
+	apiErr, ok := asAPIError(err)
+	if !ok || apiErr.Code != EosInternalErrorCode {
+		if isPermanent {
+			// rejected by relay
+			return PushErrorOther
+		}
+		return PushErrorNetwork
+	}
+	switch code := apiErr.ErrorStruct.Code; {
+	case code == EosInternalDuplicateErrorCode:
+		return PushErrorDuplicate
+	case code == EosExpiredTrxErrorCode:
+		return PushErrorExpired
+	case code == EosCPUUsageExceededErrorCode:
+		return PushErrorCPUExceeded
+	case code == EosNetUsageExceededErrorCode:
+		return PushErrorNetExceeded
+	case code >= EosResourceExhaustedErrorCodeMin && code <= EosResourceExhaustedErrorCodeMax:
+		return PushErrorResource
+	case code >= EosAuthorizationErrorCodeMin && code <= EosAuthorizationErrorCodeMax:
+		return PushErrorAuth
+	default:
+		return PushErrorOther
+	}
+}
+
+// isRetryablePushError reports whether push of the category could succeed on the next attempt:
+// network failures and exhausted resources are transient, expired trx is rebuilt with new expiration,
+// rejected trx is not retried
+func isRetryablePushError(category string) bool {
+	switch category {
+	case PushErrorCPUExceeded, PushErrorNetExceeded, PushErrorResource, PushErrorExpired, PushErrorNetwork:
+		return true
+	default:
+		return false
+	}
+}
+
+// TrxBuilder builds trx on the given chain state
+type TrxBuilder func(txOpts *eos.TxOptions) (*eos.PackedTransaction, error)
+
+// failures of trx building stages of buildAndPushWithRetry, they aren't retried
+type chainStateError struct{ error }
+type buildTrxError struct{ error }
+
+// buildAndPushWithRetry builds and pushes trx retrying transient push errors with exponential backoff,
+// every retry fetches fresh chain state and rebuilds trx, so it doesn't reuse stale reference block.
+// Duplicate trx means it was already applied by the previous attempt, not retried push errors are permanent
+func (app *App) buildAndPushWithRetry(ctx context.Context, build TrxBuilder) (*eos.PackedTransaction, string, error) {
+	var packedTx *eos.PackedTransaction
+	var trxID string
+	attempt := 0
+	err := utils.RetryWithBackoffContext(ctx, func() error {
+		if attempt++; attempt > 1 {
+			app.invalidateChainState()
+		}
+		var txOpts *eos.TxOptions
+		err := utils.RetryWithTimeout(func() error {
+			var e error
+			txOpts, e = app.getTxOpts(ctx)
+			return e
+		}, app.HTTP.RetryAmount, app.HTTP.Timeout, app.HTTP.RetryDelay)
+		if err != nil {
+			return utils.Permanent(chainStateError{err})
+		}
+		if packedTx, err = build(txOpts); err != nil {
+			return utils.Permanent(buildTrxError{err})
+		}
+		trxID, err = app.pushAttempt(ctx, packedTx)
+		return err
+	}, app.Push.MaxAttempts, app.Push.BaseDelay, app.Push.MaxDelay)
+	if permanent, ok := err.(*utils.PermanentError); ok {
+		switch permanent.Err.(type) {
+		case chainStateError, buildTrxError:
+			return nil, "", permanent.Err
+		}
+	}
+	return packedTx, trxID, err
+}
+
+// pushAttempt pushes trx once, returned error is permanent unless the push can be retried
+func (app *App) pushAttempt(ctx context.Context, packedTx *eos.PackedTransaction) (string, error) {
+	trxID, err := app.pushTransaction(ctx, packedTx)
+	if err == nil {
+		return trxID, nil
+	}
+	if isCircuitOpen(err) {
+		return "", err
+	}
+	category := classifyPushError(err)
+	metrics.PushErrors.WithLabelValues(category).Inc()
+	if category == PushErrorDuplicate {
+		id, idErr := packedTx.ID()
+		if idErr != nil {
+			return "", utils.Permanent(idErr)
+		}
+		ctxLogger(ctx).Debug().Msgf("Got duplicate trx error, assuming as OK, trxID: %s", id.String())
+		return id.String(), nil
+	}
+	if utils.IsPermanent(err) || !isRetryablePushError(category) {
+		return "", utils.Permanent(err)
+	}
+	ctxLogger(ctx).Debug().Msgf("Push failed with %s error, reason: %s", category, err.Error())
+	return "", err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/rs/zerolog/log"
+)
+
+type RateLimitConfig struct {
+	RPS        float64 // requests per second allowed for all clients together, 0 disables
+	Burst      int
+	PerIPRPS   float64 // requests per second allowed for a single source IP, 0 disables
+	PerIPBurst int
+	MaxClients int // source IPs tracked at once, least recently seen ones are forgotten
+}
+
+// requestCost returns amount of tokens request takes, false means response is already written
+type requestCost func(writer ResponseWriter, req *Request) (int, bool)
+
+// singleRequest is cost of a request signing one trx
+func singleRequest(ResponseWriter, *Request) (int, bool) {
+	return 1, true
+}
+
+// rateLimit returns middleware rejecting requests exceeding global or per source IP rate with 429,
+// limiter state is shared by all handlers wrapped with the returned middleware
+func (app *App) rateLimit() func(cost requestCost, next http.HandlerFunc) http.HandlerFunc {
+	cfg := app.RateLimit
+	if cfg.RPS <= 0 && cfg.PerIPRPS <= 0 {
+		return func(_ requestCost, next http.HandlerFunc) http.HandlerFunc {
+			return next
+		}
+	}
+	var global *utils.TokenBucket
+	if cfg.RPS > 0 {
+		global = utils.NewTokenBucket(cfg.RPS, cfg.Burst)
+	}
+	var clients *utils.LRUCache
+	if cfg.PerIPRPS > 0 {
+		clients = utils.NewLRUCache(cfg.MaxClients)
+	}
+	clientBucket := func(ip string) *utils.TokenBucket {
+		for {
+			if bucket, ok := clients.Get(ip); ok {
+				return bucket.(*utils.TokenBucket)
+			}
+			bucket := utils.NewTokenBucket(cfg.PerIPRPS, cfg.PerIPBurst)
+			if clients.Add(ip, bucket) {
+				return bucket
+			}
+		}
+	}
+	return func(cost requestCost, next http.HandlerFunc) http.HandlerFunc {
+		return func(writer ResponseWriter, req *Request) {
+			n, ok := cost(writer, req)
+			if !ok {
+				return
+			}
+			if clients != nil {
+				ip := remoteIP(req)
+				if !clientBucket(ip).AllowN(n) {
+					log.Warn().Msgf("Rate limited request, path: %s, remote: %s", req.URL.Path, ip)
+					respondWithError(writer, http.StatusTooManyRequests, ErrorCodeRateLimited, "too many requests from the client")
+					return
+				}
+			}
+			if global != nil && !global.AllowN(n) {
+				log.Warn().Msgf("Rate limited request, path: %s", req.URL.Path)
+				respondWithError(writer, http.StatusTooManyRequests, ErrorCodeRateLimited, "too many requests")
+				return
+			}
+			next(writer, req)
+		}
+	}
+}
+
+func remoteIP(req *Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
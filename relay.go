@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+type RelayConfig struct {
+	URL string // if set signed transactions are sent to relay service instead of the node
+}
+
+type relayResponse struct {
+	TransactionID string `json:"transaction_id"`
+}
+
+// pushTransaction sends signidice trx to the relay service if configured or directly to the node,
+// in dry run mode trx is only logged
+func (app *App) pushTransaction(ctx context.Context, packedTx *eos.PackedTransaction) (string, error) {
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		metrics.PushTransactionTimeMs.Observe(elapsed.Seconds() * 1000)
+	}()
+	if app.DryRun {
+		return app.dryRunPush(packedTx)
+	}
+	var trxID string
+	err := app.guardPush(ctx, func() error {
+		var e error
+		if app.Relay.URL == "" {
+			trxID, e = app.pushToNode(ctx, packedTx)
+		} else {
+			trxID, e = app.relayTransaction(ctx, packedTx)
+		}
+		return e
+	})
+	return trxID, err
+}
+
+// relayTransaction POSTs packed trx in push_transaction format to the relay,
+// 4xx responses are considered permanent and aren't retried
+func (app *App) relayTransaction(ctx context.Context, packedTx *eos.PackedTransaction) (string, error) {
+	body, err := jsonCodec.Marshal(packedTx)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: app.HTTP.Timeout}
+	var trxID string
+	var permanentErr error
+	err = utils.Retry(func() error {
+		req, err := http.NewRequest(http.MethodPost, app.Relay.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			permanentErr = fmt.Errorf("relay rejected trx, status: %d, body: %s", resp.StatusCode, content)
+			return nil
+		}
+		if resp.StatusCode > 299 {
+			return fmt.Errorf("relay failed, status: %d, body: %s", resp.StatusCode, content)
+		}
+		result := relayResponse{}
+		if err := jsonCodec.Unmarshal(content, &result); err != nil || result.TransactionID == "" {
+			id, err := packedTx.ID()
+			if err != nil {
+				return err
+			}
+			result.TransactionID = id.String()
+		}
+		trxID = result.TransactionID
+		return nil
+	}, app.HTTP.RetryAmount, app.HTTP.RetryDelay)
+	if err != nil {
+		return "", err
+	}
+	if permanentErr != nil {
+		return "", utils.Permanent(permanentErr)
+	}
+	log.Debug().Msgf("Relayed trx, trxID: %s", trxID)
+	return trxID, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// ListenerFactory creates a standalone broker listener which delivers messages to events chan
+type ListenerFactory func(events chan<- *broker.EventMessage) EventListener
+
+type ReplayRequest struct {
+	Topic *broker.EventType `json:"topic"` // first subscribed topic when not set
+	From  uint64            `json:"from"`
+	To    uint64            `json:"to"`
+}
+
+type ReplayResult struct {
+	Topic     broker.EventType `json:"topic"`
+	From      uint64           `json:"from"`
+	To        uint64           `json:"to"`
+	Processed int              `json:"processed"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	TxIDs     []string         `json:"txids"`
+}
+
+// ReplayRange reprocesses events with offsets in [from, to] using an ephemeral subscription,
+// main subscription and committed offset are left untouched
+func (app *App) ReplayRange(ctx context.Context, topic broker.EventType, from, to uint64) (*ReplayResult, error) {
+	if app.NewReplayListener == nil {
+		return nil, fmt.Errorf("replay listener is not configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, app.Broker.ReplayTimeout)
+	defer cancel()
+
+	events := make(chan *broker.EventMessage)
+	listener := app.NewReplayListener(events)
+	go listener.Run(ctx)
+	if _, err := listener.Subscribe(topic, from); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, err := listener.Unsubscribe(topic); err != nil {
+			log.Warn().Msgf("Failed to unsubscribe replay listener, reason: %s", err.Error())
+		}
+	}()
+
+	result := &ReplayResult{Topic: topic, From: from, To: to, TxIDs: []string{}}
+	for {
+		select {
+		case <-ctx.Done():
+			return result, fmt.Errorf("replay interrupted after %d events: %s", result.Processed, ctx.Err().Error())
+		case eventMessage := <-events:
+			for _, event := range eventMessage.Events {
+				if event.Offset < from || event.Offset > to {
+					continue
+				}
+				result.Processed++
+				if txID := app.handleEvent(ctx, event); txID != nil {
+					result.Succeeded++
+					result.TxIDs = append(result.TxIDs, *txID)
+				} else {
+					result.Failed++
+				}
+			}
+			if eventMessage.Offset >= to {
+				return result, nil
+			}
+		}
+	}
+}
+
+func (app *App) ReplayQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /replay")
+	rawRequest, ok := app.readBody(writer, req)
+	if !ok {
+		return
+	}
+	replayReq := &ReplayRequest{}
+	if err := app.decodeInput(rawRequest, replayReq); err != nil {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeDeserializeFailed,
+			app.inputError("failed to deserialize replay request", err))
+		return
+	}
+	if replayReq.From > replayReq.To {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid offset range")
+		return
+	}
+	topic := app.Broker.Topics[0].ID
+	if replayReq.Topic != nil {
+		topic = *replayReq.Topic
+	}
+	if _, ok := app.offsets[topic]; !ok {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "topic is not subscribed")
+		return
+	}
+	result, err := app.ReplayRange(req.Context(), topic, replayReq.From, replayReq.To)
+	if err != nil {
+		log.Warn().Msgf("failed to replay events, reason: %s", err.Error())
+		if result == nil {
+			respondWithError(writer, http.StatusInternalServerError, ErrorCodeInternal,
+				"failed to replay events, reason: "+err.Error())
+			return
+		}
+		respondWithJSON(writer, http.StatusGatewayTimeout, JSONResponse{"error": err.Error(), "result": result})
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": result})
+}
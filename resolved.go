@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+// ResolvedCheckConfig enables lookup of the request session in the game contract before signing,
+// so redelivered events of already resolved requests don't end up in a duplicate push
+type ResolvedCheckConfig struct {
+	Enabled bool
+	Table   eos.TableName // sessions table of the game contract, scoped by the contract and keyed by request ID
+	// session state waiting for signidice_part_2, session in any other state or removed one is resolved
+	PendingState uint8
+}
+
+// requestResolved reports whether the game contract doesn't wait for signidice_part_2 of the event request anymore
+func (app *App) requestResolved(ctx context.Context, event *broker.Event) (bool, error) {
+	requestID := strconv.FormatUint(event.RequestID, 10)
+	var resp *eos.GetTableRowsResp
+	err := app.chainRequest(ctx, "get_table_rows", func() error {
+		var e error
+		resp, e = app.bcAPI.GetTableRows(eos.GetTableRowsRequest{
+			Code:       event.Sender,
+			Scope:      event.Sender,
+			Table:      string(app.ResolvedCheck.Table),
+			LowerBound: requestID,
+			UpperBound: requestID,
+			Limit:      1,
+			JSON:       true,
+		})
+		return e
+	})
+	if err != nil {
+		return false, err
+	}
+	var rows []struct {
+		State uint8 `json:"state"`
+	}
+	if err := json.Unmarshal(resp.Rows, &rows); err != nil {
+		return false, err
+	}
+	return len(rows) == 0 || rows[0].State != app.ResolvedCheck.PendingState, nil
+}
+
+// ResolvedRequestsEventMiddleware drops events of requests already resolved on chain,
+// events are processed as usual when the check fails
+func (app *App) ResolvedRequestsEventMiddleware(next EventHandler) EventHandler {
+	return func(ctx context.Context, event *broker.Event) *string {
+		resolved, err := app.requestResolved(ctx, event)
+		if err != nil {
+			log.Warn().Msgf("Failed to check whether request is resolved, sessionID: %d, reason: %s",
+				event.RequestID, err.Error())
+			return next(ctx, event)
+		}
+		if !resolved {
+			return next(ctx, event)
+		}
+		metrics.ResolvedEvents.Inc()
+		log.Info().Msgf("Skipping event of already resolved request, sessionID: %d, sender: %s",
+			event.RequestID, event.Sender)
+		if offsets, ok := app.offsets[event.EventType]; ok {
+			offsets.drop(event)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/rs/zerolog/log"
+)
+
+type TopUpConfig struct {
+	Contract   eos.AccountName
+	Action     eos.ActionName
+	Permission eos.PermissionName
+	Data       json.RawMessage // action arguments, packed with the contract ABI
+}
+
+type ResourcesConfig struct {
+	Enabled   bool
+	Interval  time.Duration
+	Account   eos.AccountName // account paying for trxs, casino account if empty
+	Threshold float64         // free resource share triggering warning, e.g. 0.1
+	TopUp     TopUpConfig     // action to push when resources are low, disabled if Action is empty
+}
+
+const (
+	ResourceCPU = "cpu"
+	ResourceNET = "net"
+	ResourceRAM = "ram"
+)
+
+type ResourceUsage struct {
+	Resource string
+	Used     int64
+	Max      int64
+}
+
+func (u ResourceUsage) FreeRatio() float64 {
+	return float64(u.Max-u.Used) / float64(u.Max)
+}
+
+// ResourceHook is called with resources which went below threshold
+type ResourceHook func(low []ResourceUsage) error
+
+func (app *App) resourcesAccount() eos.AccountName {
+	if app.Resources.Account != "" {
+		return app.Resources.Account
+	}
+	return app.BlockChain.CasinoAccountName
+}
+
+// RunResourceMonitor periodically checks account resources until ctx is done
+func (app *App) RunResourceMonitor(ctx context.Context) {
+	ticker := time.NewTicker(app.Resources.Interval)
+	defer ticker.Stop()
+	for {
+		if err := app.checkResources(); err != nil {
+			log.Warn().Msgf("Failed to check account resources, account: %s, reason: %s",
+				app.resourcesAccount(), err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *App) checkResources() error {
+	account, err := app.bcAPI.GetAccount(app.resourcesAccount())
+	if err != nil {
+		return err
+	}
+	usages := []ResourceUsage{
+		{ResourceCPU, int64(account.CPULimit.Max - account.CPULimit.Available), int64(account.CPULimit.Max)},
+		{ResourceNET, int64(account.NetLimit.Max - account.NetLimit.Available), int64(account.NetLimit.Max)},
+		{ResourceRAM, int64(account.RAMUsage), int64(account.RAMQuota)},
+	}
+	var low []ResourceUsage
+	for _, usage := range usages {
+		if usage.Max <= 0 {
+			// unlimited resource
+			continue
+		}
+		metrics.AccountResourceFreeRatio.WithLabelValues(usage.Resource).Set(usage.FreeRatio())
+		if usage.FreeRatio() < app.Resources.Threshold {
+			metrics.AccountResourceLow.WithLabelValues(usage.Resource).Inc()
+			log.Warn().Msgf("Account resource is running low, account: %s, resource: %s, used: %d, max: %d",
+				app.resourcesAccount(), usage.Resource, usage.Used, usage.Max)
+			low = append(low, usage)
+		}
+	}
+	if len(low) == 0 || app.ResourceLowHook == nil {
+		return nil
+	}
+	if err := app.ResourceLowHook(low); err != nil {
+		return fmt.Errorf("resource hook failed: %s", err.Error())
+	}
+	return nil
+}
+
+// topUp pushes configured top-up action (e.g. powerup or delegatebw)
+func (app *App) topUp(low []ResourceUsage) error {
+	cfg := app.Resources.TopUp
+	var payload eos.M
+	if err := jsonCodec.Unmarshal(cfg.Data, &payload); err != nil {
+		return fmt.Errorf("invalid top-up action data: %s", err.Error())
+	}
+	data, err := app.bcAPI.ABIJSONToBin(cfg.Contract, eos.Name(cfg.Action), payload)
+	if err != nil {
+		return err
+	}
+	action := &eos.Action{
+		Account:       cfg.Contract,
+		Name:          cfg.Action,
+		Authorization: []eos.PermissionLevel{{Actor: app.resourcesAccount(), Permission: cfg.Permission}},
+		ActionData:    eos.NewActionDataFromHexData(data),
+	}
+	txOpts, err := app.getTxOpts(context.Background())
+	if err != nil {
+		return err
+	}
+	tx := eos.NewSignedTransaction(NewTransaction([]*eos.Action{action}, txOpts, app.TrxExpiration))
+	signer, err := trxSigner(app.bcAPI)
+	if err != nil {
+		return err
+	}
+	availableKeys, err := signer.AvailableKeys()
+	if err != nil {
+		return err
+	}
+	var requiredKeys []ecc.PublicKey
+	if err := app.chainRequest(context.Background(), "get_required_keys", func() error {
+		var e error
+		requiredKeys, e = GetRequiredKeys(context.Background(), app.bcAPI, tx.Transaction, availableKeys)
+		return e
+	}); err != nil {
+		return err
+	}
+	signedTx, err := signer.Sign(tx, txOpts.ChainID, requiredKeys...)
+	if err != nil {
+		return err
+	}
+	packedTx, err := signedTx.Pack(txOpts.Compress)
+	if err != nil {
+		return err
+	}
+	trxID, err := app.pushTransaction(context.Background(), packedTx)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Sent resources top-up txn, account: %s, trxID: %s", app.resourcesAccount(), trxID)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/rs/zerolog/log"
+)
+
+type ReloadRsaRequest struct {
+	RSAKey string `json:"rsa_key"` // base64 encoded PEM with PKCS1 or PKCS8 private key
+}
+
+// known message which digest is signed by the startup self-test
+const rsaSelfTestMessage = "casino-backend RSA self-test"
+
+// CheckRsaKeyPair signs known digest and verifies it with the public key, so RSA key which doesn't match
+// the one registered in the contract fails startup instead of every signidice_part_2 on-chain
+func CheckRsaKeyPair(key *rsa.PrivateKey, pub *rsa.PublicKey, hash crypto.Hash) error {
+	if !hash.Available() {
+		return fmt.Errorf("digest hash %d is not available", hash)
+	}
+	h := hash.New()
+	h.Write([]byte(rsaSelfTestMessage))
+	digest := h.Sum(nil)
+	signature, err := utils.RsaSign(digest, key, hash)
+	if err != nil {
+		return fmt.Errorf("failed to sign self-test digest: %s", err.Error())
+	}
+	if err := utils.RsaVerify(digest, signature, pub, hash); err != nil {
+		return fmt.Errorf("RSA key doesn't match RSA public key: %s", err.Error())
+	}
+	return nil
+}
+
+// rsaKey returns current signing key, signings started before the reload keep using the old one
+func (app *App) rsaKey() *rsa.PrivateKey {
+	app.rsaKeyLock.RLock()
+	defer app.rsaKeyLock.RUnlock()
+	return app.BlockChain.RSAKey
+}
+
+func (app *App) setRsaKey(key *rsa.PrivateKey) {
+	app.rsaKeyLock.Lock()
+	defer app.rsaKeyLock.Unlock()
+	app.BlockChain.RSAKey = key
+}
+
+// ReloadRsaQuery replaces RSA signing key without restart,
+// the endpoint is disabled unless auth token is configured
+func (app *App) ReloadRsaQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /reload_rsa")
+	if app.Auth.Token == "" {
+		respondWithError(writer, http.StatusForbidden, ErrorCodeUnauthorized, "RSA key reload requires auth token")
+		return
+	}
+	rawRequest, _ := ioutil.ReadAll(req.Body)
+	reloadReq := &ReloadRsaRequest{}
+	if err := app.decodeInput(rawRequest, reloadReq); err != nil {
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeDeserializeFailed,
+			app.inputError("failed to deserialize reload request", err))
+		return
+	}
+	key, err := utils.ReadRsa(reloadReq.RSAKey, app.BlockChain.RSAKeyPassphrase)
+	if err != nil {
+		log.Warn().Msgf("failed to parse RSA key, reason: %s", err.Error())
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid RSA key")
+		return
+	}
+	if err := key.Validate(); err != nil {
+		log.Warn().Msgf("RSA key is invalid, reason: %s", err.Error())
+		respondWithError(writer, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid RSA key")
+		return
+	}
+	app.setRsaKey(key)
+	encoded, err := utils.RsaPublicKeyBase64(&key.PublicKey)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, ErrorCodeInternal, "failed to encode RSA public key")
+		return
+	}
+	log.Info().Msgf("RSA key reloaded, public key: %s", encoded)
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "ok", "rsa_key": encoded})
+}
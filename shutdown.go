@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type ShutdownConfig struct {
+	HTTPTimeout   time.Duration // grace period of in-flight requests, remaining connections are closed after it
+	BrokerTimeout time.Duration
+	DrainTimeout  time.Duration
+	OffsetTimeout time.Duration
+}
+
+type shutdownStep struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// shutdown runs steps one by one, step which exceeds its timeout is abandoned
+// and shutdown proceeds with the next one
+func shutdown(steps []shutdownStep) {
+	for i, step := range steps {
+		step := step
+		log.Info().Msgf("Shutdown step %d: %s", i+1, step.name)
+		ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+		done := make(chan error, 1)
+		go func() { done <- step.run(ctx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Error().Msgf("Shutdown step %s failed, reason: %s", step.name, err.Error())
+			}
+		case <-ctx.Done():
+			log.Error().Msgf("Shutdown step %s timed out after %s", step.name, step.timeout)
+		}
+		cancel()
+	}
+}
+
+// stopHTTP gracefully stops the http server, remaining connections are closed when ctx is done
+func (app *App) stopHTTP(ctx context.Context) error {
+	server := app.getServer()
+	if server == nil {
+		return nil
+	}
+	return stopServer(ctx, func() { _ = server.Shutdown(context.Background()) }, func() { _ = server.Close() })
+}
+
+// stopServer waits for graceful shutdown to finish in-flight requests,
+// when ctx is done first remaining connections are closed with shutdownNow, so hung handler can't block shutdown
+func stopServer(ctx context.Context, shutdown, shutdownNow func()) error {
+	done := make(chan struct{})
+	go func() {
+		shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		shutdownNow()
+		return fmt.Errorf("connections were closed forcibly")
+	}
+}
+
+// unsubscribeTopics drops subscriptions of all topics on the broker side, failed topic doesn't stop unsubscribing the rest
+func (app *App) unsubscribeTopics(ctx context.Context) error {
+	failed := 0
+	for _, topic := range app.Broker.Topics {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, err := app.BrokerClient.Unsubscribe(topic.ID); err != nil {
+			log.Warn().Msgf("Failed to unsubscribe from topic %d, reason: %s", topic.ID, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to unsubscribe from %d of %d topics", failed, len(app.Broker.Topics))
+	}
+	return nil
+}
+
+// shutdownSteps returns ordered shutdown sequence: stop accepting requests, unsubscribe from broker,
+// stop the processor, drain in-flight events, flush offset, report
+func (app *App) shutdownSteps(stopHTTP func(ctx context.Context) error, stopProcessor func()) []shutdownStep {
+	return []shutdownStep{
+		{"stop accepting requests", app.Shutdown.HTTPTimeout, func(ctx context.Context) error {
+			app.setReady(false)
+			return stopHTTP(ctx)
+		}},
+		{"unsubscribe from broker", app.Shutdown.BrokerTimeout, app.unsubscribeTopics},
+		// separate step, so the processor is stopped even if unsubscribe hangs
+		{"stop event processor", app.Shutdown.BrokerTimeout, func(ctx context.Context) error {
+			stopProcessor()
+			return nil
+		}},
+		{"drain in-flight events", app.Shutdown.DrainTimeout, func(ctx context.Context) error {
+			drained := make(chan struct{})
+			go func() {
+				app.inFlight.Wait()
+				app.pendingResults.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+				return nil
+			case <-ctx.Done():
+				// abandoned events stop waiting for node calls
+				app.cancelEvents()
+				return ctx.Err()
+			}
+		}},
+		{"close audit log", app.Shutdown.OffsetTimeout, func(ctx context.Context) error {
+			if app.auditLog == nil {
+				return nil
+			}
+			return app.auditLog.Close()
+		}},
+		{"flush signed requests", app.Shutdown.OffsetTimeout, func(ctx context.Context) error {
+			if app.signedRequests == nil {
+				return nil
+			}
+			return app.signedRequests.Close()
+		}},
+		{"flush offset", app.Shutdown.OffsetTimeout, func(ctx context.Context) error {
+			if s, ok := app.OffsetStore.(interface{ Sync() error }); ok {
+				if err := s.Sync(); err != nil {
+					return err
+				}
+			}
+			if c, ok := app.OffsetStore.(io.Closer); ok {
+				return c.Close()
+			}
+			return nil
+		}},
+		{"report", time.Second, func(ctx context.Context) error {
+			log.Info().Msgf("Stopped, processed events: %d, failed events: %d",
+				atomic.LoadUint64(&app.processedEvents), atomic.LoadUint64(&app.failedEvents))
+			return nil
+		}},
+	}
+}
+
+// IsReady reports whether app is subscribed to the broker, fetched chain state and accepts requests
+func (app *App) IsReady() bool {
+	return atomic.LoadInt32(&app.ready) == 1
+}
+
+func (app *App) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&app.ready, value)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+type SigningCapConfig struct {
+	MaxPerAccount int           // deposit trxs signed per casino account within a window, 0 disables
+	Window        time.Duration // windows are aligned to UTC midnight, so 24h one resets daily at 00:00 UTC
+	Path          string        // file the counts are kept in across restarts, in memory only when empty
+}
+
+// signingCapState is persisted counts of the current window
+type signingCapState struct {
+	WindowStart time.Time               `json:"window_start"`
+	Counts      map[eos.AccountName]int `json:"counts"`
+}
+
+// signingCap limits deposit trxs signed per casino account within a window, so an abused deposit key
+// can't sign more than the cap until the window is over
+type signingCap struct {
+	lock    sync.Mutex
+	max     int
+	window  time.Duration
+	state   signingCapState   // guarded by lock
+	storage *utils.AtomicFile // nil when counts aren't persisted
+	now     func() time.Time
+}
+
+func newSigningCap(cfg SigningCapConfig) *signingCap {
+	if cfg.MaxPerAccount <= 0 {
+		return nil
+	}
+	return &signingCap{max: cfg.MaxPerAccount, window: cfg.Window, now: time.Now,
+		state: signingCapState{Counts: make(map[eos.AccountName]int)}}
+}
+
+// load reads counts stored before and persists further ones to storage, counts of a passed window are dropped
+func (c *signingCap) load(storage *utils.AtomicFile) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	content, err := ioutil.ReadAll(storage)
+	if err != nil {
+		return err
+	}
+	if content = bytes.TrimSpace(content); len(content) > 0 {
+		var state signingCapState
+		if err := json.Unmarshal(content, &state); err != nil {
+			return fmt.Errorf("invalid signing cap file content: %s", err.Error())
+		}
+		if state.Counts != nil {
+			c.state = state
+		}
+	}
+	c.storage = storage
+	c.rotate()
+	return nil
+}
+
+// rotate resets counts when the current window is over, lock should be held
+func (c *signingCap) rotate() {
+	start := c.now().UTC().Truncate(c.window)
+	if !c.state.WindowStart.Equal(start) {
+		c.state = signingCapState{WindowStart: start, Counts: make(map[eos.AccountName]int)}
+	}
+}
+
+// take counts a trx of the account, returns false if the cap is reached
+func (c *signingCap) take(account eos.AccountName) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rotate()
+	if c.state.Counts[account] >= c.max {
+		return false
+	}
+	c.state.Counts[account]++
+	c.persist()
+	return true
+}
+
+// refund returns the count taken for a trx which wasn't signed
+func (c *signingCap) refund(account eos.AccountName) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rotate()
+	if c.state.Counts[account] > 0 {
+		c.state.Counts[account]--
+		c.persist()
+	}
+}
+
+// resetsAt returns when the current window is over
+func (c *signingCap) resetsAt() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rotate()
+	return c.state.WindowStart.Add(c.window)
+}
+
+// persist writes counts, a failure is logged only as in-memory counts are still enforced; lock should be held
+func (c *signingCap) persist() {
+	if c.storage == nil {
+		return
+	}
+	content, err := json.Marshal(c.state)
+	if err == nil {
+		err = c.storage.WriteAtomic(content)
+	}
+	if err != nil {
+		log.Warn().Msgf("Failed to persist signing cap counts, reason: %s", err.Error())
+	}
+}
+
+// takeSigningCap counts deposit trx of the casino account against the cap before it's signed
+func (app *App) takeSigningCap(account eos.AccountName) *depositError {
+	if app.signingCap == nil || app.signingCap.take(account) {
+		return nil
+	}
+	metrics.SigningCapExceeded.WithLabelValues(string(account)).Inc()
+	resetsAt := app.signingCap.resetsAt()
+	log.Warn().Msgf("Signing cap of %d trxs is reached, account: %s, resets at: %s",
+		app.signingCap.max, account, resetsAt.Format(time.RFC3339))
+	return &depositError{http.StatusTooManyRequests, ErrorCodeSigningCapExceeded,
+		fmt.Sprintf("signing cap of %d trxs is reached for the account, resets at %s",
+			app.signingCap.max, resetsAt.Format(time.RFC3339))}
+}
+
+// refundSigningCap returns the count of deposit trx failed to be signed
+func (app *App) refundSigningCap(account eos.AccountName) {
+	if app.signingCap != nil {
+		app.signingCap.refund(account)
+	}
+}
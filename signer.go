@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+)
+
+// DigestSigner signs signidice digest and returns base64 signature expected by the contract,
+// so the key can be kept outside of the service, e.g. in KMS or HSM
+type DigestSigner interface {
+	Sign(digest eos.Checksum256) (string, error)
+}
+
+// LocalRsaSigner signs with RSA key held in memory, key is taken on every signing so reloaded key applies at once
+type LocalRsaSigner struct {
+	Key  func() *rsa.PrivateKey
+	Hash crypto.Hash // hash the digests are made with
+}
+
+func (s LocalRsaSigner) Sign(digest eos.Checksum256) (string, error) {
+	return utils.RsaSign(digest, s.Key(), s.Hash)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// Standby mode: instance subscribes and follows the broker stream advancing
+// its own (shadow) offset, but doesn't sign or push anything until promoted.
+//
+// Leader election is out of scope of the service: it's assumed that an external
+// coordinator (orchestrator, lease holder or operator) promotes exactly one instance
+// and only after the previous active one is stopped, otherwise both will sign the same events.
+// Active instance can't be demoted back to standby without restart.
+
+func (app *App) IsStandby() bool {
+	return atomic.LoadInt32(&app.standby) == 1
+}
+
+// ShadowOffset returns offset of the topic reached by the instance while in standby mode
+func (app *App) ShadowOffset(topic broker.EventType) uint64 {
+	if offset, ok := app.shadowOffsets[topic]; ok {
+		return atomic.LoadUint64(offset)
+	}
+	return 0
+}
+
+// storeMaxOffset advances shadow offset, older offset of a redelivered message is ignored
+func storeMaxOffset(shadow *uint64, offset uint64) {
+	for {
+		current := atomic.LoadUint64(shadow)
+		if offset <= current || atomic.CompareAndSwapUint64(shadow, current, offset) {
+			return
+		}
+	}
+}
+
+// ShadowOffsets returns offsets of all subscribed topics reached while in standby mode
+func (app *App) ShadowOffsets() map[broker.EventType]uint64 {
+	offsets := make(map[broker.EventType]uint64, len(app.Broker.Topics))
+	for _, topic := range app.Broker.Topics {
+		offsets[topic.ID] = app.ShadowOffset(topic.ID)
+	}
+	return offsets
+}
+
+// Promote switches standby instance to active, returns false if it was active already
+func (app *App) Promote() bool {
+	return atomic.CompareAndSwapInt32(&app.standby, 1, 0)
+}
+
+func (app *App) PromoteQuery(writer ResponseWriter, req *Request) {
+	log.Info().Msg("Called /promote")
+	if !app.Promote() {
+		respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "already active"})
+		return
+	}
+	offsets := app.ShadowOffsets()
+	log.Info().Msgf("Promoted to active, shadow offsets: %v", offsets)
+	// offset of the first topic is kept for single topic clients
+	respondWithJSON(writer, http.StatusOK, JSONResponse{"result": "promoted",
+		"offset": app.ShadowOffset(app.Broker.Topics[0].ID), "offsets": offsets})
+}
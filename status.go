@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// node which head block num doesn't change that long is reported as stalled, blocks are produced every 0.5s
+const ChainStallTimeout = 30 * time.Second
+
+// StatusQuery reports signer progress: committed offset per topic, events processed since start,
+// time of the last event received from the broker and chain state of the node
+func (app *App) StatusQuery(writer ResponseWriter, req *Request) {
+	offsets := make(map[broker.EventType]uint64, len(app.Broker.Topics))
+	for _, topic := range app.Broker.Topics {
+		offset, err := app.offsets[topic.ID].committed(topic.Offset)
+		if err != nil {
+			log.Warn().Msgf("Failed to read committed offset of topic %d, reason: %s", topic.ID, err.Error())
+			continue
+		}
+		offsets[topic.ID] = offset
+	}
+	var lastEvent *time.Time
+	if received := app.LastEventReceived(); !received.IsZero() {
+		received = received.UTC()
+		lastEvent = &received
+	}
+	status := JSONResponse{
+		"signs_per_minute": metrics.SigniDiceSignRate.RatePerMinute(),
+		"offsets":          offsets,
+		"casino_account":   app.BlockChain.CasinoAccountName,
+		"uptime_seconds":   int64(time.Since(app.started) / time.Second),
+		"processed_events": atomic.LoadUint64(&app.processedEvents),
+		"failed_events":    atomic.LoadUint64(&app.failedEvents),
+		"last_event_time":  lastEvent, // null until the first event is received
+		"push_breaker":     app.pushBreakerState(),
+		"drained":          app.IsDrained(),
+		"in_flight_events": app.InFlightEvents(),
+	}
+	for key, value := range app.chainStatus(req.Context()) {
+		status[key] = value
+	}
+	respondWithJSON(writer, http.StatusOK, status)
+}
+
+// chainStatus reports head and last irreversible block of the node, info is cached for GetInfoCacheTTL
+func (app *App) chainStatus(ctx context.Context) JSONResponse {
+	info, err := app.getInfo(ctx)
+	if err != nil {
+		log.Warn().Msgf("Failed to get chain info, reason: %s", err.Error())
+		return JSONResponse{"chain_error": err.Error()}
+	}
+	app.lastGetInfoLock.Lock()
+	stalled := time.Since(app.headBlockChanged) >= ChainStallTimeout
+	app.lastGetInfoLock.Unlock()
+	return JSONResponse{
+		"head_block_num":              info.HeadBlockNum,
+		"last_irreversible_block_num": info.LastIrreversibleBlockNum,
+		"chain_id":                    info.ChainID,
+		"chain_stalled":               stalled, // head block num hasn't changed within ChainStallTimeout
+	}
+}
+
+// pushBreakerState returns state of the push circuit breaker, "disabled" when it's not configured
+func (app *App) pushBreakerState() string {
+	if app.pushBreaker == nil {
+		return "disabled"
+	}
+	return app.pushBreaker.State()
+}
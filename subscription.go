@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaoCasino/casino-backend/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// subscribeTopics subscribes to every topic from its last committed offset
+func (app *App) subscribeTopics() error {
+	for _, topic := range app.Broker.Topics {
+		offset, err := app.offsets[topic.ID].committed(topic.Offset)
+		if err != nil {
+			log.Warn().Msgf("Failed to read committed offset of topic %d, reason: %s", topic.ID, err.Error())
+			return err
+		}
+		if _, err = app.BrokerClient.Subscribe(topic.ID, offset); err != nil {
+			log.Warn().Msgf("Failed to subscribe to topic %d, reason: %s", topic.ID, err.Error())
+			return err
+		}
+		app.offsetGaps.expect(topic.ID, offset)
+		log.Debug().Msgf("subscribed to topic %d with offset %v", topic.ID, offset)
+	}
+	app.touchSubscription()
+	return nil
+}
+
+// touchSubscription marks subscription as alive, it's called on subscribe and on every received event message
+func (app *App) touchSubscription() {
+	atomic.StoreInt64(&app.subscriptionActivity, time.Now().UnixNano())
+}
+
+func (app *App) eventReceived() {
+	atomic.StoreInt64(&app.lastEventReceived, time.Now().UnixNano())
+	app.touchSubscription()
+}
+
+// LastEventReceived returns time of the last event message from the broker, zero if nothing is received yet
+func (app *App) LastEventReceived() time.Time {
+	if stamp := atomic.LoadInt64(&app.lastEventReceived); stamp != 0 {
+		return time.Unix(0, stamp)
+	}
+	return time.Time{}
+}
+
+// resubscribe renews subscriptions of all topics from their committed offsets,
+// events received but not committed yet are redelivered and skipped by dedup
+func (app *App) resubscribe() error {
+	for _, topic := range app.Broker.Topics {
+		if _, err := app.BrokerClient.Unsubscribe(topic.ID); err != nil {
+			log.Warn().Msgf("Failed to unsubscribe from topic %d, reason: %s", topic.ID, err.Error())
+		}
+	}
+	return app.subscribeTopics()
+}
+
+// RunSubscriptionWatchdog re-subscribes when no event messages are received within idle window,
+// because broker may expire subscriptions silently
+func (app *App) RunSubscriptionWatchdog(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&app.subscriptionActivity)))
+			if since < idle || app.IsDrained() {
+				continue
+			}
+			log.Warn().Msgf("No events received for %s, re-subscribing", since.Truncate(time.Second))
+			metrics.BrokerResubscribes.Inc()
+			if err := app.resubscribe(); err != nil {
+				log.Error().Msgf("Failed to re-subscribe, reason: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type TLSConfig struct {
+	CertFile string // PEM encoded, HTTPS is served when both files are set
+	KeyFile  string
+}
+
+// Enabled is true when both files are set, config with only one of them is rejected by Validate
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// ServerConfig tunes API server connections, 0 timeouts mean no limit
+type ServerConfig struct {
+	ReadTimeout  time.Duration // reading the whole request including body, slow clients are cut off after it
+	WriteTimeout time.Duration // from the end of request headers to the end of response, covers signing and pushing
+	IdleTimeout  time.Duration // keep-alive connection waiting for the next request, ReadTimeout when 0
+	HTTP2        bool          // negotiate HTTP/2 when TLS is enabled, plain HTTP is served with HTTP/1.1 only
+}
+
+// ListenAndServe serves API on addr over HTTPS when TLS is configured, plain HTTP otherwise
+func (app *App) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return app.Serve(listener)
+}
+
+// Serve serves API on listener until stopHTTP is called
+func (app *App) Serve(listener net.Listener) error {
+	server := &http.Server{
+		Handler:      app.GetRouter(),
+		ReadTimeout:  app.Server.ReadTimeout,
+		WriteTimeout: app.Server.WriteTimeout,
+		IdleTimeout:  app.Server.IdleTimeout,
+	}
+	var err error
+	if app.TLS.Enabled() {
+		cert, loadErr := tls.LoadX509KeyPair(app.TLS.CertFile, app.TLS.KeyFile)
+		if loadErr != nil {
+			listener.Close()
+			return fmt.Errorf("failed to load TLS key pair: %s", loadErr.Error())
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if !app.Server.HTTP2 {
+			// non-nil map disables HTTP/2 set up by net/http
+			server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		app.setServer(server)
+		log.Info().Msgf("Serving HTTPS on %s, HTTP/2: %t", listener.Addr(), app.Server.HTTP2)
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		app.setServer(server)
+		log.Warn().Msgf("TLS is not configured, serving plain HTTP on %s", listener.Addr())
+		err = server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (app *App) setServer(server *http.Server) {
+	app.serverLock.Lock()
+	defer app.serverLock.Unlock()
+	app.server = server
+}
+
+func (app *App) getServer() *http.Server {
+	app.serverLock.Lock()
+	defer app.serverLock.Unlock()
+	return app.server
+}
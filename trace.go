@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DaoCasino/casino-backend/utils"
+	"github.com/eoscanada/eos-go"
+	"github.com/rs/zerolog/log"
+)
+
+const sendTransaction2Path = "/v1/chain/send_transaction2"
+
+var errNotSupported = errors.New("not supported by the node")
+
+type sendTransaction2Request struct {
+	ReturnFailureTrace bool                   `json:"return_failure_trace"`
+	RetryTrx           bool                   `json:"retry_trx"`
+	Transaction        *eos.PackedTransaction `json:"transaction"`
+}
+
+// traceException is fc::exception of the trx or action trace
+type traceException struct {
+	Code    int    `json:"code"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+	Stack   []struct {
+		Format string                 `json:"format"`
+		Data   map[string]interface{} `json:"data"`
+	} `json:"stack"`
+}
+
+type sendTransaction2Response struct {
+	TransactionID string `json:"transaction_id"`
+	Processed     struct {
+		Except       *traceException `json:"except"`
+		ActionTraces []struct {
+			Receiver eos.AccountName `json:"receiver"`
+			Console  string          `json:"console"`
+			Except   *traceException `json:"except"`
+		} `json:"action_traces"`
+	} `json:"processed"`
+}
+
+// TrxTraceError is trx rejection reported by send_transaction2 with the failure trace
+type TrxTraceError struct {
+	eos.APIError
+	Trace string // consoles and exceptions of the trx actions
+}
+
+// asAPIError returns node error of push_transaction or send_transaction2
+func asAPIError(err error) (eos.APIError, bool) {
+	if permanent, ok := err.(*utils.PermanentError); ok {
+		err = permanent.Err
+	}
+	switch e := err.(type) {
+	case eos.APIError:
+		return e, true
+	case *TrxTraceError:
+		return e.APIError, true
+	}
+	return eos.APIError{}, false
+}
+
+// failureTrace returns trace of the failed push, empty if node didn't report it
+func failureTrace(err error) string {
+	if permanent, ok := err.(*utils.PermanentError); ok {
+		err = permanent.Err
+	}
+	if traceErr, ok := err.(*TrxTraceError); ok {
+		return traceErr.Trace
+	}
+	return ""
+}
+
+// details renders exception stack the same way nodeos does in error details
+func (e *traceException) details() []eos.APIErrorDetail {
+	details := make([]eos.APIErrorDetail, 0, len(e.Stack))
+	for _, item := range e.Stack {
+		message := item.Format
+		for key, value := range item.Data {
+			message = strings.Replace(message, "${"+key+"}", fmt.Sprint(value), -1)
+		}
+		details = append(details, eos.APIErrorDetail{Message: message})
+	}
+	return details
+}
+
+func (r *sendTransaction2Response) traceError() *TrxTraceError {
+	except := r.Processed.Except
+	apiErr := eos.APIError{Code: EosInternalErrorCode, Message: "Internal Service Error"}
+	apiErr.ErrorStruct.Code = except.Code
+	apiErr.ErrorStruct.Name = except.Name
+	apiErr.ErrorStruct.What = except.Message
+	apiErr.ErrorStruct.Details = except.details()
+	var trace []string
+	for _, action := range r.Processed.ActionTraces {
+		if action.Console != "" {
+			trace = append(trace, fmt.Sprintf("%s console: %s", action.Receiver, action.Console))
+		}
+		if action.Except != nil {
+			trace = append(trace, fmt.Sprintf("%s except: %s", action.Receiver, action.Except.Message))
+		}
+	}
+	for _, detail := range apiErr.ErrorStruct.Details {
+		trace = append(trace, detail.Message)
+	}
+	return &TrxTraceError{APIError: apiErr, Trace: strings.Join(trace, "; ")}
+}
+
+// sendTransaction2 pushes trx with send_transaction2 asking for the failure trace,
+// returns errNotSupported if the node doesn't have the endpoint
+func (app *App) sendTransaction2(ctx context.Context, packedTx *eos.PackedTransaction) (string, error) {
+	body, err := jsonCodec.Marshal(&sendTransaction2Request{ReturnFailureTrace: true, Transaction: packedTx})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, app.bcAPI.BaseURL+sendTransaction2Path, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for key, values := range app.bcAPI.Header {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	resp, err := app.bcAPI.HttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errNotSupported
+	}
+	if resp.StatusCode > 299 {
+		var apiErr eos.APIError
+		if err := jsonCodec.Unmarshal(content, &apiErr); err != nil {
+			return "", fmt.Errorf("send_transaction2 failed, status: %d, body: %s", resp.StatusCode, content)
+		}
+		return "", apiErr
+	}
+	result := &sendTransaction2Response{}
+	if err := jsonCodec.Unmarshal(content, result); err != nil {
+		return "", err
+	}
+	if result.Processed.Except != nil {
+		return "", result.traceError()
+	}
+	return result.TransactionID, nil
+}
+
+// pushToNode pushes trx with send_transaction2 when it's enabled and supported by the node,
+// classic push_transaction is used otherwise
+func (app *App) pushToNode(ctx context.Context, packedTx *eos.PackedTransaction) (string, error) {
+	if app.Push.SendTransaction2 && atomic.LoadInt32(&app.sendTrx2Unsupported) == 0 {
+		var trxID string
+		err := app.chainRequest(ctx, "send_transaction2", func() error {
+			var e error
+			trxID, e = app.sendTransaction2(ctx, packedTx)
+			return e
+		})
+		if err != errNotSupported {
+			return trxID, err
+		}
+		log.Warn().Msg("Node doesn't support send_transaction2, falling back to push_transaction")
+		atomic.StoreInt32(&app.sendTrx2Unsupported, 1)
+	}
+	var trxID string
+	err := app.chainRequest(ctx, "push_transaction", func() error {
+		result, err := app.bcAPI.PushTransaction(packedTx)
+		if err != nil {
+			return err
+		}
+		trxID = result.TransactionID
+		return nil
+	})
+	return trxID, err
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// AtomicWriter replaces the whole storage content at once
+type AtomicWriter interface {
+	WriteAtomic(content []byte) error
+}
+
+// AtomicFile is FileStorage which never leaves file in a partial state:
+// content is written to a temp file in the same dir and renamed over the target.
+// Every Write replaces the whole content, Truncate and Seek only reset reading
+type AtomicFile struct {
+	// NoSync skips fsync of the content before rename, trading durability on power loss for write throughput
+	NoSync bool
+
+	m        sync.Mutex
+	path     string
+	reader   *bytes.Reader
+	rename   func(oldpath, newpath string) error
+	syncFile func(f *os.File) error
+}
+
+func NewAtomicFile(path string) *AtomicFile {
+	return &AtomicFile{path: path, rename: os.Rename, syncFile: (*os.File).Sync}
+}
+
+func (f *AtomicFile) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.reader == nil {
+		content, err := ioutil.ReadFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		f.reader = bytes.NewReader(content)
+	}
+	return f.reader.Read(p)
+}
+
+func (f *AtomicFile) Write(b []byte) (int, error) {
+	if err := f.WriteAtomic(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *AtomicFile) WriteAtomic(content []byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.reader = nil
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if !f.NoSync {
+		if err := f.syncFile(tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return f.rename(tmp.Name(), f.path)
+}
+
+// Sync flushes the directory entry, so the renamed file survives power loss
+func (f *AtomicFile) Sync() error {
+	dir, err := os.Open(filepath.Dir(f.path))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func (f *AtomicFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.reader = nil
+	return nil
+}
+
+func (f *AtomicFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.reader == nil {
+		return 0, nil
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+var _ FileStorage = (*AtomicFile)(nil)
+var _ Syncer = (*AtomicFile)(nil)
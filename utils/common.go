@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -20,6 +21,20 @@ func WithTimeout(f func() error, timeout time.Duration) error {
 	}
 }
 
+// WithContext runs f until it returns or ctx is done, f keeps running in background after ctx is done
+func WithContext(ctx context.Context, f func() error) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- f()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e := <-ch:
+		return e
+	}
+}
+
 func Retry(f func() error, n int, retryDelay time.Duration) error {
 	var e error
 	for n > 0 {
@@ -45,3 +60,62 @@ func RetryWithTimeout(f func() error, n int, timeout time.Duration, retryDelay t
 	}
 	return e
 }
+
+// PermanentError marks error which shouldn't be retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func Permanent(err error) error {
+	return &PermanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// RetryWithBackoff calls f up to attempts times, delay starts at baseDelay and doubles
+// after every failed attempt up to maxDelay, PermanentError stops retries and is returned as is.
+// f is called at least once
+func RetryWithBackoff(f func() error, attempts int, baseDelay, maxDelay time.Duration) error {
+	return RetryWithBackoffContext(context.Background(), f, attempts, baseDelay, maxDelay)
+}
+
+// RetryWithBackoffContext is RetryWithBackoff which stops waiting for the next attempt when ctx is done,
+// ctx error is returned in that case
+func RetryWithBackoffContext(ctx context.Context, f func() error, attempts int, baseDelay, maxDelay time.Duration) error {
+	var e error
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := baseDelay
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if e = f(); e == nil {
+			return nil
+		}
+		if IsPermanent(e) {
+			log.Debug().Msgf("Attempt %d failed with permanent error: %v", attempt, e.Error())
+			return e
+		}
+		if attempt == attempts {
+			break
+		}
+		log.Debug().Msgf("Attempt %d of %d failed, retrying in %v, error: %v", attempt, attempts, delay, e.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	return e
+}
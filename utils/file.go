@@ -4,16 +4,20 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	_ "crypto/sha256" // digest hashes
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,6 +28,19 @@ type FileStorage interface {
 	Seek(offset int64, whence int) (ret int64, err error)
 }
 
+// Syncer is implemented by storages able to flush written content to disk, like *os.File
+type Syncer interface {
+	Sync() error
+}
+
+// syncStorage flushes storage to disk, storages which aren't Syncer are left as is
+func syncStorage(w FileStorage) error {
+	if syncer, ok := w.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
 func ReadOffset(r FileStorage) (uint64, error) {
 	log.Debug().Msg("reading offset")
 	var offset uint64
@@ -33,37 +50,136 @@ func ReadOffset(r FileStorage) (uint64, error) {
 
 func WriteOffset(w FileStorage, offset uint64) error {
 	log.Debug().Msgf("writing offset, value: %v", offset)
-	bs := []byte(strconv.Itoa(int(offset)))
+	return writeContent(w, []byte(strconv.Itoa(int(offset))))
+}
+
+// writeContent replaces the whole storage content
+func writeContent(w FileStorage, content []byte) error {
+	if atomicWriter, ok := w.(AtomicWriter); ok {
+		return atomicWriter.WriteAtomic(content)
+	}
 	if err := w.Truncate(0); err != nil {
 		return err
 	}
 	if _, err := w.Seek(0, 0); err != nil {
 		return err
 	}
-	_, err := w.Write(bs)
+	_, err := w.Write(content)
 	return err
 }
 
-func ReadWIF(filename string) string {
+const (
+	base58Alphabet   = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	legacyWIFLength  = 51
+	legacyWIFPrefix  = "5"
+	privateKeyPrefix = "PVT_K1_"
+)
+
+// ReadWIF reads private key from file and checks it can be parsed, so broken key file fails at startup
+func ReadWIF(filename string) (string, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Panic().Msg(err.Error())
+		return "", err
+	}
+	wif := strings.TrimSpace(string(content))
+	if err := ValidateWIFFormat(wif); err != nil {
+		return "", fmt.Errorf("invalid WIF in %s, reason: %s", filename, err.Error())
+	}
+	if _, err := ecc.NewPrivateKey(wif); err != nil {
+		return "", fmt.Errorf("invalid WIF in %s, reason: %s", filename, err.Error())
+	}
+	return wif, nil
+}
+
+// ValidateWIFFormat checks that wif looks like a legacy or PVT_K1_ prefixed private key
+func ValidateWIFFormat(wif string) error {
+	if wif == "" {
+		return fmt.Errorf("WIF is empty")
 	}
-	wif := strings.TrimSpace(strings.TrimSuffix(string(content), "\n"))
-	return wif
+	material := wif
+	if strings.HasPrefix(wif, privateKeyPrefix) {
+		material = wif[len(privateKeyPrefix):]
+	} else if !strings.HasPrefix(wif, legacyWIFPrefix) || len(wif) != legacyWIFLength {
+		return fmt.Errorf("WIF should be %d chars long and start with %q", legacyWIFLength, legacyWIFPrefix)
+	}
+	if material == "" {
+		return fmt.Errorf("WIF has no key material")
+	}
+	for _, c := range material {
+		if !strings.ContainsRune(base58Alphabet, c) {
+			return fmt.Errorf("WIF contains non base58 character %q", c)
+		}
+	}
+	return nil
 }
 
-func ReadRsa(base64Rsa string) (*rsa.PrivateKey, error) {
+// ReadRsa parses base64 encoded PEM with PKCS1 ("RSA PRIVATE KEY") or PKCS8 ("PRIVATE KEY") RSA key.
+// PEM block encrypted with passphrase (Proc-Type: 4,ENCRYPTED) is decrypted with passphrase, it's ignored for unencrypted one
+func ReadRsa(base64Rsa string, passphrase []byte) (*rsa.PrivateKey, error) {
 	data, err := base64.StdEncoding.DecodeString(base64Rsa)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(data)
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	return parseRsa(data, passphrase)
+}
+
+// ReadRsaFromFile reads RSA key from PEM file in any format accepted by ReadRsa
+func ReadRsaFromFile(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return key, err
+	return parseRsa(data, passphrase)
+}
+
+func parseRsa(data []byte, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	der := block.Bytes
+	// legacy PEM encryption, the one written by openssl rsa -aes256
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("RSA key is encrypted, but passphrase is not set")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+			if err == x509.IncorrectPasswordError {
+				return nil, fmt.Errorf("wrong RSA key passphrase")
+			}
+			return nil, fmt.Errorf("failed to decrypt RSA key: %s", err.Error())
+		}
+		key, err := parseRsaDER(block.Type, der)
+		if err != nil {
+			// decryption with wrong passphrase isn't always detected by padding check
+			return nil, fmt.Errorf("wrong RSA key passphrase or corrupted key: %s", err.Error())
+		}
+		return key, nil
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("encrypted PKCS8 keys are not supported, encrypt with openssl rsa -aes256 instead")
+	}
+	return parseRsaDER(block.Type, der)
+}
+
+func parseRsaDER(blockType string, der []byte) (*rsa.PrivateKey, error) {
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("PKCS8 key is %T, not an RSA key", parsed)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q, expected RSA PRIVATE KEY or PRIVATE KEY", blockType)
+	}
 }
 
 func GetConfigPath(envVar, defaultValue string) string {
@@ -74,12 +190,43 @@ func GetConfigPath(envVar, defaultValue string) string {
 	return defaultValue
 }
 
-func GetAddr(port int) string {
-	return ":" + strconv.Itoa(port)
+// GetAddr returns listen address, empty host binds to all interfaces
+func GetAddr(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
-func RsaSign(digest eos.Checksum256, key *rsa.PrivateKey) (string, error) {
-	sign, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+// digest hashes by config name
+var digestHashes = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// ParseDigestHash returns hash by its name: sha256, sha384 or sha512
+func ParseDigestHash(name string) (crypto.Hash, error) {
+	hash, ok := digestHashes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported digest hash %q", name)
+	}
+	return hash, nil
+}
+
+func checkDigest(digest eos.Checksum256, hash crypto.Hash) error {
+	if !hash.Available() {
+		return fmt.Errorf("digest hash %d is not available", hash)
+	}
+	if len(digest) != hash.Size() {
+		return fmt.Errorf("digest should be %d bytes, got %d", hash.Size(), len(digest))
+	}
+	return nil
+}
+
+// RsaSign signs digest made with hash, digest length should match the hash
+func RsaSign(digest eos.Checksum256, key *rsa.PrivateKey, hash crypto.Hash) (string, error) {
+	if err := checkDigest(digest, hash); err != nil {
+		return "", err
+	}
+	sign, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
 	if err != nil {
 		return "", err
 	}
@@ -87,3 +234,42 @@ func RsaSign(digest eos.Checksum256, key *rsa.PrivateKey) (string, error) {
 	// contract requires base64 string
 	return base64.StdEncoding.EncodeToString(sign), nil
 }
+
+// RsaVerify checks base64 signature made by RsaSign
+func RsaVerify(digest eos.Checksum256, signature string, key *rsa.PublicKey, hash crypto.Hash) error {
+	if err := checkDigest(digest, hash); err != nil {
+		return err
+	}
+	sign, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(key, hash, digest, sign)
+}
+
+// ReadRsaPublicKey parses public key in the format returned by RsaPublicKeyBase64
+func ReadRsaPublicKey(base64Key string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(base64Key)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is %T, not an RSA key", parsed)
+	}
+	return key, nil
+}
+
+// RsaPublicKeyBase64 returns public key in the on-chain registration format:
+// base64 encoded DER SubjectPublicKeyInfo without PEM armor
+func RsaPublicKeyBase64(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
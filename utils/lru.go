@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// LRUCache is a fixed size cache evicting least recently used entries, safe for concurrent use
+type LRUCache struct {
+	m     sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if item, ok := c.items[key]; ok {
+		c.order.MoveToFront(item)
+		return item.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+// Add stores value unless key is already present, returns false in that case
+func (c *LRUCache) Add(key string, value interface{}) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if item, ok := c.items[key]; ok {
+		c.order.MoveToFront(item)
+		return false
+	}
+	c.push(key, value)
+	return true
+}
+
+func (c *LRUCache) Set(key string, value interface{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if item, ok := c.items[key]; ok {
+		item.Value.(*lruEntry).value = value
+		c.order.MoveToFront(item)
+		return
+	}
+	c.push(key, value)
+}
+
+func (c *LRUCache) push(key string, value interface{}) {
+	c.items[key] = c.order.PushFront(&lruEntry{key, value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Remove(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if item, ok := c.items[key]; ok {
+		c.order.Remove(item)
+		delete(c.items, key)
+	}
+}
+
+func (c *LRUCache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoOffset is returned by OffsetStore when nothing is committed for the topic yet
+var ErrNoOffset = errors.New("no offset stored")
+
+// CorruptedOffsetError is returned when offset file content can't be trusted,
+// such file is never overwritten, so the operator can inspect it and restore the offset manually
+type CorruptedOffsetError struct {
+	Reason string
+}
+
+func (e *CorruptedOffsetError) Error() string {
+	return e.Reason
+}
+
+// OffsetStore persists committed offset of every broker topic
+type OffsetStore interface {
+	ReadOffset(topic broker.EventType) (uint64, error)
+	WriteOffset(topic broker.EventType, offset uint64) error
+}
+
+// JSONOffsetStore keeps offsets of all topics in a single JSON document
+// {"offsets": {"<topic>": offset}, "checksum": "<crc32 of offsets>"}, content not matching the checksum is reported as corrupted.
+// Storage with a single plain offset, as written by WriteOffset, or with offsets map without checksum
+// is migrated on first read: a plain offset is assigned to legacyTopic and the document is written back.
+// Reads and writes are serialized, so offsets of different topics can be committed concurrently
+type JSONOffsetStore struct {
+	m           sync.Mutex
+	storage     FileStorage
+	legacyTopic broker.EventType
+	offsets     map[broker.EventType]uint64 // nil until loaded
+	// SyncWrites fsyncs storage after every write, so committed offset isn't lost on power loss
+	SyncWrites bool
+}
+
+type offsetDocument struct {
+	Offsets  map[broker.EventType]uint64 `json:"offsets"`
+	Checksum string                      `json:"checksum"`
+}
+
+// offsetsChecksum is hex encoded crc32 of offsets JSON, map keys are marshalled sorted so it's stable
+func offsetsChecksum(offsets map[broker.EventType]uint64) (string, error) {
+	content, err := json.Marshal(offsets)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), nil
+}
+
+func NewJSONOffsetStore(storage FileStorage, legacyTopic broker.EventType) *JSONOffsetStore {
+	return &JSONOffsetStore{storage: storage, legacyTopic: legacyTopic}
+}
+
+func (s *JSONOffsetStore) ReadOffset(topic broker.EventType) (uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	offset, ok := s.offsets[topic]
+	if !ok {
+		return 0, ErrNoOffset
+	}
+	return offset, nil
+}
+
+func (s *JSONOffsetStore) WriteOffset(topic broker.EventType, offset uint64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	log.Debug().Msgf("writing offset, topic: %d, value: %v", topic, offset)
+	prev, existed := s.offsets[topic]
+	s.offsets[topic] = offset
+	if err := s.flush(); err != nil {
+		if existed {
+			s.offsets[topic] = prev
+		} else {
+			delete(s.offsets, topic)
+		}
+		return err
+	}
+	return nil
+}
+
+// Close closes underlying storage if it's closable
+func (s *JSONOffsetStore) Close() error {
+	if c, ok := s.storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *JSONOffsetStore) load() error {
+	if s.offsets != nil {
+		return nil
+	}
+	if _, err := s.storage.Seek(0, 0); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(s.storage)
+	if err != nil {
+		return err
+	}
+	content = bytes.TrimSpace(content)
+	offsets := make(map[broker.EventType]uint64)
+	if len(content) == 0 {
+		s.offsets = offsets
+		return nil
+	}
+	var doc offsetDocument
+	if err := json.Unmarshal(content, &doc); err == nil && doc.Offsets != nil {
+		checksum, err := offsetsChecksum(doc.Offsets)
+		if err != nil {
+			return err
+		}
+		if doc.Checksum != checksum {
+			return corruptedOffset(fmt.Sprintf("offset file checksum mismatch, stored: %q, computed: %q", doc.Checksum, checksum))
+		}
+		s.offsets = doc.Offsets
+		return nil
+	}
+	if err := json.Unmarshal(content, &offsets); err == nil {
+		log.Info().Msgf("Migrating offsets %s to checksummed document", content)
+	} else {
+		legacy, err := strconv.ParseUint(string(content), 10, 64)
+		if err != nil {
+			return corruptedOffset(fmt.Sprintf("invalid offset file content: %q", content))
+		}
+		offsets[s.legacyTopic] = legacy
+		log.Info().Msgf("Migrating single offset %d to topic %d", legacy, s.legacyTopic)
+	}
+	s.offsets = offsets
+	if err := s.flush(); err != nil {
+		// retry migration on the next access
+		s.offsets = nil
+		return err
+	}
+	return nil
+}
+
+func corruptedOffset(reason string) error {
+	log.Error().Msgf("Offset file is corrupted, fix or remove it to resume from configured offset, reason: %s", reason)
+	return &CorruptedOffsetError{reason}
+}
+
+func (s *JSONOffsetStore) flush() error {
+	checksum, err := offsetsChecksum(s.offsets)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(offsetDocument{s.offsets, checksum})
+	if err != nil {
+		return err
+	}
+	if err := writeContent(s.storage, content); err != nil {
+		return err
+	}
+	if s.SyncWrites {
+		return syncStorage(s.storage)
+	}
+	return nil
+}
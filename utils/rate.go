@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindowCounter counts events happened within the last window,
+// window is split into buckets so precision is window/buckets
+type SlidingWindowCounter struct {
+	m      sync.Mutex
+	window time.Duration
+	bucket time.Duration
+	counts []uint64
+	slots  []int64 // absolute bucket number stored in each slot
+	now    func() time.Time
+}
+
+func NewSlidingWindowCounter(window time.Duration, buckets int) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		window: window,
+		bucket: window / time.Duration(buckets),
+		counts: make([]uint64, buckets),
+		slots:  make([]int64, buckets),
+		now:    time.Now,
+	}
+}
+
+func (c *SlidingWindowCounter) current() (int, int64) {
+	slot := c.now().UnixNano() / int64(c.bucket)
+	return int(slot % int64(len(c.counts))), slot
+}
+
+func (c *SlidingWindowCounter) Add(n uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	i, slot := c.current()
+	if c.slots[i] != slot {
+		c.slots[i] = slot
+		c.counts[i] = 0
+	}
+	c.counts[i] += n
+}
+
+// Count returns amount of events within the window
+func (c *SlidingWindowCounter) Count() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, slot := c.current()
+	oldest := slot - int64(len(c.counts)) + 1
+	var total uint64
+	for i := range c.counts {
+		if c.slots[i] >= oldest {
+			total += c.counts[i]
+		}
+	}
+	return total
+}
+
+// RatePerMinute returns average amount of events per minute within the window
+func (c *SlidingWindowCounter) RatePerMinute() float64 {
+	return float64(c.Count()) * float64(time.Minute) / float64(c.window)
+}
+
+// TokenBucket allows rate events per second on average and bursts up to burst events
+type TokenBucket struct {
+	m      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewTokenBucket creates full bucket, burst less than 1 is treated as 1
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// Allow takes a token if there is one
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if there are enough. n greater than burst is allowed with full bucket
+// and leaves it in debt, so every event is counted without rejecting such batches forever
+func (b *TokenBucket) AllowN(n int) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < math.Min(float64(n), b.burst) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
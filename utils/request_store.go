@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type RequestEntry struct {
+	TrxID string    `json:"trx_id"`
+	Time  time.Time `json:"time"`
+}
+
+// RequestStore remembers trx IDs of recently signed requests in a JSON document {"<key>": entry},
+// so they survive restarts. Added entries are kept in memory until Flush.
+// Entries beyond maxCount or older than maxAge are evicted, 0 disables the limit
+type RequestStore struct {
+	m        sync.Mutex
+	storage  FileStorage
+	maxCount int
+	maxAge   time.Duration
+	entries  map[string]RequestEntry
+	dirty    bool
+	now      func() time.Time
+}
+
+// NewRequestStore loads entries stored before
+func NewRequestStore(storage FileStorage, maxCount int, maxAge time.Duration) (*RequestStore, error) {
+	s := &RequestStore{storage: storage, maxCount: maxCount, maxAge: maxAge,
+		entries: make(map[string]RequestEntry), now: time.Now}
+	if _, err := storage.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(storage)
+	if err != nil {
+		return nil, err
+	}
+	if content = bytes.TrimSpace(content); len(content) > 0 {
+		if err := json.Unmarshal(content, &s.entries); err != nil {
+			return nil, fmt.Errorf("invalid requests file content: %s", err.Error())
+		}
+	}
+	s.evict()
+	return s, nil
+}
+
+// Get returns trx ID of the request if it isn't expired
+func (s *RequestStore) Get(key string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || s.expired(entry) {
+		return "", false
+	}
+	return entry.TrxID, true
+}
+
+func (s *RequestStore) Add(key string, trxID string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.entries[key] = RequestEntry{TrxID: trxID, Time: s.now().UTC()}
+	s.dirty = true
+	if s.maxCount > 0 && len(s.entries) > s.maxCount {
+		s.removeOldest()
+	}
+}
+
+func (s *RequestStore) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.entries)
+}
+
+// Flush evicts expired entries and writes the rest if anything changed since the last flush
+func (s *RequestStore) Flush() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.evict()
+	if !s.dirty {
+		return nil
+	}
+	content, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	if err := writeContent(s.storage, content); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close flushes entries and closes underlying storage if it's closable
+func (s *RequestStore) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if c, ok := s.storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *RequestStore) expired(entry RequestEntry) bool {
+	return s.maxAge > 0 && s.now().Sub(entry.Time) > s.maxAge
+}
+
+func (s *RequestStore) evict() {
+	for key, entry := range s.entries {
+		if s.expired(entry) {
+			delete(s.entries, key)
+			s.dirty = true
+		}
+	}
+	for s.maxCount > 0 && len(s.entries) > s.maxCount {
+		s.removeOldest()
+	}
+}
+
+func (s *RequestStore) removeOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range s.entries {
+		if oldestKey == "" || entry.Time.Before(oldest) {
+			oldestKey, oldest = key, entry.Time
+		}
+	}
+	delete(s.entries, oldestKey)
+	s.dirty = true
+}
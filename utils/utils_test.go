@@ -1,10 +1,28 @@
 package utils
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	broker "github.com/DaoCasino/platform-action-monitor-client"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -57,3 +75,631 @@ func TestRetryWithTimeout(t *testing.T) {
 	assert.Nil(RetryWithTimeout(failer(3, 2*time.Millisecond), 4, time.Millisecond, time.Millisecond))
 	assert.NotNil(RetryWithTimeout(failer(3, time.Millisecond), 1, 3*time.Millisecond, time.Millisecond))
 }
+
+func TestRetryWithBackoff(t *testing.T) {
+	assert := assert.New(t)
+	var calls []time.Time
+	failer := func(times int, err error) func() error {
+		calls = nil
+		return func() error {
+			calls = append(calls, time.Now())
+			if times == 0 {
+				return nil
+			}
+			times--
+			return err
+		}
+	}
+	transient := fmt.Errorf("deadline exceeded")
+	assert.Nil(RetryWithBackoff(failer(3, transient), 4, 2*time.Millisecond, 5*time.Millisecond))
+	assert.Len(calls, 4)
+	// 2ms, 4ms, capped 5ms
+	assert.True(calls[2].Sub(calls[1]) >= 4*time.Millisecond)
+	assert.True(calls[3].Sub(calls[2]) >= 5*time.Millisecond)
+
+	assert.Equal(transient, RetryWithBackoff(failer(3, transient), 3, time.Millisecond, time.Millisecond))
+	assert.Len(calls, 3)
+
+	permanent := fmt.Errorf("duplicate")
+	err := RetryWithBackoff(failer(3, Permanent(permanent)), 3, time.Millisecond, time.Millisecond)
+	assert.True(IsPermanent(err))
+	assert.Equal("duplicate", err.Error())
+	assert.Len(calls, 1)
+
+	// done ctx interrupts waiting for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	start := time.Now()
+	err = RetryWithBackoffContext(ctx, failer(3, transient), 3, time.Second, time.Second)
+	assert.Equal(context.Canceled, err)
+	assert.Len(calls, 1)
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestLRUCache(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewLRUCache(2)
+	assert.True(cache.Add("a", 1))
+	assert.True(cache.Add("b", 2))
+	assert.False(cache.Add("a", 3))
+	value, ok := cache.Get("a")
+	assert.True(ok)
+	assert.Equal(1, value)
+
+	// b is the least recently used
+	cache.Set("c", 3)
+	_, ok = cache.Get("b")
+	assert.False(ok)
+	assert.Equal(2, cache.Len())
+
+	cache.Remove("a")
+	_, ok = cache.Get("a")
+	assert.False(ok)
+	assert.Equal(1, cache.Len())
+}
+
+func writeTempFile(t *testing.T, dir, content string) string {
+	f, err := ioutil.TempFile(dir, "casino-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReadWIF(t *testing.T) {
+	assert := assert.New(t)
+	const wif = "5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAbuatmU"
+	dir, err := ioutil.TempDir("", "casino-wif")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	valid := func(content, expected string) {
+		read, err := ReadWIF(writeTempFile(t, dir, content))
+		assert.Nil(err, content)
+		assert.Equal(expected, read)
+	}
+	invalid := func(content string) {
+		read, err := ReadWIF(writeTempFile(t, dir, content))
+		assert.Error(err, content)
+		assert.Equal("", read)
+	}
+	valid(wif+"\n", wif)
+	valid(" "+wif+"\r\n", wif)
+	valid("PVT_K1_"+wif, "PVT_K1_"+wif)
+	invalid("")
+	invalid(" \n\t\n")
+	invalid("notawif")
+	invalid("5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAbua0lU")
+	// well formed, but checksum doesn't match
+	invalid("5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAbuatmV")
+	invalid("PVT_K1_" + wif[1:])
+
+	_, err = ReadWIF(filepath.Join(dir, "missing"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRsaPublicKeyBase64(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	encoded, err := RsaPublicKeyBase64(&key.PublicKey)
+	assert.Nil(err)
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	assert.Nil(err)
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	assert.Nil(err)
+	assert.Equal(&key.PublicKey, parsed)
+}
+
+func TestRsaSignDigestHash(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	sha256Digest := sha256.Sum256([]byte("digest"))
+	sha512Digest := sha512.Sum512([]byte("digest"))
+
+	hash, err := ParseDigestHash("sha256")
+	assert.Nil(err)
+	assert.Equal(crypto.SHA256, hash)
+	signature, err := RsaSign(sha256Digest[:], key, hash)
+	assert.Nil(err)
+	assert.Nil(RsaVerify(sha256Digest[:], signature, &key.PublicKey, crypto.SHA256))
+	_, err = RsaSign(sha512Digest[:], key, hash)
+	assert.EqualError(err, "digest should be 32 bytes, got 64")
+
+	hash, err = ParseDigestHash("SHA512")
+	assert.Nil(err)
+	assert.Equal(crypto.SHA512, hash)
+	signature, err = RsaSign(sha512Digest[:], key, hash)
+	assert.Nil(err)
+	assert.Nil(RsaVerify(sha512Digest[:], signature, &key.PublicKey, crypto.SHA512))
+	// signature is bound to the hash
+	assert.Error(RsaVerify(sha512Digest[:], signature, &key.PublicKey, crypto.SHA384))
+	_, err = RsaSign(sha256Digest[:], key, hash)
+	assert.EqualError(err, "digest should be 64 bytes, got 32")
+
+	_, err = ParseDigestHash("md5")
+	assert.EqualError(err, `unsupported digest hash "md5"`)
+	_, err = RsaSign(sha256Digest[:], key, 0)
+	assert.Error(err)
+}
+
+func TestRsaVerify(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	digest := sha256.Sum256([]byte("digest"))
+
+	signature, err := RsaSign(digest[:], key, crypto.SHA256)
+	assert.Nil(err)
+	assert.Nil(RsaVerify(digest[:], signature, &key.PublicKey, crypto.SHA256))
+	assert.Error(RsaVerify(digest[:], signature, &other.PublicKey, crypto.SHA256))
+	otherDigest := sha256.Sum256([]byte("other"))
+	assert.Error(RsaVerify(otherDigest[:], signature, &key.PublicKey, crypto.SHA256))
+	assert.Error(RsaVerify(digest[:], "not base64", &key.PublicKey, crypto.SHA256))
+
+	encoded, err := RsaPublicKeyBase64(&key.PublicKey)
+	assert.Nil(err)
+	parsed, err := ReadRsaPublicKey(encoded)
+	assert.Nil(err)
+	assert.Equal(&key.PublicKey, parsed)
+	_, err = ReadRsaPublicKey(base64.StdEncoding.EncodeToString([]byte("garbage")))
+	assert.Error(err)
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	counter := NewSlidingWindowCounter(time.Minute, 60)
+	counter.now = func() time.Time { return now }
+
+	assert.Equal(uint64(0), counter.Count())
+	counter.Add(1)
+	now = now.Add(30 * time.Second)
+	counter.Add(2)
+	assert.Equal(uint64(3), counter.Count())
+	assert.Equal(3.0, counter.RatePerMinute())
+
+	now = now.Add(31 * time.Second)
+	assert.Equal(uint64(2), counter.Count())
+
+	now = now.Add(time.Hour)
+	assert.Equal(uint64(0), counter.Count())
+	assert.Equal(0.0, counter.RatePerMinute())
+
+	halfMinute := NewSlidingWindowCounter(30*time.Second, 30)
+	halfMinute.now = func() time.Time { return now }
+	halfMinute.Add(5)
+	assert.Equal(10.0, halfMinute.RatePerMinute())
+}
+
+func TestGetAddr(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(":8080", GetAddr("", 8080))
+	assert.Equal("127.0.0.1:8080", GetAddr("127.0.0.1", 8080))
+	assert.Equal("[::1]:8080", GetAddr("::1", 8080))
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	bucket := NewTokenBucket(2, 3)
+	bucket.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(bucket.Allow())
+	}
+	assert.False(bucket.Allow())
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(bucket.Allow())
+	assert.False(bucket.Allow())
+
+	// tokens don't accumulate beyond burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(bucket.Allow())
+	}
+	assert.False(bucket.Allow())
+}
+
+func TestTokenBucketAllowN(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	bucket := NewTokenBucket(2, 3)
+	bucket.now = func() time.Time { return now }
+
+	assert.True(bucket.AllowN(2))
+	assert.False(bucket.AllowN(2))
+	assert.True(bucket.AllowN(1))
+
+	// more than burst needs full bucket and leaves it in debt
+	now = now.Add(time.Hour)
+	assert.True(bucket.AllowN(5))
+	now = now.Add(time.Second)
+	assert.False(bucket.Allow())
+	now = now.Add(500 * time.Millisecond)
+	assert.True(bucket.Allow())
+}
+
+func TestAtomicFileOffset(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offset")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset")
+
+	f := NewAtomicFile(path)
+	_, err = ReadOffset(f)
+	assert.Equal(io.EOF, err)
+
+	assert.Nil(WriteOffset(f, 5))
+	offset, err := ReadOffset(NewAtomicFile(path))
+	assert.Nil(err)
+	assert.Equal(uint64(5), offset)
+
+	// crash before rename must leave previous offset intact
+	f.rename = func(oldpath, newpath string) error { return fmt.Errorf("crashed") }
+	assert.NotNil(WriteOffset(f, 7))
+	offset, err = ReadOffset(NewAtomicFile(path))
+	assert.Nil(err)
+	assert.Equal(uint64(5), offset)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(files, 1)
+
+	f.rename = os.Rename
+	assert.Nil(WriteOffset(f, 12))
+	assert.Nil(WriteOffset(f, 8))
+	offset, err = ReadOffset(NewAtomicFile(path))
+	assert.Nil(err)
+	assert.Equal(uint64(8), offset)
+}
+
+func TestReadRsa(t *testing.T) {
+	assert := assert.New(t)
+	encode := func(blockType string, der []byte) string {
+		return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+
+	parsed, err := ReadRsa(encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), nil)
+	assert.Nil(err)
+	assert.Equal(key.D, parsed.D)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(err)
+	parsed, err = ReadRsa(encode("PRIVATE KEY", pkcs8), nil)
+	assert.Nil(err)
+	assert.Equal(key.D, parsed.D)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	ecPkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	assert.Nil(err)
+	_, err = ReadRsa(encode("PRIVATE KEY", ecPkcs8), nil)
+	assert.EqualError(err, "PKCS8 key is *ecdsa.PrivateKey, not an RSA key")
+
+	_, err = ReadRsa(encode("EC PRIVATE KEY", ecPkcs8), nil)
+	assert.NotNil(err)
+	_, err = ReadRsa(base64.StdEncoding.EncodeToString([]byte("not pem")), nil)
+	assert.EqualError(err, "no PEM data found")
+}
+
+func TestReadRsaFromFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-rsa")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+
+	path := filepath.Join(dir, "rsa.pem")
+	content := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.Nil(ioutil.WriteFile(path, content, 0600))
+	parsed, err := ReadRsaFromFile(path, nil)
+	assert.Nil(err)
+	assert.Equal(key.D, parsed.D)
+
+	// file holds PEM itself, not base64
+	encoded := filepath.Join(dir, "rsa.base64")
+	assert.Nil(ioutil.WriteFile(encoded, []byte(base64.StdEncoding.EncodeToString(content)), 0600))
+	_, err = ReadRsaFromFile(encoded, nil)
+	assert.EqualError(err, "no PEM data found")
+
+	_, err = ReadRsaFromFile(filepath.Join(dir, "missing.pem"), nil)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestReadEncryptedRsa(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	passphrase := []byte("secret")
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key),
+		passphrase, x509.PEMCipherAES256)
+	assert.Nil(err)
+	encrypted := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block))
+
+	parsed, err := ReadRsa(encrypted, passphrase)
+	assert.Nil(err)
+	assert.Equal(key.D, parsed.D)
+
+	_, err = ReadRsa(encrypted, []byte("wrong"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "wrong RSA key passphrase")
+	}
+	_, err = ReadRsa(encrypted, nil)
+	assert.EqualError(err, "RSA key is encrypted, but passphrase is not set")
+
+	// passphrase doesn't affect unencrypted keys
+	plain := base64.StdEncoding.EncodeToString(
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	parsed, err = ReadRsa(plain, passphrase)
+	assert.Nil(err)
+	assert.Equal(key.D, parsed.D)
+
+	_, err = ReadRsa(base64.StdEncoding.EncodeToString(
+		pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{1}})), passphrase)
+	assert.EqualError(err, "encrypted PKCS8 keys are not supported, encrypt with openssl rsa -aes256 instead")
+}
+
+func TestJSONOffsetStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offsets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset")
+
+	store := NewJSONOffsetStore(NewAtomicFile(path), 0)
+	_, err = store.ReadOffset(1)
+	assert.Equal(ErrNoOffset, err)
+
+	assert.Nil(store.WriteOffset(1, 5))
+	assert.Nil(store.WriteOffset(2, 7))
+	assert.Nil(store.WriteOffset(1, 6))
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(`{"offsets":{"1":6,"2":7},"checksum":"`+checksum(`{"1":6,"2":7}`)+`"}`, string(content))
+
+	reopened := NewJSONOffsetStore(NewAtomicFile(path), 0)
+	offset, err := reopened.ReadOffset(1)
+	assert.Nil(err)
+	assert.Equal(uint64(6), offset)
+	offset, err = reopened.ReadOffset(2)
+	assert.Nil(err)
+	assert.Equal(uint64(7), offset)
+	_, err = reopened.ReadOffset(0)
+	assert.Equal(ErrNoOffset, err)
+
+	// failed write keeps previous offset
+	f := NewAtomicFile(path)
+	f.rename = func(oldpath, newpath string) error { return fmt.Errorf("crashed") }
+	failing := NewJSONOffsetStore(f, 0)
+	assert.NotNil(failing.WriteOffset(1, 8))
+	offset, err = failing.ReadOffset(1)
+	assert.Nil(err)
+	assert.Equal(uint64(6), offset)
+}
+
+// run with -race: offsets of different topics are committed from concurrent workers
+func TestJSONOffsetStoreConcurrentWrites(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offsets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset")
+	store := NewJSONOffsetStore(NewAtomicFile(path), 0)
+
+	const topics, writes = 8, 50
+	var wg sync.WaitGroup
+	for topic := 0; topic < topics; topic++ {
+		wg.Add(1)
+		go func(topic broker.EventType) {
+			defer wg.Done()
+			for offset := uint64(1); offset <= writes; offset++ {
+				assert.Nil(store.WriteOffset(topic, offset))
+				_, err := store.ReadOffset(topic)
+				assert.Nil(err)
+			}
+		}(broker.EventType(topic))
+	}
+	wg.Wait()
+
+	reopened := NewJSONOffsetStore(NewAtomicFile(path), 0)
+	for topic := 0; topic < topics; topic++ {
+		offset, err := reopened.ReadOffset(broker.EventType(topic))
+		assert.Nil(err)
+		assert.Equal(uint64(writes), offset)
+	}
+}
+
+func TestJSONOffsetStoreMigration(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offsets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset")
+	assert.Nil(WriteOffset(NewAtomicFile(path), 42))
+
+	store := NewJSONOffsetStore(NewAtomicFile(path), 3)
+	offset, err := store.ReadOffset(3)
+	assert.Nil(err)
+	assert.Equal(uint64(42), offset)
+	_, err = store.ReadOffset(1)
+	assert.Equal(ErrNoOffset, err)
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(`{"offsets":{"3":42},"checksum":"`+checksum(`{"3":42}`)+`"}`, string(content))
+
+	// offsets map without checksum
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"1":5,"3":43}`), 0644))
+	offset, err = NewJSONOffsetStore(NewAtomicFile(path), 3).ReadOffset(1)
+	assert.Nil(err)
+	assert.Equal(uint64(5), offset)
+	content, err = ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(`{"offsets":{"1":5,"3":43},"checksum":"`+checksum(`{"1":5,"3":43}`)+`"}`, string(content))
+}
+
+func checksum(offsets string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(offsets)))
+}
+
+func TestJSONOffsetStoreChecksum(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offsets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offset")
+
+	// valid
+	valid := `{"offsets":{"1":6},"checksum":"` + checksum(`{"1":6}`) + `"}`
+	assert.Nil(ioutil.WriteFile(path, []byte(valid), 0644))
+	offset, err := NewJSONOffsetStore(NewAtomicFile(path), 0).ReadOffset(1)
+	assert.Nil(err)
+	assert.Equal(uint64(6), offset)
+
+	// empty
+	assert.Nil(ioutil.WriteFile(path, []byte(" \n"), 0644))
+	_, err = NewJSONOffsetStore(NewAtomicFile(path), 0).ReadOffset(1)
+	assert.Equal(ErrNoOffset, err)
+
+	corrupted := map[string]string{
+		"checksum mismatch": `{"offsets":{"1":9},"checksum":"` + checksum(`{"1":6}`) + `"}`,
+		"missing checksum":  `{"offsets":{"1":6}}`,
+		"truncated":         valid[:len(valid)/2],
+		"garbage":           "garbage",
+	}
+	for name, content := range corrupted {
+		assert.Nil(ioutil.WriteFile(path, []byte(content), 0644))
+		store := NewJSONOffsetStore(NewAtomicFile(path), 0)
+		_, err = store.ReadOffset(1)
+		assert.IsType(&CorruptedOffsetError{}, err, name)
+		// corrupted file is left for the operator
+		assert.NotNil(store.WriteOffset(1, 10), name)
+		stored, err := ioutil.ReadFile(path)
+		assert.Nil(err)
+		assert.Equal(content, string(stored), name)
+	}
+	assert.Nil(ioutil.WriteFile(path, []byte("garbage"), 0644))
+	_, err = NewJSONOffsetStore(NewAtomicFile(path), 0).ReadOffset(1)
+	assert.EqualError(err, `invalid offset file content: "garbage"`)
+}
+
+// syncCountingFile counts Sync calls of the wrapped file
+type syncCountingFile struct {
+	*AtomicFile
+	syncs int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	return f.AtomicFile.Sync()
+}
+
+func TestJSONOffsetStoreSync(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-offsets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	f := &syncCountingFile{AtomicFile: NewAtomicFile(filepath.Join(dir, "offset"))}
+
+	store := NewJSONOffsetStore(f, 0)
+	assert.Nil(store.WriteOffset(1, 5))
+	assert.Equal(0, f.syncs)
+
+	store.SyncWrites = true
+	assert.Nil(store.WriteOffset(1, 6))
+	assert.Nil(store.WriteOffset(2, 7))
+	assert.Equal(2, f.syncs)
+
+	offset, err := NewJSONOffsetStore(NewAtomicFile(filepath.Join(dir, "offset")), 0).ReadOffset(1)
+	assert.Nil(err)
+	assert.Equal(uint64(6), offset)
+}
+
+func TestAtomicFileNoSync(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-atomic-file")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	f := NewAtomicFile(filepath.Join(dir, "offset"))
+	syncs := 0
+	f.syncFile = func(file *os.File) error {
+		syncs++
+		return file.Sync()
+	}
+
+	assert.Nil(f.WriteAtomic([]byte("1")))
+	assert.Equal(1, syncs)
+
+	f.NoSync = true
+	assert.Nil(f.WriteAtomic([]byte("2")))
+	assert.Equal(1, syncs)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "offset"))
+	assert.Nil(err)
+	assert.Equal("2", string(content))
+}
+
+func TestRequestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "casino-requests")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "requests.json")
+	now := time.Now().UTC()
+	clock := func() time.Time { return now }
+
+	store, err := NewRequestStore(NewAtomicFile(path), 2, time.Hour)
+	assert.Nil(err)
+	store.now = clock
+	store.Add("dice:1", "trx1")
+	now = now.Add(time.Minute)
+	store.Add("dice:2", "trx2")
+	// nothing is written until flush
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	assert.Nil(store.Flush())
+
+	// entries survive reopening
+	reopened, err := NewRequestStore(NewAtomicFile(path), 2, time.Hour)
+	assert.Nil(err)
+	reopened.now = clock
+	trxID, ok := reopened.Get("dice:1")
+	assert.True(ok)
+	assert.Equal("trx1", trxID)
+
+	// the oldest entry is evicted when count is exceeded
+	now = now.Add(time.Minute)
+	reopened.Add("dice:3", "trx3")
+	assert.Equal(2, reopened.Len())
+	_, ok = reopened.Get("dice:1")
+	assert.False(ok)
+
+	// expired entries aren't returned and are dropped on flush
+	now = now.Add(59*time.Minute + 30*time.Second)
+	_, ok = reopened.Get("dice:2")
+	assert.False(ok)
+	trxID, ok = reopened.Get("dice:3")
+	assert.True(ok)
+	assert.Equal("trx3", trxID)
+	assert.Nil(reopened.Flush())
+	assert.Equal(1, reopened.Len())
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Contains(string(content), `"dice:3":{"trx_id":"trx3"`)
+	assert.NotContains(string(content), "dice:2")
+
+	assert.Nil(ioutil.WriteFile(path, []byte("garbage"), 0644))
+	_, err = NewRequestStore(NewAtomicFile(path), 2, time.Hour)
+	assert.NotNil(err)
+}
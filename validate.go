@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	broker "github.com/DaoCasino/platform-action-monitor-client"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+)
+
+// compressed public key size
+const publicKeySize = 33
+
+// regular account name: up to 12 chars of a-z, 1-5 and dots, not ending with a dot
+var accountNameRe = regexp.MustCompile(`^[a-z1-5.]{0,11}[a-z1-5]$`)
+
+func validateAccountName(field string, name eos.AccountName) error {
+	if name == "" {
+		return fmt.Errorf("%s is not set", field)
+	}
+	if !accountNameRe.MatchString(string(name)) {
+		return fmt.Errorf("%s %q is not a valid account name", field, name)
+	}
+	return nil
+}
+
+func validatePublicKey(field string, key ecc.PublicKey) error {
+	if len(key.Content) == 0 {
+		return fmt.Errorf("%s is not set", field)
+	}
+	if len(key.Content) != publicKeySize {
+		return fmt.Errorf("%s should be %d bytes, got %d", field, publicKeySize, len(key.Content))
+	}
+	return nil
+}
+
+// Validate checks that required fields are set and well-formed, so misconfigured
+// service fails at startup instead of failing to sign the first event
+func (cfg *AppConfig) Validate() error {
+	bc := cfg.BlockChain
+	// empty chain ID is detected from the node on startup
+	detectChainID := len(bc.ChainID) == 0 && bc.ChainIDCheck != ChainIDCheckOff
+	if len(bc.ChainID) != 32 && !detectChainID {
+		return fmt.Errorf("chain ID should be 32 bytes, got %d", len(bc.ChainID))
+	}
+	if bytes.Equal(bc.ChainID, make([]byte, 32)) {
+		return fmt.Errorf("chain ID is zero")
+	}
+	if err := validateAccountName("casino account name", bc.CasinoAccountName); err != nil {
+		return err
+	}
+	if err := validateAccountName("platform account name", bc.PlatformAccountName); err != nil {
+		return err
+	}
+	if bc.RSAKey == nil {
+		return fmt.Errorf("RSA key is not set")
+	}
+	if err := bc.RSAKey.Validate(); err != nil {
+		return fmt.Errorf("RSA key is invalid: %s", err.Error())
+	}
+	if !bc.DigestHash.Available() {
+		return fmt.Errorf("digest hash is not set")
+	}
+	if err := validatePublicKey("deposit key", bc.EosPubKeys.Deposit); err != nil {
+		return err
+	}
+	if err := validatePublicKey("signidice key", bc.EosPubKeys.SigniDice); err != nil {
+		return err
+	}
+	if len(bc.EosPubKeys.Deposits) == 0 {
+		return fmt.Errorf("deposit keys are not set")
+	}
+	for account, key := range bc.EosPubKeys.AccountDeposits {
+		if account == "" {
+			return fmt.Errorf("deposit key account is empty")
+		}
+		if err := validatePublicKey("deposit key of account "+string(account), key); err != nil {
+			return err
+		}
+	}
+	if err := validatePublicKey("platform public key", bc.PlatformPubKey); err != nil {
+		return err
+	}
+	// permission names follow the account name rules
+	for field, permission := range map[string]eos.PermissionName{
+		"signidice permission": bc.Permissions.SigniDice,
+		"deposit permission":   bc.Permissions.Deposit,
+	} {
+		if permission == "" {
+			continue
+		}
+		if err := validateAccountName(field, eos.AN(string(permission))); err != nil {
+			return err
+		}
+	}
+	if cfg.HTTP.RetryAmount < 1 {
+		return fmt.Errorf("HTTP retry amount should be positive")
+	}
+	if cfg.HTTP.Timeout <= 0 {
+		return fmt.Errorf("HTTP timeout should be positive")
+	}
+	for _, nodeURL := range cfg.Nodes.URLs {
+		if u, err := url.Parse(nodeURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid node URL: %s", nodeURL)
+		}
+	}
+	if len(cfg.Nodes.URLs) > 1 && cfg.Nodes.HealthCheckInterval <= 0 {
+		return fmt.Errorf("node health check interval should be positive")
+	}
+	if cfg.TrxExpiration < 0 || cfg.TrxExpiration > MaxTransactionLifetime {
+		return fmt.Errorf("trx expiration should be from 0 to %s", MaxTransactionLifetime)
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS cert and key files should be set both or neither, cert: %q, key: %q",
+			cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	}
+	if cfg.Server.ReadTimeout < 0 || cfg.Server.WriteTimeout < 0 || cfg.Server.IdleTimeout < 0 {
+		return fmt.Errorf("server timeouts should not be negative")
+	}
+	if cfg.Processor.EventTimeout < 0 {
+		return fmt.Errorf("event timeout shouldn't be negative")
+	}
+	if cfg.Processor.EventBufferSize < 0 {
+		return fmt.Errorf("event buffer size should not be negative")
+	}
+	if cfg.Processor.SignedRequestsPath != "" && cfg.Processor.SignedRequestsFlushInterval <= 0 {
+		return fmt.Errorf("signed requests flush interval should be positive")
+	}
+	if cfg.SigningCap.MaxPerAccount < 0 {
+		return fmt.Errorf("signing cap should not be negative")
+	}
+	if cfg.SigningCap.MaxPerAccount > 0 && cfg.SigningCap.Window <= 0 {
+		return fmt.Errorf("signing cap window should be positive")
+	}
+	if cfg.ResolvedCheck.Enabled && cfg.ResolvedCheck.Table == "" {
+		return fmt.Errorf("resolved check table is not set")
+	}
+	if cfg.Push.Breaker.FailureThreshold < 0 {
+		return fmt.Errorf("push breaker failures should not be negative")
+	}
+	if cfg.Push.Breaker.FailureThreshold > 0 && cfg.Push.Breaker.Cooldown <= 0 {
+		return fmt.Errorf("push breaker cooldown should be positive")
+	}
+	if cfg.Resources.Enabled && cfg.Resources.Interval <= 0 {
+		return fmt.Errorf("resources check interval should be positive")
+	}
+	if len(cfg.Broker.Topics) == 0 {
+		return fmt.Errorf("broker topics are not set")
+	}
+	topics := make(map[broker.EventType]bool, len(cfg.Broker.Topics))
+	for _, topic := range cfg.Broker.Topics {
+		if topics[topic.ID] {
+			return fmt.Errorf("broker topic %d is duplicated", topic.ID)
+		}
+		topics[topic.ID] = true
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import "net/http"
+
+// build info, injected at build time:
+// go build -ldflags "-X main.Version=v1.2.3 -X main.GitCommit=$(git rev-parse HEAD) -X main.BuildTime=$(date -u +%FT%TZ)"
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
+
+func (app *App) VersionQuery(writer ResponseWriter, req *Request) {
+	respondWithJSON(writer, http.StatusOK, JSONResponse{
+		"version":    Version,
+		"git_commit": GitCommit,
+		"build_time": BuildTime,
+	})
+}